@@ -0,0 +1,92 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+// SetPodBypass takes the pod out of traffic capture while bypass is set, e.g. to debug it talking
+// to other pods directly. Its ipset entries and inbound route are removed, but the server still
+// remembers the IP it was added with, and neither the informers nor ReconcileDataplane add it back.
+// Clearing bypass adds the pod back to the mesh. Bypass lasts until the pod is deleted or the
+// server restarts.
+func (s *Server) SetPodBypass(pod *corev1.Pod, bypass bool) error {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	ip := pod.Status.PodIP
+	if ip == "" {
+		ip = s.podIPs[pod.UID]
+	}
+
+	if !bypass {
+		if !s.bypassedPods.Contains(string(pod.UID)) {
+			return nil
+		}
+		s.bypassedPods.Delete(string(pod.UID))
+		log.Infof("Pod '%s/%s' (%s) is no longer bypassed", pod.Namespace, pod.Name, string(pod.UID))
+		if ip != pod.Status.PodIP {
+			pod = pod.DeepCopy()
+			pod.Status.PodIP = ip
+		}
+		return s.addPodToMeshLocked(pod)
+	}
+
+	if s.bypassedPods == nil {
+		s.bypassedPods = sets.New()
+	}
+	s.bypassedPods.Insert(string(pod.UID))
+	log.Infof("Bypassing pod '%s/%s' (%s)", pod.Namespace, pod.Name, string(pod.UID))
+	s.removePodDataplane(pod, ip)
+	return nil
+}
+
+// withoutBypassedPods returns the pods which are not bypassed. meshMu must be held.
+func (s *Server) withoutBypassedPods(pods []*corev1.Pod) []*corev1.Pod {
+	if len(s.bypassedPods) == 0 {
+		return pods
+	}
+	res := make([]*corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if !s.bypassedPods.Contains(string(pod.UID)) {
+			res = append(res, pod)
+		}
+	}
+	return res
+}
+
+// capturesPod reports whether the pod matches the capture selector, if there is one.
+func (s *Server) capturesPod(pod *corev1.Pod) bool {
+	return s.captureSelector == nil || s.captureSelector.Matches(labels.Set(pod.Labels))
+}
+
+// capturedPods returns the pods matching the capture selector.
+func (s *Server) capturedPods(pods []*corev1.Pod) []*corev1.Pod {
+	if s.captureSelector == nil {
+		return pods
+	}
+	res := make([]*corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if s.capturesPod(pod) {
+			res = append(res, pod)
+		} else {
+			log.Debugf("Pod '%s/%s' (%s) doesn't match the capture selector %s", pod.Namespace, pod.Name, string(pod.UID), s.captureSelector)
+		}
+	}
+	return res
+}
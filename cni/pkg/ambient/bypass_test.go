@@ -0,0 +1,131 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestSetPodBypass(t *testing.T) {
+	cases := []struct {
+		name string
+		// podIP is the IP of the pod passed to SetPodBypass, which may be gone from its status.
+		podIP string
+	}{
+		{
+			name:  "pod ip",
+			podIP: "10.0.0.1",
+		},
+		{
+			name: "remembered pod ip",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{}
+			setFakeIpset(t, f)
+			nl := setFakeNetlink(t)
+			s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables(), inboundTunIndex: 7}
+			s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+			inMesh := func() bool {
+				return len(f.entries) == 1 && f.entries[0].IP.Equal(net.ParseIP("10.0.0.1")) && len(nl.routes) == 1
+			}
+			if !inMesh() {
+				t.Fatalf("expected the pod to be added, got entries %v and routes %v", f.entries, nl.routes)
+			}
+
+			if err := s.SetPodBypass(newTestPod("a", "a", tc.podIP), true); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.entries) != 0 || len(nl.routes) != 0 {
+				t.Fatalf("expected the bypassed pod to be removed, got entries %v and routes %v", f.entries, nl.routes)
+			}
+			if s.podIPs["uid-a"] != "10.0.0.1" {
+				t.Errorf("expected the pod ip to be remembered, got %v", s.podIPs)
+			}
+
+			// Neither the informers nor the reconciler add a bypassed pod back.
+			s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+			if _, err := s.addPodsToMesh([]*corev1.Pod{newTestPod("a", "a", "10.0.0.1")}); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.entries) != 0 || len(nl.routes) != 0 {
+				t.Fatalf("expected the bypassed pod not to be added, got entries %v and routes %v", f.entries, nl.routes)
+			}
+
+			if err := s.SetPodBypass(newTestPod("a", "a", tc.podIP), false); err != nil {
+				t.Fatal(err)
+			}
+			if !inMesh() {
+				t.Errorf("expected the pod to be added back, got entries %v and routes %v", f.entries, nl.routes)
+			}
+			if err := s.SetPodBypass(newTestPod("a", "a", tc.podIP), false); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.added) != 2 {
+				t.Errorf("expected clearing bypass twice to add the pod once, got adds %v", f.added)
+			}
+		})
+	}
+}
+
+func TestSetPodBypassDeletedPod(t *testing.T) {
+	setFakeIpset(t, &fakeIpset{})
+	setFakeNetlink(t)
+	s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables(), inboundTunIndex: 7}
+	s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+	if err := s.SetPodBypass(newTestPod("a", "a", "10.0.0.1"), true); err != nil {
+		t.Fatal(err)
+	}
+
+	s.delPodFromMesh(newTestPod("a", "a", "10.0.0.1"))
+	if s.bypassedPods.Contains("uid-a") {
+		t.Errorf("expected the bypass to be cleared with the pod deletion")
+	}
+}
+
+func TestCaptureSelector(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	setFakeNetlink(t)
+	s := &Server{
+		hostIP:          "10.0.0.100",
+		routeTables:     DefaultRouteTables(),
+		inboundTunIndex: 7,
+		captureSelector: labels.SelectorFromSet(labels.Set{"ambient-rollout": "true"}),
+	}
+
+	skipped := newTestPod("a", "a", "10.0.0.1")
+	matching := newTestPod("b", "b", "10.0.0.2")
+	matching.Labels = map[string]string{"ambient-rollout": "true"}
+	s.addPodToMesh(skipped)
+	s.addPodToMesh(matching)
+	if len(f.entries) != 1 || !f.entries[0].IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("expected only the matching pod to be added, got %v", f.entries)
+	}
+
+	f.entries = nil
+	if _, err := s.addPodsToMesh([]*corev1.Pod{skipped, matching}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.entries) != 1 || !f.entries[0].IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected only the matching pod to be added in bulk, got %v", f.entries)
+	}
+}
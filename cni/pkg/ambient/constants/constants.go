@@ -45,6 +45,15 @@ const (
 	ZTunnelOutboundTunIP = "192.168.127.2"
 	TunPrefix            = 30
 
+	InboundTunVNI  = 1000
+	OutboundTunVNI = 1001
+
+	// GenevePort is the default UDP destination port of the tunnels.
+	GenevePort = 6081
+	// WireGuardPort is the default UDP port of the WireGuard link between a CPU node and its DPU
+	// node.
+	WireGuardPort = 51820
+
 	ChainZTunnelPrerouting  = "ztunnel-PREROUTING"
 	ChainZTunnelPostrouting = "ztunnel-POSTROUTING"
 	ChainZTunnelInput       = "ztunnel-INPUT"
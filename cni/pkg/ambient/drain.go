@@ -0,0 +1,99 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Drain stops adding pods to the mesh, e.g. while the node is cordoned for maintenance. The pods
+// already in the mesh are kept, unless removeMembers, in which case they are removed one by one as
+// by DelPodFromMesh. Draining lasts until the server restarts. It is published in the
+// AmbientConfigFile, so that the CNI plugin stops adding the new pods too.
+func (s *Server) Drain(removeMembers bool) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+	s.UpdateConfig()
+	log.Infof("Draining, pods are no longer added to the mesh")
+	if !removeMembers {
+		return nil
+	}
+
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	pods, err := memberPods()
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		s.delPodFromMeshLocked(pod)
+	}
+	log.Infof("Drained %d pods from the mesh", len(pods))
+	return nil
+}
+
+// isDraining reports whether Drain was called.
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// memberPods returns a pod for each ipset entry, with the IP of the entry and the namespace, name
+// and UID of its comment, which is all delPodFromMesh needs of a pod.
+func memberPods() ([]*corev1.Pod, error) {
+	// The namespace of an entry without one in its comment selects the ipset of the entry.
+	setNamespaces := map[string]string{}
+	for namespace, name := range namespaceIpsets {
+		setNamespaces[name] = namespace
+	}
+
+	var pods []*corev1.Pod
+	for _, name := range append([]string{ipsetName}, extraIpsetNames()...) {
+		set := Ipset
+		if name != ipsetName {
+			set = extraIpsets[name]
+		}
+		entries, err := set.List()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w: %v", ErrIpsetMissing, err)
+			}
+			return nil, &NetlinkError{Op: "IpsetList", Err: err}
+		}
+		for _, entry := range entries {
+			pod := &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Namespace: setNamespaces[name],
+					UID:       types.UID(commentUID(entry.Comment)),
+				},
+				Status: corev1.PodStatus{PodIP: entry.IP.String()},
+			}
+			if parts := strings.SplitN(entry.Comment, "/", 3); len(parts) == 3 {
+				pod.Namespace, pod.Name = parts[0], parts[1]
+			}
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
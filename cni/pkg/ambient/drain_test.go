@@ -0,0 +1,88 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestDrain(t *testing.T) {
+	cases := []struct {
+		name          string
+		removeMembers bool
+	}{
+		{
+			name: "keep members",
+		},
+		{
+			name:          "remove members",
+			removeMembers: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{
+				entries: []netlink.IPSetEntry{
+					{IP: net.ParseIP("10.0.0.1").To4(), Comment: "default/a/uid-a"},
+					{IP: net.ParseIP("10.0.0.2").To4(), Comment: "uid-b"},
+				},
+			}
+			setFakeIpset(t, f)
+			nl := setFakeNetlink(t)
+			setAmbientConfigPath(t)
+			s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables()}
+			for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+				rte, err := podRoute(ip, s.hostIP, s.routeTables.Inbound, 7)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nl.routes = append(nl.routes, *rte)
+			}
+
+			if err := s.Drain(tc.removeMembers); err != nil {
+				t.Fatal(err)
+			}
+			// The CNI plugin reads the draining state from the config file.
+			cfg, err := ReadAmbientConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !cfg.Draining {
+				t.Errorf("expected the config file to be draining")
+			}
+			lists := f.lists
+			s.addPodToMesh(newTestPod("c", "c", "10.0.0.3"))
+			if _, err := s.addPodsToMesh([]*corev1.Pod{newTestPod("d", "d", "10.0.0.4")}); err != nil {
+				t.Fatal(err)
+			}
+			if len(f.added) != 0 || f.lists != lists {
+				t.Errorf("expected no pods to be added while draining, got %v and %d lists", f.added, f.lists-lists)
+			}
+
+			expectedMembers := 2
+			if tc.removeMembers {
+				expectedMembers = 0
+			}
+			if len(f.entries) != expectedMembers || len(nl.routes) != expectedMembers {
+				t.Errorf("expected %d members, got entries %v and routes %v", expectedMembers, f.entries, nl.routes)
+			}
+		})
+	}
+}
@@ -0,0 +1,265 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// dryRun makes the node setup print the commands, proc writes and netlink calls it would make
+// instead of making them. It is set from AmbientArgs.DryRun.
+var dryRun = false
+
+// dryRunOut receives the dry-run output, as a shell script that can be compared line by line with
+// redirect-worker.sh.
+var dryRunOut io.Writer = os.Stdout
+
+// printDryRun prints a command to dryRunOut, quoting the arguments for the shell.
+func printDryRun(cmd string, args ...string) {
+	words := make([]string, 0, len(args)+1)
+	for _, w := range append([]string{cmd}, args...) {
+		words = append(words, shellQuote(w))
+	}
+	fmt.Fprintln(dryRunOut, strings.Join(words, " "))
+}
+
+func shellQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if strings.IndexFunc(s, func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_./:=@%+,", r))
+	}) == -1 {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// The netlink wrappers below make the netlink calls of the node setup, or print the equivalent ip
+// command in dry-run mode.
+
+func linkAdd(link netlink.Link) error {
+	if dryRun {
+		args := []string{"link", "add", link.Attrs().Name}
+		if geneve, ok := link.(*netlink.Geneve); ok {
+			args = append(args, geneveArgs(geneve, geneve.Remote.String())...)
+		} else if _, ok := link.(*netlink.Wireguard); ok {
+			args = append(args, "type", "wireguard")
+		}
+		printDryRun("ip", args...)
+		return nil
+	}
+	return netlink.LinkAdd(link)
+}
+
+func linkDel(link netlink.Link) error {
+	if dryRun {
+		printDryRun("ip", "link", "del", link.Attrs().Name)
+		return nil
+	}
+	return netlink.LinkDel(link)
+}
+
+func linkSetMTU(link netlink.Link, mtu int) error {
+	if dryRun {
+		printDryRun("ip", "link", "set", link.Attrs().Name, "mtu", strconv.Itoa(mtu))
+		return nil
+	}
+	return netlink.LinkSetMTU(link, mtu)
+}
+
+func linkSetUp(link netlink.Link) error {
+	if dryRun {
+		printDryRun("ip", "link", "set", link.Attrs().Name, "up")
+		return nil
+	}
+	return netlink.LinkSetUp(link)
+}
+
+func addrReplace(link netlink.Link, addr *netlink.Addr) error {
+	if dryRun {
+		printDryRun("ip", "addr", "replace", addr.IPNet.String(), "dev", link.Attrs().Name)
+		return nil
+	}
+	return netlink.AddrReplace(link, addr)
+}
+
+func addrDel(link netlink.Link, addr *netlink.Addr) error {
+	if dryRun {
+		printDryRun("ip", "addr", "del", addr.IPNet.String(), "dev", link.Attrs().Name)
+		return nil
+	}
+	return netlink.AddrDel(link, addr)
+}
+
+func routeAdd(route *netlink.Route) error {
+	if dryRun {
+		printDryRun("ip", append([]string{"route", "add"}, routeArgs(route)...)...)
+		return nil
+	}
+	return netlink.RouteAdd(route)
+}
+
+func routeDel(route *netlink.Route) error {
+	if dryRun {
+		printDryRun("ip", append([]string{"route", "del"}, routeArgs(route)...)...)
+		return nil
+	}
+	return netlink.RouteDel(route)
+}
+
+func ruleAdd(rule *netlink.Rule) error {
+	if dryRun {
+		printDryRun("ip", append([]string{"rule", "add"}, ruleArgs(rule)...)...)
+		return nil
+	}
+	return netlink.RuleAdd(rule)
+}
+
+func ruleDel(rule *netlink.Rule) error {
+	if dryRun {
+		printDryRun("ip", append([]string{"rule", "del"}, ruleArgs(rule)...)...)
+		return nil
+	}
+	return netlink.RuleDel(rule)
+}
+
+// ruleArgs returns the ip rule arguments describing rule.
+func ruleArgs(rule *netlink.Rule) []string {
+	args := []string{"priority", strconv.Itoa(rule.Priority)}
+	if rule.Mark >= 0 {
+		args = append(args, "fwmark", fmt.Sprintf("0x%x/0x%x", rule.Mark, uint32(rule.Mask)))
+	}
+	if rule.Goto >= 0 {
+		args = append(args, "goto", strconv.Itoa(rule.Goto))
+	} else {
+		args = append(args, "lookup", strconv.Itoa(rule.Table))
+	}
+	return args
+}
+
+// routeArgs returns the ip route arguments describing route.
+func routeArgs(route *netlink.Route) []string {
+	var args []string
+	if route.Table != 0 {
+		args = append(args, "table", strconv.Itoa(route.Table))
+	}
+	if route.Dst != nil {
+		args = append(args, route.Dst.String())
+	} else {
+		args = append(args, "default")
+	}
+	if route.Gw != nil {
+		args = append(args, "via", route.Gw.String())
+	}
+	if route.LinkIndex != 0 {
+		dev := fmt.Sprintf("if%d", route.LinkIndex)
+		if link, err := netlink.LinkByIndex(route.LinkIndex); err == nil {
+			dev = link.Attrs().Name
+		}
+		args = append(args, "dev", dev)
+	}
+	if route.Src != nil {
+		args = append(args, "src", route.Src.String())
+	}
+	return args
+}
+
+// dryRunIpset prints the ipset changes instead of making them. Listing is passed through, so that
+// membership checks still see the real set.
+type dryRunIpset struct {
+	IpsetHandle
+	name string
+}
+
+func (d dryRunIpset) CreateSet() error {
+	printDryRun("ipset", append([]string{"create", d.name, "hash:ip", "comment"}, ipsetSize.args()...)...)
+	return nil
+}
+
+func (d dryRunIpset) DestroySet() error {
+	printDryRun("ipset", "destroy", d.name)
+	return nil
+}
+
+func (d dryRunIpset) AddIP(ip net.IP, comment string) error {
+	printDryRun("ipset", "add", d.name, ip.String(), "comment", comment)
+	return nil
+}
+
+func (d dryRunIpset) DeleteIP(ip net.IP) error {
+	printDryRun("ipset", "del", d.name, ip.String())
+	return nil
+}
+
+func (d dryRunIpset) Flush() error {
+	printDryRun("ipset", "flush", d.name)
+	return nil
+}
+
+// dryRunIptables prints the iptables changes instead of making them. No rules or chains are
+// reported to exist, so the full setup is printed.
+type dryRunIptables struct {
+	cmd string
+}
+
+func (dryRunIptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	return false, nil
+}
+
+func (d dryRunIptables) Append(table, chain string, rulespec ...string) error {
+	printDryRun(d.cmd, append([]string{"-t", table, "-A", chain}, rulespec...)...)
+	return nil
+}
+
+func (d dryRunIptables) Insert(table, chain string, pos int, rulespec ...string) error {
+	printDryRun(d.cmd, append([]string{"-t", table, "-I", chain, strconv.Itoa(pos)}, rulespec...)...)
+	return nil
+}
+
+func (d dryRunIptables) Delete(table, chain string, rulespec ...string) error {
+	printDryRun(d.cmd, append([]string{"-t", table, "-D", chain}, rulespec...)...)
+	return nil
+}
+
+func (dryRunIptables) ChainExists(table, chain string) (bool, error) {
+	return false, nil
+}
+
+func (dryRunIptables) List(table, chain string) ([]string, error) {
+	return nil, nil
+}
+
+func (d dryRunIptables) NewChain(table, chain string) error {
+	printDryRun(d.cmd, "-t", table, "-N", chain)
+	return nil
+}
+
+func (d dryRunIptables) ClearChain(table, chain string) error {
+	printDryRun(d.cmd, "-t", table, "-F", chain)
+	return nil
+}
+
+func (d dryRunIptables) DeleteChain(table, chain string) error {
+	printDryRun(d.cmd, "-t", table, "-X", chain)
+	return nil
+}
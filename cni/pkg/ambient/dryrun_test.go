@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+func setDryRun(t *testing.T) *bytes.Buffer {
+	out := &bytes.Buffer{}
+	origOut := dryRunOut
+	dryRun, dryRunOut = true, out
+	t.Cleanup(func() {
+		dryRun, dryRunOut = false, origOut
+	})
+	return out
+}
+
+func TestDryRun(t *testing.T) {
+	out := setDryRun(t)
+
+	proc := filepath.Join(t.TempDir(), "rp_filter")
+	if err := os.WriteFile(proc, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetProcChecked(proc, "0"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := GetProc(proc); got != "1" {
+		t.Errorf("expected %s to be untouched, got %q", proc, got)
+	}
+
+	_, err := iptablesAppend(context.Background(), []*iptablesRule{
+		newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+			"-m", "set", "!", "--match-set", ipsetName, "src", "-j", "RETURN"),
+	}, defaultIptablesWait, backoff{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, dst, _ := net.ParseCIDR("10.0.0.1/32")
+	if err := routeAdd(&netlink.Route{Table: 100, Dst: dst, Gw: net.ParseIP("192.168.126.2")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := execute(context.Background(), "ip", "rule", "add", "priority", "100", "fwmark", "0x200/0x200", "goto", "32766"); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "echo 0 > " + proc + "\n" +
+		IptablesCmd + " -t mangle -A ztunnel-PREROUTING -m set '!' --match-set ztunnel-pods-ips src -j RETURN\n" +
+		"ip route add table 100 10.0.0.1/32 via 192.168.126.2\n" +
+		"ip rule add priority 100 fwmark 0x200/0x200 goto 32766\n"
+	if out.String() != expected {
+		t.Errorf("expected output:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// The values of the node which DumpRules leaves as variables of the script.
+const (
+	dumpDevice    = "${DEVICE}"
+	dumpZTunnelIP = "${ZTUNNEL_IP}"
+	dumpDPUIP     = "${DPU_IP}"
+)
+
+// DumpRules returns the ipset, iptables, proc and ip commands of the node setup of a CPU node, or
+// of a DPU node if cpu is false, as a bash script in the spirit of redirect-worker.sh. The commands
+// are rendered from the same definitions CreateRulesOnCPUNode and CreateRulesOnDPUNode apply. The
+// device, which is the CPU device or the ztunnel veth, the ztunnel IP and the DPU IP are left as
+// variables to set when running the script.
+//
+// DNS capture, which depends on the ztunnel pod, and the rp_filter writes to the other interfaces
+// of the node are left out.
+func (s *Server) DumpRules(cpu bool) string {
+	var b strings.Builder
+	line := func(cmd string, args ...string) {
+		words := make([]string, 0, len(args)+1)
+		for _, w := range append([]string{cmd}, args...) {
+			words = append(words, scriptQuote(w))
+		}
+		b.WriteString(strings.Join(words, " ") + "\n")
+	}
+	section := func(comment string) {
+		b.WriteString("\n# " + comment + "\n")
+	}
+
+	nodeType := "DPU"
+	if cpu {
+		nodeType = "CPU"
+	}
+	b.WriteString("#!/usr/bin/env bash\n")
+	b.WriteString("# ztunnel redirection setup of a " + nodeType + " node.\n")
+	b.WriteString("set -ex\n\n")
+	if cpu {
+		b.WriteString(": \"${DEVICE:?set DEVICE to the device routing to the DPU}\"\n")
+		b.WriteString(": \"${DPU_IP:?set DPU_IP to the IP of the DPU}\"\n")
+	} else {
+		b.WriteString(": \"${DEVICE:?set DEVICE to the ztunnel veth}\"\n")
+	}
+	b.WriteString(": \"${ZTUNNEL_IP:?set ZTUNNEL_IP to the IP of ztunnel}\"\n")
+
+	section("ipsets of the mesh pods")
+	for _, name := range append([]string{ipsetName}, extraIpsetNames()...) {
+		line("ipset", append([]string{"create", name, "hash:ip", "comment"}, ipsetSize.args()...)...)
+	}
+	if s.enableIPv6 {
+		line("ipset", append([]string{"create", ipset6Name, "hash:ip", "family", "inet6", "comment"}, ipsetSize.args()...)...)
+	}
+	if s.enablePortIpset {
+		line("ipset", append([]string{"create", ipsetPortName, "hash:ip,port", "comment"}, ipsetSize.args()...)...)
+	}
+
+	section("ztunnel chains")
+	for _, c := range ztunnelChains {
+		line(IptablesCmd, "-t", c.table, "-N", c.chain)
+		line(IptablesCmd, "-t", c.table, "-I", c.parent, "1", "-j", c.chain)
+	}
+
+	var appendRules, appendRules2 []*iptablesRule
+	if cpu {
+		appendRules, appendRules2 = s.cpuNodeRules(dumpDevice, dumpZTunnelIP, false)
+	} else {
+		appendRules, appendRules2 = s.dpuNodeRules(dumpDevice, dumpZTunnelIP, false)
+	}
+	section("ztunnel rules")
+	for _, group := range [][]*iptablesRule{appendRules, appendRules2, s.ipv6Rules(appendRules, appendRules2)} {
+		for _, rule := range group {
+			cmd := IptablesCmd
+			if rule.IPv6 {
+				cmd = ip6tablesCmd()
+			}
+			line(cmd, append([]string{"-t", rule.Table, "-A", rule.Chain}, rule.RuleSpec...)...)
+		}
+	}
+
+	section("proc files")
+	echo := func(procs map[string]string) {
+		paths := make([]string, 0, len(procs))
+		for path := range procs {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			b.WriteString("echo " + scriptQuote(procs[path]) + " > " + scriptQuote(path) + "\n")
+		}
+	}
+	var routes []*ExecList
+	if cpu {
+		rpFilters, procs := cpuNodeProcs(dumpDevice)
+		for _, path := range rpFilters {
+			b.WriteString("echo 0 > " + scriptQuote(path) + "\n")
+		}
+		echo(procs)
+		routes = s.cpuNodeRoutes(dumpDevice, dumpDPUIP)
+	} else {
+		echo(dpuNodeProcs(dumpDevice))
+
+		section("tunnels to ztunnel")
+		for _, t := range s.dpuTunnels(dumpZTunnelIP) {
+			// The remote is the variable itself, which the link of dpuTunnels can't hold.
+			line("ip", append([]string{"link", "add", t.link.Name}, geneveArgs(t.link, dumpZTunnelIP)...)...)
+			if s.tunnelMTU != 0 {
+				line("ip", "link", "set", t.link.Name, "mtu", strconv.Itoa(s.tunnelMTU))
+			}
+			line("ip", "addr", "add", fmt.Sprintf("%s/%d", t.ip, constants.TunPrefix), "dev", t.link.Name)
+			line("ip", "link", "set", t.link.Name, "up")
+			echo(tunnelProcs(t.link.Name))
+		}
+		routes = s.dpuNodeRoutes(dumpDevice, dumpZTunnelIP)
+	}
+
+	section("routes and ip rules")
+	for _, route := range routes {
+		line(route.Cmd, route.Args...)
+	}
+	rulesOf := offmesh.DPUNode
+	if cpu {
+		rulesOf = offmesh.CPUNode
+	}
+	for _, rule := range s.ipRules(rulesOf) {
+		rule := rule
+		line("ip", append([]string{"rule", "add"}, ruleArgs(&rule)...)...)
+	}
+	return b.String()
+}
+
+// scriptQuote quotes s for the script of DumpRules. Words with a variable of the script are double
+// quoted, so that the variable is expanded.
+func scriptQuote(s string) string {
+	if !strings.Contains(s, "${") {
+		return shellQuote(s)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`").Replace(s) + `"`
+}
@@ -0,0 +1,177 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// scriptWords splits a line of the DumpRules script into its words, undoing the quoting.
+func scriptWords(t *testing.T, line string) []string {
+	t.Helper()
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case quote == '"':
+			switch r {
+			case '"':
+				quote = 0
+			case '\\':
+				escaped = true
+			default:
+				word.WriteRune(r)
+			}
+		case r == ' ':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == '\\':
+			escaped, inWord = true, true
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		t.Fatalf("unterminated quoting in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+func TestDumpRules(t *testing.T) {
+	for _, cpu := range []bool{true, false} {
+		name := "dpu"
+		if cpu {
+			name = "cpu"
+		}
+		t.Run(name, func(t *testing.T) {
+			s := &Server{
+				hostIP:      "10.0.0.100",
+				routeTables: DefaultRouteTables(),
+				tunnelVNIs:  DefaultTunnelVNIs(),
+				tunnelMTU:   1450,
+			}
+			script := s.DumpRules(cpu)
+
+			var (
+				rules  []*iptablesRule
+				routes []*ExecList
+				links  []string
+			)
+			procs := map[string]string{}
+			for _, line := range strings.Split(script, "\n") {
+				if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ":") || line == "set -ex" {
+					continue
+				}
+				words := scriptWords(t, line)
+				switch {
+				case words[0] == IptablesCmd && words[3] == "-A":
+					rules = append(rules, &iptablesRule{Table: words[2], Chain: words[4], RuleSpec: words[5:]})
+				case words[0] == "ip" && (words[1] == "route" || words[1] == "rule"):
+					routes = append(routes, newExec(words[0], words[1:]))
+				case words[0] == "ip" && words[1] == "link" && words[2] == "add":
+					links = append(links, strings.Join(words[3:], " "))
+				case words[0] == "echo":
+					procs[words[3]] = words[1]
+				}
+			}
+
+			var expectedRules []*iptablesRule
+			var expectedRoutes []*ExecList
+			var expectedLinks []string
+			expectedProcs := map[string]string{}
+			if cpu {
+				r1, r2 := s.cpuNodeRules(dumpDevice, dumpZTunnelIP, false)
+				expectedRules = append(r1, r2...)
+				expectedRoutes = append(s.cpuNodeRoutes(dumpDevice, dumpDPUIP), ruleAdds(s.ipRules(offmesh.CPUNode))...)
+				rpFilters, others := cpuNodeProcs(dumpDevice)
+				for _, path := range rpFilters {
+					expectedProcs[path] = "0"
+				}
+				for path, value := range others {
+					expectedProcs[path] = value
+				}
+			} else {
+				r1, r2 := s.dpuNodeRules(dumpDevice, dumpZTunnelIP, false)
+				expectedRules = append(r1, r2...)
+				expectedRoutes = append(s.dpuNodeRoutes(dumpDevice, dumpZTunnelIP), ruleAdds(s.ipRules(offmesh.DPUNode))...)
+				for path, value := range dpuNodeProcs(dumpDevice) {
+					expectedProcs[path] = value
+				}
+				for _, name := range []string{constants.InboundTun, constants.OutboundTun} {
+					for path, value := range tunnelProcs(name) {
+						expectedProcs[path] = value
+					}
+				}
+				expectedLinks = []string{
+					constants.InboundTun + " type geneve id 1000 remote " + dumpZTunnelIP + " dstport 6081",
+					constants.OutboundTun + " type geneve id 1001 remote " + dumpZTunnelIP + " dstport 6081",
+				}
+			}
+
+			if !reflect.DeepEqual(rules, expectedRules) {
+				t.Errorf("expected the iptables rules of the setup, got:\n%s", script)
+			}
+			if !reflect.DeepEqual(routes, expectedRoutes) {
+				t.Errorf("expected the routes of the setup %v, got %v", expectedRoutes, routes)
+			}
+			if !reflect.DeepEqual(procs, expectedProcs) {
+				t.Errorf("expected the proc files of the setup %v, got %v", expectedProcs, procs)
+			}
+			if !reflect.DeepEqual(links, expectedLinks) {
+				t.Errorf("expected the tunnels %v, got %v", expectedLinks, links)
+			}
+		})
+	}
+}
+
+// ruleAdds returns the ip rule add commands of rules.
+func ruleAdds(rules []netlink.Rule) []*ExecList {
+	var commands []*ExecList
+	for _, rule := range rules {
+		rule := rule
+		commands = append(commands, newExec("ip", append([]string{"rule", "add"}, ruleArgs(&rule)...)))
+	}
+	return commands
+}
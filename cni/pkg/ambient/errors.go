@@ -0,0 +1,142 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/vishvananda/netlink"
+
+	ipsetlib "istio.io/istio/cni/pkg/ipset"
+)
+
+// Errors returned by the ambient dataplane functions. Callers should compare against
+// these with errors.Is, as they are usually wrapped with more context.
+var (
+	// ErrNoOffmeshPair is returned when this node has no CPU/DPU pair in the offmesh cluster config.
+	ErrNoOffmeshPair = errors.New("no offmesh pair configured")
+	// ErrInvalidPodIP is returned when a pod IP is missing or cannot be parsed.
+	ErrInvalidPodIP = errors.New("invalid pod ip")
+	// ErrNoRouteToDest is returned when no route exists for a destination.
+	ErrNoRouteToDest = errors.New("no route to destination")
+	// ErrIpsetMissing is returned when the pod ipset does not exist.
+	ErrIpsetMissing = errors.New("ipset does not exist")
+	// ErrDeviceNotFound is returned when no network device matches a lookup.
+	ErrDeviceNotFound = errors.New("network device not found")
+	// ErrHostIPNotFound is returned when the host IP can't be found from the node.
+	ErrHostIPNotFound = errors.New("host ip not found")
+	// ErrHostIPTimeout is returned by GetHostIP when the host IP isn't found in time, e.g. as listing
+	// the interfaces of the node hangs.
+	ErrHostIPTimeout = errors.New("timed out getting host ip")
+	// ErrInvalidZtunnelIP is returned when the ztunnel IP given for node setup is missing or
+	// cannot be parsed.
+	ErrInvalidZtunnelIP = errors.New("invalid ztunnel ip")
+	// ErrPodNotRemoved is returned when a pod is still in the ipset or route table after removal.
+	ErrPodNotRemoved = errors.New("pod not removed from mesh")
+	// ErrZTunnelNotReady is returned when ztunnel doesn't accept connections on its health port in
+	// time.
+	ErrZTunnelNotReady = errors.New("ztunnel not ready")
+	// ErrKernelModulesMissing is returned by Preflight when kernel modules of the node setup are
+	// not available.
+	ErrKernelModulesMissing = errors.New("kernel modules missing")
+	// ErrDeviceGone is returned by node setup when a device it routes through disappeared, e.g. the
+	// ztunnel veth when ztunnel restarts. Node setup should be run again once the device is back.
+	ErrDeviceGone = errors.New("network device disappeared during node setup")
+	// ErrCaptureInconsistent is returned by IsIPCaptured when an IP is in the ipset without an
+	// inbound route, or the other way around.
+	ErrCaptureInconsistent = errors.New("ipset and inbound routes disagree")
+	// ErrRouteConflict is returned when a route can't be added as another route to the same
+	// destination exists, e.g. one left by another CNI.
+	ErrRouteConflict = errors.New("conflicting route exists")
+	// ErrIpsetFull is returned when a pod can't be added to its ipset as the set holds its maximum
+	// number of elements.
+	ErrIpsetFull = errors.New("ipset is full")
+	// ErrPermission is returned when a netlink operation, command or proc write isn't permitted,
+	// e.g. as the process lacks CAP_NET_ADMIN. Retrying doesn't help.
+	ErrPermission = errors.New("operation not permitted")
+)
+
+// NetlinkError is returned when a netlink operation fails.
+type NetlinkError struct {
+	// Op is the netlink operation that failed, e.g. "RouteList".
+	Op  string
+	Err error
+}
+
+func (e *NetlinkError) Error() string {
+	return fmt.Sprintf("netlink %s failed: %v", e.Op, e.Err)
+}
+
+func (e *NetlinkError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the sentinel errors of the common failures of netlink operations: ErrPermission,
+// ErrDeviceNotFound, ErrRouteConflict, ErrIpsetMissing and ErrIpsetFull.
+func (e *NetlinkError) Is(target error) bool {
+	switch target {
+	case ErrPermission:
+		return errors.Is(e.Err, syscall.EPERM) || errors.Is(e.Err, syscall.EACCES)
+	case ErrDeviceNotFound:
+		var notFound netlink.LinkNotFoundError
+		return errors.Is(e.Err, syscall.ENODEV) || errors.As(e.Err, &notFound)
+	case ErrRouteConflict:
+		return e.Op == "RouteAdd" && errors.Is(e.Err, syscall.EEXIST)
+	case ErrIpsetMissing:
+		return strings.HasPrefix(e.Op, "Ipset") && errors.Is(e.Err, os.ErrNotExist)
+	case ErrIpsetFull:
+		return e.Op == "IpsetAdd" && ipsetlib.IsSetFull(e.Err)
+	}
+	return false
+}
+
+// commandError is the error of a failed command, whose message is the command line followed by the
+// stderr of the command. It wraps the sentinel error of the failure, if stderr describes a common
+// one.
+type commandError struct {
+	cmd    string
+	args   []string
+	stderr string
+	kind   error
+}
+
+func newCommandError(cmd string, args []string, stderr string) error {
+	e := &commandError{cmd: cmd, args: args, stderr: stderr}
+	switch {
+	case strings.Contains(stderr, "Operation not permitted") || strings.Contains(stderr, "Permission denied"):
+		e.kind = ErrPermission
+	case strings.Contains(stderr, "Cannot find device"):
+		e.kind = ErrDeviceNotFound
+	case strings.Contains(stderr, "does not exist") && cmd == "ipset":
+		e.kind = ErrIpsetMissing
+	case strings.Contains(stderr, "File exists") && cmd == "ip" && len(args) > 0 && args[0] == "route":
+		e.kind = ErrRouteConflict
+	case strings.Contains(stderr, "File exists") && cmd == "ip" && len(args) > 1 && args[0] == "link" && args[1] == "add":
+		e.kind = os.ErrExist
+	}
+	return e
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s %s: %s", e.cmd, strings.Join(e.args, " "), strings.TrimSpace(e.stderr))
+}
+
+func (e *commandError) Unwrap() error {
+	return e.kind
+}
@@ -0,0 +1,266 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+func TestTypedErrors(t *testing.T) {
+	// withInboundTun sets up a fake netlink with the inbound tunnel, for the pod routes.
+	withInboundTun := func(routeAddErr error) func(t *testing.T) {
+		return func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9}}
+			nl.routeAddErr = routeAddErr
+		}
+	}
+
+	cases := []struct {
+		name     string
+		ipset    *fakeIpset
+		setup    func(t *testing.T)
+		call     func() error
+		expected error
+	}{
+		{
+			name: "podRoute without ip",
+			call: func() error {
+				_, err := podRoute("", "10.0.0.100", constants.RouteTableInbound, 0)
+				return err
+			},
+			expected: ErrInvalidPodIP,
+		},
+		{
+			name: "podRoute with malformed ip",
+			call: func() error {
+				_, err := podRoute("10.0.0", "10.0.0.100", constants.RouteTableInbound, 0)
+				return err
+			},
+			expected: ErrInvalidPodIP,
+		},
+		{
+			name: "getDeviceWithDestinationOf with malformed ip",
+			call: func() error {
+				_, err := getDeviceWithDestinationOf("not-an-ip")
+				return err
+			},
+			expected: ErrInvalidPodIP,
+		},
+		{
+			name: "GetHostNetDevice with unknown address",
+			call: func() error {
+				_, err := GetHostNetDevice("203.0.113.254")
+				return err
+			},
+			expected: ErrDeviceNotFound,
+		},
+		{
+			name:  "IsPodInIpset with missing ipset",
+			ipset: &fakeIpset{listErr: fmt.Errorf("failed to list ipset: %w", syscall.ENOENT)},
+			call: func() error {
+				_, err := IsPodInIpset(newTestPod("a", "a", "10.0.0.1"))
+				return err
+			},
+			expected: ErrIpsetMissing,
+		},
+		{
+			name:  "AddPodsToMesh with missing ipset",
+			ipset: &fakeIpset{listErr: fmt.Errorf("failed to list ipset: %w", syscall.ENOENT)},
+			setup: withInboundTun(nil),
+			call: func() error {
+				_, err := AddPodsToMesh([]*corev1.Pod{newTestPod("a", "a", "10.0.0.1")}, testHostIP)
+				return err
+			},
+			expected: ErrIpsetMissing,
+		},
+		{
+			name:  "AddPodToMesh without permission",
+			ipset: &fakeIpset{addErr: syscall.EPERM},
+			setup: withInboundTun(nil),
+			call: func() error {
+				return AddPodToMesh(newTestPod("a", "a", "10.0.0.1"), "", testHostIP, "")
+			},
+			expected: ErrPermission,
+		},
+		{
+			name:  "AddPodToMesh without host IP",
+			ipset: &fakeIpset{},
+			setup: withInboundTun(nil),
+			call: func() error {
+				return AddPodToMesh(newTestPod("a", "a", "10.0.0.1"), "", "", "")
+			},
+			expected: ErrHostIPNotFound,
+		},
+		{
+			name:  "AddPodToMesh with full ipset",
+			ipset: &fakeIpset{addErr: errors.New("Hash is full, cannot add more elements")},
+			setup: withInboundTun(nil),
+			call: func() error {
+				return AddPodToMesh(newTestPod("a", "a", "10.0.0.1"), "", testHostIP, "")
+			},
+			expected: ErrIpsetFull,
+		},
+		{
+			name:  "AddPodToMesh with conflicting route",
+			ipset: &fakeIpset{},
+			setup: withInboundTun(syscall.EEXIST),
+			call: func() error {
+				return AddPodToMesh(newTestPod("a", "a", "10.0.0.1"), "", testHostIP, "")
+			},
+			expected: ErrRouteConflict,
+		},
+		{
+			name:  "AddPodsToMesh with conflicting route",
+			ipset: &fakeIpset{},
+			setup: withInboundTun(syscall.EEXIST),
+			call: func() error {
+				_, err := AddPodsToMesh([]*corev1.Pod{newTestPod("a", "a", "10.0.0.1")}, testHostIP)
+				return err
+			},
+			expected: ErrRouteConflict,
+		},
+		{
+			name:  "addPodRoute without inbound tunnel",
+			ipset: &fakeIpset{},
+			setup: func(t *testing.T) { setFakeNetlink(t) },
+			call: func() error {
+				return addPodRoute("10.0.0.1", "10.0.0.100", constants.RouteTableInbound, 0)
+			},
+			expected: ErrDeviceNotFound,
+		},
+		{
+			name: "ipset command without permission",
+			call: func() error {
+				return newCommandError("ipset", []string{"add", "ztunnel-pods-ips", "10.0.0.1"},
+					"ipset v7.15: Kernel error received: Operation not permitted")
+			},
+			expected: ErrPermission,
+		},
+		{
+			name: "ipset command on missing set",
+			call: func() error {
+				return newCommandError("ipset", []string{"list", "ztunnel-pods-ips"},
+					"ipset v7.15: The set with the given name does not exist")
+			},
+			expected: ErrIpsetMissing,
+		},
+		{
+			name: "ip route command with conflicting route",
+			call: func() error {
+				return newCommandError("ip", []string{"route", "add", "10.0.0.1"}, "RTNETLINK answers: File exists")
+			},
+			expected: ErrRouteConflict,
+		},
+		{
+			name: "ip link command with existing link",
+			call: func() error {
+				return newCommandError("ip", []string{"link", "add", "istioin", "type", "geneve"}, "RTNETLINK answers: File exists")
+			},
+			expected: os.ErrExist,
+		},
+		{
+			name: "ip command on missing device",
+			call: func() error {
+				return newCommandError("ip", []string{"route", "add", "10.0.0.1", "dev", "veth0"}, `Cannot find device "veth0"`)
+			},
+			expected: ErrDeviceNotFound,
+		},
+		{
+			name: "CreateRulesOnCPUNode without pair",
+			call: func() error {
+				return (&Server{}).CreateRulesOnCPUNode(context.Background(), "eth0", "10.0.0.2", false)
+			},
+			expected: ErrNoOffmeshPair,
+		},
+		{
+			name: "CreateRulesOnDPUNode without pair",
+			call: func() error {
+				return (&Server{}).CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false)
+			},
+			expected: ErrNoOffmeshPair,
+		},
+		{
+			name: "CreateRulesOnCPUNode with invalid pair IP",
+			call: func() error {
+				s := &Server{nodeName: "cpu1", offmeshCluster: offmesh.ClusterConfig{
+					Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "dpu1.local"}},
+				}}
+				return s.CreateRulesOnCPUNode(context.Background(), "eth0", "10.0.0.2", false)
+			},
+			expected: ErrNoOffmeshPair,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.ipset != nil {
+				setFakeIpset(t, tc.ipset)
+			}
+			if tc.setup != nil {
+				tc.setup(t)
+			}
+			err := tc.call()
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+func TestNoOffmeshPairMessage(t *testing.T) {
+	s := &Server{nodeName: "dpu1", offmeshCluster: offmesh.ClusterConfig{}}
+	_, err := s.getOffmeshPair(offmesh.DPUNode)
+	expected := "no offmesh CPU node paired with dpu1"
+	if err == nil || !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected an error containing %q, got %v", expected, err)
+	}
+}
+
+func TestNetlinkErrorUnwrap(t *testing.T) {
+	setFakeIpset(t, &fakeIpset{listErr: syscall.EPERM})
+
+	_, err := IsPodInIpset(newTestPod("a", "a", "10.0.0.1"))
+	var nlErr *NetlinkError
+	if !errors.As(err, &nlErr) {
+		t.Fatalf("expected NetlinkError, got %v", err)
+	}
+	if nlErr.Op != "IpsetList" || !errors.Is(err, syscall.EPERM) {
+		t.Errorf("unexpected netlink error: %v", err)
+	}
+}
+
+func TestCommandErrorMessage(t *testing.T) {
+	err := newCommandError("ip", []string{"rule", "add"}, "RTNETLINK answers: File exists\n")
+	if expected := "ip rule add: RTNETLINK answers: File exists"; err.Error() != expected {
+		t.Errorf("expected the command and its stderr as message %q, got %q", expected, err.Error())
+	}
+	// Only route commands fail with a conflicting route.
+	if errors.Is(err, ErrRouteConflict) {
+		t.Errorf("expected an ip rule failure not to be a route conflict")
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// ParsePortList parses a comma separated list of ports, as used by the exclusion env vars.
+func ParsePortList(ports string) ([]uint16, error) {
+	var res []uint16
+	for _, p := range strings.Split(ports, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid port %q", p)
+		}
+		res = append(res, uint16(port))
+	}
+	return res, nil
+}
+
+// ParseIDList parses a comma separated list of user or group IDs, as used by the owner exclusion
+// env vars.
+func ParseIDList(ids string) ([]uint32, error) {
+	var res []uint32
+	for _, id := range strings.Split(ids, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(id, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ID %q", id)
+		}
+		res = append(res, uint32(n))
+	}
+	return res, nil
+}
+
+// portExclusionRules returns the rules skipping the traffic of the excluded ports, which bypasses
+// ztunnel. They set the conn skip mark, which includes the skip mark, so that the packets returning
+// on the connection are skipped too.
+func (s *Server) portExclusionRules() []*iptablesRule {
+	marks := s.markArgs()
+	var rules []*iptablesRule
+	for _, proto := range []string{"tcp", "udp"} {
+		// Traffic to the ports of mesh pods.
+		for _, port := range s.excludeInboundPorts {
+			rules = append(rules, newIptableRule(
+				constants.TableMangle,
+				constants.ChainZTunnelPrerouting,
+				"-p", proto,
+				"--dport", strconv.Itoa(int(port)),
+				"-m", "set",
+				"--match-set", ipsetName, "dst",
+				"-j", "MARK",
+				"--set-mark", marks.ConnSkipMark,
+			))
+		}
+		// Traffic from mesh pods to the ports.
+		for _, port := range s.excludeOutboundPorts {
+			rules = append(rules, newIptableRule(
+				constants.TableMangle,
+				constants.ChainZTunnelPrerouting,
+				"-p", proto,
+				"--dport", strconv.Itoa(int(port)),
+				"-m", "set",
+				"--match-set", ipsetName, "src",
+				"-j", "MARK",
+				"--set-mark", marks.ConnSkipMark,
+			))
+		}
+	}
+	return rules
+}
+
+// parseExcludedCIDRs parses the CIDRs excluded from capture. CIDRs overlapping a pod CIDR are
+// rejected, as they would take mesh pods out of the mesh.
+func parseExcludedCIDRs(cidrs, podCIDRs []string) ([]netip.Prefix, error) {
+	pods := make([]netip.Prefix, 0, len(podCIDRs))
+	for _, c := range podCIDRs {
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pod CIDR %q: %v", c, err)
+		}
+		pods = append(pods, prefix)
+	}
+
+	var res []netip.Prefix
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %v", c, err)
+		}
+		if !prefix.Addr().Is4() {
+			return nil, fmt.Errorf("CIDR %s is not IPv4", prefix)
+		}
+		for _, pod := range pods {
+			if prefix.Overlaps(pod) {
+				return nil, fmt.Errorf("CIDR %s overlaps the pod CIDR %s", prefix, pod)
+			}
+		}
+		res = append(res, prefix.Masked())
+	}
+	return res, nil
+}
+
+// cidrExclusionRules returns the rules skipping the traffic to the excluded CIDRs. Like the port
+// exclusions, they set the conn skip mark so that the replies are skipped too.
+func (s *Server) cidrExclusionRules() []*iptablesRule {
+	marks := s.markArgs()
+	rules := make([]*iptablesRule, 0, len(s.excludeOutboundCIDRs))
+	for _, cidr := range s.excludeOutboundCIDRs {
+		rules = append(rules, newIptableRule(
+			constants.TableMangle,
+			constants.ChainZTunnelPrerouting,
+			"-d", cidr.String(),
+			"-j", "MARK",
+			"--set-mark", marks.ConnSkipMark,
+		))
+	}
+	return rules
+}
+
+// linkLocalMulticastCIDRs are the link-local and multicast destinations, which are never served
+// by mesh pods. Capturing their traffic breaks e.g. the cloud metadata server over TCP and VRRP.
+var linkLocalMulticastCIDRs = []string{"169.254.0.0/16", "224.0.0.0/4"}
+
+// linkLocalMulticastRules returns the rules skipping the traffic to linkLocalMulticastCIDRs, if
+// enabled. Like the CIDR exclusions, they set the conn skip mark.
+func (s *Server) linkLocalMulticastRules() []*iptablesRule {
+	if !s.excludeLinkLocalMulticast {
+		return nil
+	}
+	marks := s.markArgs()
+	rules := make([]*iptablesRule, 0, len(linkLocalMulticastCIDRs))
+	for _, cidr := range linkLocalMulticastCIDRs {
+		rules = append(rules, newIptableRule(
+			constants.TableMangle,
+			constants.ChainZTunnelPrerouting,
+			"-d", cidr,
+			"-j", "MARK",
+			"--set-mark", marks.ConnSkipMark,
+		))
+	}
+	return rules
+}
+
+// ownerExclusionRules returns the rules skipping the traffic of host processes owned by the
+// excluded users and groups, such as kubelet probes which may be sent from a pod range address and
+// so aren't skipped by the host IP rule. Like the port exclusions, they set the conn skip mark.
+func (s *Server) ownerExclusionRules() []*iptablesRule {
+	marks := s.markArgs()
+	rules := make([]*iptablesRule, 0, len(s.excludeOwnerUIDs)+len(s.excludeOwnerGIDs))
+	for _, uid := range s.excludeOwnerUIDs {
+		rules = append(rules, newIptableRule(
+			constants.TableMangle,
+			constants.ChainZTunnelOutput,
+			"-m", "owner",
+			"--uid-owner", strconv.FormatUint(uint64(uid), 10),
+			"-j", "MARK",
+			"--set-mark", marks.ConnSkipMark,
+		))
+	}
+	for _, gid := range s.excludeOwnerGIDs {
+		rules = append(rules, newIptableRule(
+			constants.TableMangle,
+			constants.ChainZTunnelOutput,
+			"-m", "owner",
+			"--gid-owner", strconv.FormatUint(uint64(gid), 10),
+			"-j", "MARK",
+			"--set-mark", marks.ConnSkipMark,
+		))
+	}
+	return rules
+}
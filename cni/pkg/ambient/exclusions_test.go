@@ -0,0 +1,287 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+func TestParsePortList(t *testing.T) {
+	cases := []struct {
+		name      string
+		ports     string
+		expected  []uint16
+		expectErr bool
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name:     "ports",
+			ports:    "5000, 8080,",
+			expected: []uint16{5000, 8080},
+		},
+		{
+			name:      "out of range",
+			ports:     "70000",
+			expectErr: true,
+		},
+		{
+			name:      "zero",
+			ports:     "0",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParsePortList(tc.ports)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// ruleIndex returns the index of the first rule whose spec contains all of args, or -1.
+func ruleIndex(rules []*iptablesRule, args ...string) int {
+	for i, r := range rules {
+		spec := " " + strings.Join(r.RuleSpec, " ") + " "
+		found := true
+		for _, a := range args {
+			if !strings.Contains(spec, " "+a+" ") {
+				found = false
+				break
+			}
+		}
+		if found {
+			return i
+		}
+	}
+	return -1
+}
+
+func TestPortExclusionsPrecedeOutboundMark(t *testing.T) {
+	s := &Server{excludeInboundPorts: []uint16{5000}, excludeOutboundPorts: []uint16{6000}}
+	cpu1, cpu2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	dpu1, dpu2 := s.dpuNodeRules("veth0", "10.0.0.2", false)
+
+	for name, rules := range map[string][]*iptablesRule{
+		"cpu": append(cpu1, cpu2...),
+		"dpu": append(dpu1, dpu2...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			outbound := ruleIndex(rules, "--set-mark", constants.OutboundMark)
+			// The last skip mark return before the outbound mark.
+			skipReturn := -1
+			for i := outbound - 1; i >= 0 && skipReturn == -1; i-- {
+				if ruleIndex(rules[i:i+1], "--mark", constants.SkipMark, "RETURN") == 0 {
+					skipReturn = i
+				}
+			}
+			for _, port := range []string{"5000", "6000"} {
+				for _, proto := range []string{"tcp", "udp"} {
+					excl := ruleIndex(rules, "-p", proto, "--dport", port, "--set-mark", constants.ConnSkipMark)
+					if excl == -1 {
+						t.Fatalf("no %s exclusion rule for port %s", proto, port)
+					}
+					if excl > outbound {
+						t.Errorf("exclusion rule for %s/%s at %d follows the outbound mark rule at %d", proto, port, excl, outbound)
+					}
+					if excl > skipReturn {
+						t.Errorf("exclusion rule for %s/%s at %d follows the last skip mark return at %d", proto, port, excl, skipReturn)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseExcludedCIDRs(t *testing.T) {
+	podCIDRs := []string{"10.244.0.0/16"}
+	cases := []struct {
+		name      string
+		cidrs     []string
+		expected  []netip.Prefix
+		expectErr bool
+	}{
+		{
+			name:  "empty",
+			cidrs: []string{""},
+		},
+		{
+			name:     "cidrs",
+			cidrs:    []string{"169.254.169.254/32", " 192.168.10.1/24"},
+			expected: []netip.Prefix{netip.MustParsePrefix("169.254.169.254/32"), netip.MustParsePrefix("192.168.10.0/24")},
+		},
+		{
+			name:      "invalid",
+			cidrs:     []string{"169.254.169.254"},
+			expectErr: true,
+		},
+		{
+			name:      "overlaps pod CIDR",
+			cidrs:     []string{"10.0.0.0/8"},
+			expectErr: true,
+		},
+		{
+			name:      "ipv6",
+			cidrs:     []string{"fd00::/64"},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseExcludedCIDRs(tc.cidrs, podCIDRs)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// skipMarkFor returns whether a packet to dst is given the skip mark by a rule matching on the
+// destination alone, before the ipset destination match.
+func skipMarkFor(rules []*iptablesRule, dst netip.Addr) bool {
+	for _, r := range rules {
+		if ruleIndex([]*iptablesRule{r}, "--match-set", ipsetName, "dst") == 0 {
+			return false
+		}
+		spec := r.RuleSpec
+		if len(spec) != 6 || spec[0] != "-d" || spec[2] != "-j" || spec[3] != "MARK" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(spec[1])
+		if err == nil && prefix.Contains(dst) && spec[5] == constants.ConnSkipMark {
+			return true
+		}
+	}
+	return false
+}
+
+func TestCIDRExclusionSkipMark(t *testing.T) {
+	s := &Server{excludeOutboundCIDRs: []netip.Prefix{netip.MustParsePrefix("169.254.169.254/32"), netip.MustParsePrefix("192.168.10.0/24")}}
+	_, rules := s.cpuNodeRules("eth0", "10.0.0.2", false)
+
+	cases := []struct {
+		dst      string
+		expected bool
+	}{
+		{"169.254.169.254", true},
+		{"192.168.10.20", true},
+		{"192.168.11.20", false},
+	}
+	for _, tc := range cases {
+		if got := skipMarkFor(rules, netip.MustParseAddr(tc.dst)); got != tc.expected {
+			t.Errorf("expected skip mark for %s to be %v, got %v", tc.dst, tc.expected, got)
+		}
+	}
+}
+
+func TestLinkLocalMulticastPrecedeOutboundMark(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		s := &Server{excludeLinkLocalMulticast: enabled}
+		cpu1, cpu2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+		dpu1, dpu2 := s.dpuNodeRules("veth0", "10.0.0.2", false)
+
+		for name, rules := range map[string][]*iptablesRule{
+			"cpu": append(cpu1, cpu2...),
+			"dpu": append(dpu1, dpu2...),
+		} {
+			t.Run(fmt.Sprintf("%s enabled=%v", name, enabled), func(t *testing.T) {
+				outbound := ruleIndex(rules, "--set-mark", constants.OutboundMark)
+				for _, cidr := range []string{"169.254.0.0/16", "224.0.0.0/4"} {
+					skip := ruleIndex(rules, "-d", cidr, "--set-mark", constants.ConnSkipMark)
+					if !enabled {
+						if skip != -1 {
+							t.Errorf("expected no skip rule for %s, got %v", cidr, rules[skip].RuleSpec)
+						}
+						continue
+					}
+					if skip == -1 {
+						t.Fatalf("no skip rule for %s", cidr)
+					}
+					if rules[skip].Chain != constants.ChainZTunnelPrerouting {
+						t.Errorf("expected the skip rule for %s in %s, got %s", cidr, constants.ChainZTunnelPrerouting, rules[skip].Chain)
+					}
+					if skip > outbound {
+						t.Errorf("skip rule for %s at %d follows the outbound mark rule at %d", cidr, skip, outbound)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestOwnerExclusionRules(t *testing.T) {
+	cases := []struct {
+		name     string
+		server   *Server
+		expected [][]string
+	}{
+		{
+			name:   "none",
+			server: &Server{},
+		},
+		{
+			name:   "uids and gids",
+			server: &Server{excludeOwnerUIDs: []uint32{0, 1000}, excludeOwnerGIDs: []uint32{2000}},
+			expected: [][]string{
+				{"--uid-owner", "0"},
+				{"--uid-owner", "1000"},
+				{"--gid-owner", "2000"},
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu, _ := tc.server.cpuNodeRules("eth0", "10.0.0.2", false)
+			dpu, _ := tc.server.dpuNodeRules("veth0", "10.0.0.2", false)
+			for name, rules := range map[string][]*iptablesRule{"cpu": cpu, "dpu": dpu} {
+				var got [][]string
+				for _, r := range rules {
+					if ruleIndex([]*iptablesRule{r}, "-m", "owner") != 0 {
+						continue
+					}
+					if r.Table != constants.TableMangle || r.Chain != constants.ChainZTunnelOutput {
+						t.Errorf("%s: expected the owner rule in %s/%s, got %s/%s", name,
+							constants.TableMangle, constants.ChainZTunnelOutput, r.Table, r.Chain)
+					}
+					if ruleIndex([]*iptablesRule{r}, "--set-mark", constants.ConnSkipMark) != 0 {
+						t.Errorf("%s: expected the owner rule to set the conn skip mark, got %v", name, r.RuleSpec)
+					}
+					got = append(got, r.RuleSpec[2:4])
+				}
+				if !reflect.DeepEqual(got, tc.expected) {
+					t.Errorf("%s: expected owner matches %v, got %v", name, tc.expected, got)
+				}
+			}
+		})
+	}
+}
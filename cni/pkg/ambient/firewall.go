@@ -0,0 +1,132 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"fmt"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	ipsetlib "istio.io/istio/cni/pkg/ipset"
+)
+
+// FirewallBackend selects how the ztunnel redirection rules are applied.
+type FirewallBackend string
+
+const (
+	// FirewallIptables applies the rules with the iptables binaries. This is the default.
+	FirewallIptables FirewallBackend = "iptables"
+	// FirewallNftables applies the rules natively with nft, for nftables-only nodes. Mesh
+	// membership is then kept in an nft set instead of an ipset.
+	FirewallNftables FirewallBackend = "nftables"
+)
+
+// firewall applies the ztunnel chains and rules. Rules are always described in iptables syntax,
+// with newIptableRule, and are translated by backends that need another syntax.
+type firewall interface {
+	// initChains creates the ztunnel chains and hooks them up, or flushes them if they already exist.
+	initChains(ctx context.Context) error
+	// deleteChains removes the ztunnel chains and their rules.
+	deleteChains(ctx context.Context)
+	// appendRules appends the rules in order, stopping at the first failure. The rules that were
+	// appended successfully are returned, even on failure, so that they can be rolled back.
+	appendRules(ctx context.Context, rules []*iptablesRule) ([]*iptablesRule, error)
+	// deleteRules deletes previously appended rules. All rules are attempted.
+	deleteRules(ctx context.Context, rules []*iptablesRule) error
+}
+
+// ipsetBackend is the backend of Ipset, which the namespace ipsets are created with too.
+var ipsetBackend = FirewallIptables
+
+// UseFirewallBackend sets the backend used for mesh membership, by pointing Ipset at the matching
+// set implementation. The CNI plugin calls this with the backend of the ambient controller.
+func UseFirewallBackend(backend FirewallBackend) error {
+	if backend == "" {
+		backend = FirewallIptables
+	}
+	set, err := newIpsetHandle(backend, ipsetName)
+	if err != nil {
+		return err
+	}
+	Ipset = set
+	ipsetBackend = backend
+	return nil
+}
+
+// newIpsetHandle returns the set implementation of backend for the ipset name.
+func newIpsetHandle(backend FirewallBackend, name string) (IpsetHandle, error) {
+	switch backend {
+	case FirewallIptables:
+		return &ipsetlib.IPSet{Name: name, HashSize: ipsetSize.HashSize, MaxElem: ipsetSize.MaxElem}, nil
+	case FirewallNftables:
+		return newNftSet(name), nil
+	default:
+		return nil, fmt.Errorf("unknown firewall backend %q", backend)
+	}
+}
+
+func (s *Server) firewall() firewall {
+	if s.firewallBackend == FirewallNftables {
+		return s.nft
+	}
+	return iptablesFirewall{s: s}
+}
+
+// iptablesFirewall applies the rules with the iptables binaries.
+type iptablesFirewall struct {
+	s *Server
+}
+
+func (f iptablesFirewall) initChains(ctx context.Context) error {
+	f.s.DetectIptablesCommand(ctx)
+	handles, err := f.s.iptablesHandles()
+	if err != nil {
+		return err
+	}
+
+	for _, ipt := range handles {
+		// Check if chain exists, if it exists flush.. otherwise initialize
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L28
+		exists, err := ipt.Exists(constants.TableMangle, constants.ChainOutput, "-j", constants.ChainZTunnelOutput)
+		if err != nil {
+			return fmt.Errorf("failed to check for chain %s: %v", constants.ChainZTunnelOutput, err)
+		}
+		if exists {
+			log.Debugf("Chain %s already exists, flushing", constants.ChainOutput)
+			flushChains(ctx, ipt)
+			continue
+		}
+		log.Debugf("Initializing lists")
+		if err := initializeChains(ctx, ipt); err != nil {
+			return err
+		}
+	}
+	if _, err := f.s.DetectConflicts(); err != nil {
+		log.Warnf("Failed to check for conflicting iptables rules: %v", err)
+	}
+	return nil
+}
+
+func (f iptablesFirewall) deleteChains(ctx context.Context) {
+	f.s.cleanRules(ctx)
+}
+
+func (f iptablesFirewall) appendRules(ctx context.Context, rules []*iptablesRule) ([]*iptablesRule, error) {
+	return iptablesAppend(ctx, rules, f.s.iptablesLockWait(), f.s.backoff)
+}
+
+func (f iptablesFirewall) deleteRules(ctx context.Context, rules []*iptablesRule) error {
+	return iptablesDelete(ctx, rules, f.s.iptablesLockWait())
+}
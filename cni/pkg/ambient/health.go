@@ -0,0 +1,174 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// HealthFailure is an invariant of the node setup that doesn't hold.
+type HealthFailure struct {
+	Invariant string `json:"invariant"`
+	Reason    string `json:"reason"`
+}
+
+// HealthCheckResult is the result of HealthCheck.
+type HealthCheckResult struct {
+	Failures []HealthFailure `json:"failures"`
+}
+
+// Healthy reports whether all invariants hold.
+func (r HealthCheckResult) Healthy() bool {
+	return len(r.Failures) == 0
+}
+
+// Err returns an error listing the failed invariants, or nil if healthy.
+func (r HealthCheckResult) Err() error {
+	if r.Healthy() {
+		return nil
+	}
+	failures := make([]string, 0, len(r.Failures))
+	for _, f := range r.Failures {
+		failures = append(failures, f.Invariant+": "+f.Reason)
+	}
+	return fmt.Errorf("ambient dataplane unhealthy: %s", strings.Join(failures, "; "))
+}
+
+func (r *HealthCheckResult) fail(invariant string, format string, args ...any) {
+	r.Failures = append(r.Failures, HealthFailure{Invariant: invariant, Reason: fmt.Sprintf(format, args...)})
+}
+
+// HealthCheck verifies that the node setup done by CreateRulesOn*Node is still in place, e.g. that
+// the chains weren't flushed by another component. Nothing is checked until ztunnel is running, as
+// the node is only set up then.
+func (s *Server) HealthCheck() HealthCheckResult {
+	var res HealthCheckResult
+	if !s.isZTunnelRunning() {
+		return res
+	}
+
+	if s.firewallBackend == FirewallNftables {
+		if err := s.executor().Run(context.Background(), "nft", "list", "table", "ip", nftTable); err != nil {
+			res.fail("nft table "+nftTable, "%v", err)
+		}
+	} else {
+		s.checkIptables(&res)
+	}
+
+	if offmesh.MyNodeType(s.nodeName, s.offmeshCluster) == offmesh.DPUNode {
+		s.checkTunnelUp(&res, constants.InboundTun)
+		s.checkTunnelUp(&res, constants.OutboundTun)
+		s.checkProxyDefaultRoute(&res)
+	}
+	return res
+}
+
+// checkIptables checks that the ztunnel chains are hooked up, and that the marking rules applied
+// in the mangle table are still present.
+func (s *Server) checkIptables(res *HealthCheckResult) {
+	ipt, err := newIptablesHandle(s.iptablesLockWait())
+	if err != nil {
+		res.fail("iptables", "%v", err)
+		return
+	}
+
+	for _, c := range ztunnelChains {
+		invariant := fmt.Sprintf("chain %s/%s", c.table, c.chain)
+		exists, err := ipt.ChainExists(c.table, c.chain)
+		if err != nil {
+			res.fail(invariant, "%v", err)
+			continue
+		}
+		if !exists {
+			res.fail(invariant, "chain is missing")
+			continue
+		}
+		exists, err = ipt.Exists(c.table, c.parent, "-j", c.chain)
+		if err != nil {
+			res.fail(invariant, "%v", err)
+		} else if !exists {
+			res.fail(invariant, "no jump from %s", c.parent)
+		}
+	}
+
+	s.mu.Lock()
+	rules := s.appliedRules
+	s.mu.Unlock()
+	for _, rule := range rules {
+		if rule.Table != constants.TableMangle || rule.IPv6 || !isMarkRule(rule) {
+			continue
+		}
+		invariant := fmt.Sprintf("rule %s/%s %s", rule.Table, rule.Chain, strings.Join(rule.RuleSpec, " "))
+		exists, err := ipt.Exists(rule.Table, rule.Chain, rule.RuleSpec...)
+		if err != nil {
+			res.fail(invariant, "%v", err)
+		} else if !exists {
+			res.fail(invariant, "rule is missing")
+		}
+	}
+}
+
+// isMarkRule reports whether the rule sets a packet or conn mark.
+func isMarkRule(rule *iptablesRule) bool {
+	for i, arg := range rule.RuleSpec {
+		if arg == "-j" && i+1 < len(rule.RuleSpec) {
+			target := rule.RuleSpec[i+1]
+			return target == "MARK" || target == "CONNMARK"
+		}
+	}
+	return false
+}
+
+func (s *Server) checkTunnelUp(res *HealthCheckResult, name string) {
+	invariant := "tunnel " + name
+	link, err := s.netlink().LinkByName(name)
+	if err != nil {
+		res.fail(invariant, "%v", err)
+		return
+	}
+	if _, ok := link.(*netlink.Geneve); !ok {
+		res.fail(invariant, "link is a %s, not geneve", link.Type())
+		return
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		res.fail(invariant, "link is down")
+	}
+}
+
+func (s *Server) checkProxyDefaultRoute(res *HealthCheckResult) {
+	invariant := fmt.Sprintf("default route in table %d", s.routeTables.Proxy)
+	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: s.routeTables.Proxy}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		res.fail(invariant, "%v", &NetlinkError{Op: "RouteList", Err: err})
+		return
+	}
+	for _, r := range routes {
+		if r.Dst == nil {
+			return
+		}
+		if ones, _ := r.Dst.Mask.Size(); ones == 0 {
+			return
+		}
+	}
+	res.fail(invariant, "route is missing")
+}
@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+func TestHealthCheck(t *testing.T) {
+	markRule := newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+		"-i", constants.InboundTun, "-j", "MARK", "--set-mark", constants.SkipMark)
+	acceptRule := newIptableRule(constants.TableNat, constants.ChainZTunnelPrerouting,
+		"-m", "mark", "--mark", constants.OutboundMark, "-j", "ACCEPT")
+
+	cases := []struct {
+		name     string
+		running  bool
+		tamper   func(f *fakeIptables)
+		expected []string
+	}{
+		{
+			name:    "healthy",
+			running: true,
+		},
+		{
+			name:   "ztunnel not running",
+			tamper: func(f *fakeIptables) { f.rules = map[string][]string{} },
+		},
+		{
+			name:    "mark rule flushed",
+			running: true,
+			tamper: func(f *fakeIptables) {
+				_ = f.ClearChain(constants.TableMangle, constants.ChainZTunnelPrerouting)
+			},
+			expected: []string{"rule mangle/ztunnel-PREROUTING -i istioin -j MARK --set-mark 0x200/0x200"},
+		},
+		{
+			name:    "chain unhooked",
+			running: true,
+			tamper: func(f *fakeIptables) {
+				_ = f.Delete(constants.TableMangle, constants.ChainOutput, "-j", constants.ChainZTunnelOutput)
+			},
+			expected: []string{"chain mangle/ztunnel-OUTPUT"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeIptables()
+			setFakeIptables(t, f)
+			s := &Server{ztunnelRunning: tc.running}
+			if err := s.initializeLists(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.applyRulesTransactional(context.Background(), []*iptablesRule{markRule, acceptRule}); err != nil {
+				t.Fatal(err)
+			}
+			if tc.tamper != nil {
+				tc.tamper(f)
+			}
+
+			res := s.HealthCheck()
+			var got []string
+			for _, failure := range res.Failures {
+				got = append(got, failure.Invariant)
+			}
+			if strings.Join(got, ",") != strings.Join(tc.expected, ",") {
+				t.Errorf("expected failures %v, got %+v", tc.expected, res.Failures)
+			}
+			if res.Healthy() != (res.Err() == nil) {
+				t.Errorf("Healthy and Err disagree: %v", res.Err())
+			}
+		})
+	}
+}
@@ -15,6 +15,8 @@
 package ambient
 
 import (
+	"fmt"
+
 	mesh "istio.io/api/mesh/v1alpha1"
 	"istio.io/istio/pilot/pkg/ambient/ambientpod"
 	"istio.io/istio/pkg/kube/controllers"
@@ -118,7 +120,7 @@ func (s *Server) Reconcile(name types.NamespacedName) error {
 		log.Errorf("Failed to list pods in namespace %s: %v", name.Name, err)
 		return err
 	}
-	nodeType := offmesh.MyNodeType(NodeName, s.offmeshCluster)
+	nodeType := offmesh.MyNodeType(s.nodeName, s.offmeshCluster)
 	if (s.isAmbientGlobal() || (s.isAmbientNamespaced() && matchAmbient)) && !matchDisabled {
 		if ambientpod.HasLegacyLabel(ns.GetLabels()) {
 			log.Errorf(ErrLegacyLabel, name.Name)
@@ -127,26 +129,41 @@ func (s *Server) Reconcile(name types.NamespacedName) error {
 		}
 		log.Infof("Namespace %s is enabled in ambient mesh", name.Name)
 
+		var podsToAdd []*corev1.Pod
 		for _, pod := range pods {
-			podToAdd := (nodeType == offmesh.CPUNode && podOnMyNode(pod)) ||
-				(nodeType == offmesh.DPUNode && IsPodOnMyCPU(pod, s.offmeshCluster))
+			podToAdd := (nodeType == offmesh.CPUNode && s.podOnMyNode(pod)) ||
+				(nodeType == offmesh.DPUNode && s.isPodOnMyCPU(pod))
 			if podToAdd && !ambientpod.PodHasOptOut(pod) {
 				log.Debugf("Adding pod to mesh: %s", pod.Name)
-				AddPodToMesh(pod, "")
+				podsToAdd = append(podsToAdd, pod)
 			} else {
-				log.Debugf("Pod %s is not on my node, ignoring (on node: %s vs %s)", pod.Name, pod.Spec.NodeName, NodeName)
+				log.Debugf("Pod %s is not on my node, ignoring (on node: %s vs %s)", pod.Name, pod.Spec.NodeName, s.nodeName)
+			}
+		}
+		results, err := s.addPodsToMesh(podsToAdd)
+		if err != nil {
+			log.Errorf("Failed to add pods in namespace %s to mesh: %v", name.Name, err)
+		}
+		// Put the namespace back in queue for the pods which failed, the pods already added are
+		// skipped when it is reconciled again.
+		if failed := FailedPodAdds(results); len(failed) > 0 {
+			for _, r := range results {
+				if !r.Added {
+					log.Warnf("Pod %s in namespace %s was not added to mesh: %v", r.UID, name.Name, r.Err)
+				}
 			}
+			return fmt.Errorf("%d pods in namespace %s were not added to mesh", len(failed), name.Name)
 		}
 	} else {
 		log.Infof("Namespace %s is disabled from ambient mesh", name.Name)
 		for _, pod := range pods {
-			podToAdd := (nodeType == offmesh.CPUNode && podOnMyNode(pod)) ||
-				(nodeType == offmesh.DPUNode && IsPodOnMyCPU(pod, s.offmeshCluster))
+			podToAdd := (nodeType == offmesh.CPUNode && s.podOnMyNode(pod)) ||
+				(nodeType == offmesh.DPUNode && s.isPodOnMyCPU(pod))
 			if podToAdd {
 				log.Debugf("Checking if in ipset and deleting pod: %s", pod.Name)
-				DelPodFromMesh(pod)
+				s.delPodFromMesh(pod)
 			} else {
-				log.Debugf("Pod %s is not on my node, ignoring (on node: %s vs %s)", pod.Name, pod.Spec.NodeName, NodeName)
+				log.Debugf("Pod %s is not on my node, ignoring (on node: %s vs %s)", pod.Name, pod.Spec.NodeName, s.nodeName)
 			}
 		}
 	}
@@ -155,7 +172,7 @@ func (s *Server) Reconcile(name types.NamespacedName) error {
 }
 
 func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
-	if offmesh.MyNodeType(NodeName, s.offmeshCluster) == offmesh.CPUNode {
+	if offmesh.MyNodeType(s.nodeName, s.offmeshCluster) == offmesh.CPUNode {
 		return &cache.ResourceEventHandlerFuncs{
 			// We only handle existing resources, so if we get an add event,
 			// we need to check to see if pod is running, if so, it's safe to
@@ -170,24 +187,24 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 
 				scopeLog := log.WithLabels("type", "add")
 
-				scopeLog.Infof("caching pod: %v, ztunnelPod: %v,IsZtunnelOnMyDPU: %v", pod.Name, ztunnelPod(pod), IsZtunnelOnMyDPU(pod, s.offmeshCluster))
+				scopeLog.Infof("caching pod: %v, ztunnelPod: %v,IsZtunnelOnMyDPU: %v", pod.Name, ztunnelPod(pod), s.isZtunnelOnMyDPU(pod))
 
-				if ztunnelPod(pod) && IsZtunnelOnMyDPU(pod, s.offmeshCluster) {
+				if ztunnelPod(pod) && s.isZtunnelOnMyDPU(pod) {
 					if pod.Status.Phase != corev1.PodRunning {
 						return
 					}
 
 					scopeLog.Infof("ztunnel is now running")
 
-					veth, err := GetHostNetDevice(offmesh.GetMyPair(NodeName, s.offmeshCluster).IP)
-					scopeLog.Infof("hostIP=%v, eth:%v", offmesh.GetMyPair(NodeName, s.offmeshCluster).IP, veth)
+					veth, err := GetHostNetDevice(offmesh.GetMyPair(s.nodeName, s.offmeshCluster).IP)
+					scopeLog.Infof("hostIP=%v, eth:%v", offmesh.GetMyPair(s.nodeName, s.offmeshCluster).IP, veth)
 					if err != nil {
 						scopeLog.Errorf("Failed to get device for ztunnel ip: %v", err)
 						return
 					}
 
 					captureDNS := getEnvFromPod(pod, "ISTIO_META_DNS_CAPTURE") == "true"
-					err = s.CreateRulesOnCPUNode(veth, pod.Status.PodIP, captureDNS)
+					err = s.CreateRulesOnCPUNode(s.ctx, veth, pod.Status.PodIP, captureDNS)
 					if err != nil {
 						scopeLog.Errorf("Failed to configure node rules for ztunnel: %v", err)
 						return
@@ -209,22 +226,22 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				scopeLog := log.WithLabels("type", "update")
 				scopeLog.Infof("caching pod: %v", newPod.Name)
 
-				if ztunnelPod(newPod) && IsZtunnelOnMyDPU(newPod, s.offmeshCluster) {
+				if ztunnelPod(newPod) && s.isZtunnelOnMyDPU(newPod) {
 					// This will catch if ztunnel begins running after us... otherwise it gets handled by AddFunc
 					if newPod.Status.Phase != corev1.PodRunning || oldPod.Status.Phase == newPod.Status.Phase {
 						return
 					}
 					scopeLog.Infof("ztunnel is now running")
 
-					veth, err := GetHostNetDevice(offmesh.GetMyPair(NodeName, s.offmeshCluster).IP)
-					scopeLog.Infof("hostIP=%v, eth:%v", offmesh.GetMyPair(NodeName, s.offmeshCluster).IP, veth)
+					veth, err := GetHostNetDevice(offmesh.GetMyPair(s.nodeName, s.offmeshCluster).IP)
+					scopeLog.Infof("hostIP=%v, eth:%v", offmesh.GetMyPair(s.nodeName, s.offmeshCluster).IP, veth)
 					if err != nil {
 						scopeLog.Errorf("Failed to get device for ztunnel ip: %v", err)
 						return
 					}
 
 					captureDNS := getEnvFromPod(newPod, "ISTIO_META_DNS_CAPTURE") == "true"
-					err = s.CreateRulesOnCPUNode(veth, newPod.Status.PodIP, captureDNS)
+					err = s.CreateRulesOnCPUNode(s.ctx, veth, newPod.Status.PodIP, captureDNS)
 					if err != nil {
 						scopeLog.Errorf("Failed to configure node for ztunnel: %v", err)
 						return
@@ -238,9 +255,9 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				}
 
 				// Catch pod with opt out applied
-				if ambientpod.PodHasOptOut(newPod) && !ambientpod.PodHasOptOut(oldPod) && podOnMyNode(newPod) {
+				if ambientpod.PodHasOptOut(newPod) && !ambientpod.PodHasOptOut(oldPod) && s.podOnMyNode(newPod) {
 					scopeLog.Debugf("Pod %s matches opt out, but was not before, removing from mesh", newPod.Name)
-					DelPodFromMesh(newPod)
+					s.delPodFromMesh(newPod)
 					return
 				}
 			},
@@ -254,13 +271,19 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				//	scopeLog.Debugf("skipping pod not on my node")
 				//	return
 				//}
-				if ztunnelPod(pod) && IsZtunnelOnMyDPU(pod, s.offmeshCluster) {
+				if ztunnelPod(pod) && s.isZtunnelOnMyDPU(pod) {
 					scopeLog.Infof("ztunnel is now stopped... cleaning up.")
-					s.cleanup()
 					s.setZTunnelRunning(false)
-				} else if podOnMyNode(pod) && IsPodInIpset(pod) {
-					scopeLog.Infof("Pod %s/%s is now stopped... cleaning up.", pod.Namespace, pod.Name)
-					DelPodFromMesh(pod)
+					s.cleanup()
+				} else if s.podOnMyNode(pod) {
+					inIpset, err := s.isPodInIpset(pod)
+					if err != nil {
+						scopeLog.Warnf("Unable to determine if pod %s/%s is in ipset, removing its route only: %v", pod.Namespace, pod.Name, err)
+					}
+					if err != nil || inIpset {
+						scopeLog.Infof("Pod %s/%s is now stopped... cleaning up.", pod.Namespace, pod.Name)
+						s.delPodFromMesh(pod)
+					}
 				}
 			},
 		}
@@ -273,7 +296,7 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 
 			scopeLog := log.WithLabels("type", "add")
 
-			if podOnMyNode(pod) && ztunnelPod(pod) {
+			if s.podOnMyNode(pod) && ztunnelPod(pod) {
 				if pod.Status.Phase != corev1.PodRunning {
 					return
 				}
@@ -287,7 +310,8 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				}
 
 				captureDNS := getEnvFromPod(pod, "ISTIO_META_DNS_CAPTURE") == "true"
-				err = s.CreateRulesOnDPUNode(veth, pod.Status.PodIP, captureDNS)
+				s.setZTunnelIPs(pod)
+				err = s.CreateRulesOnDPUNode(s.ctx, veth, pod.Status.PodIP, captureDNS)
 				if err != nil {
 					scopeLog.Errorf("Failed to configure node rules for ztunnel: %v", err)
 					return
@@ -305,8 +329,8 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				scopeLog.Errorf("Failed to configure node rules for ztunnel: %v", err)
 				return
 			}
-			if IsPodOnMyCPU(pod, s.offmeshCluster) && ambientpod.ShouldPodBeInIpset(ns, pod, s.meshMode.String(), true) {
-				AddPodToMesh(pod, "")
+			if s.isPodOnMyCPU(pod) && ambientpod.ShouldPodBeInIpset(ns, pod, s.meshMode.String(), true) {
+				s.addPodToMesh(pod)
 			}
 
 		},
@@ -318,7 +342,7 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 
 			scopeLog := log.WithLabels("type", "update")
 
-			if ztunnelPod(newPod) && podOnMyNode(newPod) {
+			if ztunnelPod(newPod) && s.podOnMyNode(newPod) {
 				// This will catch if ztunnel begins running after us... otherwise it gets handled by AddFunc
 				if newPod.Status.Phase != corev1.PodRunning || oldPod.Status.Phase == newPod.Status.Phase {
 					return
@@ -332,7 +356,8 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				}
 
 				captureDNS := getEnvFromPod(newPod, "ISTIO_META_DNS_CAPTURE") == "true"
-				err = s.CreateRulesOnDPUNode(veth, newPod.Status.PodIP, captureDNS)
+				s.setZTunnelIPs(newPod)
+				err = s.CreateRulesOnDPUNode(s.ctx, veth, newPod.Status.PodIP, captureDNS)
 				if err != nil {
 					scopeLog.Errorf("Failed to configure node for ztunnel: %v", err)
 					return
@@ -350,13 +375,13 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 				scopeLog.Errorf("Failed to configure node rules for ztunnel: %v", err)
 				return
 			}
-			if IsPodOnMyCPU(newPod, s.offmeshCluster) && ambientpod.ShouldPodBeInIpset(ns, newPod, s.meshMode.String(), true) {
-				AddPodToMesh(newPod, "")
+			if s.isPodOnMyCPU(newPod) && ambientpod.ShouldPodBeInIpset(ns, newPod, s.meshMode.String(), true) {
+				s.addPodToMesh(newPod)
 			}
 			// Catch pod with opt out applied
-			if ambientpod.PodHasOptOut(newPod) && !ambientpod.PodHasOptOut(oldPod) && podOnMyNode(newPod) {
+			if ambientpod.PodHasOptOut(newPod) && !ambientpod.PodHasOptOut(oldPod) && s.podOnMyNode(newPod) {
 				scopeLog.Debugf("Pod %s matches opt out, but was not before, removing from mesh", newPod.Name)
-				DelPodFromMesh(newPod)
+				s.delPodFromMesh(newPod)
 				return
 			}
 		},
@@ -371,13 +396,19 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 			//	return
 			//}
 
-			if podOnMyNode(pod) && ztunnelPod(pod) {
+			if s.podOnMyNode(pod) && ztunnelPod(pod) {
 				scopeLog.Infof("ztunnel is now stopped... cleaning up.")
-				s.cleanup()
 				s.setZTunnelRunning(false)
-			} else if IsPodOnMyCPU(pod, s.offmeshCluster) && IsPodInIpset(pod) {
-				scopeLog.Infof("Pod %s/%s is now stopped... cleaning up.", pod.Namespace, pod.Name)
-				DelPodFromMesh(pod)
+				s.cleanup()
+			} else if s.isPodOnMyCPU(pod) {
+				inIpset, err := s.isPodInIpset(pod)
+				if err != nil {
+					scopeLog.Warnf("Unable to determine if pod %s/%s is in ipset, removing its route only: %v", pod.Namespace, pod.Name, err)
+				}
+				if err != nil || inIpset {
+					scopeLog.Infof("Pod %s/%s is now stopped... cleaning up.", pod.Namespace, pod.Name)
+					s.delPodFromMesh(pod)
+				}
 			}
 		},
 	}
@@ -386,3 +417,22 @@ func (s *Server) podHandler() *cache.ResourceEventHandlerFuncs {
 func ztunnelPod(pod *corev1.Pod) bool {
 	return pod.GetLabels()["app"] == "ztunnel"
 }
+
+// hostNetworkPod reports whether the pod uses the host network. Its IP is the host IP, so adding it
+// to the mesh would capture the traffic of the node.
+func hostNetworkPod(pod *corev1.Pod) bool {
+	return pod.Spec.HostNetwork
+}
+
+// withoutHostNetworkPods returns pods without the host network pods, logging that they are skipped.
+func withoutHostNetworkPods(pods []*corev1.Pod) []*corev1.Pod {
+	res := make([]*corev1.Pod, 0, len(pods))
+	for _, pod := range pods {
+		if hostNetworkPod(pod) {
+			log.Infof("Skipping pod '%s/%s' (%s), which uses the host network", pod.Namespace, pod.Name, string(pod.UID))
+			continue
+		}
+		res = append(res, pod)
+	}
+	return res
+}
@@ -0,0 +1,172 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+const ipsetPortName = "ztunnel-pods-ip-ports"
+
+// ipsetPortMatch is the match-set direction of the rules matching IpsetPort: the source IP and the
+// destination port of the packet, one per dimension of the hash:ip,port set.
+const ipsetPortMatch = "src,dst"
+
+// ipsetProtocols are the protocols of the hash:ip,port entries, by their ipset name.
+var ipsetProtocols = map[string]uint8{
+	"tcp":  6,
+	"udp":  17,
+	"sctp": 132,
+}
+
+// IpsetPortHandle manages a hash:ip,port ipset, whose entries are pod IPs with a protocol and a
+// destination port.
+type IpsetPortHandle interface {
+	CreateSet() error
+	DestroySet() error
+	AddIPPort(ip net.IP, proto string, port uint16, comment string) error
+	DeleteIPPort(ip net.IP, proto string, port uint16) error
+	Flush() error
+	List() ([]netlink.IPSetEntry, error)
+}
+
+// IpsetPort holds the mesh pods whose traffic is only captured to some destination ports, each
+// entry being a pod IP and a port. It is only set up if the port ipset is enabled.
+var IpsetPort IpsetPortHandle = &ipsetPortCmd{Name: ipsetPortName}
+
+// ipsetPortCmd is an IpsetPortHandle running the ipset binary, as the netlink ipset API only
+// creates hash:ip sets.
+type ipsetPortCmd struct {
+	Name string
+}
+
+func (m *ipsetPortCmd) CreateSet() error {
+	args := append([]string{"create", m.Name, "hash:ip,port", "comment", "-exist"}, ipsetSize.args()...)
+	err := execute(context.Background(), "ipset", args...)
+	if err != nil {
+		return fmt.Errorf("failed to create ipset %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetPortCmd) DestroySet() error {
+	if err := execute(context.Background(), "ipset", "destroy", m.Name); err != nil {
+		return fmt.Errorf("failed to destroy ipset %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetPortCmd) AddIPPort(ip net.IP, proto string, port uint16, comment string) error {
+	elem, err := ipPortElem(ip, proto, port)
+	if err != nil {
+		return err
+	}
+	args := []string{"add", m.Name, elem}
+	if comment != "" {
+		args = append(args, "comment", comment)
+	}
+	if err := execute(context.Background(), "ipset", append(args, "-exist")...); err != nil {
+		return fmt.Errorf("failed to add %s to ipset %s: %v", elem, m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetPortCmd) DeleteIPPort(ip net.IP, proto string, port uint16) error {
+	elem, err := ipPortElem(ip, proto, port)
+	if err != nil {
+		return err
+	}
+	if err := execute(context.Background(), "ipset", "del", m.Name, elem, "-exist"); err != nil {
+		return fmt.Errorf("failed to delete %s from ipset %s: %v", elem, m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetPortCmd) Flush() error {
+	if err := execute(context.Background(), "ipset", "flush", m.Name); err != nil {
+		return fmt.Errorf("failed to flush ipset %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetPortCmd) List() ([]netlink.IPSetEntry, error) {
+	out, err := executeOutput(context.Background(), "ipset", "save", m.Name)
+	if err != nil {
+		if strings.Contains(out, "does not exist") {
+			return nil, fmt.Errorf("failed to list ipset %s: %w", m.Name, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to list ipset %s: %v: %s", m.Name, err, out)
+	}
+	return parseIpsetSave(out)
+}
+
+// ipPortElem returns the hash:ip,port element of ip, proto and port, like 10.0.0.1,tcp:8080.
+func ipPortElem(ip net.IP, proto string, port uint16) (string, error) {
+	if ip.To4() == nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPodIP, ip)
+	}
+	if _, ok := ipsetProtocols[proto]; !ok {
+		return "", fmt.Errorf("unsupported protocol %q for ipset %s", proto, ipsetPortName)
+	}
+	return ip.To4().String() + "," + proto + ":" + strconv.Itoa(int(port)), nil
+}
+
+// parseIPPortElem parses the protocol and port of a hash:ip,port element, proto:port, into entry.
+// ipset lists elements without a protocol as tcp.
+func parseIPPortElem(elem string, entry *netlink.IPSetEntry) error {
+	proto, portStr, ok := strings.Cut(elem, ":")
+	if !ok {
+		proto, portStr = "tcp", elem
+	}
+	protoNum, ok := ipsetProtocols[proto]
+	if !ok {
+		return fmt.Errorf("unsupported protocol %q", proto)
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid port %q: %v", portStr, err)
+	}
+	p := uint16(port)
+	entry.Protocol, entry.Port = &protoNum, &p
+	return nil
+}
+
+// portCaptureRules returns the rules marking the TCP connections from the members of IpsetPort to
+// their ports for ztunnel, if the port ipset is enabled.
+func (s *Server) portCaptureRules() []*iptablesRule {
+	if !s.enablePortIpset {
+		return nil
+	}
+	return []*iptablesRule{
+		newIptableRule(
+			constants.TableMangle,
+			constants.ChainZTunnelPrerouting,
+			"-p", "tcp",
+			"-m", "set",
+			"--match-set", ipsetPortName, ipsetPortMatch,
+			"-j", "MARK",
+			"--set-mark", s.markArgs().OutboundMark,
+		),
+	}
+}
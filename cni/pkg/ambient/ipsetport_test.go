@@ -0,0 +1,70 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPortCaptureRules(t *testing.T) {
+	out := setDryRun(t)
+	if err := IpsetPort.AddIPPort(net.ParseIP("10.0.0.1"), "tcp", 8080, "default/a/uid-a"); err != nil {
+		t.Fatal(err)
+	}
+	expected := "ipset add " + ipsetPortName + " 10.0.0.1,tcp:8080 comment default/a/uid-a -exist\n"
+	if out.String() != expected {
+		t.Fatalf("expected %q, got %q", expected, out.String())
+	}
+	// The entry as listed by ipset save.
+	entries, err := parseIpsetSave(strings.Replace(strings.TrimSuffix(out.String(), " -exist\n"), "ipset add", "add", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Port == nil || *entries[0].Port != 8080 || *entries[0].Protocol != ipsetProtocols["tcp"] {
+		t.Fatalf("expected an entry for 10.0.0.1,tcp:8080, got %+v", entries)
+	}
+
+	s := &Server{enablePortIpset: true, routeTables: DefaultRouteTables()}
+	_, cpuRules := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	_, dpuRules := s.dpuNodeRules("veth0", "10.0.0.2", false)
+	for name, rules := range map[string][]*iptablesRule{"cpu": cpuRules, "dpu": dpuRules} {
+		i := ruleIndex(rules, "--match-set", ipsetPortName)
+		if i == -1 {
+			t.Errorf("%s: expected a rule matching %s", name, ipsetPortName)
+			continue
+		}
+		spec := rules[i].RuleSpec
+		// The entry matches the source IP and the destination port and protocol of the packet.
+		dirs := strings.Split(spec[indexOf(spec, ipsetPortName)+1], ",")
+		if len(dirs) != 2 || dirs[0] != "src" || dirs[1] != "dst" {
+			t.Errorf("%s: expected the ip of the entry to match the source and its port the destination, got %v", name, spec)
+		}
+		if p := indexOf(spec, "-p"); p == -1 || ipsetProtocols[spec[p+1]] != *entries[0].Protocol {
+			t.Errorf("%s: expected the rule to match the protocol of the entry, got %v", name, spec)
+		}
+	}
+
+	s.enableIPv6 = true
+	_, rules := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	if ruleIndex(s.ipv6Rules(rules), "--match-set", ipsetPortName) != -1 {
+		t.Errorf("expected no IPv6 rule matching the IPv4 %s", ipsetPortName)
+	}
+	s.enablePortIpset = false
+	if len(s.portCaptureRules()) != 0 {
+		t.Errorf("expected no rules with the port ipset disabled")
+	}
+}
@@ -0,0 +1,289 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// maxIpsetName is the longest ipset name accepted by the kernel.
+const maxIpsetName = 31
+
+// namespaceIpsets maps namespaces to the names of the ipsets their mesh pods are added to instead
+// of Ipset, and extraIpsets holds those ipsets by name. They are set by UseNamespaceIpsets.
+var (
+	namespaceIpsets = map[string]string{}
+	extraIpsets     = map[string]IpsetHandle{}
+)
+
+// ParseNamespaceIpsets parses a comma separated list of namespace=ipset pairs, as used by the
+// namespace ipset env var. Several namespaces may share an ipset.
+func ParseNamespaceIpsets(mapping string) (map[string]string, error) {
+	res := make(map[string]string)
+	for _, pair := range strings.Split(mapping, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		namespace, name, ok := strings.Cut(pair, "=")
+		namespace, name = strings.TrimSpace(namespace), strings.TrimSpace(name)
+		if !ok || namespace == "" || name == "" {
+			return nil, fmt.Errorf("invalid namespace ipset %q, expected namespace=ipset", pair)
+		}
+		if len(name) > maxIpsetName {
+			return nil, fmt.Errorf("invalid namespace ipset %q, ipset names are at most %d characters", pair, maxIpsetName)
+		}
+		if name == ipsetName || name == ipset6Name {
+			return nil, fmt.Errorf("invalid namespace ipset %q, %s is reserved", pair, name)
+		}
+		if _, ok := res[namespace]; ok {
+			return nil, fmt.Errorf("duplicate namespace %s in namespace ipsets", namespace)
+		}
+		res[namespace] = name
+	}
+	return res, nil
+}
+
+// UseNamespaceIpsets sets the ipsets the mesh pods of the namespaces in mapping are added to, with
+// the set implementation of the firewall backend, so it must be called after UseFirewallBackend.
+// The pods of the other namespaces are added to Ipset. The CNI plugin calls this with the mapping
+// of the ambient controller.
+func UseNamespaceIpsets(mapping map[string]string) error {
+	sets := make(map[string]IpsetHandle)
+	for _, name := range mapping {
+		if _, ok := sets[name]; ok {
+			continue
+		}
+		set, err := newIpsetHandle(ipsetBackend, name)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			set = dryRunIpset{IpsetHandle: set, name: name}
+		}
+		sets[name] = set
+	}
+	if mapping == nil {
+		mapping = map[string]string{}
+	}
+	namespaceIpsets = mapping
+	extraIpsets = sets
+	return nil
+}
+
+// IpsetSize is the initial hash size and the maximum number of elements of the ipsets of the mesh
+// pods. The kernel defaults, 1024 and 65536, may be exceeded on a DPU node serving a large CPU
+// node, and pods added to a full set are not captured.
+type IpsetSize struct {
+	HashSize uint32
+	MaxElem  uint32
+}
+
+// DefaultIpsetSize returns the ipset size used if none is configured, sized for large nodes.
+func DefaultIpsetSize() IpsetSize {
+	return IpsetSize{HashSize: 4096, MaxElem: 262144}
+}
+
+// Validate checks that the hash size is a power of 2 of at least 64, which the kernel would round
+// it to otherwise, and that the set can hold at least as many elements as its hash size.
+func (z IpsetSize) Validate() error {
+	if z.HashSize < 64 || z.HashSize&(z.HashSize-1) != 0 {
+		return fmt.Errorf("invalid ipset hash size %d, expected a power of 2 of at least 64", z.HashSize)
+	}
+	if z.MaxElem < z.HashSize {
+		return fmt.Errorf("invalid ipset max elements %d, expected at least the hash size %d", z.MaxElem, z.HashSize)
+	}
+	return nil
+}
+
+// args returns the size arguments of the ipset create command.
+func (z IpsetSize) args() []string {
+	return []string{"hashsize", strconv.FormatUint(uint64(z.HashSize), 10), "maxelem", strconv.FormatUint(uint64(z.MaxElem), 10)}
+}
+
+// ipsetSize is the size the ipsets of the mesh pods are created with. Existing sets keep their
+// size. It is set by UseIpsetSize.
+var ipsetSize = DefaultIpsetSize()
+
+// UseIpsetSize sets the size the ipsets of the mesh pods are created with, so it must be called
+// before UseFirewallBackend and UseNamespaceIpsets. The nft sets of the nftables backend are not
+// sized.
+func UseIpsetSize(size IpsetSize) error {
+	if err := size.Validate(); err != nil {
+		return err
+	}
+	ipsetSize = size
+	return nil
+}
+
+// logIpsetFull logs that the ipset of pod is full if err, of adding the pod to it, says so. Such
+// pods are silently not captured, so the log tells how to fix it.
+func logIpsetFull(pod *corev1.Pod, err error) {
+	if errors.Is(err, ErrIpsetFull) {
+		log.Errorf("The ipset of pod %s/%s is full, with at most %d members, so the pod is not captured. "+
+			"Raise AMBIENT_IPSET_MAX_ELEM, or spread the namespaces over several ipsets with AMBIENT_NAMESPACE_IPSETS",
+			pod.Namespace, pod.Name, ipsetSize.MaxElem)
+	}
+}
+
+// ipsetFor returns the ipset of the mesh pods in namespace.
+func ipsetFor(namespace string) IpsetHandle {
+	if name, ok := namespaceIpsets[namespace]; ok {
+		return extraIpsets[name]
+	}
+	return Ipset
+}
+
+// extraIpsetNames returns the names of the namespace ipsets, sorted.
+func extraIpsetNames() []string {
+	names := make([]string, 0, len(extraIpsets))
+	for name := range extraIpsets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// allIpsets returns Ipset followed by the namespace ipsets, sorted by name.
+func allIpsets() []IpsetHandle {
+	res := []IpsetHandle{Ipset}
+	for _, name := range extraIpsetNames() {
+		res = append(res, extraIpsets[name])
+	}
+	return res
+}
+
+// ipsetRules adds a copy of each rule matching Ipset for each namespace ipset, right after the
+// rule, so that the pods of every set are captured.
+func ipsetRules(rules []*iptablesRule) []*iptablesRule {
+	names := extraIpsetNames()
+	if len(names) == 0 {
+		return rules
+	}
+	res := make([]*iptablesRule, 0, len(rules))
+	for _, rule := range rules {
+		res = append(res, rule)
+		i := indexOf(rule.RuleSpec, ipsetName)
+		if i < 0 {
+			continue
+		}
+		for _, name := range names {
+			spec := append([]string(nil), rule.RuleSpec...)
+			spec[i] = name
+			res = append(res, &iptablesRule{Table: rule.Table, Chain: rule.Chain, RuleSpec: spec, IPv6: rule.IPv6})
+		}
+	}
+	return res
+}
+
+// indexOf returns the index of the first arg equal to s, or -1.
+func indexOf(args []string, s string) int {
+	for i, arg := range args {
+		if arg == s {
+			return i
+		}
+	}
+	return -1
+}
+
+// ipsetSchemaChecker is implemented by the ipset handles which can tell whether an existing set has
+// the type and options they create sets with.
+type ipsetSchemaChecker interface {
+	SchemaMatches() (bool, error)
+}
+
+// ipsetCommentChecker is implemented by the ipset handles which can tell whether their set stores
+// the comments of its entries.
+type ipsetCommentChecker interface {
+	CommentsSupported() (bool, error)
+}
+
+// ipsetReplacer is implemented by the ipset handles which can atomically replace the members of
+// their set.
+type ipsetReplacer interface {
+	Replace(entries []netlink.IPSetEntry) error
+}
+
+// EnsureIpset creates the ipset of set. An existing set with another type or options, e.g. created
+// by an older version, is recreated with its members: they are listed, the set is destroyed and
+// created again, and they are added back. The set can only be destroyed while no rule matches it,
+// so this is called after the ztunnel chains are flushed.
+//
+// Whether the set stores comments is then recorded, for isPodInIpset.
+func (s *Server) EnsureIpset(set IpsetHandle) error {
+	err := s.ensureIpset(set)
+	if err == nil || errors.Is(err, os.ErrExist) {
+		s.detectIpsetComments(set)
+	}
+	return err
+}
+
+func (s *Server) ensureIpset(set IpsetHandle) error {
+	checker, ok := set.(ipsetSchemaChecker)
+	if !ok {
+		return set.CreateSet()
+	}
+	// The set doesn't exist yet if it can't be listed, which CreateSet reports otherwise.
+	if matches, err := checker.SchemaMatches(); err != nil || matches {
+		return set.CreateSet()
+	}
+
+	entries, err := set.List()
+	if err != nil {
+		return err
+	}
+	log.Infof("Recreating ipset with %d members, as its schema changed", len(entries))
+	if err := set.DestroySet(); err != nil {
+		return fmt.Errorf("failed to destroy ipset for recreation: %v", err)
+	}
+	if err := set.CreateSet(); err != nil {
+		return err
+	}
+	var errs error
+	for _, entry := range entries {
+		if err := set.AddIP(entry.IP, entry.Comment); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// detectIpsetComments records whether set stores the comments of its entries. The sets are all
+// created by the same kernel, so this holds for each of them. Sets which can't tell, e.g. in
+// dry-run mode, are taken to not store them.
+func (s *Server) detectIpsetComments(set IpsetHandle) {
+	supported := false
+	if checker, ok := set.(ipsetCommentChecker); ok {
+		var err error
+		if supported, err = checker.CommentsSupported(); err != nil {
+			log.Warnf("Failed to check whether the ipset stores comments, matching pods by IP too: %v", err)
+		}
+	}
+	if !supported {
+		log.Infof("The ipset doesn't store comments, matching pods by IP too")
+	}
+	s.mu.Lock()
+	s.ipsetComments = supported
+	s.mu.Unlock()
+}
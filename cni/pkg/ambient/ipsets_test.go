@@ -0,0 +1,235 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	ipsetlib "istio.io/istio/cni/pkg/ipset"
+)
+
+// setFakeNamespaceIpsets maps the namespaces to fake ipsets of the same name.
+func setFakeNamespaceIpsets(t *testing.T, sets map[string]*fakeIpset) {
+	origNamespaces, origSets := namespaceIpsets, extraIpsets
+	namespaceIpsets = map[string]string{}
+	extraIpsets = map[string]IpsetHandle{}
+	for namespace, set := range sets {
+		namespaceIpsets[namespace] = namespace
+		extraIpsets[namespace] = set
+	}
+	t.Cleanup(func() {
+		namespaceIpsets, extraIpsets = origNamespaces, origSets
+	})
+}
+
+func TestParseNamespaceIpsets(t *testing.T) {
+	cases := []struct {
+		name      string
+		mapping   string
+		expected  map[string]string
+		expectErr bool
+	}{
+		{
+			name:     "empty",
+			expected: map[string]string{},
+		},
+		{
+			name:     "mapping",
+			mapping:  "bypass=bypass-pods, legacy=bypass-pods,",
+			expected: map[string]string{"bypass": "bypass-pods", "legacy": "bypass-pods"},
+		},
+		{
+			name:      "missing ipset",
+			mapping:   "bypass=",
+			expectErr: true,
+		},
+		{
+			name:      "default ipset",
+			mapping:   "bypass=" + ipsetName,
+			expectErr: true,
+		},
+		{
+			name:      "long ipset",
+			mapping:   "bypass=" + strings.Repeat("a", maxIpsetName+1),
+			expectErr: true,
+		},
+		{
+			name:      "duplicate namespace",
+			mapping:   "bypass=a,bypass=b",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := ParseNamespaceIpsets(tc.mapping)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if !tc.expectErr && !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestAddPodToMeshNamespaceIpset(t *testing.T) {
+	defaultSet := &fakeIpset{}
+	setFakeIpset(t, defaultSet)
+	bypassSet := &fakeIpset{}
+	setFakeNamespaceIpsets(t, map[string]*fakeIpset{"bypass": bypassSet})
+	nl := setFakeNetlink(t)
+	nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9}}
+
+	pod := newTestPod("a", "a", "10.0.0.1")
+	pod.Namespace = "bypass"
+	if err := AddPodToMesh(pod, "", testHostIP, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(bypassSet.added) != 1 || bypassSet.added[0].String() != "10.0.0.1" {
+		t.Errorf("expected the pod to be added to the namespace ipset, got %v", bypassSet.added)
+	}
+	if len(defaultSet.added) != 0 {
+		t.Errorf("expected nothing to be added to the default ipset, got %v", defaultSet.added)
+	}
+
+	if err := AddPodToMesh(newTestPod("b", "b", "10.0.0.2"), "", testHostIP, ""); err != nil {
+		t.Fatal(err)
+	}
+	if len(defaultSet.added) != 1 || defaultSet.added[0].String() != "10.0.0.2" {
+		t.Errorf("expected the pod of an unmapped namespace to be added to the default ipset, got %v", defaultSet.added)
+	}
+}
+
+func TestIpsetRules(t *testing.T) {
+	setFakeNamespaceIpsets(t, map[string]*fakeIpset{"b": {}, "a": {}})
+	rules := []*iptablesRule{
+		newIptableRule("mangle", "ztunnel-PREROUTING", "-m", "set", "--match-set", ipsetName, "src", "-j", "MARK", "--set-mark", "0x100/0x100"),
+		newIptableRule("mangle", "ztunnel-PREROUTING", "-j", "RETURN"),
+	}
+	var got []string
+	for _, rule := range ipsetRules(rules) {
+		got = append(got, strings.Join(rule.RuleSpec, " "))
+	}
+	expected := []string{
+		"-m set --match-set " + ipsetName + " src -j MARK --set-mark 0x100/0x100",
+		"-m set --match-set a src -j MARK --set-mark 0x100/0x100",
+		"-m set --match-set b src -j MARK --set-mark 0x100/0x100",
+		"-j RETURN",
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+// schemaIpset is a fakeIpset with a type, which CreateSet sets if the set doesn't exist.
+type schemaIpset struct {
+	fakeIpset
+	typ       string
+	destroyed int
+}
+
+func (f *schemaIpset) CreateSet() error {
+	if f.typ == "" {
+		f.typ = "hash:ip"
+	}
+	return nil
+}
+
+func (f *schemaIpset) DestroySet() error {
+	f.destroyed++
+	f.typ = ""
+	f.entries = nil
+	return nil
+}
+
+func (f *schemaIpset) SchemaMatches() (bool, error) {
+	return f.typ == "hash:ip", nil
+}
+
+func TestEnsureIpset(t *testing.T) {
+	entries := []netlink.IPSetEntry{
+		{IP: net.ParseIP("10.0.0.1"), Comment: "default/a/uid-a"},
+		{IP: net.ParseIP("10.0.0.2"), Comment: "default/b/uid-b"},
+	}
+	cases := []struct {
+		name            string
+		typ             string
+		expectDestroyed int
+	}{
+		{name: "matching schema", typ: "hash:ip"},
+		{name: "other type", typ: "hash:ip,mark", expectDestroyed: 1},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			set := &schemaIpset{typ: tc.typ}
+			set.entries = append([]netlink.IPSetEntry(nil), entries...)
+			if err := (&Server{}).EnsureIpset(set); err != nil {
+				t.Fatal(err)
+			}
+			if set.destroyed != tc.expectDestroyed {
+				t.Errorf("expected the set to be destroyed %d times, got %d", tc.expectDestroyed, set.destroyed)
+			}
+			if set.typ != "hash:ip" {
+				t.Errorf("expected a hash:ip set, got %s", set.typ)
+			}
+			if !reflect.DeepEqual(set.entries, entries) {
+				t.Errorf("expected the members %v to be kept, got %v", entries, set.entries)
+			}
+		})
+	}
+}
+
+func TestUseIpsetSize(t *testing.T) {
+	orig := ipsetSize
+	t.Cleanup(func() { ipsetSize = orig })
+
+	for _, size := range []IpsetSize{{HashSize: 1000, MaxElem: 1}, {HashSize: 32, MaxElem: 1}, {HashSize: 1024}} {
+		if err := UseIpsetSize(size); err == nil {
+			t.Errorf("expected %+v to be rejected", size)
+		}
+	}
+	if err := UseIpsetSize(IpsetSize{HashSize: 1024, MaxElem: 500000}); err != nil {
+		t.Fatal(err)
+	}
+
+	handle, err := newIpsetHandle(FirewallIptables, "ztunnel-pods-ips")
+	if err != nil {
+		t.Fatal(err)
+	}
+	set, ok := handle.(*ipsetlib.IPSet)
+	if !ok {
+		t.Fatalf("expected an ipset, got %T", handle)
+	}
+	if set.HashSize != 1024 || set.MaxElem != 500000 {
+		t.Errorf("expected the set to be created with hashsize 1024 and maxelem 500000, got %d and %d", set.HashSize, set.MaxElem)
+	}
+
+	out := setDryRun(t)
+	if err := (dryRunIpset{name: "ztunnel-pods-ips"}).CreateSet(); err != nil {
+		t.Fatal(err)
+	}
+	expected := "ipset create ztunnel-pods-ips hash:ip comment hashsize 1024 maxelem 500000\n"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+}
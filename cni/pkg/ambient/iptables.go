@@ -15,16 +15,25 @@
 package ambient
 
 import (
+	"context"
+	"fmt"
+	"os/exec"
 	"strconv"
 	"strings"
 
+	"github.com/coreos/go-iptables/iptables"
+	"go.uber.org/multierr"
+
 	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/util/sets"
 )
 
 type iptablesRule struct {
 	Table    string
 	Chain    string
 	RuleSpec []string
+	// IPv6 rules are applied with ip6tables.
+	IPv6 bool
 }
 
 var IptablesCmd = "iptables-nft"
@@ -33,7 +42,7 @@ var IptablesCmd = "iptables-nft"
 // based on output of iptables-nft or if the command exists.
 //
 // Logic is based on Kubernetes https://github.com/danwinship/kubernetes/blob/ca32fd23cca0797aa787fc5d883807d4eee6899f/build/debian-iptables/iptables-wrapper
-func (s *Server) DetectIptablesCommand() {
+func (s *Server) DetectIptablesCommand(ctx context.Context) {
 	var err error
 	var numLegacyLines int
 	var numNftLines int
@@ -41,7 +50,7 @@ func (s *Server) DetectIptablesCommand() {
 
 	log.Infof("Detecting iptables command")
 
-	output, err = executeOutput("bash", "-c",
+	output, err = s.executor().Output(ctx, "bash", "-c",
 		"(iptables-legacy-save || true; ip6tables-legacy-save || true) 2>/dev/null | grep '^-' | wc -l",
 	)
 	if err != nil {
@@ -59,7 +68,7 @@ func (s *Server) DetectIptablesCommand() {
 		return
 	}
 
-	output, err = executeOutput("bash", "-c",
+	output, err = s.executor().Output(ctx, "bash", "-c",
 		`(timeout 5 sh -c "iptables-nft-save; ip6tables-nft-save" || true) 2>/dev/null | grep '^-' | wc -l`,
 	)
 	if err != nil {
@@ -80,51 +89,150 @@ func (s *Server) DetectIptablesCommand() {
 	log.Infof("Using iptables command: %s", IptablesCmd)
 }
 
+// iptablesHandle is the set of iptables operations used for the ztunnel chains. It is implemented
+// by *iptables.IPTables, and exists so that tests can substitute a fake.
+type iptablesHandle interface {
+	Exists(table, chain string, rulespec ...string) (bool, error)
+	Append(table, chain string, rulespec ...string) error
+	Insert(table, chain string, pos int, rulespec ...string) error
+	Delete(table, chain string, rulespec ...string) error
+	ChainExists(table, chain string) (bool, error)
+	List(table, chain string) ([]string, error)
+	NewChain(table, chain string) error
+	ClearChain(table, chain string) error
+	DeleteChain(table, chain string) error
+}
+
+// defaultIptablesWait is how long iptables waits for the xtables lock by default, in seconds.
+const defaultIptablesWait = 5
+
+// newIptablesHandle returns a handle running IptablesCmd, or printing the commands in dry-run mode.
+// The commands wait up to wait seconds for the xtables lock held by other iptables users, e.g.
+// kube-proxy, rather than failing right away.
+var newIptablesHandle = func(wait int) (iptablesHandle, error) {
+	return newIptablesCmdHandle(IptablesCmd, iptables.ProtocolIPv4, wait)
+}
+
+// newIp6tablesHandle is like newIptablesHandle, for the ip6tables variant of IptablesCmd.
+var newIp6tablesHandle = func(wait int) (iptablesHandle, error) {
+	return newIptablesCmdHandle(ip6tablesCmd(), iptables.ProtocolIPv6, wait)
+}
+
+// newIptablesCmdHandle returns a handle running cmd with the -w (--wait) option.
+func newIptablesCmdHandle(cmd string, proto iptables.Protocol, wait int) (iptablesHandle, error) {
+	if dryRun {
+		return dryRunIptables{cmd: cmd}, nil
+	}
+	path, err := exec.LookPath(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %s: %v", cmd, err)
+	}
+	ipt, err := iptables.New(iptables.Path(path), iptables.IPFamily(proto), iptables.Timeout(wait))
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize %s: %v", cmd, err)
+	}
+	return ipt, nil
+}
+
+// iptablesHandles returns the handles for the ztunnel chains: iptables, and ip6tables if IPv6 is
+// enabled.
+func (s *Server) iptablesHandles() ([]iptablesHandle, error) {
+	ipt, err := newIptablesHandle(s.iptablesLockWait())
+	if err != nil {
+		return nil, err
+	}
+	if !s.enableIPv6 {
+		return []iptablesHandle{ipt}, nil
+	}
+	ip6t, err := newIp6tablesHandle(s.iptablesLockWait())
+	if err != nil {
+		return nil, err
+	}
+	return []iptablesHandle{ipt, ip6t}, nil
+}
+
+// iptablesLockWait returns how long iptables waits for the xtables lock, in seconds.
+func (s *Server) iptablesLockWait() int {
+	if s.iptablesWait > 0 {
+		return s.iptablesWait
+	}
+	return defaultIptablesWait
+}
+
+// ruleHandles creates the iptables and ip6tables handles for applying rules on first use. The
+// handles wait up to wait seconds for the xtables lock.
+type ruleHandles struct {
+	wait   int
+	v4, v6 iptablesHandle
+}
+
+func (h *ruleHandles) get(rule *iptablesRule) (iptablesHandle, error) {
+	var err error
+	if rule.IPv6 {
+		if h.v6 == nil {
+			h.v6, err = newIp6tablesHandle(h.wait)
+		}
+		return h.v6, err
+	}
+	if h.v4 == nil {
+		h.v4, err = newIptablesHandle(h.wait)
+	}
+	return h.v4, err
+}
+
+// ztunnelChains are the ztunnel chains, and the built-in chains that jump to them. The nat chains
+// hold the DNS capture rules, so they must be torn down with the mangle chains.
+var ztunnelChains = []struct {
+	table  string
+	chain  string
+	parent string
+}{
+	{constants.TableNat, constants.ChainZTunnelPrerouting, constants.ChainPrerouting},
+	{constants.TableNat, constants.ChainZTunnelPostrouting, constants.ChainPostrouting},
+	{constants.TableMangle, constants.ChainZTunnelPrerouting, constants.ChainPrerouting},
+	{constants.TableMangle, constants.ChainZTunnelPostrouting, constants.ChainPostrouting},
+	{constants.TableMangle, constants.ChainZTunnelOutput, constants.ChainOutput},
+	{constants.TableMangle, constants.ChainZTunnelInput, constants.ChainInput},
+	{constants.TableMangle, constants.ChainZTunnelForward, constants.ChainForward},
+}
+
 // Initialize the chains and lists for ztunnel
 // https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L36-L47
-func (s *Server) initializeLists() error {
-	var err error
+func (s *Server) initializeLists(ctx context.Context) error {
+	handles, err := s.iptablesHandles()
+	if err != nil {
+		return err
+	}
+	for _, ipt := range handles {
+		if err := initializeChains(ctx, ipt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	s.DetectIptablesCommand()
-
-	list := []*ExecList{
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableNat, "-N", constants.ChainZTunnelPrerouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableNat, "-I", "PREROUTING", "-j", constants.ChainZTunnelPrerouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableNat, "-N", constants.ChainZTunnelPostrouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableNat, "-I", "POSTROUTING", "-j", constants.ChainZTunnelPostrouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-N", constants.ChainZTunnelPrerouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-I", "PREROUTING", "-j", constants.ChainZTunnelPrerouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-N", constants.ChainZTunnelPostrouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-I", "POSTROUTING", "-j", constants.ChainZTunnelPostrouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-N", constants.ChainZTunnelOutput}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-I", "OUTPUT", "-j", constants.ChainZTunnelOutput}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-N", constants.ChainZTunnelInput}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-I", "INPUT", "-j", constants.ChainZTunnelInput}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-N", constants.ChainZTunnelForward}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-I", "FORWARD", "-j", constants.ChainZTunnelForward}),
-	}
-
-	for _, l := range list {
-		err = execute(l.Cmd, l.Args...)
+func initializeChains(ctx context.Context, ipt iptablesHandle) error {
+	for _, c := range ztunnelChains {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		exists, err := ipt.ChainExists(c.table, c.chain)
 		if err != nil {
-			if strings.Contains(err.Error(), "Chain already exists") {
-				log.Debugf("Chain already exists caught during running command %v: %v", l.Cmd, err)
-			} else {
-				log.Errorf("Error running command %v (can safely ignore chain exist errors): %v", l.Cmd, err)
+			return fmt.Errorf("failed to check for chain %s/%s: %v", c.table, c.chain, err)
+		}
+		if exists {
+			log.Debugf("Chain %s/%s already exists", c.table, c.chain)
+		} else if err := ipt.NewChain(c.table, c.chain); err != nil {
+			return fmt.Errorf("failed to create chain %s/%s: %v", c.table, c.chain, err)
+		}
+
+		exists, err = ipt.Exists(c.table, c.parent, "-j", c.chain)
+		if err != nil {
+			return fmt.Errorf("failed to check for jump to %s/%s: %v", c.table, c.chain, err)
+		}
+		if !exists {
+			if err := ipt.Insert(c.table, c.parent, 1, "-j", c.chain); err != nil {
+				return fmt.Errorf("failed to insert jump to %s/%s: %v", c.table, c.chain, err)
 			}
 		}
 	}
@@ -132,153 +240,120 @@ func (s *Server) initializeLists() error {
 	return nil
 }
 
+// DetectConflicts returns the rules of the mangle PREROUTING chain which jump elsewhere before the
+// jump to the ztunnel chain, with a warning for each. Such rules, e.g. from Calico or kube-proxy,
+// may accept or return packets early, which silently prevents them from being marked for ztunnel.
+func (s *Server) DetectConflicts() ([]string, error) {
+	ipt, err := newIptablesHandle(s.iptablesLockWait())
+	if err != nil {
+		return nil, err
+	}
+	rules, err := ipt.List(constants.TableMangle, constants.ChainPrerouting)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chain %s/%s: %v", constants.TableMangle, constants.ChainPrerouting, err)
+	}
+	conflicts := precedingJumps(rules, constants.ChainZTunnelPrerouting)
+	for _, rule := range conflicts {
+		log.Warnf("Rule %q precedes the jump to %s/%s, and may prevent mesh traffic from being captured",
+			rule, constants.TableMangle, constants.ChainZTunnelPrerouting)
+	}
+	return conflicts, nil
+}
+
+// precedingJumps returns the rules, as listed by iptables -S, which jump to a chain or target other
+// than the ztunnel chains before the jump to chain. If there is no jump to chain, nothing is
+// returned, as there is nothing to shadow.
+func precedingJumps(rules []string, chain string) []string {
+	var jumps []string
+	for _, rule := range rules {
+		fields := strings.Fields(rule)
+		if len(fields) == 0 || fields[0] != "-A" {
+			continue
+		}
+		target := ""
+		for i, f := range fields {
+			if (f == "-j" || f == "-g") && i+1 < len(fields) {
+				target = fields[i+1]
+			}
+		}
+		if target == chain {
+			return jumps
+		}
+		if target != "" && !strings.HasPrefix(target, "ztunnel-") {
+			jumps = append(jumps, rule)
+		}
+	}
+	return nil
+}
+
 // Flush the chains and lists for ztunnel
 // https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L29-L34
-func (s *Server) flushLists() {
-	var err error
+func (s *Server) flushLists(ctx context.Context) {
+	handles, err := s.iptablesHandles()
+	if err != nil {
+		log.Warnf("Error flushing chains: %v", err)
+		return
+	}
+	for _, ipt := range handles {
+		flushChains(ctx, ipt)
+	}
+}
 
-	list := []*ExecList{
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableNat, "-F", constants.ChainZTunnelPrerouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableNat, "-F", constants.ChainZTunnelPostrouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-F", constants.ChainZTunnelPrerouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-F", constants.ChainZTunnelPostrouting}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-F", constants.ChainZTunnelOutput}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-F", constants.ChainZTunnelInput}),
-		newExec(IptablesCmd,
-			[]string{"-t", constants.TableMangle, "-F", constants.ChainZTunnelForward}),
-	}
-
-	for _, l := range list {
-		err = execute(l.Cmd, l.Args...)
-		if err != nil {
-			log.Warnf("Error running command %v: %v", l.Cmd, err)
+func flushChains(ctx context.Context, ipt iptablesHandle) {
+	for _, c := range ztunnelChains {
+		if ctx.Err() != nil {
+			return
+		}
+		if err := ipt.ClearChain(c.table, c.chain); err != nil {
+			log.Warnf("Error flushing chain %s/%s: %v", c.table, c.chain, err)
 		}
 	}
 }
 
-func (s *Server) cleanRules() {
-	var err error
+func (s *Server) cleanRules(ctx context.Context) {
+	handles, err := s.iptablesHandles()
+	if err != nil {
+		log.Errorf("Error cleaning chains: %v", err)
+		return
+	}
 
-	s.flushLists()
-
-	list := []*ExecList{
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableNat,
-				"-D", constants.ChainPrerouting,
-				"-j", constants.ChainZTunnelPrerouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableNat,
-				"-X", constants.ChainZTunnelPrerouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableNat,
-				"-D", constants.ChainPostrouting,
-				"-j", constants.ChainZTunnelPostrouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableNat,
-				"-X", constants.ChainZTunnelPostrouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-D", constants.ChainPrerouting,
-				"-j", constants.ChainZTunnelPrerouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-X", constants.ChainZTunnelPrerouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-D", constants.ChainPostrouting,
-				"-j", constants.ChainZTunnelPostrouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-X", constants.ChainZTunnelPostrouting,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-D", constants.ChainForward,
-				"-j", constants.ChainZTunnelForward,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-X", constants.ChainZTunnelForward,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-D", constants.ChainInput,
-				"-j", constants.ChainZTunnelInput,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-X", constants.ChainZTunnelInput,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-D", constants.ChainOutput,
-				"-j", constants.ChainZTunnelOutput,
-			},
-		),
-		newExec(
-			IptablesCmd,
-			[]string{
-				"-t", constants.TableMangle,
-				"-X", constants.ChainZTunnelOutput,
-			},
-		),
-	}
-
-	for _, l := range list {
-		err = execute(l.Cmd, l.Args...)
+	for _, ipt := range handles {
+		flushChains(ctx, ipt)
+		for _, c := range ztunnelChains {
+			if ctx.Err() != nil {
+				return
+			}
+			exists, err := ipt.ChainExists(c.table, c.chain)
+			if err != nil {
+				log.Errorf("Error checking for chain %s/%s: %v", c.table, c.chain, err)
+				continue
+			}
+			if !exists {
+				continue
+			}
+			deleteJumps(ipt, c.table, c.parent, c.chain)
+			if err := ipt.DeleteChain(c.table, c.chain); err != nil {
+				log.Errorf("Error deleting chain %s/%s: %v", c.table, c.chain, err)
+			}
+		}
+	}
+}
+
+// deleteJumps deletes every jump from parent to chain. There may be several, e.g. from setup
+// racing with a previous instance, and the chain can't be deleted while any is left.
+func deleteJumps(ipt iptablesHandle, table, parent, chain string) {
+	for {
+		exists, err := ipt.Exists(table, parent, "-j", chain)
 		if err != nil {
-			log.Errorf("Error running command %v: %v", l.Cmd, err)
+			log.Errorf("Error checking for jump to chain %s/%s: %v", table, chain, err)
+			return
+		}
+		if !exists {
+			return
+		}
+		if err := ipt.Delete(table, parent, "-j", chain); err != nil {
+			log.Errorf("Error deleting jump to chain %s/%s: %v", table, chain, err)
+			return
 		}
 	}
 }
@@ -291,13 +366,274 @@ func newIptableRule(table, chain string, rule ...string) *iptablesRule {
 	}
 }
 
-func iptablesAppend(rules []*iptablesRule) error {
+// iptablesAppend appends the rules in order, stopping at the first failure. Each command waits up
+// to wait seconds for the xtables lock, and transient failures are retried with b. The rules that
+// were appended successfully are returned, even on failure, so that they can be rolled back.
+func iptablesAppend(ctx context.Context, rules []*iptablesRule, wait int, b backoff) ([]*iptablesRule, error) {
+	handles := ruleHandles{wait: wait}
+	added := make([]*iptablesRule, 0, len(rules))
 	for _, rule := range rules {
+		if err := ctx.Err(); err != nil {
+			return added, err
+		}
+		ipt, err := handles.get(rule)
+		if err != nil {
+			return added, err
+		}
 		log.Debugf("Appending rule: %+v", rule)
-		err := execute(IptablesCmd, append([]string{"-t", rule.Table, "-A", rule.Chain}, rule.RuleSpec...)...)
+		err = b.retry(ctx, func() error {
+			return ipt.Append(rule.Table, rule.Chain, rule.RuleSpec...)
+		})
+		if err != nil {
+			return added, fmt.Errorf("failed to append rule %+v: %v", rule, err)
+		}
+		added = append(added, rule)
+	}
+	return added, nil
+}
+
+// iptablesDelete deletes the rules, in reverse order. All rules are attempted, and the failures
+// are returned together. Each command waits up to wait seconds for the xtables lock.
+func iptablesDelete(ctx context.Context, rules []*iptablesRule, wait int) error {
+	handles := ruleHandles{wait: wait}
+	var errs error
+	for i := len(rules) - 1; i >= 0; i-- {
+		if err := ctx.Err(); err != nil {
+			return multierr.Append(errs, err)
+		}
+		rule := rules[i]
+		ipt, err := handles.get(rule)
 		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		log.Debugf("Deleting rule: %+v", rule)
+		if err := ipt.Delete(rule.Table, rule.Chain, rule.RuleSpec...); err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to delete rule %+v: %v", rule, err))
+		}
+	}
+	return errs
+}
+
+// applyRulesTransactional appends each group of rules in order. If any rule fails, every rule
+// appended by this call is deleted again, so the node is not left half-configured, and the
+// original error is returned. The rollback is done even if ctx is cancelled.
+func (s *Server) applyRulesTransactional(ctx context.Context, ruleGroups ...[]*iptablesRule) error {
+	var applied []*iptablesRule
+	for _, rules := range ruleGroups {
+		added, err := s.firewall().appendRules(ctx, rules)
+		applied = append(applied, added...)
+		if err != nil {
+			log.Warnf("Rolling back %d rules: %v", len(applied), err)
+			if rbErr := s.firewall().deleteRules(context.Background(), applied); rbErr != nil {
+				log.Errorf("Failed to roll back rules: %v", rbErr)
+			}
 			return err
 		}
 	}
+
+	s.mu.Lock()
+	s.appliedRules = applied
+	s.completeChains = nil
+	s.mu.Unlock()
 	return nil
 }
+
+// applyNodeRules applies the rules of node setup, in the two groups returned by cpuNodeRules and
+// dpuNodeRules. With a ztunnel health port, the capture rules, which mark the outbound traffic of
+// mesh pods for ztunnel, are withheld until WaitForZTunnel passes, so that the traffic isn't
+// black-holed while ztunnel doesn't listen yet. The other rules only skip traffic, so they are
+// applied first.
+func (s *Server) applyNodeRules(ctx context.Context, ztunnelIP string, appendRules, appendRules2 []*iptablesRule) error {
+	if s.ztunnelHealthPort == 0 {
+		return s.applyRulesTransactional(ctx, appendRules, appendRules2, s.ipv6Rules(appendRules, appendRules2))
+	}
+	rules2, capture := splitCaptureRules(appendRules2, s.markArgs().OutboundMark)
+	if err := s.applyRulesTransactional(ctx, appendRules, rules2, s.ipv6Rules(appendRules, rules2)); err != nil {
+		return err
+	}
+
+	if dryRun {
+		log.Infof("Dry-run mode, not waiting for ztunnel on port %d", s.ztunnelHealthPort)
+	} else if err := s.WaitForZTunnel(ctx, ztunnelIP, s.ztunnelHealthPort, s.ztunnelHealthTimeout); err != nil {
+		return err
+	}
+
+	capture = append(capture, s.ipv6Rules(capture)...)
+	added, err := s.firewall().appendRules(ctx, capture)
+	if err != nil {
+		if rbErr := s.firewall().deleteRules(context.Background(), added); rbErr != nil {
+			log.Errorf("Failed to roll back capture rules: %v", rbErr)
+		}
+		return err
+	}
+	s.mu.Lock()
+	s.appliedRules = append(s.appliedRules, added...)
+	s.completeChains = nil
+	s.mu.Unlock()
+	return nil
+}
+
+// splitCaptureRules splits off the rules setting the outbound mark, which are the last ones of their
+// chain, from rules.
+func splitCaptureRules(rules []*iptablesRule, outboundMark string) (others, capture []*iptablesRule) {
+	for _, rule := range rules {
+		if i := indexOf(rule.RuleSpec, "--set-mark"); i != -1 && i+1 < len(rule.RuleSpec) && rule.RuleSpec[i+1] == outboundMark {
+			capture = append(capture, rule)
+		} else {
+			others = append(others, rule)
+		}
+	}
+	return others, capture
+}
+
+// EnsureRules repairs the ztunnel chains and rules after another tool, e.g. a node agent running
+// iptables-restore, removed some of them. Unlike CreateRulesOn*Node, nothing is flushed: missing
+// chains and jumps are recreated, and each rule applied by the last node setup that is missing is
+// inserted back at its position among the rules still present, so established marks are kept.
+// When nothing is missing, only the chains are listed, so a watchdog can call it often.
+// Nothing is done until ztunnel is running, or with the nftables backend.
+func (s *Server) EnsureRules(ctx context.Context) error {
+	if !s.isZTunnelRunning() || s.firewallBackend == FirewallNftables {
+		return nil
+	}
+	if err := s.initializeLists(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	rules := s.appliedRules
+	s.mu.Unlock()
+
+	handles := ruleHandles{wait: s.iptablesLockWait()}
+	for _, c := range appliedChainsOf(rules) {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		ipt, err := handles.get(c.rules[0])
+		if err != nil {
+			return err
+		}
+		if err := s.ensureChainRules(ctx, ipt, c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appliedChain is a chain of one family, and the rules applied to it, in order.
+type appliedChain struct {
+	key   string
+	table string
+	chain string
+	rules []*iptablesRule
+}
+
+// appliedChainsOf groups rules by their chain and family, in the order the chains first appear.
+func appliedChainsOf(rules []*iptablesRule) []*appliedChain {
+	var chains []*appliedChain
+	byKey := map[string]*appliedChain{}
+	for _, rule := range rules {
+		key := fmt.Sprintf("%s/%s/%t", rule.Table, rule.Chain, rule.IPv6)
+		c, ok := byKey[key]
+		if !ok {
+			c = &appliedChain{key: key, table: rule.Table, chain: rule.Chain}
+			byKey[key] = c
+			chains = append(chains, c)
+		}
+		c.rules = append(c.rules, rule)
+	}
+	return chains
+}
+
+// ensureChainRules inserts the missing rules of c back. The rules listed in the chain are compared
+// in order with the listing of the chain from when it was last complete, as iptables lists the rules
+// in its own form, so that a missing copy of a rule which is in the chain twice is noticed, which
+// Exists can't tell apart. The rules of other tools in the chain are skipped over. Until the chain
+// was seen complete, the rules are checked with Exists instead.
+func (s *Server) ensureChainRules(ctx context.Context, ipt iptablesHandle, c *appliedChain) error {
+	s.mu.Lock()
+	complete := s.completeChains[c.key]
+	s.mu.Unlock()
+	if len(complete) != len(c.rules) {
+		return s.ensureChainRulesExist(ctx, ipt, c)
+	}
+
+	listed, err := ipt.List(c.table, c.chain)
+	if err != nil {
+		return fmt.Errorf("failed to list chain %s/%s: %v", c.table, c.chain, err)
+	}
+	listed = appendedRules(listed)
+	own := sets.New(complete...)
+	next := 0
+	for i, rule := range c.rules {
+		for next < len(listed) && !own.Contains(listed[next]) {
+			next++
+		}
+		if next < len(listed) && listed[next] == complete[i] {
+			next++
+			continue
+		}
+		if err := s.restoreRule(ctx, ipt, rule, next+1); err != nil {
+			return err
+		}
+		listed = append(listed[:next], append([]string{complete[i]}, listed[next:]...)...)
+		next++
+	}
+	return nil
+}
+
+// ensureChainRulesExist inserts the rules of c which don't exist back, and records the listing of
+// the chain once it is complete for ensureChainRules.
+func (s *Server) ensureChainRulesExist(ctx context.Context, ipt iptablesHandle, c *appliedChain) error {
+	for i, rule := range c.rules {
+		exists, err := ipt.Exists(rule.Table, rule.Chain, rule.RuleSpec...)
+		if err != nil {
+			return fmt.Errorf("failed to check for rule %+v: %v", rule, err)
+		}
+		if !exists {
+			if err := s.restoreRule(ctx, ipt, rule, i+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	listed, err := ipt.List(c.table, c.chain)
+	if err != nil {
+		return fmt.Errorf("failed to list chain %s/%s: %v", c.table, c.chain, err)
+	}
+	// With the rules of other tools in the chain, which listed rules are ours is unknown.
+	if listed = appendedRules(listed); len(listed) == len(c.rules) {
+		s.mu.Lock()
+		if s.completeChains == nil {
+			s.completeChains = map[string][]string{}
+		}
+		s.completeChains[c.key] = listed
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// restoreRule inserts rule at pos of its chain.
+func (s *Server) restoreRule(ctx context.Context, ipt iptablesHandle, rule *iptablesRule, pos int) error {
+	log.Infof("Restoring missing rule: %+v", rule)
+	err := s.backoff.retry(ctx, func() error {
+		return ipt.Insert(rule.Table, rule.Chain, pos, rule.RuleSpec...)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore rule %+v: %v", rule, err)
+	}
+	return nil
+}
+
+// appendedRules returns the rules in the output of iptables -S for a chain, which also lists the
+// chain itself.
+func appendedRules(listed []string) []string {
+	var rules []string
+	for _, line := range listed {
+		if strings.HasPrefix(line, "-A ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
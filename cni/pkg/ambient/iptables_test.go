@@ -0,0 +1,487 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// fakeIptables is an in-memory iptablesHandle. Rules are kept per table/chain, as joined specs.
+// If failAppend is set, appending a rule containing it fails.
+type fakeIptables struct {
+	rules      map[string][]string
+	failAppend string
+}
+
+func newFakeIptables() *fakeIptables {
+	f := &fakeIptables{rules: map[string][]string{}}
+	for _, chain := range []string{constants.ChainPrerouting, constants.ChainPostrouting, constants.ChainOutput} {
+		f.rules[constants.TableNat+"/"+chain] = nil
+	}
+	for _, chain := range []string{
+		constants.ChainPrerouting, constants.ChainPostrouting, constants.ChainOutput,
+		constants.ChainInput, constants.ChainForward,
+	} {
+		f.rules[constants.TableMangle+"/"+chain] = nil
+	}
+	return f
+}
+
+func (f *fakeIptables) Exists(table, chain string, rulespec ...string) (bool, error) {
+	rules, ok := f.rules[table+"/"+chain]
+	if !ok {
+		return false, errors.New("no chain")
+	}
+	spec := strings.Join(rulespec, " ")
+	for _, r := range rules {
+		if r == spec {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (f *fakeIptables) Append(table, chain string, rulespec ...string) error {
+	key := table + "/" + chain
+	if _, ok := f.rules[key]; !ok {
+		return errors.New("no chain")
+	}
+	spec := strings.Join(rulespec, " ")
+	if f.failAppend != "" && strings.Contains(spec, f.failAppend) {
+		return errors.New("append failed")
+	}
+	f.rules[key] = append(f.rules[key], spec)
+	return nil
+}
+
+func (f *fakeIptables) Insert(table, chain string, pos int, rulespec ...string) error {
+	key := table + "/" + chain
+	if _, ok := f.rules[key]; !ok {
+		return errors.New("no chain")
+	}
+	if pos < 1 || pos > len(f.rules[key])+1 {
+		return errors.New("index of insertion too big")
+	}
+	rules := append([]string{}, f.rules[key][:pos-1]...)
+	rules = append(rules, strings.Join(rulespec, " "))
+	f.rules[key] = append(rules, f.rules[key][pos-1:]...)
+	return nil
+}
+
+func (f *fakeIptables) Delete(table, chain string, rulespec ...string) error {
+	key := table + "/" + chain
+	spec := strings.Join(rulespec, " ")
+	for i, r := range f.rules[key] {
+		if r == spec {
+			f.rules[key] = append(f.rules[key][:i], f.rules[key][i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("no rule")
+}
+
+func (f *fakeIptables) ChainExists(table, chain string) (bool, error) {
+	_, ok := f.rules[table+"/"+chain]
+	return ok, nil
+}
+
+func (f *fakeIptables) List(table, chain string) ([]string, error) {
+	rules, ok := f.rules[table+"/"+chain]
+	if !ok {
+		return nil, errors.New("no chain")
+	}
+	listed := make([]string, 0, len(rules))
+	for _, r := range rules {
+		listed = append(listed, "-A "+chain+" "+r)
+	}
+	return listed, nil
+}
+
+func (f *fakeIptables) NewChain(table, chain string) error {
+	key := table + "/" + chain
+	if _, ok := f.rules[key]; ok {
+		return errors.New("chain already exists")
+	}
+	f.rules[key] = nil
+	return nil
+}
+
+func (f *fakeIptables) ClearChain(table, chain string) error {
+	f.rules[table+"/"+chain] = nil
+	return nil
+}
+
+func (f *fakeIptables) DeleteChain(table, chain string) error {
+	for key, rules := range f.rules {
+		if !strings.HasPrefix(key, table+"/") {
+			continue
+		}
+		for _, r := range rules {
+			if r == "-j "+chain {
+				return errors.New("chain is referenced")
+			}
+		}
+	}
+	delete(f.rules, table+"/"+chain)
+	return nil
+}
+
+func setFakeIptables(t *testing.T, f *fakeIptables) {
+	orig := newIptablesHandle
+	newIptablesHandle = func(int) (iptablesHandle, error) {
+		return f, nil
+	}
+	t.Cleanup(func() {
+		newIptablesHandle = orig
+	})
+}
+
+func TestInitializeListsIdempotent(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	s := &Server{}
+
+	for i := 0; i < 2; i++ {
+		if err := s.initializeLists(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range ztunnelChains {
+		jumps := f.rules[c.table+"/"+c.parent]
+		if len(jumps) != 1 || jumps[0] != "-j "+c.chain {
+			t.Errorf("expected a single jump to %s/%s, got %v", c.table, c.chain, jumps)
+		}
+	}
+}
+
+func TestApplyRulesTransactional(t *testing.T) {
+	f := newFakeIptables()
+	f.failAppend = "RETURN"
+	setFakeIptables(t, f)
+	s := &Server{}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s.applyRulesTransactional(context.Background(),
+		[]*iptablesRule{
+			newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting, "-j", "ACCEPT"),
+		},
+		[]*iptablesRule{
+			newIptableRule(constants.TableMangle, constants.ChainZTunnelOutput, "-j", "ACCEPT"),
+			newIptableRule(constants.TableMangle, constants.ChainZTunnelOutput, "-j", "RETURN"),
+		},
+	)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	for _, chain := range []string{constants.ChainZTunnelPrerouting, constants.ChainZTunnelOutput} {
+		if rules := f.rules[constants.TableMangle+"/"+chain]; len(rules) != 0 {
+			t.Errorf("expected the rules in %s to be rolled back, got %v", chain, rules)
+		}
+	}
+}
+
+func TestApplyRulesTransactionalKeepsPreviousRules(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	s := &Server{}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	previous := []*iptablesRule{newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting, "-j", "ACCEPT")}
+	if err := s.applyRulesTransactional(context.Background(), previous); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the rules appended by the failing call are rolled back.
+	f.failAppend = "RETURN"
+	err := s.applyRulesTransactional(context.Background(), []*iptablesRule{
+		newIptableRule(constants.TableMangle, constants.ChainZTunnelOutput, "-j", "ACCEPT"),
+		newIptableRule(constants.TableMangle, constants.ChainZTunnelOutput, "-j", "RETURN"),
+	})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if rules := f.rules[constants.TableMangle+"/"+constants.ChainZTunnelPrerouting]; !reflect.DeepEqual(rules, []string{"-j ACCEPT"}) {
+		t.Errorf("expected the previous rule to be kept, got %v", rules)
+	}
+	if rules := f.rules[constants.TableMangle+"/"+constants.ChainZTunnelOutput]; len(rules) != 0 {
+		t.Errorf("expected the rules in %s to be rolled back, got %v", constants.ChainZTunnelOutput, rules)
+	}
+	// The failed call doesn't replace the rules of the last node setup.
+	if !reflect.DeepEqual(s.appliedRules, previous) {
+		t.Errorf("expected the applied rules to stay %v, got %v", previous, s.appliedRules)
+	}
+}
+
+func TestEnsureRules(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	s := &Server{ztunnelRunning: true}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	appendRules, appendRules2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	if err := s.applyRulesTransactional(context.Background(), appendRules, appendRules2); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func() map[string][]string {
+		rules := map[string][]string{}
+		for k, v := range f.rules {
+			rules[k] = append([]string{}, v...)
+		}
+		return rules
+	}
+	want := snapshot()
+
+	// Remove a rule from the middle of its chain, as another tool restoring its own rules would.
+	missing := appendRules2[1]
+	if err := f.Delete(missing.Table, missing.Chain, missing.RuleSpec...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.EnsureRules(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.rules, want) {
+		t.Errorf("expected the rules to be restored in place:\n%v\ngot:\n%v", want, f.rules)
+	}
+
+	// With nothing missing, nothing changes.
+	if err := s.EnsureRules(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.rules, want) {
+		t.Errorf("expected no change, got %v", f.rules)
+	}
+}
+
+func TestEnsureRulesDuplicate(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	s := &Server{ztunnelRunning: true}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	appendRules, appendRules2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	if err := s.applyRulesTransactional(context.Background(), appendRules, appendRules2); err != nil {
+		t.Fatal(err)
+	}
+	// The chains are complete, which EnsureRules records.
+	if err := s.EnsureRules(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rule which is in its chain twice, e.g. the skip mark RETURN.
+	var duplicate *iptablesRule
+	seen := map[string]bool{}
+	for _, rule := range append(appendRules, appendRules2...) {
+		key := rule.Table + "/" + rule.Chain + " " + strings.Join(rule.RuleSpec, " ")
+		if seen[key] {
+			duplicate = rule
+			break
+		}
+		seen[key] = true
+	}
+	if duplicate == nil {
+		t.Fatal("expected a rule in its chain twice")
+	}
+	key := duplicate.Table + "/" + duplicate.Chain
+	// Another tool added a rule of its own up front.
+	f.rules[key] = append([]string{"-j LOG"}, f.rules[key]...)
+	want := append([]string{}, f.rules[key]...)
+
+	// One copy is removed, which Exists can't tell, as the other copy still matches.
+	if err := f.Delete(duplicate.Table, duplicate.Chain, duplicate.RuleSpec...); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.EnsureRules(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.rules[key], want) {
+		t.Errorf("expected the copy to be restored in place:\n%v\ngot:\n%v", want, f.rules[key])
+	}
+}
+
+func TestApplyNodeRulesWaitsForZTunnel(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	s := &Server{ztunnelHealthPort: 15021, ztunnelHealthTimeout: 10 * time.Second}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	appendRules, appendRules2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+
+	captured := func() bool {
+		for _, r := range f.rules[constants.TableMangle+"/"+constants.ChainZTunnelPrerouting] {
+			if strings.HasSuffix(r, "--set-mark "+constants.OutboundMark) {
+				return true
+			}
+		}
+		return false
+	}
+	dials := 0
+	orig := dialZTunnel
+	dialZTunnel = func(ctx context.Context, addr string) error {
+		dials++
+		if captured() {
+			t.Errorf("the capture rule was applied before ztunnel was ready")
+		}
+		if addr != "10.0.0.2:15021" {
+			t.Errorf("expected a dial to 10.0.0.2:15021, got %s", addr)
+		}
+		if dials < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	t.Cleanup(func() {
+		dialZTunnel = orig
+	})
+
+	if err := s.applyNodeRules(context.Background(), "10.0.0.2", appendRules, appendRules2); err != nil {
+		t.Fatal(err)
+	}
+	if dials != 3 {
+		t.Errorf("expected 3 dials, got %d", dials)
+	}
+	if !captured() {
+		t.Errorf("expected the capture rule to be applied once ztunnel is ready")
+	}
+	if len(s.appliedRules) != len(appendRules)+len(appendRules2) {
+		t.Errorf("expected all %d rules to be recorded, got %d", len(appendRules)+len(appendRules2), len(s.appliedRules))
+	}
+}
+
+func TestDetectConflicts(t *testing.T) {
+	cases := []struct {
+		name     string
+		rules    []string
+		expected []string
+	}{
+		{
+			name:  "ztunnel first",
+			rules: []string{"-j " + constants.ChainZTunnelPrerouting, "-j cali-PREROUTING"},
+		},
+		{
+			name:     "calico first",
+			rules:    []string{"-j cali-PREROUTING", "-m mark --mark 0x1 -j RETURN", "-j " + constants.ChainZTunnelPrerouting},
+			expected: []string{"-A PREROUTING -j cali-PREROUTING", "-A PREROUTING -m mark --mark 0x1 -j RETURN"},
+		},
+		{
+			name:  "not a jump",
+			rules: []string{"-m comment --comment foo", "-j " + constants.ChainZTunnelPrerouting},
+		},
+		{
+			name:  "no ztunnel jump",
+			rules: []string{"-j cali-PREROUTING"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFakeIptables()
+			f.rules[constants.TableMangle+"/"+constants.ChainPrerouting] = tc.rules
+			setFakeIptables(t, f)
+
+			got, err := (&Server{}).DetectConflicts()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestCleanRules(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	s := &Server{}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// A duplicate jump, which would keep the chain referenced if only one was deleted.
+	if err := f.Insert(constants.TableNat, constants.ChainPrerouting, 1, "-j", constants.ChainZTunnelPrerouting); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := iptablesAppend(context.Background(), s.dnsCaptureRules("10.0.0.2"), defaultIptablesWait, backoff{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s.cleanRules(context.Background())
+	for _, c := range ztunnelChains {
+		if exists, _ := f.ChainExists(c.table, c.chain); exists {
+			t.Errorf("expected chain %s/%s to be deleted", c.table, c.chain)
+		}
+		if exists, _ := f.Exists(c.table, c.parent, "-j", c.chain); exists {
+			t.Errorf("expected no jump to %s/%s", c.table, c.chain)
+		}
+	}
+}
+
+func TestIptablesWait(t *testing.T) {
+	// A stand-in for iptables, recording the arguments of each command.
+	dir := t.TempDir()
+	argsFile := filepath.Join(dir, "args")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = --version ]; then echo 'iptables v1.8.7 (nf_tables)'; exit 0; fi\n" +
+		"echo \"$@\" >> " + argsFile + "\n"
+	cmd := filepath.Join(dir, "iptables")
+	if err := os.WriteFile(cmd, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	orig := IptablesCmd
+	IptablesCmd = cmd
+	t.Cleanup(func() {
+		IptablesCmd = orig
+	})
+
+	s := &Server{iptablesWait: 7}
+	rule := newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting, "-j", "RETURN")
+	if _, err := iptablesAppend(context.Background(), []*iptablesRule{rule}, s.iptablesLockWait(), backoff{}); err != nil {
+		t.Fatal(err)
+	}
+	ipt, err := newIptablesHandle(s.iptablesLockWait())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ipt.Exists(rule.Table, rule.Chain, rule.RuleSpec...); err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := os.ReadFile(argsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"-t mangle -A ztunnel-PREROUTING -j RETURN --wait 7",
+		"-t mangle -C ztunnel-PREROUTING -j RETURN --wait 7",
+	}
+	if got := strings.Split(strings.TrimSpace(string(out)), "\n"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected commands %v, got %v", expected, got)
+	}
+}
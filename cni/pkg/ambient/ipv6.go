@@ -0,0 +1,256 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const ipset6Name = "ztunnel-pods-ips6"
+
+// Ipset6 holds the IPv6 addresses of the mesh pods, on dual-stack nodes with IPv6 enabled.
+var Ipset6 IpsetHandle = &ipsetCmd{Name: ipset6Name, Family: "inet6"}
+
+// ipsetCmd is an IpsetHandle running the ipset binary. The netlink ipset API only creates inet
+// sets, so this is used for the IPv6 set.
+type ipsetCmd struct {
+	Name   string
+	Family string
+}
+
+func (m *ipsetCmd) CreateSet() error {
+	args := append([]string{"create", m.Name, "hash:ip", "family", m.Family, "comment", "-exist"}, ipsetSize.args()...)
+	err := execute(context.Background(), "ipset", args...)
+	if err != nil {
+		return fmt.Errorf("failed to create ipset %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetCmd) DestroySet() error {
+	if err := execute(context.Background(), "ipset", "destroy", m.Name); err != nil {
+		return fmt.Errorf("failed to destroy ipset %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetCmd) AddIP(ip net.IP, comment string) error {
+	args := []string{"add", m.Name, ip.String()}
+	if comment != "" {
+		args = append(args, "comment", comment)
+	}
+	if err := execute(context.Background(), "ipset", append(args, "-exist")...); err != nil {
+		return fmt.Errorf("failed to add IP %s to ipset %s: %v", ip, m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetCmd) DeleteIP(ip net.IP) error {
+	if err := execute(context.Background(), "ipset", "del", m.Name, ip.String(), "-exist"); err != nil {
+		return fmt.Errorf("failed to delete IP %s from ipset %s: %v", ip, m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetCmd) Flush() error {
+	if err := execute(context.Background(), "ipset", "flush", m.Name); err != nil {
+		return fmt.Errorf("failed to flush ipset %s: %v", m.Name, err)
+	}
+	return nil
+}
+
+func (m *ipsetCmd) List() ([]netlink.IPSetEntry, error) {
+	out, err := executeOutput(context.Background(), "ipset", "save", m.Name)
+	if err != nil {
+		if strings.Contains(out, "does not exist") {
+			return nil, fmt.Errorf("failed to list ipset %s: %w", m.Name, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to list ipset %s: %v: %s", m.Name, err, out)
+	}
+	return parseIpsetSave(out)
+}
+
+// parseIpsetSave parses the entries from the output of ipset save, which are lines like
+// `add ztunnel-pods-ips6 fd00::1 comment "uid"`, or `add ztunnel-pods-ip-ports 10.0.0.1,tcp:8080`
+// for IpsetPort.
+func parseIpsetSave(out string) ([]netlink.IPSetEntry, error) {
+	var entries []netlink.IPSetEntry
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != "add" {
+			continue
+		}
+		// The elements of hash:ip,port sets are ip,proto:port.
+		ipStr, portStr, hasPort := strings.Cut(fields[2], ",")
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP %q in ipset", fields[2])
+		}
+		entry := netlink.IPSetEntry{IP: ip}
+		if hasPort {
+			if err := parseIPPortElem(portStr, &entry); err != nil {
+				return nil, fmt.Errorf("invalid ipset entry %q: %v", line, err)
+			}
+		}
+		if len(fields) >= 5 && fields[3] == "comment" {
+			comment, err := strconv.Unquote(strings.Join(fields[4:], " "))
+			if err != nil {
+				return nil, fmt.Errorf("invalid comment in ipset entry %q: %v", line, err)
+			}
+			entry.Comment = comment
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ip6tablesCmd returns the ip6tables variant of IptablesCmd.
+func ip6tablesCmd() string {
+	return strings.Replace(IptablesCmd, "iptables", "ip6tables", 1)
+}
+
+// isIPv6 reports whether ip is an IPv6 address.
+func isIPv6(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.To4() == nil
+}
+
+// podIPv6s returns the IPv6 addresses of the pod.
+func podIPv6s(pod *corev1.Pod) []string {
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		if isIPv6(ip.IP) {
+			ips = append(ips, ip.IP)
+		}
+	}
+	if len(ips) == 0 && isIPv6(pod.Status.PodIP) {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+// podAddrs returns the addresses of the pod, the primary pod IP first.
+func podAddrs(pod *corev1.Pod) []string {
+	var ips []string
+	if pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	for _, ip := range pod.Status.PodIPs {
+		if ip.IP != pod.Status.PodIP {
+			ips = append(ips, ip.IP)
+		}
+	}
+	return ips
+}
+
+// addPodToIpset6 adds an IPv6 address of the pod to Ipset6. Only the ipset is changed, as the pod
+// routes go through the IPv4 inbound tunnel.
+func addPodToIpset6(pod *corev1.Pod, ip string) error {
+	entries, err := Ipset6.List()
+	if err != nil {
+		return err
+	}
+	parsed := net.ParseIP(ip)
+	for _, entry := range entries {
+		if entry.IP.Equal(parsed) {
+			log.Infof("Pod '%s/%s' (%s) IP %s is in ipset", pod.Name, pod.Namespace, string(pod.UID), ip)
+			return nil
+		}
+	}
+	log.Infof("Adding pod '%s/%s' (%s) IP %s to ipset", pod.Name, pod.Namespace, string(pod.UID), ip)
+	return Ipset6.AddIP(parsed, ipsetComment(pod))
+}
+
+// delPodFromIpset6 removes the entries of the pod from Ipset6. Entries are matched by UID as well
+// as IP, as the IPs are often cleared from the status of terminated pods. If Ipset6 doesn't exist,
+// e.g. IPv6 is disabled, the pod isn't in it and there is nothing to do.
+func delPodFromIpset6(pod *corev1.Pod) error {
+	entries, err := Ipset6.List()
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ips := podIPv6s(pod)
+	var errs error
+	for _, entry := range entries {
+		match := commentUID(entry.Comment) == string(pod.UID)
+		for _, ip := range ips {
+			match = match || entry.IP.Equal(net.ParseIP(ip))
+		}
+		if !match {
+			continue
+		}
+		log.Infof("Removing pod '%s/%s' (%s) IP %s from ipset", pod.Name, pod.Namespace, string(pod.UID), entry.IP)
+		if err := Ipset6.DeleteIP(entry.IP); err != nil {
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// ipv6Rules mirrors the rules for ip6tables when IPv6 is enabled, matching Ipset6 instead of the
+// IPv4 ipset. Rules with IPv4 addresses, such as those of ztunnel and the tunnels, have no IPv6
+// counterpart and are skipped.
+func (s *Server) ipv6Rules(ruleGroups ...[]*iptablesRule) []*iptablesRule {
+	if !s.enableIPv6 {
+		return nil
+	}
+	var rules []*iptablesRule
+	for _, group := range ruleGroups {
+		for _, rule := range group {
+			// IpsetPort only holds IPv4 addresses.
+			if hasIPv4Arg(rule) || indexOf(rule.RuleSpec, ipsetPortName) != -1 {
+				continue
+			}
+			spec := make([]string, len(rule.RuleSpec))
+			for i, arg := range rule.RuleSpec {
+				if arg == ipsetName {
+					arg = ipset6Name
+				}
+				spec[i] = arg
+			}
+			rules = append(rules, &iptablesRule{Table: rule.Table, Chain: rule.Chain, RuleSpec: spec, IPv6: true})
+		}
+	}
+	return rules
+}
+
+// hasIPv4Arg reports whether any argument of the rule is an IPv4 address, CIDR or address:port.
+func hasIPv4Arg(rule *iptablesRule) bool {
+	for _, arg := range rule.RuleSpec {
+		if host, _, err := net.SplitHostPort(arg); err == nil {
+			arg = host
+		}
+		if ip, _, err := net.ParseCIDR(arg); err == nil {
+			arg = ip.String()
+		}
+		if ip := net.ParseIP(arg); ip != nil && ip.To4() != nil {
+			return true
+		}
+	}
+	return false
+}
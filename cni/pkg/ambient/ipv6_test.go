@@ -0,0 +1,153 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func setFakeIpset6(t *testing.T, f *fakeIpset) {
+	orig := Ipset6
+	Ipset6 = f
+	t.Cleanup(func() {
+		Ipset6 = orig
+	})
+}
+
+func TestParseIpsetSave(t *testing.T) {
+	out := `create ztunnel-pods-ips6 hash:ip family inet6 hashsize 1024 maxelem 65536 comment
+add ztunnel-pods-ips6 fd00::1 comment "uid-a"
+add ztunnel-pods-ips6 fd00::2`
+	got, err := parseIpsetSave(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []netlink.IPSetEntry{
+		{IP: net.ParseIP("fd00::1"), Comment: "uid-a"},
+		{IP: net.ParseIP("fd00::2")},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestAddPodToMeshIPv6(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	f6 := &fakeIpset{}
+	setFakeIpset6(t, f6)
+
+	_ = AddPodToMesh(newTestPod("a", "a", "10.0.0.1"), "fd00::1", testHostIP, "")
+	if len(f6.added) != 1 || !f6.added[0].Equal(net.ParseIP("fd00::1")) {
+		t.Errorf("expected the IPv6 pod ip to be added to the IPv6 ipset, got %v", f6.added)
+	}
+	if len(f.added) != 0 {
+		t.Errorf("expected no IPv4 ipset adds, got %v", f.added)
+	}
+}
+
+func TestDelPodFromMeshIPv6(t *testing.T) {
+	setFakeIpset(t, &fakeIpset{})
+	f6 := &fakeIpset{}
+	setFakeIpset6(t, f6)
+	s := &Server{routeTables: DefaultRouteTables(), enableIPv6: true}
+
+	pod := newTestPod("a", "a", "10.0.0.1")
+	pod.Status.PodIPs = []corev1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}}
+	s.addPodToMesh(pod)
+	if len(f6.entries) != 1 {
+		t.Fatalf("expected the IPv6 pod ip in the IPv6 ipset, got %v", f6.entries)
+	}
+
+	// The IPs are cleared from the status, so the entry is found by UID.
+	s.delPodFromMesh(newTestPod("a", "a", ""))
+	if len(f6.entries) != 0 {
+		t.Errorf("expected the IPv6 ipset to be empty, got %v", f6.entries)
+	}
+}
+
+func TestDelPodFromMeshDualStack(t *testing.T) {
+	setFakeNetlink(t)
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	f6 := &fakeIpset{}
+	setFakeIpset6(t, f6)
+
+	pod := newTestPod("a", "a", "10.0.0.1")
+	pod.Status.PodIPs = []corev1.PodIP{{IP: "10.0.0.1"}, {IP: "fd00::1"}}
+	_ = AddPodToMesh(pod, "10.0.0.1", testHostIP, "")
+	_ = AddPodToMesh(pod, "fd00::1", testHostIP, "")
+	if len(f.entries) != 1 || len(f6.entries) != 1 {
+		t.Fatalf("expected one entry in each ipset, got %v and %v", f.entries, f6.entries)
+	}
+
+	DelPodFromMesh(pod, testHostIP)
+	if len(f.entries) != 0 || len(f6.entries) != 0 {
+		t.Errorf("expected both ipsets to be empty, got %v and %v", f.entries, f6.entries)
+	}
+}
+
+func TestDelPodFromMeshIPv6Primary(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	f6 := &fakeIpset{}
+	setFakeIpset6(t, f6)
+
+	pod := newTestPod("a", "a", "fd00::1")
+	_ = AddPodToMesh(pod, "", testHostIP, "")
+	DelPodFromMesh(pod, testHostIP)
+	if len(f6.entries) != 0 {
+		t.Errorf("expected the IPv6 ipset to be empty, got %v", f6.entries)
+	}
+	if len(f.deleted) != 0 {
+		t.Errorf("expected no IPv4 ipset deletes, got %v", f.deleted)
+	}
+}
+
+func TestDelPodFromIpset6Missing(t *testing.T) {
+	setFakeIpset6(t, &fakeIpset{listErr: fmt.Errorf("failed to list ipset: %w", os.ErrNotExist)})
+	if err := delPodFromIpset6(newTestPod("a", "a", "fd00::1")); err != nil {
+		t.Errorf("expected a missing IPv6 ipset to be ignored, got %v", err)
+	}
+}
+
+func TestIPv6Rules(t *testing.T) {
+	s := &Server{}
+	cpu1, cpu2 := s.cpuNodeRules("eth0", "10.0.0.2", true)
+	if rules := s.ipv6Rules(cpu1, cpu2); rules != nil {
+		t.Errorf("expected no IPv6 rules when disabled, got %v", rules)
+	}
+
+	s.enableIPv6 = true
+	rules := s.ipv6Rules(cpu1, cpu2)
+	if ruleIndex(rules, "--match-set", ipset6Name) == -1 {
+		t.Errorf("expected an IPv6 rule matching %s", ipset6Name)
+	}
+	for _, r := range rules {
+		if !r.IPv6 {
+			t.Errorf("expected an IPv6 rule, got %+v", r)
+		}
+		if hasIPv4Arg(r) || ruleIndex([]*iptablesRule{r}, ipsetName) == 0 {
+			t.Errorf("expected no IPv4 arguments, got %+v", r)
+		}
+	}
+}
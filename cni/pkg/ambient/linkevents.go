@@ -0,0 +1,212 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// linkEventDebounce is how long ReapplyOnLinkEvent collects events before repairing, so that a
+// burst, e.g. a tunnel going down along with its routes, is repaired once. It is a variable for
+// tests.
+var linkEventDebounce = 500 * time.Millisecond
+
+// tunnelLinks are the links of the node setup whose changes are repaired, of any node type.
+var tunnelLinks = []string{constants.InboundTun, constants.OutboundTun, constants.CPUTun, constants.DPUTun}
+
+// linkEventRepair is what the events collected by ReapplyOnLinkEvent call for: the tunnels to bring
+// back up, the interfaces to disable rp_filter on, and whether the rules are to be ensured.
+type linkEventRepair struct {
+	tunnels []string
+	ifaces  []string
+	ensure  bool
+}
+
+func (r *linkEventRepair) addTunnel(name string) {
+	if indexOf(r.tunnels, name) == -1 {
+		r.tunnels = append(r.tunnels, name)
+	}
+}
+
+func (r *linkEventRepair) addIface(name string) {
+	if indexOf(r.ifaces, name) == -1 {
+		r.ifaces = append(r.ifaces, name)
+	}
+}
+
+func (r *linkEventRepair) empty() bool {
+	return len(r.ifaces) == 0 && !r.ensure
+}
+
+// ReapplyOnLinkEvent subscribes to the link and route events of the node and repairs the node
+// setup as they happen, until ctx is done: a tunnel going down or deleted is brought back up or
+// recreated, a change of a tunnel or the removal of a route of the outbound or proxy table re-runs
+// EnsureRules, and rp_filter is disabled
+// on the tunnels and on the interfaces of s.rpFilterScope as they are created, which default to
+// rp_filter=1. Events are debounced by linkEventDebounce. Like the node setup it repairs, nothing
+// is done while ztunnel isn't running.
+//
+// It returns an error if the events can't be subscribed to or the subscription ends before ctx is
+// done, in which case reconcileRPFilterLoop is the fallback.
+func (s *Server) ReapplyOnLinkEvent(ctx context.Context) error {
+	done := make(chan struct{})
+	defer close(done)
+	links := make(chan netlink.LinkUpdate, 64)
+	if err := s.netlink().LinkSubscribe(links, done); err != nil {
+		return &NetlinkError{Op: "LinkSubscribe", Err: err}
+	}
+	routes := make(chan netlink.RouteUpdate, 64)
+	if err := s.netlink().RouteSubscribe(routes, done); err != nil {
+		return &NetlinkError{Op: "RouteSubscribe", Err: err}
+	}
+	match, _ := s.rpFilterScope.matcher()
+
+	// Interfaces created before the subscription are caught up with once.
+	if match != nil && s.isZTunnelRunning() {
+		s.resetRPFilters(match)
+	}
+
+	var pending linkEventRepair
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case update, ok := <-links:
+			if !ok {
+				return errors.New("link event subscription closed")
+			}
+			s.collectLinkEvent(&pending, update, match)
+		case update, ok := <-routes:
+			if !ok {
+				return errors.New("route event subscription closed")
+			}
+			if update.Type == unix.RTM_DELROUTE && (update.Table == s.routeTables.Outbound || update.Table == s.routeTables.Proxy) {
+				pending.ensure = true
+			}
+		case <-debounce:
+			debounce = nil
+			s.repairLinkEvents(ctx, pending)
+			pending = linkEventRepair{}
+			continue
+		}
+		if debounce == nil && !pending.empty() {
+			debounce = time.After(linkEventDebounce)
+		}
+	}
+}
+
+// collectLinkEvent adds to r the repair called for by a link event. Events of the tunnels call for
+// both disabling rp_filter and ensuring the rules, and for bringing the tunnel back if it went down
+// or was deleted. The creation of other interfaces within
+// match, which may be nil, for disabling rp_filter.
+func (s *Server) collectLinkEvent(r *linkEventRepair, update netlink.LinkUpdate, match func(name string) bool) {
+	if update.Link == nil {
+		return
+	}
+	name := update.Link.Attrs().Name
+	switch {
+	case indexOf(tunnelLinks, name) != -1:
+		if update.Header.Type == unix.RTM_DELLINK || update.Link.Attrs().Flags&net.FlagUp == 0 {
+			log.Infof("Tunnel %s went down, repairing it", name)
+			r.addTunnel(name)
+		}
+		r.addIface(name)
+		r.ensure = true
+	case update.Header.Type == unix.RTM_NEWLINK && match != nil && match(name):
+		r.addIface(name)
+	}
+}
+
+// repairLinkEvents brings the tunnels back, ensures the rules and then disables rp_filter, as called
+// for by r. It holds setupMu, so that it doesn't race the node setup or reinstall what a cleanup
+// is removing. Failures are only logged, as the next event or the periodic reconcile retries.
+func (s *Server) repairLinkEvents(ctx context.Context, r linkEventRepair) {
+	s.setupMu.Lock()
+	defer s.setupMu.Unlock()
+	if !s.isZTunnelRunning() {
+		return
+	}
+	if len(r.tunnels) > 0 {
+		if err := s.repairTunnels(ctx, r.tunnels); err != nil {
+			log.Warnf("Failed to repair tunnels after link event: %v", err)
+		}
+	}
+	if r.ensure {
+		if err := s.EnsureRules(ctx); err != nil {
+			log.Warnf("Failed to ensure rules after link event: %v", err)
+		}
+	}
+	if len(r.ifaces) > 0 {
+		s.resetRPFilters(func(name string) bool { return indexOf(r.ifaces, name) != -1 })
+	}
+}
+
+// repairTunnels brings the tunnels of the node setup among names back up, recreating the deleted
+// ones: the tunnels to ztunnel of a DPU node, and the WireGuard link to the offmesh pair.
+func (s *Server) repairTunnels(ctx context.Context, names []string) error {
+	nodeType := offmesh.MyNodeType(s.nodeName, s.offmeshCluster)
+	var errs error
+	if nodeType == offmesh.DPUNode {
+		s.mu.Lock()
+		var ztunnelIP string
+		if len(s.ztunnelIPs) > 0 {
+			ztunnelIP = s.ztunnelIPs[0]
+		}
+		s.mu.Unlock()
+		for _, t := range s.dpuTunnels(ztunnelIP) {
+			if indexOf(names, t.link.Name) == -1 {
+				continue
+			}
+			if err := s.ensureTunnel(ctx, t.link, t.ip); err != nil {
+				errs = multierr.Append(errs, err)
+				continue
+			}
+			s.setProcs(tunnelProcs(t.link.Name))
+		}
+		s.resetInboundTunIndex()
+	}
+	if nodeType == offmesh.CPUNode || nodeType == offmesh.DPUNode {
+		if name, _, _ := wireGuardLink(nodeType); indexOf(names, name) != -1 {
+			pair, err := s.getOffmeshPair(nodeType)
+			if err == nil {
+				err = s.ensureWireGuard(ctx, nodeType, pair.IP)
+			}
+			errs = multierr.Append(errs, err)
+		}
+	}
+	return errs
+}
+
+// resetRPFilters runs disableRPFilters on the interfaces within match, logging the outcome.
+func (s *Server) resetRPFilters(match func(name string) bool) {
+	changed, err := disableRPFilters(match)
+	if len(changed) > 0 {
+		log.Infof("Disabled rp_filter for new interfaces %v", changed)
+	}
+	if err != nil {
+		log.Warnf("Failed to disable rp_filter for new interfaces: %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+	"istio.io/istio/pkg/test/util/retry"
+)
+
+func TestReapplyOnLinkEventTunnelDown(t *testing.T) {
+	f := newFakeIptables()
+	setFakeIptables(t, f)
+	nl := setFakeNetlink(t)
+	dir := t.TempDir()
+	origDir, origDebounce := procConfDir, linkEventDebounce
+	procConfDir, linkEventDebounce = dir, 10*time.Millisecond
+	t.Cleanup(func() {
+		procConfDir, linkEventDebounce = origDir, origDebounce
+	})
+
+	s := &Server{ztunnelRunning: true, rpFilterScope: RPFilterScopeMeshOnly, routeTables: DefaultRouteTables()}
+	if err := s.initializeLists(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	appendRules, appendRules2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	if err := s.applyRulesTransactional(context.Background(), appendRules, appendRules2); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]string{}
+	for k, v := range f.rules {
+		want[k] = append([]string{}, v...)
+	}
+	// Another tool removed a rule, which is only noticed once the tunnel goes down.
+	missing := appendRules2[1]
+	if err := f.Delete(missing.Table, missing.Chain, missing.RuleSpec...); err != nil {
+		t.Fatal(err)
+	}
+	// The tunnel is recreated with rp_filter enabled.
+	rpFilter := filepath.Join(dir, constants.InboundTun, "rp_filter")
+	if err := os.MkdirAll(filepath.Dir(rpFilter), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(rpFilter, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.ReapplyOnLinkEvent(ctx)
+	}()
+	var links chan<- netlink.LinkUpdate
+	retry.UntilSuccessOrFail(t, func() error {
+		if links = nl.subscribed(); links == nil {
+			return errors.New("not subscribed to link events")
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+
+	tun := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 10}}
+	links <- netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: tun}
+	links <- netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: tun}
+
+	// The rules are ensured before rp_filter is disabled.
+	retry.UntilSuccessOrFail(t, func() error {
+		if got, err := GetProc(rpFilter); err != nil || got != "0" {
+			return fmt.Errorf("expected rp_filter to be disabled, got %q: %v", got, err)
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+	cancel()
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(f.rules, want) {
+		t.Errorf("expected the rules to be restored:\n%v\ngot:\n%v", want, f.rules)
+	}
+}
+
+func TestCollectLinkEvent(t *testing.T) {
+	all, _ := RPFilterScopeAll.matcher()
+	veth := &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 11}}
+	tun := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.OutboundTun, Index: 10, Flags: net.FlagUp}}
+	cases := []struct {
+		name     string
+		update   netlink.LinkUpdate
+		match    func(string) bool
+		expected linkEventRepair
+	}{
+		{
+			name:     "new veth",
+			update:   netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: veth},
+			match:    all,
+			expected: linkEventRepair{ifaces: []string{"veth1"}},
+		},
+		{
+			name:   "new veth out of scope",
+			update: netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: veth},
+		},
+		{
+			name:   "deleted veth",
+			update: netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: veth},
+			match:  all,
+		},
+		{
+			name:     "tunnel up",
+			update:   netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: tun},
+			expected: linkEventRepair{ifaces: []string{constants.OutboundTun}, ensure: true},
+		},
+		{
+			name:   "tunnel down",
+			update: netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_NEWLINK}, Link: &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.OutboundTun}}},
+			expected: linkEventRepair{
+				tunnels: []string{constants.OutboundTun},
+				ifaces:  []string{constants.OutboundTun},
+				ensure:  true,
+			},
+		},
+		{
+			name:   "tunnel deleted",
+			update: netlink.LinkUpdate{Header: unix.NlMsghdr{Type: unix.RTM_DELLINK}, Link: tun},
+			expected: linkEventRepair{
+				tunnels: []string{constants.OutboundTun},
+				ifaces:  []string{constants.OutboundTun},
+				ensure:  true,
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var r linkEventRepair
+			(&Server{}).collectLinkEvent(&r, tc.update, tc.match)
+			if !reflect.DeepEqual(r, tc.expected) {
+				t.Errorf("expected %+v, got %+v", tc.expected, r)
+			}
+		})
+	}
+}
+
+func TestRepairLinkEventsTunnelDeleted(t *testing.T) {
+	origDir := procConfDir
+	procConfDir = t.TempDir()
+	t.Cleanup(func() {
+		procConfDir = origDir
+	})
+	cluster := offmesh.ClusterConfig{
+		Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+	}
+
+	for _, running := range []bool{true, false} {
+		t.Run(fmt.Sprintf("running %v", running), func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			s := &Server{
+				nodeName:       "dpu1",
+				offmeshCluster: cluster,
+				ztunnelRunning: running,
+				ztunnelIPs:     []string{"10.0.0.2"},
+				tunnelMTU:      1400,
+				routeTables:    DefaultRouteTables(),
+			}
+			s.repairLinkEvents(context.Background(), linkEventRepair{tunnels: []string{constants.InboundTun}})
+
+			_, recreated := nl.links[constants.InboundTun]
+			if recreated != running || nl.up != running {
+				t.Errorf("expected the tunnel to be recreated and up %v, got %v and %v", running, recreated, nl.up)
+			}
+			if _, ok := nl.links[constants.OutboundTun]; ok {
+				t.Errorf("expected only the deleted tunnel to be recreated")
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// defaultMarkBase is the mark base giving the marks of the constants package.
+const defaultMarkBase = 0x10
+
+// markBits is the number of mark bits used, starting at the base.
+const markBits = 6
+
+// Marks are the packet and conn marks used to steer traffic to and from ztunnel. They are derived
+// from a base bit, so that they can be moved as a block away from the marks of other dataplanes.
+type Marks struct {
+	// Base is the lowest bit of the marks.
+	Base uint32
+	// Outbound marks outbound traffic of mesh pods, routed to ztunnel.
+	Outbound uint32
+	// Skip marks traffic which bypasses ztunnel.
+	Skip uint32
+	// ConnSkip marks connections which bypass ztunnel. It includes Skip.
+	ConnSkip uint32
+	// Proxy marks connections of ztunnel. It includes Skip.
+	Proxy uint32
+	// ProxyRet marks traffic returning to ztunnel.
+	ProxyRet uint32
+}
+
+// DefaultMarks returns the marks used when no base is configured, which are those of the constants
+// package.
+func DefaultMarks() Marks {
+	m, _ := MarksFromBase(defaultMarkBase)
+	return m
+}
+
+// MarksFromBase derives the marks from base, a single bit. The marks use the bits from base up to
+// base<<5.
+func MarksFromBase(base uint32) (Marks, error) {
+	if bits.OnesCount32(base) != 1 {
+		return Marks{}, fmt.Errorf("mark base 0x%x must be a single bit", base)
+	}
+	if bits.TrailingZeros32(base)+markBits > 32 {
+		return Marks{}, fmt.Errorf("mark base 0x%x is too high, the marks use %d bits from it", base, markBits)
+	}
+	skip := base << 5
+	return Marks{
+		Base:     base,
+		Outbound: base << 4,
+		Skip:     skip,
+		ConnSkip: skip | base<<1,
+		Proxy:    skip | base,
+		ProxyRet: base << 2,
+	}, nil
+}
+
+// footprint returns the bits the marks may set or match.
+func (m Marks) footprint() uint32 {
+	return m.Outbound | m.Skip | m.ConnSkip | m.Proxy | m.ProxyRet
+}
+
+// knownMarks are the mark bits used by other dataplanes, keyed by name.
+var knownMarks = map[string]uint32{
+	// kube-proxy marks packets to masquerade with 0x4000 and packets to drop with 0x8000.
+	"kube-proxy": 0xc000,
+	// Cilium uses 0x0f00 for its magic marks, and the upper 16 bits for security identities.
+	"cilium": 0xffff0f00,
+	// Calico's default mark mask.
+	"calico": 0xffff0000,
+}
+
+// detectDataplanes returns the dataplanes of knownMarks found on the node, from the links they
+// create. kube-proxy is assumed to be present.
+func (s *Server) detectDataplanes() ([]string, error) {
+	links, err := s.netlink().LinkList()
+	if err != nil {
+		return nil, &NetlinkError{Op: "LinkList", Err: err}
+	}
+	found := []string{"kube-proxy"}
+	var cilium, calico bool
+	for _, link := range links {
+		name := link.Attrs().Name
+		cilium = cilium || strings.HasPrefix(name, "cilium_")
+		calico = calico || strings.HasPrefix(name, "cali") || name == "vxlan.calico"
+	}
+	if cilium {
+		found = append(found, "cilium")
+	}
+	if calico {
+		found = append(found, "calico")
+	}
+	return found, nil
+}
+
+// validateMarks checks that the marks of s don't overlap the marks of the other dataplanes found
+// on the node.
+func (s *Server) validateMarks() error {
+	dataplanes, err := s.detectDataplanes()
+	if err != nil {
+		return err
+	}
+	for _, dataplane := range dataplanes {
+		if overlap := s.marks.footprint() & knownMarks[dataplane]; overlap != 0 {
+			return fmt.Errorf("marks 0x%x overlap the marks of %s in 0x%x, set AMBIENT_MARK_BASE to move them",
+				s.marks.footprint(), dataplane, overlap)
+		}
+	}
+	return nil
+}
+
+// markArgs are the marks formatted as rule arguments: value/mask for the marks, and the bare value
+// for the masks. The width matches the constants package.
+type markArgs struct {
+	OutboundMark string
+	SkipMark     string
+	ConnSkipMark string
+	ConnSkipMask string
+	ProxyMark    string
+	ProxyMask    string
+	ProxyRetMark string
+}
+
+// markArgs returns the marks of s as rule arguments. A Server without marks uses DefaultMarks.
+func (s *Server) markArgs() markArgs {
+	m := s.marks
+	if m == (Marks{}) {
+		m = DefaultMarks()
+	}
+	mask := func(v uint32) string {
+		return fmt.Sprintf("0x%03x", v)
+	}
+	mark := func(v uint32) string {
+		return mask(v) + "/" + mask(v)
+	}
+	return markArgs{
+		OutboundMark: mark(m.Outbound),
+		SkipMark:     mark(m.Skip),
+		ConnSkipMark: mark(m.ConnSkip),
+		ConnSkipMask: mask(m.ConnSkip),
+		ProxyMark:    mark(m.Proxy),
+		ProxyMask:    mask(m.Proxy),
+		ProxyRetMark: mark(m.ProxyRet),
+	}
+}
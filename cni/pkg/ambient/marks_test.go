@@ -0,0 +1,162 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+func TestMarksFromBase(t *testing.T) {
+	cases := []struct {
+		name      string
+		base      uint32
+		expectErr bool
+	}{
+		{name: "default", base: defaultMarkBase},
+		{name: "lowest", base: 0x1},
+		{name: "highest", base: 1 << 26},
+		{name: "zero", base: 0, expectErr: true},
+		{name: "several bits", base: 0x30, expectErr: true},
+		{name: "too high", base: 1 << 27, expectErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			m, err := MarksFromBase(tc.base)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if tc.expectErr {
+				return
+			}
+			if m.ConnSkip&m.Skip != m.Skip || m.Proxy&m.Skip != m.Skip {
+				t.Errorf("expected the conn skip and proxy marks to include the skip mark, got %+v", m)
+			}
+			if m.Outbound&m.Skip != 0 || m.Outbound&m.ProxyRet != 0 || m.Skip&m.ProxyRet != 0 || m.ConnSkip == m.Proxy {
+				t.Errorf("expected distinct marks, got %+v", m)
+			}
+			if m.footprint() != tc.base*0x37 {
+				t.Errorf("expected the marks to stay within 6 bits of the base, got footprint 0x%x", m.footprint())
+			}
+		})
+	}
+}
+
+func TestDefaultMarkArgs(t *testing.T) {
+	expected := markArgs{
+		OutboundMark: constants.OutboundMark,
+		SkipMark:     constants.SkipMark,
+		ConnSkipMark: constants.ConnSkipMark,
+		ConnSkipMask: constants.ConnSkipMask,
+		ProxyMark:    constants.ProxyMark,
+		ProxyMask:    constants.ProxyMask,
+		ProxyRetMark: constants.ProxyRetMark,
+	}
+	for name, s := range map[string]*Server{
+		"unset":   {},
+		"default": {marks: DefaultMarks()},
+	} {
+		if got := s.markArgs(); got != expected {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, got)
+		}
+	}
+}
+
+func TestCustomMarks(t *testing.T) {
+	marks, err := MarksFromBase(0x1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		marks:                marks,
+		routeTables:          DefaultRouteTables(),
+		excludeInboundPorts:  []uint16{5000},
+		excludeOutboundPorts: []uint16{6000},
+		excludeOwnerUIDs:     []uint32{0},
+	}
+	defaults := map[string]bool{
+		constants.OutboundMark: true,
+		constants.SkipMark:     true,
+		constants.ConnSkipMark: true,
+		constants.ConnSkipMask: true,
+		constants.ProxyMark:    true,
+		constants.ProxyMask:    true,
+		constants.ProxyRetMark: true,
+	}
+
+	cpu1, cpu2 := s.cpuNodeRules("eth0", "10.0.0.2", true)
+	dpu1, dpu2 := s.dpuNodeRules("veth0", "10.0.0.2", true)
+	for name, rules := range map[string][]*iptablesRule{
+		"cpu": append(cpu1, cpu2...),
+		"dpu": append(dpu1, dpu2...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			if ruleIndex(rules, "--set-mark", "0x010/0x010") == -1 {
+				t.Errorf("no rule sets the outbound mark of base 0x1")
+			}
+			for _, rule := range rules {
+				for _, arg := range rule.RuleSpec {
+					if defaults[arg] {
+						t.Errorf("rule %v uses the default mark %s", rule.RuleSpec, arg)
+					}
+				}
+			}
+		})
+	}
+
+	for _, rule := range s.ipRules(offmesh.DPUNode) {
+		if rule.Mask != -1 && uint32(rule.Mask)&^marks.footprint() != 0 {
+			t.Errorf("ip rule %v matches marks outside 0x%x", rule, marks.footprint())
+		}
+	}
+}
+
+func TestValidateMarks(t *testing.T) {
+	cases := []struct {
+		name      string
+		links     []string
+		base      uint32
+		expectErr bool
+	}{
+		{name: "no other dataplane", links: []string{"eth0"}, base: defaultMarkBase},
+		{name: "cilium", links: []string{"eth0", "cilium_host"}, base: defaultMarkBase, expectErr: true},
+		{name: "cilium with moved marks", links: []string{"eth0", "cilium_host"}, base: 0x1},
+		{name: "calico", links: []string{"cali1234", "vxlan.calico"}, base: defaultMarkBase},
+		{name: "calico collision", links: []string{"cali1234"}, base: 0x10000, expectErr: true},
+		{name: "kube-proxy collision", links: []string{"eth0"}, base: 0x200, expectErr: true},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			for _, name := range tc.links {
+				nl.links[name] = &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: name}}
+			}
+			marks, err := MarksFromBase(tc.base)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s := &Server{marks: marks}
+			if err := s.validateMarks(); (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// MeshMember is a pod IP in the ipset or the inbound route table. A consistent member is in both;
+// otherwise the ipset and routes disagree, e.g. after a crash between the two updates.
+type MeshMember struct {
+	IP string `json:"ip"`
+	// UID is the UID of the pod, from the ipset entry comment.
+	UID        string `json:"uid,omitempty"`
+	InIpset    bool   `json:"inIpset"`
+	HasRoute   bool   `json:"hasRoute"`
+	Consistent bool   `json:"consistent"`
+}
+
+// ListMeshMembers returns the pod IPs in the ipsets or the inbound route table, sorted by IP.
+func (s *Server) ListMeshMembers() ([]MeshMember, error) {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+
+	var entries []netlink.IPSetEntry
+	for _, set := range allIpsets() {
+		setEntries, err := set.List()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w: %v", ErrIpsetMissing, err)
+			}
+			return nil, &NetlinkError{Op: "IpsetList", Err: err}
+		}
+		entries = append(entries, setEntries...)
+	}
+	routes, err := s.netlink().RouteListFiltered(
+		netlink.FAMILY_V4,
+		&netlink.Route{Table: s.routeTables.Inbound},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, &NetlinkError{Op: "RouteList", Err: err}
+	}
+	return meshMembers(entries, routes), nil
+}
+
+// IsIPCaptured reports whether the traffic of the pod IP ip is captured, that is whether ip is in an
+// ipset and has an inbound route. If only one of them is set up, an error wrapping
+// ErrCaptureInconsistent says which.
+func (s *Server) IsIPCaptured(ip string) (bool, error) {
+	podIP, err := parsePodIP(ip)
+	if err != nil {
+		return false, err
+	}
+
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	var entries []netlink.IPSetEntry
+	for _, set := range allIpsets() {
+		setEntries, err := set.List()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return false, fmt.Errorf("%w: %v", ErrIpsetMissing, err)
+			}
+			return false, &NetlinkError{Op: "IpsetList", Err: err}
+		}
+		for _, entry := range setEntries {
+			if entry.IP.Equal(podIP) {
+				entries = append(entries, entry)
+			}
+		}
+	}
+	routes, err := s.netlink().RouteListFiltered(
+		netlink.FAMILY_V4,
+		&netlink.Route{Table: s.routeTables.Inbound, Dst: &net.IPNet{IP: podIP, Mask: net.CIDRMask(32, 32)}},
+		netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
+	if err != nil {
+		return false, &NetlinkError{Op: "RouteList", Err: err}
+	}
+
+	members := meshMembers(entries, routes)
+	if len(members) == 0 {
+		return false, nil
+	}
+	m := members[0]
+	switch {
+	case m.Consistent:
+		return true, nil
+	case m.InIpset:
+		return false, fmt.Errorf("%w: %s is in the ipset (%s) without an inbound route", ErrCaptureInconsistent, ip, m.UID)
+	default:
+		return false, fmt.Errorf("%w: %s has an inbound route but is not in the ipset", ErrCaptureInconsistent, ip)
+	}
+}
+
+// meshMembers matches the ipset entries with the pod routes, which go via the inbound tunnel.
+func meshMembers(entries []netlink.IPSetEntry, routes []netlink.Route) []MeshMember {
+	members := map[string]*MeshMember{}
+	member := func(ip string) *MeshMember {
+		m, ok := members[ip]
+		if !ok {
+			m = &MeshMember{IP: ip}
+			members[ip] = m
+		}
+		return m
+	}
+	for _, entry := range entries {
+		m := member(entry.IP.String())
+		m.InIpset = true
+		m.UID = commentUID(entry.Comment)
+	}
+	for _, r := range routes {
+		if r.Dst == nil || r.Gw == nil || r.Gw.String() != constants.ZTunnelInboundTunIP {
+			continue
+		}
+		member(r.Dst.IP.String()).HasRoute = true
+	}
+
+	res := make([]MeshMember, 0, len(members))
+	for _, m := range members {
+		m.Consistent = m.InIpset && m.HasRoute
+		res = append(res, *m)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		a, _ := netip.ParseAddr(res[i].IP)
+		b, _ := netip.ParseAddr(res[j].IP)
+		return a.Less(b)
+	})
+	return res
+}
@@ -0,0 +1,126 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+func TestMeshMembers(t *testing.T) {
+	podRoute := func(ip string) netlink.Route {
+		return netlink.Route{
+			Dst: &net.IPNet{IP: net.ParseIP(ip).To4(), Mask: net.CIDRMask(32, 32)},
+			Gw:  net.ParseIP(constants.ZTunnelInboundTunIP),
+		}
+	}
+	entries := []netlink.IPSetEntry{
+		{IP: net.ParseIP("10.0.0.10").To4(), Comment: "uid-a"},
+		{IP: net.ParseIP("10.0.0.2").To4(), Comment: "uid-b"},
+	}
+	routes := []netlink.Route{
+		podRoute("10.0.0.10"),
+		podRoute("10.0.0.3"),
+		// Not a pod route, as it doesn't go via the tunnel.
+		{Dst: &net.IPNet{IP: net.ParseIP("10.0.0.4").To4(), Mask: net.CIDRMask(32, 32)}},
+	}
+
+	expected := []MeshMember{
+		{IP: "10.0.0.2", UID: "uid-b", InIpset: true},
+		{IP: "10.0.0.3", HasRoute: true},
+		{IP: "10.0.0.10", UID: "uid-a", InIpset: true, HasRoute: true, Consistent: true},
+	}
+	if got := meshMembers(entries, routes); !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %+v, got %+v", expected, got)
+	}
+}
+
+func TestIsIPCaptured(t *testing.T) {
+	cases := []struct {
+		name      string
+		inIpset   bool
+		hasRoute  bool
+		expected  bool
+		expectErr error
+	}{
+		{
+			name:     "consistent present",
+			inIpset:  true,
+			hasRoute: true,
+			expected: true,
+		},
+		{
+			name: "consistent absent",
+		},
+		{
+			name:      "ipset only",
+			inIpset:   true,
+			expectErr: ErrCaptureInconsistent,
+		},
+		{
+			name:      "route only",
+			hasRoute:  true,
+			expectErr: ErrCaptureInconsistent,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// Another pod is captured in every case.
+			f := &fakeIpset{entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.244.2.8").To4(), Comment: "default/b/uid-b"}}}
+			setFakeIpset(t, f)
+			nl := setFakeNetlink(t)
+			s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables()}
+			ips := []string{"10.244.2.8"}
+			if tc.inIpset {
+				f.entries = append(f.entries, netlink.IPSetEntry{IP: net.ParseIP("10.244.2.7").To4(), Comment: "default/a/uid-a"})
+			}
+			if tc.hasRoute {
+				ips = append(ips, "10.244.2.7")
+			}
+			for _, ip := range ips {
+				rte, err := podRoute(ip, s.hostIP, s.routeTables.Inbound, 7)
+				if err != nil {
+					t.Fatal(err)
+				}
+				nl.routes = append(nl.routes, *rte)
+			}
+
+			got, err := s.IsIPCaptured("10.244.2.7")
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Fatalf("expected %v, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	if _, err := (&Server{}).IsIPCaptured("10.244.2"); !errors.Is(err, ErrInvalidPodIP) {
+		t.Errorf("expected ErrInvalidPodIP, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"strings"
+	"time"
+
+	"istio.io/pkg/monitoring"
+)
+
+var (
+	operationLabel = monitoring.MustCreateLabel("operation")
+	addOperation   = "add"
+	delOperation   = "delete"
+
+	resultLabel   = monitoring.MustCreateLabel("result")
+	resultSuccess = "success"
+	resultFail    = "fail"
+
+	// Operations on the dataplane that can fail, for dataplaneErrors.
+	ipsetOperation    = "ipset"
+	routeOperation    = "route"
+	procOperation     = "proc"
+	iptablesOperation = "iptables"
+	linkOperation     = "link"
+
+	// phaseLabel is the phase of node setup, one of the dataplane operations.
+	phaseLabel = monitoring.MustCreateLabel("phase")
+
+	meshMembers = monitoring.NewGauge(
+		"istio_cni_ambient_mesh_members",
+		"Number of pod IPs in the ambient mesh ipset",
+	)
+
+	meshOperations = monitoring.NewSum(
+		"istio_cni_ambient_mesh_operations_total",
+		"Total number of pods added to or removed from the ambient mesh",
+		monitoring.WithLabels(operationLabel, resultLabel),
+	)
+
+	dataplaneErrors = monitoring.NewSum(
+		"istio_cni_ambient_dataplane_errors_total",
+		"Total number of failed ipset, route, proc, iptables and link operations",
+		monitoring.WithLabels(operationLabel),
+	)
+
+	setupPhaseDuration = monitoring.NewDistribution(
+		"istio_cni_ambient_setup_phase_duration_seconds",
+		"Duration of the ipset, iptables, link, proc and route phases of node setup",
+		[]float64{.001, .01, .1, .5, 1, 5, 10, 30},
+		monitoring.WithLabels(phaseLabel),
+	)
+)
+
+func init() {
+	monitoring.MustRegister(meshMembers)
+	monitoring.MustRegister(meshOperations)
+	monitoring.MustRegister(dataplaneErrors)
+	monitoring.MustRegister(setupPhaseDuration)
+}
+
+// phaseTimer times the consecutive phases of a node setup into setupPhaseDuration.
+type phaseTimer struct {
+	last      time.Time
+	breakdown []string
+}
+
+func newPhaseTimer() *phaseTimer {
+	return &phaseTimer{last: time.Now()}
+}
+
+// done records the time since the previous phase ended, or since the timer was created, as the
+// duration of phase.
+func (t *phaseTimer) done(phase string) {
+	now := time.Now()
+	d := now.Sub(t.last)
+	t.last = now
+	setupPhaseDuration.With(phaseLabel.Value(phase)).Record(d.Seconds())
+	t.breakdown = append(t.breakdown, phase+"="+d.String())
+}
+
+// String returns the durations of the phases done, like "ipset=1ms iptables=20ms".
+func (t *phaseTimer) String() string {
+	return strings.Join(t.breakdown, " ")
+}
+
+// recordMeshOperation records the result of adding a pod to, or removing it from, the mesh.
+func recordMeshOperation(operation string, failed bool) {
+	result := resultSuccess
+	if failed {
+		result = resultFail
+	}
+	meshOperations.With(operationLabel.Value(operation), resultLabel.Value(result)).Increment()
+}
+
+func recordDataplaneError(operation string) {
+	dataplaneErrors.With(operationLabel.Value(operation)).Increment()
+}
+
+// recordMeshMembers updates the mesh member gauge from the ipsets.
+func recordMeshMembers() {
+	members := 0
+	for _, set := range allIpsets() {
+		entries, err := set.List()
+		if err != nil {
+			log.Debugf("Failed to list ipset for metrics: %v", err)
+			return
+		}
+		members += len(entries)
+	}
+	meshMembers.Record(float64(members))
+}
@@ -0,0 +1,146 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+
+	"istio.io/istio/pkg/offmesh"
+	"istio.io/istio/pkg/test/util/retry"
+	"istio.io/pkg/monitoring"
+)
+
+type testExporter struct {
+	sync.Mutex
+
+	rows map[string][]*view.Row
+}
+
+func (t *testExporter) ExportView(d *view.Data) {
+	t.Lock()
+	t.rows[d.View.Name] = d.Rows
+	t.Unlock()
+}
+
+// sum returns the value of a sum metric with the given labels, or 0 if it wasn't recorded.
+func (t *testExporter) sum(metric monitoring.Metric, tags ...tag.Tag) float64 {
+	t.Lock()
+	defer t.Unlock()
+	for _, r := range t.rows[metric.Name()] {
+		if !reflect.DeepEqual(r.Tags, tags) {
+			continue
+		}
+		if sd, ok := r.Data.(*view.SumData); ok {
+			return sd.Value
+		}
+	}
+	return 0
+}
+
+// count returns the number of observations of a distribution metric with the given labels, or 0
+// if it wasn't recorded.
+func (t *testExporter) count(metric monitoring.Metric, tags ...tag.Tag) int64 {
+	t.Lock()
+	defer t.Unlock()
+	for _, r := range t.rows[metric.Name()] {
+		if !reflect.DeepEqual(r.Tags, tags) {
+			continue
+		}
+		if dd, ok := r.Data.(*view.DistributionData); ok {
+			return dd.Count
+		}
+	}
+	return 0
+}
+
+func TestDelPodFromMeshMetrics(t *testing.T) {
+	exp := &testExporter{rows: map[string][]*view.Row{}}
+	view.RegisterExporter(exp)
+	view.SetReportingPeriod(time.Millisecond)
+	t.Cleanup(func() {
+		view.UnregisterExporter(exp)
+	})
+
+	setFakeIpset(t, &fakeIpset{listErr: errors.New("netlink failure")})
+	DelPodFromMesh(newTestPod("pod1", "1", "10.0.0.1"), testHostIP)
+
+	// Tags are sorted by key.
+	failTags := []tag.Tag{
+		{Key: tag.Key(operationLabel), Value: delOperation},
+		{Key: tag.Key(resultLabel), Value: resultFail},
+	}
+	ipsetTags := []tag.Tag{{Key: tag.Key(operationLabel), Value: ipsetOperation}}
+	retry.UntilSuccessOrFail(t, func() error {
+		if got := exp.sum(meshOperations, failTags...); got < 1 {
+			return fmt.Errorf("expected a failed delete, got %v", got)
+		}
+		if got := exp.sum(dataplaneErrors, ipsetTags...); got < 1 {
+			return fmt.Errorf("expected an ipset error, got %v", got)
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+}
+
+func TestCreateRulesOnDPUNodePhaseMetrics(t *testing.T) {
+	exp := &testExporter{rows: map[string][]*view.Row{}}
+	view.RegisterExporter(exp)
+	view.SetReportingPeriod(time.Millisecond)
+	t.Cleanup(func() {
+		view.UnregisterExporter(exp)
+	})
+
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	origCmd := IptablesCmd
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+	})
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        &fakeExecutor{},
+	}
+	if err := s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false); err != nil {
+		t.Fatal(err)
+	}
+
+	phases := []string{ipsetOperation, iptablesOperation, linkOperation, procOperation, routeOperation}
+	retry.UntilSuccessOrFail(t, func() error {
+		for _, phase := range phases {
+			if got := exp.count(setupPhaseDuration, tag.Tag{Key: tag.Key(phaseLabel), Value: phase}); got < 1 {
+				return fmt.Errorf("expected an observation of phase %s, got %d", phase, got)
+			}
+		}
+		return nil
+	}, retry.Timeout(time.Second))
+}
@@ -21,566 +21,1740 @@ import (
 	"net"
 	"net/netip"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/containernetworking/plugins/pkg/ns"
 	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	"golang.org/x/sync/errgroup"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 
 	"istio.io/istio/cni/pkg/ambient/constants"
 	"istio.io/istio/pkg/offmesh"
+	"istio.io/istio/pkg/util/sets"
 	istiolog "istio.io/pkg/log"
 )
 
 var log = istiolog.RegisterScope("ambient", "ambient controller", 0)
 
-func IsPodInIpset(pod *corev1.Pod) bool {
-	ipset, err := Ipset.List()
+// podLog returns log labeled with the pod, namespace, uid and ip of a mesh change of pod, so that
+// log pipelines can filter the messages of a pod. If ip is empty, the pod IP is used.
+func podLog(pod *corev1.Pod, ip string) *istiolog.Scope {
+	if ip == "" {
+		ip = pod.Status.PodIP
+	}
+	return log.WithLabels("pod", pod.Name, "namespace", pod.Namespace, "uid", string(pod.UID), "ip", ip)
+}
+
+// maxIpsetComment is the longest ipset entry comment. ipset allows 255 bytes, but nftables set
+// element comments only 128.
+const maxIpsetComment = 128
+
+// ipsetComment returns the comment of the ipset entries of the pod, namespace/name/uid, which makes
+// the entries recognizable when listing the ipset. The name is truncated if needed to fit, but the
+// UID never is, as entries are matched on it.
+func ipsetComment(pod *corev1.Pod) string {
+	name := pod.Name
+	if over := len(pod.Namespace) + len(name) + len(pod.UID) + 2 - maxIpsetComment; over > 0 {
+		if over > len(name) {
+			return string(pod.UID)
+		}
+		name = name[:len(name)-over]
+	}
+	return pod.Namespace + "/" + name + "/" + string(pod.UID)
+}
+
+// commentUID returns the pod UID of an ipset entry comment. Comments are namespace/name/uid, or
+// just the UID for entries added by older versions.
+func commentUID(comment string) string {
+	return comment[strings.LastIndex(comment, "/")+1:]
+}
+
+// IsPodInIpset reports whether the pod is a member of the ipset of its namespace. An error is
+// returned if the ipset could not be listed, in which case membership is unknown.
+func IsPodInIpset(pod *corev1.Pod) (bool, error) {
+	return podInIpset(pod, false)
+}
+
+// isPodInIpset is IsPodInIpset, except that if the ipset stores comments, the entries are only
+// matched by the UID in their comment. The entry of another pod which got a recycled IP of the pod
+// is then not taken for the pod's.
+func (s *Server) isPodInIpset(pod *corev1.Pod) (bool, error) {
+	s.mu.Lock()
+	uidOnly := s.ipsetComments
+	s.mu.Unlock()
+	return podInIpset(pod, uidOnly)
+}
+
+// podInIpset reports whether the pod is a member of the ipset of its namespace. Entries are matched
+// by the UID in their comment, and unless uidOnly, by IP too. Entries without a comment, e.g. added
+// by an older version, are always matched by IP. Host network pods are never members.
+func podInIpset(pod *corev1.Pod, uidOnly bool) (bool, error) {
+	// The IP of a host network pod is the host IP, which is never a member.
+	if hostNetworkPod(pod) {
+		return false, nil
+	}
+	ipset, err := ipsetFor(pod.Namespace).List()
 	if err != nil {
-		log.Errorf("Failed to list ipset entries: %v", err)
-		return false
+		if errors.Is(err, os.ErrNotExist) {
+			return false, fmt.Errorf("%w: %v", ErrIpsetMissing, err)
+		}
+		return false, &NetlinkError{Op: "IpsetList", Err: err}
 	}
 
 	// Since not all kernels support comments in ipset, we should also try and
 	// match against the IP
 	for _, ip := range ipset {
-		if ip.Comment == string(pod.UID) {
-			return true
+		if commentUID(ip.Comment) == string(pod.UID) {
+			return true, nil
 		}
-		if ip.IP.String() == pod.Status.PodIP {
-			return true
+		if (!uidOnly || ip.Comment == "") && ip.IP.String() == pod.Status.PodIP {
+			return true, nil
 		}
 	}
 
-	return false
+	return false, nil
 }
 
-func RouteExists(rte []string) bool {
-	output, err := executeOutput(
-		"bash", "-c",
-		fmt.Sprintf("ip route show %s | wc -l", strings.Join(rte, " ")),
-	)
+// ipsetEntryIP returns the IP of the entry of the pod, matched by UID, in the ipset of its namespace,
+// or nil if there is none.
+func ipsetEntryIP(pod *corev1.Pod) (net.IP, error) {
+	entries, err := ipsetFor(pod.Namespace).List()
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("%w: %v", ErrIpsetMissing, err)
+		}
+		return nil, &NetlinkError{Op: "IpsetList", Err: err}
+	}
+	for _, entry := range entries {
+		if entry.Comment != "" && commentUID(entry.Comment) == string(pod.UID) {
+			return entry.IP.To4(), nil
+		}
+	}
+	return nil, nil
+}
+
+// RouteExists reports whether a route with the destination, gateway and table of rte exists. The
+// device is only compared if rte has a link index.
+func RouteExists(rte *netlink.Route) bool {
+	if rte == nil || rte.Dst == nil {
+		return false
+	}
+	routes, err := defaultNetlink.RouteListFiltered(netlink.FAMILY_V4, rte, netlink.RT_FILTER_TABLE|netlink.RT_FILTER_DST)
 	if err != nil {
+		log.Debugf("Failed to list routes to %s: %v", rte.Dst, err)
 		return false
 	}
+	for _, r := range routes {
+		if !r.Gw.Equal(rte.Gw) {
+			continue
+		}
+		if rte.LinkIndex != 0 && r.LinkIndex != rte.LinkIndex {
+			continue
+		}
+		return true
+	}
+	return false
+}
 
-	log.Debugf("RouteExists(%s): %s", strings.Join(rte, " "), output)
+// AddPodToMesh adds the pod to the ipset, and routes ip from hostIP through the default inbound
+// route table. If ip is empty, the pod IP is used. ErrInvalidPodIP is returned if the IP is malformed or outside
+// the CIDRs set by UsePodCIDRs. If netns, the path of the pod network namespace provided by
+// the CNI runtime, is set, rp_filter is disabled on the pod device in it, rather than on the host
+// device routing to the pod.
+//
+// An entry of the pod with another IP, left if the pod IP changed, is replaced along with its route.
+// An error is returned if the pod couldn't be added to the ipset or its route couldn't be added,
+// as either breaks the redirection of its traffic. Disabling rp_filter is best effort, and only
+// logged on failure.
+func AddPodToMesh(pod *corev1.Pod, ip, hostIP, netns string) error {
+	return AddPodToMeshInTable(pod, ip, hostIP, netns, constants.RouteTableInbound)
+}
 
-	return output == "1"
+// AddPodToMeshInTable is AddPodToMesh with the pod routed through the inbound route table table,
+// e.g. the table of the controller read by the CNI plugin from AmbientConfigFile.
+func AddPodToMeshInTable(pod *corev1.Pod, ip, hostIP, netns string, table int) error {
+	if hostIP == "" {
+		return fmt.Errorf("failed to add pod %s to mesh: %w", pod.Name, ErrHostIPNotFound)
+	}
+	return addPodToMeshInTable(pod, ip, hostIP, netns, table, 0)
 }
 
-func AddPodToMesh(pod *corev1.Pod, ip string) {
+// addPodToMeshInTable adds the pod to the mesh, routing it from hostIP through the inbound tunnel
+// link with index tunIndex. If tunIndex is 0, the link is looked up by name. netns and the
+// returned error are as for AddPodToMesh.
+func addPodToMeshInTable(pod *corev1.Pod, ip, hostIP, netns string, table, tunIndex int) (errs error) {
+	plog := podLog(pod, ip).WithLabels("table", table)
+	if hostNetworkPod(pod) {
+		plog.Infof("Skipping pod '%s/%s' (%s), which uses the host network", pod.Namespace, pod.Name, string(pod.UID))
+		return nil
+	}
+	defer func() {
+		recordMeshOperation(addOperation, errs != nil)
+		recordMeshMembers()
+	}()
+
 	if ip == "" {
 		ip = pod.Status.PodIP
 	}
+	addr, err := normalizePodIP(ip)
+	if err != nil {
+		plog.Errorf("Not adding pod '%s/%s' (%s) to the mesh: %v", pod.Namespace, pod.Name, string(pod.UID), err)
+		return fmt.Errorf("failed to add pod %s to mesh: %w", pod.Name, err)
+	}
+	ip = addr.String()
+	if addr.Is6() {
+		if err := addPodToIpset6(pod, ip); err != nil {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("failed to add pod %s to IPv6 ipset: %v", pod.Name, err)
+		}
+		return nil
+	}
+	podIP := net.IP(addr.AsSlice())
+
+	// The entry of a pod is matched by UID, so an entry with an old IP would hide the new one.
+	if err := removeStalePodIPs(pod, podIP, hostIP, table); err != nil {
+		errs = multierr.Append(errs, err)
+	}
 
-	if !IsPodInIpset(pod) {
-		log.Infof("Adding pod '%s/%s' (%s) to ipset", pod.Name, pod.Namespace, string(pod.UID))
-		err := Ipset.AddIP(net.ParseIP(ip).To4(), string(pod.UID))
+	inIpset, err := podInIpset(pod, uidOnly)
+	if err != nil {
+		// Membership is unknown, so don't blindly re-add the pod.
+		recordDataplaneError(ipsetOperation)
+		errs = multierr.Append(errs, fmt.Errorf("failed to check ipset membership of pod %s: %w", pod.Name, err))
+	} else if !inIpset {
+		plog.Infof("Adding pod '%s/%s' (%s) to ipset", pod.Name, pod.Namespace, string(pod.UID))
+		err := ipsetFor(pod.Namespace).AddIP(podIP, ipsetComment(pod))
 		if err != nil {
-			log.Errorf("Failed to add pod %s to ipset list: %v", pod.Name, err)
+			recordDataplaneError(ipsetOperation)
+			err = &NetlinkError{Op: "IpsetAdd", Err: err}
+			logIpsetFull(pod, err)
+			errs = multierr.Append(errs, fmt.Errorf("failed to add pod %s to ipset list: %w", pod.Name, err))
 		}
 	} else {
-		log.Infof("Pod '%s/%s' (%s) is in ipset", pod.Name, pod.Namespace, string(pod.UID))
+		plog.Infof("Pod '%s/%s' (%s) is in ipset", pod.Name, pod.Namespace, string(pod.UID))
 	}
 
-	rte, err := buildRouteFromPod(pod, ip)
+	if tunIndex == 0 {
+		if tunIndex, err = lookupInboundTunIndex(); err != nil {
+			plog.Warnf("Failed to resolve inbound tunnel: %v", err)
+		}
+	}
+	rte, err := podRoute(ip, hostIP, table, tunIndex)
 	if err != nil {
-		log.Errorf("Failed to build route for pod %s: %v", pod.Name, err)
+		plog.Errorf("Failed to build route for pod %s: %v", pod.Name, err)
 	}
 
 	if !RouteExists(rte) {
-		log.Infof("Adding route for %s/%s: %+v", pod.Name, pod.Namespace, rte)
-		// @TODO Try and figure out why buildRouteFromPod doesn't return a good route that we can
-		// use err = netlink.RouteAdd(rte):
-		// Error: {"level":"error","time":"2022-06-24T16:30:59.083809Z","msg":"Failed to add route ({Ifindex: 4 Dst: 10.244.2.7/32
-		// Via: Family: 2, Address: 192.168.126.2 Src: 10.244.2.1 Gw: <nil> Flags: [] Table: 100 Realm: 0}) for pod
-		// helloworld-v2-same-node-67b6b764bf-zhmp4: invalid argument"}
-		err = execute("ip", append([]string{"route", "add"}, rte...)...)
+		plog.Infof("Adding route for %s/%s: %+v", pod.Name, pod.Namespace, rte)
+		err = addPodRoute(ip, hostIP, table, tunIndex)
 		if err != nil {
-			log.Warnf("Failed to add route (%s) for pod %s: %v", rte, pod.Name, err)
+			recordDataplaneError(routeOperation)
+			errs = multierr.Append(errs, fmt.Errorf("failed to add route (%+v) for pod %s: %w", rte, pod.Name, err))
 		}
 	} else {
-		log.Infof("Route already exists for %s/%s: %+v", pod.Name, pod.Namespace, rte)
+		plog.Infof("Route already exists for %s/%s: %+v", pod.Name, pod.Namespace, rte)
 	}
 
-	dev, err := getDeviceWithDestinationOf(ip)
-	if err != nil {
-		log.Warnf("Failed to get device for destination %s", ip)
-		return
+	if err := disablePodRPFilter(pod, ip, netns); err != nil {
+		plog.Warnf("Failed to disable rp_filter for pod %s: %v", pod.Name, err)
 	}
-	err = SetProc("/proc/sys/net/ipv4/conf/"+dev+"/rp_filter", "0")
+	return errs
+}
+
+// removeStalePodIPs removes the ipset entries of the pod with another IP than ip, and their routes
+// from table, as left when the IP of a mesh member changes. A failure to list the ipset is left for
+// the membership check to report.
+func removeStalePodIPs(pod *corev1.Pod, ip net.IP, hostIP string, table int) (errs error) {
+	set := ipsetFor(pod.Namespace)
+	entries, err := set.List()
 	if err != nil {
-		log.Warnf("Failed to set rp_filter to 0 for device %s", dev)
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.Comment == "" || commentUID(entry.Comment) != string(pod.UID) || entry.IP.Equal(ip) {
+			continue
+		}
+		log.Infof("Pod '%s/%s' (%s) changed IP from %s to %s, replacing it in the mesh",
+			pod.Namespace, pod.Name, string(pod.UID), entry.IP, ip)
+		if err := set.DeleteIP(entry.IP); err != nil {
+			recordDataplaneError(ipsetOperation)
+			errs = multierr.Append(errs, fmt.Errorf("failed to delete stale IP %s of pod %s from ipset: %v", entry.IP, pod.Name, err))
+		}
+		rte, err := podRoute(entry.IP.String(), hostIP, table, 0)
+		if err != nil || !RouteExists(rte) {
+			continue
+		}
+		if err := defaultNetlink.RouteDel(rte); err != nil {
+			recordDataplaneError(routeOperation)
+			errs = multierr.Append(errs, fmt.Errorf("failed to delete route (%+v) of stale IP of pod %s: %w", rte, pod.Name,
+				&NetlinkError{Op: "RouteDel", Err: err}))
+		}
+	}
+	return errs
+}
+
+// withNetNSPath runs a function in a network namespace. It is a variable for tests.
+var withNetNSPath = ns.WithNetNSPath
+
+// disablePodRPFilter sets rp_filter to 0 on the device of a pod with the address ip. Without netns,
+// that is the host device routing to ip, which is tracked in podRPFilters so that it is restored
+// once the pods routed through it are gone. With netns, the path of the pod network namespace, it is
+// the device with ip in that namespace, which goes away with the pod.
+func disablePodRPFilter(pod *corev1.Pod, ip, netns string) error {
+	if netns == "" {
+		dev, err := getDeviceWithDestinationOf(ip)
+		if err != nil {
+			return fmt.Errorf("failed to get device for %s: %v", ip, err)
+		}
+		if err := podRPFilters.disable(pod.UID, dev); err != nil {
+			recordDataplaneError(procOperation)
+			return fmt.Errorf("failed to set rp_filter to 0 for device %s: %w", dev, err)
+		}
+		return nil
+	}
+	return withNetNSPath(netns, func(ns.NetNS) error {
+		dev, err := getDeviceWithAddress(ip)
+		if err != nil {
+			return fmt.Errorf("failed to get device for %s: %v", ip, err)
+		}
+		if err := SetProc(filepath.Join(procConfDir, dev, "rp_filter"), "0"); err != nil {
+			recordDataplaneError(procOperation)
+			return fmt.Errorf("failed to set rp_filter to 0 for device %s: %w", dev, err)
+		}
+		return nil
+	})
+}
+
+// DelPodFromMesh removes the pod from the ipset, and its route from hostIP from the default inbound
+// route table. Every address of a dual-stack pod is removed, the IPv6 ones from Ipset6.
+func DelPodFromMesh(pod *corev1.Pod, hostIP string) {
+	ips := podAddrs(pod)
+	if len(ips) == 0 {
+		ips = []string{""}
+	}
+	for _, ip := range ips {
+		delPodFromMeshInTable(pod, ip, hostIP, constants.RouteTableInbound, false)
 	}
 }
 
-func DelPodFromMesh(pod *corev1.Pod) {
-	log.Debugf("Removing pod '%s/%s' (%s) from mesh", pod.Name, pod.Namespace, string(pod.UID))
-	if IsPodInIpset(pod) {
-		log.Infof("Removing pod '%s' (%s) from ipset", pod.Name, string(pod.UID))
-		err := Ipset.DeleteIP(net.ParseIP(pod.Status.PodIP).To4())
+// DelPodFromMeshWithIP is like DelPodFromMesh, but removes ip rather than the pod IP, which is
+// often already cleared from the status of terminated pods. If ip is empty, the pod IP is used.
+func DelPodFromMeshWithIP(pod *corev1.Pod, ip, hostIP string) {
+	delPodFromMeshInTable(pod, ip, hostIP, constants.RouteTableInbound, false)
+}
+
+// delPodFromMeshInTable removes ip of the pod from the mesh, and its route from table. If ip is
+// empty, the pod IP is used. IPv6 addresses are removed from Ipset6, as AddPodToMesh added them
+// there without a route. The ipset entry is matched as by podInIpset with uidOnly, so that the entry
+// of another pod which got a recycled IP of the pod is kept.
+func delPodFromMeshInTable(pod *corev1.Pod, ip, hostIP string, table int, uidOnly bool) {
+	plog := podLog(pod, ip).WithLabels("table", table)
+	failed := false
+	defer func() {
+		recordMeshOperation(delOperation, failed)
+		recordMeshMembers()
+	}()
+
+	if ip != "" && ip != pod.Status.PodIP {
+		pod = pod.DeepCopy()
+		pod.Status.PodIP = ip
+	}
+	if isIPv6(pod.Status.PodIP) {
+		if err := delPodFromIpset6(pod); err != nil {
+			plog.Errorf("Failed to delete pod %s from IPv6 ipset: %v", pod.Name, err)
+			recordDataplaneError(ipsetOperation)
+			failed = true
+		}
+		return
+	}
+
+	plog.Debugf("Removing pod '%s/%s' (%s) from mesh", pod.Name, pod.Namespace, string(pod.UID))
+	defer func() {
+		// rp_filter is only disabled for the IPv4 address of a pod, so release it along with it.
+		if !failed {
+			podRPFilters.release(pod.UID)
+		}
+	}()
+	if net.ParseIP(pod.Status.PodIP).To4() == nil {
+		// The IP is usually gone from the status of terminated pods, so fall back to the IP the pod
+		// was added with, which its ipset entry records.
+		last, err := ipsetEntryIP(pod)
+		if err != nil {
+			plog.Errorf("Failed to look up the ipset entry of pod %s: %v", pod.Name, err)
+			recordDataplaneError(ipsetOperation)
+			failed = true
+			return
+		}
+		if last == nil {
+			plog.Warnf("Pod '%s/%s' (%s) has no IPv4 address %q and no ipset entry, nothing to remove",
+				pod.Namespace, pod.Name, string(pod.UID), pod.Status.PodIP)
+			return
+		}
+		plog.Warnf("Pod '%s/%s' (%s) has no IPv4 address %q, removing its last known IP %s",
+			pod.Namespace, pod.Name, string(pod.UID), pod.Status.PodIP, last)
+		pod = pod.DeepCopy()
+		pod.Status.PodIP = last.String()
+		plog = podLog(pod, "").WithLabels("table", table)
+	}
+	inIpset, err := IsPodInIpset(pod)
+	if err != nil {
+		// Membership is unknown, so don't attempt a blind delete that would mask the real problem.
+		plog.Errorf("Failed to check ipset membership of pod %s: %v", pod.Name, err)
+		recordDataplaneError(ipsetOperation)
+		failed = true
+	} else if inIpset {
+		plog.Infof("Removing pod '%s' (%s) from ipset", pod.Name, string(pod.UID))
+		err := ipsetFor(pod.Namespace).DeleteIP(net.ParseIP(pod.Status.PodIP).To4())
 		if err != nil {
-			log.Errorf("Failed to delete pod %s from ipset list: %v", pod.Name, err)
+			plog.Errorf("Failed to delete pod %s from ipset list: %v", pod.Name, err)
+			recordDataplaneError(ipsetOperation)
+			failed = true
 		}
 	} else {
-		log.Infof("Pod '%s/%s' (%s) is not in ipset", pod.Name, pod.Namespace, string(pod.UID))
+		plog.Infof("Pod '%s/%s' (%s) is not in ipset", pod.Name, pod.Namespace, string(pod.UID))
 	}
-	rte, err := buildRouteFromPod(pod, "")
+	// The route is matched whatever its device, so that it is removed even if the tunnel is gone.
+	rte, err := podRoute(pod.Status.PodIP, hostIP, table, 0)
 	if err != nil {
-		log.Errorf("Failed to build route for pod %s: %v", pod.Name, err)
+		plog.Errorf("Failed to build route for pod %s: %v", pod.Name, err)
 	}
 	if RouteExists(rte) {
-		log.Infof("Removing route: %+v", rte)
-		// @TODO Try and figure out why buildRouteFromPod doesn't return a good route that we can
-		// use this:
-		// err = netlink.RouteDel(rte)
-		err = execute("ip", append([]string{"route", "del"}, rte...)...)
+		plog.Infof("Removing route: %+v", rte)
+		err = defaultNetlink.RouteDel(rte)
 		if err != nil {
-			log.Warnf("Failed to delete route (%s) for pod %s: %v", rte, pod.Name, err)
+			plog.Warnf("Failed to delete route (%+v) for pod %s: %v", rte, pod.Name, err)
+			recordDataplaneError(routeOperation)
+			failed = true
 		}
 	}
 }
 
-func buildRouteFromPod(pod *corev1.Pod, ip string) ([]string, error) {
-	if ip == "" {
-		ip = pod.Status.PodIP
+// PodAddResult is the outcome of adding one pod of a batch to the mesh.
+type PodAddResult struct {
+	UID types.UID
+	// Added is true if the pod is in its ipset and has its inbound route, whether they were added
+	// or already in place.
+	Added bool
+	// Err is why the pod wasn't added.
+	Err error
+}
+
+// FailedPodAdds returns the UIDs of the pods of results which weren't added.
+func FailedPodAdds(results []PodAddResult) []types.UID {
+	var failed []types.UID
+	for _, r := range results {
+		if !r.Added {
+			failed = append(failed, r.UID)
+		}
 	}
+	return failed
+}
 
-	if ip == "" {
-		return nil, errors.New("no ip found")
-	}
-
-	return []string{
-		"table",
-		fmt.Sprintf("%d", constants.RouteTableInbound),
-		fmt.Sprintf("%s/32", ip),
-		"via",
-		constants.ZTunnelInboundTunIP,
-		"dev",
-		constants.InboundTun,
-		"src",
-		HostIP,
-	}, nil
+// AddPodsToMesh adds a set of pods to the mesh, typically on initial sync. Unlike calling
+// AddPodToMesh for each pod, the ipset and inbound route table are only listed once, and
+// only the missing entries are added. Failures for individual pods do not stop the others
+// from being added, and are returned together. The outcome of each pod is returned too, in the
+// order of pods, so that the pods which failed can be retried. The pod IPs are validated as for
+// AddPodToMesh, and a rejected pod has a result with ErrInvalidPodIP. Host network pods are
+// skipped and have no result. The pods are routed from hostIP through the default inbound route
+// table.
+func AddPodsToMesh(pods []*corev1.Pod, hostIP string) ([]PodAddResult, error) {
+	if hostIP == "" {
+		return nil, fmt.Errorf("failed to add pods to mesh: %w", ErrHostIPNotFound)
+	}
+	return addPodsToMeshInTable(pods, hostIP, constants.RouteTableInbound, 0)
 }
 
-func (s *Server) routesAdd(routes []*netlink.Route) error {
-	for _, route := range routes {
-		log.Debugf("Adding route: %+v", route)
-		err := netlink.RouteAdd(route)
+// addPodsToMeshInTable adds the pods to the mesh, routing them from hostIP through the inbound
+// tunnel link with index tunIndex. If tunIndex is 0, the link is looked up by name once for all
+// the pods. If the ipsets or the route table can't be listed, no pod is added and there are no
+// results.
+func addPodsToMeshInTable(pods []*corev1.Pod, hostIP string, table, tunIndex int) ([]PodAddResult, error) {
+	pods = withoutHostNetworkPods(pods)
+	if len(pods) == 0 {
+		return nil, nil
+	}
+
+	// The pods are matched against the entries of the ipset of their namespace, each listed once.
+	ipsetUIDs := make(map[IpsetHandle]sets.Set)
+	ipsetIPs := make(map[IpsetHandle]sets.Set)
+	for _, pod := range pods {
+		set := ipsetFor(pod.Namespace)
+		if _, ok := ipsetIPs[set]; ok {
+			continue
+		}
+		entries, err := set.List()
 		if err != nil {
-			return err
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w: %v", ErrIpsetMissing, err)
+			}
+			return nil, &NetlinkError{Op: "IpsetList", Err: err}
+		}
+		ipsetUIDs[set] = sets.NewWithLength(len(entries))
+		ipsetIPs[set] = sets.NewWithLength(len(entries))
+		for _, entry := range entries {
+			if entry.Comment != "" {
+				ipsetUIDs[set].Insert(commentUID(entry.Comment))
+			}
+			ipsetIPs[set].Insert(entry.IP.String())
 		}
 	}
 
-	return nil
-}
-
-func getDeviceWithDestinationOf(ip string) (string, error) {
-	routes, err := netlink.RouteListFiltered(
+	routes, err := defaultNetlink.RouteListFiltered(
 		netlink.FAMILY_V4,
-		&netlink.Route{Dst: &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(32, 32)}},
-		netlink.RT_FILTER_DST)
+		&netlink.Route{Table: table},
+		netlink.RT_FILTER_TABLE)
 	if err != nil {
-		return "", err
+		return nil, &NetlinkError{Op: "RouteList", Err: err}
 	}
-
-	if len(routes) == 0 {
-		return "", errors.New("no routes found")
+	routeDsts := sets.NewWithLength(len(routes))
+	for _, r := range routes {
+		if r.Dst != nil {
+			routeDsts.Insert(r.Dst.IP.String())
+		}
 	}
 
-	linkIndex := routes[0].LinkIndex
-	link, err := netlink.LinkByIndex(linkIndex)
-	if err != nil {
-		return "", err
+	if tunIndex == 0 {
+		// On failure, the index stays 0 and the route of each pod fails with the lookup error.
+		if tunIndex, err = lookupInboundTunIndex(); err != nil {
+			log.Warnf("Failed to resolve inbound tunnel: %v", err)
+		}
 	}
-	return link.Attrs().Name, nil
-}
 
-func GetHostNetDevice(hostIP string) (string, error) {
-	links, err := netlink.LinkList()
-	if err != nil {
-		return "", err
+	var errs error
+	results := make([]PodAddResult, 0, len(pods))
+	fail := func(pod *corev1.Pod, err error) {
+		errs = multierr.Append(errs, err)
+		results = append(results, PodAddResult{UID: pod.UID, Err: err})
+		recordMeshOperation(addOperation, true)
 	}
-	for _, link := range links {
-		addrs, err := netlink.AddrList(link, netlink.FAMILY_ALL)
+	devices := sets.New()
+	for _, pod := range pods {
+		addr, err := normalizePodIP(pod.Status.PodIP)
 		if err != nil {
-			return "", err
+			fail(pod, fmt.Errorf("pod %s/%s: %w", pod.Namespace, pod.Name, err))
+			continue
 		}
-		for _, addr := range addrs {
-			if addr.IP.String() == hostIP {
-				return link.Attrs().Name, nil
+		ip := addr.String()
+		if addr.Is6() {
+			// As for AddPodToMesh, only the ipset is changed for an IPv6 pod.
+			if err := addPodToIpset6(pod, ip); err != nil {
+				recordDataplaneError(ipsetOperation)
+				fail(pod, fmt.Errorf("failed to add pod %s/%s to IPv6 ipset: %v", pod.Namespace, pod.Name, err))
+				continue
+			}
+			recordMeshOperation(addOperation, false)
+			results = append(results, PodAddResult{UID: pod.UID, Added: true})
+			continue
+		}
+		podIP := net.IP(addr.AsSlice())
+
+		set := ipsetFor(pod.Namespace)
+		if ipsetUIDs[set].Contains(string(pod.UID)) || ipsetIPs[set].Contains(ip) {
+			log.Debugf("Pod '%s/%s' (%s) is in ipset", pod.Name, pod.Namespace, string(pod.UID))
+		} else {
+			log.Infof("Adding pod '%s/%s' (%s) to ipset", pod.Name, pod.Namespace, string(pod.UID))
+			if err := set.AddIP(podIP, ipsetComment(pod)); err != nil {
+				recordDataplaneError(ipsetOperation)
+				err = &NetlinkError{Op: "IpsetAdd", Err: err}
+				logIpsetFull(pod, err)
+				fail(pod, fmt.Errorf("failed to add pod %s/%s to ipset: %w", pod.Namespace, pod.Name, err))
+				continue
 			}
 		}
+
+		if routeDsts.Contains(ip) {
+			log.Debugf("Route already exists for %s/%s", pod.Name, pod.Namespace)
+		} else {
+			log.Infof("Adding route for %s/%s", pod.Name, pod.Namespace)
+			if err := addPodRoute(ip, hostIP, table, tunIndex); err != nil {
+				recordDataplaneError(routeOperation)
+				fail(pod, fmt.Errorf("failed to add route for pod %s/%s: %w", pod.Namespace, pod.Name, err))
+				continue
+			}
+		}
+		recordMeshOperation(addOperation, false)
+		results = append(results, PodAddResult{UID: pod.UID, Added: true})
+
+		dev, err := getDeviceWithDestinationOf(ip)
+		if err != nil {
+			log.Warnf("Failed to get device for destination %s", ip)
+			continue
+		}
+		// Every pod is tracked, but a failing device is only reported once.
+		if err := podRPFilters.disable(pod.UID, dev); err != nil && !devices.InsertContains(dev) {
+			log.Warnf("Failed to set rp_filter to 0 for device %s", dev)
+			recordDataplaneError(procOperation)
+		}
+	}
+	recordMeshMembers()
+
+	return results, errs
+}
+
+// addPodToMesh calls AddPodToMesh, serialized with the other membership changes made by s. It is a
+// no-op while draining, and for a bypassed pod.
+func (s *Server) addPodToMesh(pod *corev1.Pod) {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	if err := s.addPodToMeshLocked(pod); err != nil {
+		log.Errorf("Failed to add pod %s to mesh: %v", pod.Name, err)
 	}
-	return "", errors.New("not found")
 }
 
-func GetHostIP(kubeClient kubernetes.Interface) (string, error) {
-	var ip string
-	// Get the node from the Kubernetes API
-	node, err := kubeClient.CoreV1().Nodes().Get(context.TODO(), NodeName, metav1.GetOptions{})
+// addPodToMeshLocked adds the pod to the mesh. meshMu must be held.
+func (s *Server) addPodToMeshLocked(pod *corev1.Pod) error {
+	if s.isDraining() {
+		log.Infof("Draining, not adding pod '%s/%s' (%s) to the mesh", pod.Namespace, pod.Name, string(pod.UID))
+		return nil
+	}
+	if s.bypassedPods.Contains(string(pod.UID)) {
+		log.Debugf("Pod '%s/%s' (%s) is bypassed, not adding it to the mesh", pod.Namespace, pod.Name, string(pod.UID))
+		return nil
+	}
+	if !s.capturesPod(pod) {
+		log.Infof("Pod '%s/%s' (%s) doesn't match the capture selector %s, not adding it to the mesh",
+			pod.Namespace, pod.Name, string(pod.UID), s.captureSelector)
+		return nil
+	}
+	// The informers redeliver the pods on resync, so the ipset and netlink queries are skipped for a
+	// pod already added with the same IP. ReconcileDataplane repairs entries removed since.
+	if ip := pod.Status.PodIP; ip != "" && s.addedPods[pod.UID] == ip {
+		log.Debugf("Pod '%s/%s' (%s) is already in the mesh with %s", pod.Namespace, pod.Name, string(pod.UID), ip)
+		return nil
+	}
+	s.rememberPodIP(pod)
+	err := addPodToMeshInTable(pod, "", s.routeSrc(), "", s.routeTables.Inbound, s.inboundTunLinkIndex())
 	if err != nil {
-		return "", fmt.Errorf("error getting node: %v", err)
+		delete(s.addedPods, pod.UID)
+	} else if pod.Status.PodIP != "" {
+		if s.addedPods == nil {
+			s.addedPods = map[types.UID]string{}
+		}
+		s.addedPods[pod.UID] = pod.Status.PodIP
 	}
+	s.addPodIPv6s(pod)
+	return err
+}
+
+// delPodFromMesh calls DelPodFromMesh, serialized with the other membership changes made by s. The
+// IP the pod was added with is removed, even if it is no longer in the pod status.
+func (s *Server) delPodFromMesh(pod *corev1.Pod) {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	s.delPodFromMeshLocked(pod)
+}
 
-	ip = node.Spec.PodCIDR
-	//fmt.Printf("node.Spec.PodCIDR: %v\n", ip)
-	// This needs to be done as in Kind, the node internal IP is not the one we want.
+// delPodFromMeshLocked removes the pod from the mesh, and returns the IP which was removed.
+// meshMu must be held.
+func (s *Server) delPodFromMeshLocked(pod *corev1.Pod) string {
+	ip := pod.Status.PodIP
 	if ip == "" {
-		// PodCIDR is not set, try to get the IP from the node internal IP
-		//fmt.Printf("node.Status.Addresses: %v\n", node.Status.Addresses)
-		for _, address := range node.Status.Addresses {
-			if address.Type == corev1.NodeInternalIP {
-				return address.Address, nil
-			}
-		}
-	} else {
-		network, err := netip.ParsePrefix(ip)
-		if err != nil {
-			return "", fmt.Errorf("error parsing node IP: %v\n", err)
+		ip = s.podIPs[pod.UID]
+	}
+	delete(s.podIPs, pod.UID)
+	s.bypassedPods.Delete(string(pod.UID))
+	s.removePodDataplane(pod, ip)
+	return ip
+}
+
+// removePodDataplane removes the ipset entries and the inbound route of the pod, added with ip.
+// meshMu must be held.
+func (s *Server) removePodDataplane(pod *corev1.Pod, ip string) {
+	delete(s.addedPods, pod.UID)
+	s.mu.Lock()
+	uidOnly := s.ipsetComments
+	s.mu.Unlock()
+	delPodFromMeshInTable(pod, ip, s.routeSrc(), s.routeTables.Inbound, uidOnly)
+	if s.enableIPv6 {
+		if err := delPodFromIpset6(pod); err != nil {
+			log.Errorf("Failed to delete pod %s from IPv6 ipset: %v", pod.Name, err)
+			recordDataplaneError(ipsetOperation)
 		}
+	}
+}
+
+// RemovePod removes the pod from the mesh, for the CNI DEL. Unlike delPodFromMesh, the ipset and
+// the inbound route table are listed again afterwards, and an error wrapping ErrPodNotRemoved is
+// returned if the pod is still in either, so that the CNI runtime retries the DEL.
+func (s *Server) RemovePod(pod *corev1.Pod) error {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	ip := s.delPodFromMeshLocked(pod)
+	if ip != pod.Status.PodIP {
+		pod = pod.DeepCopy()
+		pod.Status.PodIP = ip
+	}
 
-		ifaces, err := net.Interfaces()
+	var remaining []string
+	inIpset, err := s.isPodInIpset(pod)
+	if err != nil {
+		return fmt.Errorf("failed to check removal of pod %s/%s: %w", pod.Namespace, pod.Name, err)
+	}
+	if inIpset {
+		remaining = append(remaining, "ipset entry")
+	}
+	if rte, err := podRoute(ip, s.routeSrc(), s.routeTables.Inbound, 0); err == nil && RouteExists(rte) {
+		remaining = append(remaining, "route")
+	}
+	if s.enableIPv6 {
+		entries, err := Ipset6.List()
 		if err != nil {
-			return "", fmt.Errorf("error getting interfaces: %v\n", err)
+			return fmt.Errorf("failed to check removal of pod %s/%s: %v", pod.Namespace, pod.Name, err)
 		}
-		for _, iface := range ifaces {
-			addrs, err := iface.Addrs()
-			//fmt.Printf("iface: %v\n", iface)
-			if err != nil {
-				return "", fmt.Errorf("error getting addresses: %v", err)
-			}
-
-			for _, addr := range addrs {
-				//fmt.Printf("addr: %v\n", addr.String())
-				a, err := netip.ParseAddr(strings.Split(addr.String(), "/")[0])
-				if err != nil {
-					return "", fmt.Errorf("error parsing address: %v", err)
-				}
-				if network.Contains(a) {
-					return a.String(), nil
-				}
+		for _, entry := range entries {
+			if commentUID(entry.Comment) == string(pod.UID) {
+				remaining = append(remaining, "IPv6 ipset entry")
+				break
 			}
 		}
 	}
-
-	return "", nil
+	if len(remaining) > 0 {
+		return fmt.Errorf("%w: pod %s/%s still has %s", ErrPodNotRemoved, pod.Namespace, pod.Name, strings.Join(remaining, ", "))
+	}
+	return nil
 }
 
-// CreateRulesOnCPUNode initializes the routing, firewall and ipset rules on the node.
-// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh
-func (s *Server) CreateRulesOnCPUNode(cpuEth, ztunnelIP string, captureDNS bool) error {
-	var err error
-
-	log.Debugf("CreateRulesOnNode: cpuEth=%s, ztunnelIP=%s", cpuEth, ztunnelIP)
+// addPodsToMesh calls AddPodsToMesh, serialized with the other membership changes made by s. It is
+// a no-op while draining, and the bypassed pods are skipped and have no result.
+func (s *Server) addPodsToMesh(pods []*corev1.Pod) ([]PodAddResult, error) {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	if s.isDraining() {
+		log.Infof("Draining, not adding %d pods to the mesh", len(pods))
+		return nil, nil
+	}
+	pods = s.capturedPods(s.withoutBypassedPods(pods))
+	for _, pod := range pods {
+		s.rememberPodIP(pod)
+	}
+	results, err := addPodsToMeshInTable(pods, s.routeSrc(), s.routeTables.Inbound, s.inboundTunLinkIndex())
+	for _, pod := range pods {
+		s.addPodIPv6s(pod)
+	}
+	return results, err
+}
 
-	// Check if chain exists, if it exists flush.. otherwise initialize
-	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L28
-	err = execute(IptablesCmd, "-t", "mangle", "-C", "output", "-j", constants.ChainZTunnelOutput)
-	if err == nil {
-		log.Debugf("Chain %s already exists, flushing", constants.ChainOutput)
-		s.flushLists()
-	} else {
-		log.Debugf("Initializing lists")
-		err = s.initializeLists()
-		if err != nil {
-			return err
+// addPodIPv6s adds the IPv6 addresses of a dual-stack pod to the mesh, if IPv6 is enabled. The
+// primary pod IP is added by addPodToMeshInTable. meshMu must be held.
+func (s *Server) addPodIPv6s(pod *corev1.Pod) {
+	if !s.enableIPv6 {
+		return
+	}
+	for _, ip := range podIPv6s(pod) {
+		if ip != pod.Status.PodIP {
+			if err := addPodToMeshInTable(pod, ip, s.routeSrc(), "", s.routeTables.Inbound, 0); err != nil {
+				log.Errorf("Failed to add pod %s to mesh: %v", pod.Name, err)
+			}
 		}
 	}
+}
 
-	// Create ipset of pod members.
-	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L85
-	log.Debug("Creating ipset")
-	err = Ipset.CreateSet()
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		return fmt.Errorf("error creating ipset: %v", err)
+// rememberPodIP records the IP of a pod added to the mesh, for delPodFromMesh. meshMu must be held.
+func (s *Server) rememberPodIP(pod *corev1.Pod) {
+	if pod.Status.PodIP == "" {
+		return
 	}
+	if s.podIPs == nil {
+		s.podIPs = map[types.UID]string{}
+	}
+	s.podIPs[pod.UID] = pod.Status.PodIP
+}
 
-	appendRules := []*iptablesRule{
-		// Make sure that whatever is skipped is also skipped for returning packets.
-		// If we have a skip mark, save it to conn mark.
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L95
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelForward,
-			"-m", "mark",
-			"--mark", constants.ConnSkipMark,
-			"-j", "CONNMARK",
-			"--save-mark",
-			"--nfmask", constants.ConnSkipMask,
-			"--ctmask", constants.ConnSkipMask,
-		),
-		// Input chain might be needed for things in host namespace that are skipped.
-		// Place the mark here after routing was done, not sure if conn-tracking will figure
-		// it out if I do it before, as NAT might change the connection tuple.
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L99
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelInput,
-			"-m", "mark",
-			"--mark", constants.ConnSkipMark,
-			"-j", "CONNMARK",
-			"--save-mark",
-			"--nfmask", constants.ConnSkipMask,
-			"--ctmask", constants.ConnSkipMask,
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L106
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelOutput,
-			"--source", HostIP,
-			"-j", "MARK",
-			"--set-mark", constants.ConnSkipMask,
-		),
-
-		// If we have an outbound mark, we don't need kube-proxy to do anything,
-		// so accept it before kube-proxy translates service vips to pod ips
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L122
-		newIptableRule(
+// dnsCaptureRules returns the rules redirecting the DNS queries of mesh pods to ztunnel, or to the
+// configured DNS capture address. Queries over TCP, used for large responses and zone transfers,
+// are captured too unless disabled.
+func (s *Server) dnsCaptureRules(ztunnelIP string) []*iptablesRule {
+	port := s.dnsCapturePort
+	if port == 0 {
+		port = constants.DNSCapturePort
+	}
+	addr := ztunnelIP
+	if s.dnsCaptureAddr != "" {
+		addr = s.dnsCaptureAddr
+	}
+	protos := []string{"udp", "tcp"}
+	if s.dnsCaptureUDPOnly {
+		protos = protos[:1]
+	}
+	rules := make([]*iptablesRule, 0, len(protos))
+	for _, proto := range protos {
+		rules = append(rules, newIptableRule(
 			constants.TableNat,
 			constants.ChainZTunnelPrerouting,
-			"-m", "mark",
-			"--mark", constants.OutboundMark,
-			"-j", "ACCEPT",
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L123
-		newIptableRule(
-			constants.TableNat,
-			constants.ChainZTunnelPostrouting,
-			"-m", "mark",
-			"--mark", constants.OutboundMark,
-			"-j", "ACCEPT",
-		),
+			"-p", proto,
+			"-m", "set",
+			"--match-set", ipsetName, "src",
+			"--dport", "53",
+			"-j", "DNAT",
+			"--to", fmt.Sprintf("%s:%d", addr, port),
+		))
 	}
+	return rules
+}
 
-	if captureDNS {
-		appendRules = append(appendRules,
-			newIptableRule(
-				constants.TableNat,
-				constants.ChainZTunnelPrerouting,
-				"-p", "udp",
-				"-m", "set",
-				"--match-set", Ipset.Name, "src",
-				"--dport", "53",
-				"-j", "DNAT",
-				"--to", fmt.Sprintf("%s:%d", ztunnelIP, constants.DNSCapturePort),
-			),
-		)
-	}
+// podRoute returns the route of a pod IP from hostIP through the inbound tunnel link with index
+// tunIndex.
+func podRoute(ip, hostIP string, table, tunIndex int) (*netlink.Route, error) {
+	dst, err := parsePodIP(ip)
+	if err != nil {
+		return nil, err
+	}
+	return &netlink.Route{
+		Table:     table,
+		Dst:       &net.IPNet{IP: dst, Mask: net.CIDRMask(32, 32)},
+		Gw:        net.ParseIP(constants.ZTunnelInboundTunIP),
+		LinkIndex: tunIndex,
+		Src:       net.ParseIP(hostIP),
+	}, nil
+}
 
-	appendRules2 := []*iptablesRule{
-		// If we have the conn mark, restore it to mark, to make sure that the other side of the connection
-		// is skipped as well.
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L129-L130
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-m", "connmark",
-			"--mark", constants.ConnSkipMark,
-			"-j", "MARK",
-			"--set-mark", constants.SkipMark,
-		),
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-m", "mark",
-			"--mark", constants.SkipMark,
-			"-j", "RETURN",
-		),
+// routeSrc returns the source of the inbound pod routes, inboundRouteSrc if set and the host IP
+// otherwise.
+func (s *Server) routeSrc() string {
+	if s.inboundRouteSrc != "" {
+		return s.inboundRouteSrc
+	}
+	return s.hostIP
+}
 
+// validateInboundRouteSrc checks that src is an IPv4 address the inbound pod routes can use as
+// their source, so a device of the node must have it. The inbound tunnel IP is accepted as is, as
+// node setup only assigns it to the inbound tunnel later on.
+func validateInboundRouteSrc(src string) error {
+	if addr, err := netip.ParseAddr(src); err != nil || !addr.Is4() {
+		return fmt.Errorf("invalid inbound route source %q", src)
+	}
+	if src == constants.InboundTunIP {
+		return nil
+	}
+	if _, err := GetHostNetDevice(src); err != nil {
+		return fmt.Errorf("inbound route source %s is not local: %w", src, err)
+	}
+	return nil
+}
+
+// addPodRoute routes ip from hostIP through the inbound tunnel link with index tunIndex. If
+// tunIndex is 0, the link is looked up by name.
+func addPodRoute(ip, hostIP string, table, tunIndex int) error {
+	if tunIndex == 0 {
+		var err error
+		if tunIndex, err = lookupInboundTunIndex(); err != nil {
+			return err
+		}
+	}
+	rte, err := podRoute(ip, hostIP, table, tunIndex)
+	if err != nil {
+		return err
+	}
+	if err := defaultNetlink.RouteAdd(rte); err != nil {
+		return &NetlinkError{Op: "RouteAdd", Err: err}
+	}
+	return nil
+}
+
+func lookupInboundTunIndex() (int, error) {
+	link, err := defaultNetlink.LinkByName(constants.InboundTun)
+	if err != nil {
+		return 0, &NetlinkError{Op: "LinkByName", Err: err}
+	}
+	return link.Attrs().Index, nil
+}
+
+// inboundTunLinkIndex returns the cached index of the inbound tunnel link, resolving it if it isn't
+// known yet. It returns 0 if the link can't be resolved, leaving the lookup to the caller.
+func (s *Server) inboundTunLinkIndex() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inboundTunIndex == 0 {
+		index, err := lookupInboundTunIndex()
+		if err != nil {
+			log.Debugf("Failed to resolve inbound tunnel: %v", err)
+			return 0
+		}
+		s.inboundTunIndex = index
+	}
+	return s.inboundTunIndex
+}
+
+// resetInboundTunIndex forgets the cached index of the inbound tunnel link, after it was recreated
+// or deleted.
+func (s *Server) resetInboundTunIndex() {
+	s.mu.Lock()
+	s.inboundTunIndex = 0
+	s.mu.Unlock()
+}
+
+func (s *Server) routesAdd(routes []*netlink.Route) error {
+	for _, route := range routes {
+		log.Debugf("Adding route: %+v", route)
+		err := s.netlink().RouteAdd(route)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parsePodIP parses an IPv4 pod address, returning ErrInvalidPodIP if it is missing or malformed.
+func parsePodIP(ip string) (net.IP, error) {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidPodIP, ip)
+	}
+	return parsed, nil
+}
+
+// podCIDRs are the CIDRs the IPs of the pods added to the mesh by AddPodToMesh must be in. An IP is
+// only checked if a CIDR of its family is set. It is set by UsePodCIDRs.
+var podCIDRs []netip.Prefix
+
+// UsePodCIDRs sets the CIDRs the IPs of the pods added to the mesh must be in, usually the pod CIDRs
+// of the node, to catch callers passing the IP of another node or network. Nil disables the check.
+// The CNI plugin calls this with the CIDRs of the ambient controller.
+func UsePodCIDRs(cidrs []string) error {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, c := range cidrs {
+		prefix, err := netip.ParsePrefix(strings.TrimSpace(c))
+		if err != nil {
+			return fmt.Errorf("invalid pod CIDR %q: %v", c, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	podCIDRs = prefixes
+	return nil
+}
+
+// normalizePodIP parses the IP of a pod added to the mesh, returning it with IPv4-mapped IPv6
+// addresses unmapped, so that its String is canonical. ErrInvalidPodIP is returned if it is missing,
+// malformed, has a zone or is outside the podCIDRs of its family.
+func normalizePodIP(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("%w: %v", ErrInvalidPodIP, err)
+	}
+	if addr.Zone() != "" {
+		return netip.Addr{}, fmt.Errorf("%w: %q has a zone", ErrInvalidPodIP, ip)
+	}
+	addr = addr.Unmap()
+	checked := false
+	for _, prefix := range podCIDRs {
+		if prefix.Addr().Is4() != addr.Is4() {
+			continue
+		}
+		if prefix.Contains(addr) {
+			return addr, nil
+		}
+		checked = true
+	}
+	if checked {
+		return netip.Addr{}, fmt.Errorf("%w: %s is outside the pod CIDRs %v", ErrInvalidPodIP, addr, podCIDRs)
+	}
+	return addr, nil
+}
+
+// getDeviceWithDestinationOf returns the name of the device of the host route to ip, an IPv4 or
+// IPv6 address.
+func getDeviceWithDestinationOf(ip string) (string, error) {
+	dst := net.ParseIP(ip)
+	if dst == nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPodIP, ip)
+	}
+	family, bits := netlink.FAMILY_V6, 128
+	if dst4 := dst.To4(); dst4 != nil {
+		dst, family, bits = dst4, netlink.FAMILY_V4, 32
+	}
+	routes, err := defaultNetlink.RouteListFiltered(
+		family,
+		&netlink.Route{Dst: &net.IPNet{IP: dst, Mask: net.CIDRMask(bits, bits)}},
+		netlink.RT_FILTER_DST)
+	if err != nil {
+		return "", &NetlinkError{Op: "RouteList", Err: err}
+	}
+
+	if len(routes) == 0 {
+		return "", fmt.Errorf("%w: %s", ErrNoRouteToDest, ip)
+	}
+
+	linkIndex := routes[0].LinkIndex
+	link, err := defaultNetlink.LinkByIndex(linkIndex)
+	if err != nil {
+		return "", &NetlinkError{Op: "LinkByIndex", Err: err}
+	}
+	return link.Attrs().Name, nil
+}
+
+// getDeviceWithAddress returns the name of the device with the address ip. Unlike
+// getDeviceWithDestinationOf, it works in the pod network namespace, which routes its own addresses
+// through the loopback device.
+func getDeviceWithAddress(ip string) (string, error) {
+	addr, err := parsePodIP(ip)
+	if err != nil {
+		return "", err
+	}
+	links, err := defaultNetlink.LinkList()
+	if err != nil {
+		return "", &NetlinkError{Op: "LinkList", Err: err}
+	}
+	for _, link := range links {
+		addrs, err := defaultNetlink.AddrList(link, netlink.FAMILY_V4)
+		if err != nil {
+			return "", &NetlinkError{Op: "AddrList", Err: err}
+		}
+		for _, a := range addrs {
+			if a.IP.Equal(addr) {
+				return link.Attrs().Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("no device with address %s", ip)
+}
+
+func GetHostNetDevice(hostIP string) (string, error) {
+	links, err := defaultNetlink.LinkList()
+	if err != nil {
+		return "", &NetlinkError{Op: "LinkList", Err: err}
+	}
+	for _, link := range links {
+		addrs, err := defaultNetlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return "", &NetlinkError{Op: "AddrList", Err: err}
+		}
+		for _, addr := range addrs {
+			if addr.IP.String() == hostIP {
+				return link.Attrs().Name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("%w: no device has address %s", ErrDeviceNotFound, hostIP)
+}
+
+// HostIPPreference selects the host IP among several node internal IPs, e.g. on dual-homed nodes
+// where some are on a management network which can't reach the pods.
+type HostIPPreference struct {
+	// Subnet is the CIDR of the preferred internal IP.
+	Subnet string `json:"subnet,omitempty"`
+	// Interface is the name of the host interface with the preferred internal IP.
+	Interface string `json:"interface,omitempty"`
+}
+
+// These return host addresses. They are variables for tests.
+var (
+	interfaceAddrsByName = func(name string) ([]net.Addr, error) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return nil, err
+		}
+		return iface.Addrs()
+	}
+	defaultRouteAddrs = func() ([]net.Addr, error) {
+		routes, err := defaultNetlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Dst: nil}, netlink.RT_FILTER_DST)
+		if err != nil {
+			return nil, &NetlinkError{Op: "RouteList", Err: err}
+		}
+		if len(routes) == 0 {
+			return nil, fmt.Errorf("%w: default", ErrNoRouteToDest)
+		}
+		link, err := defaultNetlink.LinkByIndex(routes[0].LinkIndex)
+		if err != nil {
+			return nil, &NetlinkError{Op: "LinkByIndex", Err: err}
+		}
+		return interfaceAddrsByName(link.Attrs().Name)
+	}
+)
+
+// hostIPTimeout bounds GetHostIP, which lists every interface of the node and their addresses,
+// which may take long on nodes with thousands of interfaces. It is a variable for tests.
+var hostIPTimeout = 30 * time.Second
+
+// hostIPCache holds the host IPs resolved by GetHostIP, as they don't change while the node is up.
+var hostIPCache = struct {
+	sync.Mutex
+	ips map[hostIPCacheKey]string
+}{}
+
+type hostIPCacheKey struct {
+	nodeName string
+	pref     HostIPPreference
+}
+
+// GetHostIP returns the IP of the node nodeName which pods are routed from. It is the address of a
+// host interface within the node pod CIDR, e.g. the bridge in Kind, where the node internal IP is
+// not the one we want. If there is none, or the pod CIDR isn't set, a node internal IP is used,
+// chosen by pref when there are several.
+//
+// The lookup fails with ErrHostIPTimeout if it takes longer than hostIPTimeout. A resolved host IP
+// is cached, so later calls for the same node and pref return it right away.
+func GetHostIP(ctx context.Context, kubeClient kubernetes.Interface, nodeName string, pref HostIPPreference) (string, error) {
+	key := hostIPCacheKey{nodeName: nodeName, pref: pref}
+	hostIPCache.Lock()
+	ip, ok := hostIPCache.ips[key]
+	hostIPCache.Unlock()
+	if ok {
+		return ip, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, hostIPTimeout)
+	defer cancel()
+	// Get the node from the Kubernetes API
+	node, err := kubeClient.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("error getting node: %v", err)
+	}
+	ip, err = hostIPFromNode(ctx, node, pref)
+	if err != nil {
+		return "", err
+	}
+
+	hostIPCache.Lock()
+	if hostIPCache.ips == nil {
+		hostIPCache.ips = map[hostIPCacheKey]string{}
+	}
+	hostIPCache.ips[key] = ip
+	hostIPCache.Unlock()
+	return ip, nil
+}
+
+func hostIPFromNode(ctx context.Context, node *corev1.Node, pref HostIPPreference) (string, error) {
+	podCIDR := node.Spec.PodCIDR
+	log.Debugf("node.Spec.PodCIDR: %v", podCIDR)
+	if podCIDR != "" {
+		ip, err := hostIPInPodCIDRWithContext(ctx, podCIDR)
+		if err == nil {
+			return ip, nil
+		}
+		if !errors.Is(err, ErrHostIPNotFound) {
+			return "", err
+		}
+		log.Debugf("%v, falling back to the node internal IP", err)
+	}
+
+	log.Debugf("node.Status.Addresses: %v", node.Status.Addresses)
+	var internalIPs []string
+	for _, address := range node.Status.Addresses {
+		if address.Type == corev1.NodeInternalIP {
+			internalIPs = append(internalIPs, address.Address)
+		}
+	}
+	if len(internalIPs) > 0 {
+		return selectInternalIP(internalIPs, pref)
+	}
+	if podCIDR != "" {
+		return "", fmt.Errorf("%w: no interface address in pod CIDR %s, and no node internal IP", ErrHostIPNotFound, podCIDR)
+	}
+	return "", fmt.Errorf("%w: no pod CIDR or node internal IP", ErrHostIPNotFound)
+}
+
+// selectInternalIP chooses among the node internal IPs: the first one in the preferred subnet, else
+// the first one on the preferred interface, else the first one on the interface of the default
+// route. If none of these match, the first one is used.
+func selectInternalIP(ips []string, pref HostIPPreference) (string, error) {
+	if len(ips) == 1 {
+		return ips[0], nil
+	}
+
+	if pref.Subnet != "" {
+		subnet, err := netip.ParsePrefix(pref.Subnet)
+		if err != nil {
+			return "", fmt.Errorf("error parsing preferred subnet: %v", err)
+		}
+		for _, ip := range ips {
+			if a, err := netip.ParseAddr(ip); err == nil && subnet.Contains(a) {
+				return ip, nil
+			}
+		}
+		log.Debugf("No node internal IP in preferred subnet %s", pref.Subnet)
+	}
+
+	if pref.Interface != "" {
+		addrs, err := interfaceAddrsByName(pref.Interface)
+		if err != nil {
+			log.Debugf("Failed to get the addresses of preferred interface %s: %v", pref.Interface, err)
+		} else if ip := firstIPIn(ips, addrs); ip != "" {
+			return ip, nil
+		}
+	}
+
+	addrs, err := defaultRouteAddrs()
+	if err != nil {
+		log.Debugf("Failed to get the addresses of the default route interface: %v", err)
+	} else if ip := firstIPIn(ips, addrs); ip != "" {
+		return ip, nil
+	}
+
+	log.Debugf("No preferred node internal IP among %v, using the first one", ips)
+	return ips[0], nil
+}
+
+// firstIPIn returns the first of ips which is one of addrs, or "".
+func firstIPIn(ips []string, addrs []net.Addr) string {
+	for _, ip := range ips {
+		for _, addr := range addrs {
+			if strings.Split(addr.String(), "/")[0] == ip {
+				return ip
+			}
+		}
+	}
+	return ""
+}
+
+// hostIPInPodCIDRWithContext is like hostIPInPodCIDR, but gives up with ErrHostIPTimeout once ctx is
+// done. The netlink calls can't be interrupted, so the enumeration is left to finish in the
+// background.
+func hostIPInPodCIDRWithContext(ctx context.Context, podCIDR string) (string, error) {
+	type result struct {
+		ip  string
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		ip, err := hostIPInPodCIDR(podCIDR)
+		done <- result{ip: ip, err: err}
+	}()
+	select {
+	case r := <-done:
+		return r.ip, r.err
+	case <-ctx.Done():
+		return "", fmt.Errorf("%w: listing the interface addresses in pod CIDR %s: %v", ErrHostIPTimeout, podCIDR, ctx.Err())
+	}
+}
+
+// hostIPInPodCIDR returns the first host interface address within podCIDR. Loopback and dummy
+// interfaces are skipped: the pod CIDR may overlap the service CIDR, whose addresses kube-proxy puts
+// on the kube-ipvs0 dummy interface in IPVS mode. Addresses on physical and veth interfaces are
+// preferred over those on others, e.g. bridges.
+func hostIPInPodCIDR(podCIDR string) (string, error) {
+	network, err := netip.ParsePrefix(podCIDR)
+	if err != nil {
+		return "", fmt.Errorf("error parsing pod CIDR: %v", err)
+	}
+
+	links, err := defaultNetlink.LinkList()
+	if err != nil {
+		return "", &NetlinkError{Op: "LinkList", Err: err}
+	}
+	var fallback string
+	for _, link := range links {
+		if !hostIPInterface(link) {
+			log.Debugf("Skipping interface %s (%s) for the host IP", link.Attrs().Name, link.Type())
+			continue
+		}
+		addrs, err := defaultNetlink.AddrList(link, netlink.FAMILY_ALL)
+		if err != nil {
+			return "", &NetlinkError{Op: "AddrList", Err: err}
+		}
+		for _, addr := range addrs {
+			log.Debugf("addr: %v on %s", addr.IPNet, link.Attrs().Name)
+			a, ok := netip.AddrFromSlice(addr.IP)
+			if !ok || !network.Contains(a.Unmap()) {
+				continue
+			}
+			if link.Type() == "device" || link.Type() == "veth" {
+				return a.Unmap().String(), nil
+			}
+			if fallback == "" {
+				fallback = a.Unmap().String()
+			}
+		}
+	}
+	if fallback != "" {
+		return fallback, nil
+	}
+	return "", fmt.Errorf("%w: no interface address in pod CIDR %s", ErrHostIPNotFound, podCIDR)
+}
+
+// hostIPInterface reports whether the addresses of link may be the host IP. Those of loopback and
+// dummy interfaces, such as kube-ipvs0, are never routable from the pods.
+func hostIPInterface(link netlink.Link) bool {
+	attrs := link.Attrs()
+	return attrs.Flags&net.FlagLoopback == 0 && link.Type() != "dummy" && !strings.HasPrefix(attrs.Name, "kube-ipvs")
+}
+
+// CreateRulesOnCPUNode initializes the routing, firewall and ipset rules on the node.
+// Setup stops between phases if ctx is cancelled.
+// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh
+func (s *Server) CreateRulesOnCPUNode(ctx context.Context, cpuEth, ztunnelIP string, captureDNS bool) error {
+	s.setupMu.Lock()
+	defer s.setupMu.Unlock()
+	nlog := log.WithLabels("node", offmesh.CPUNode, "device", cpuEth, "ip", ztunnelIP)
+	var err error
+
+	nlog.Debugf("CreateRulesOnNode: cpuEth=%s, ztunnelIP=%s", cpuEth, ztunnelIP)
+	s.warnPreflight()
+
+	dpu, err := s.getOffmeshPair(offmesh.CPUNode)
+	if err != nil {
+		return err
+	}
+	if err := s.validateCPUNodeArgs(cpuEth, ztunnelIP); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := s.firewall().initChains(ctx); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// Create ipset of pod members.
+	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L85
+	nlog.Debug("Creating ipset")
+	err = s.EnsureIpset(Ipset)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		recordDataplaneError(ipsetOperation)
+		return fmt.Errorf("error creating ipset: %v", err)
+	}
+	for _, name := range extraIpsetNames() {
+		if err := s.EnsureIpset(extraIpsets[name]); err != nil && !errors.Is(err, os.ErrExist) {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("error creating ipset %s: %v", name, err)
+		}
+	}
+	if s.enableIPv6 {
+		if err := Ipset6.CreateSet(); err != nil {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("error creating IPv6 ipset: %v", err)
+		}
+	}
+	if s.enablePortIpset {
+		if err := IpsetPort.CreateSet(); err != nil {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("error creating port ipset: %v", err)
+		}
+	}
+
+	appendRules, appendRules2 := s.cpuNodeRules(cpuEth, ztunnelIP, captureDNS)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err = s.applyNodeRules(ctx, ztunnelIP, appendRules, appendRules2)
+	if err != nil {
+		recordDataplaneError(iptablesOperation)
+		return fmt.Errorf("failed to apply iptables rules: %v", err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// rp_filter must really be disabled, otherwise martians are silently dropped, so verify these writes.
+	rpFilters, procs := cpuNodeProcs(cpuEth)
+	for _, proc := range rpFilters {
+		err = s.setProcChecked(proc, "0")
+		if err != nil {
+			return fmt.Errorf("failed to disable rp_filter: %v", err)
+		}
+	}
+	var errs error
+	for proc, val := range procs {
+		err = s.setProc(proc, val)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to write to proc file %s: %v", proc, err))
+		}
+	}
+
+	s.disableRPFilterInterfaces(s.rpFilterInterfaces(cpuEth))
+
+	if err := s.ensureWireGuard(ctx, offmesh.CPUNode, dpu.IP); err != nil {
+		recordDataplaneError(linkOperation)
+		return multierr.Append(errs, err)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	routes := s.cpuNodeRoutes(cpuEth, dpu.IP)
+
+	for _, route := range routes {
+		err = s.executor().Run(ctx, route.Cmd, route.Args...)
+		if err != nil {
+			recordDataplaneError(routeOperation)
+			if deviceGone(err) {
+				// The remaining routes use the device too, stop here.
+				return multierr.Append(errs, fmt.Errorf("%w: failed to add route (%+v): %v", ErrDeviceGone, route, err))
+			}
+			errs = multierr.Append(errs, fmt.Errorf("failed to add route (%+v): %v", route, err))
+		}
+	}
+	if err := s.addIPRules(offmesh.CPUNode); err != nil {
+		recordDataplaneError(routeOperation)
+		errs = multierr.Append(errs, fmt.Errorf("failed to add ip rules: %v", err))
+	}
+
+	return errs
+}
+
+// deviceGone reports whether err of an ip command is about a device that doesn't exist.
+func deviceGone(err error) bool {
+	return errors.Is(err, syscall.ENODEV) || strings.Contains(err.Error(), "Cannot find device")
+}
+
+// cpuNodeProcs returns the proc files CreateRulesOnCPUNode writes: the rp_filter files, which are
+// set to 0, and the other files with their values.
+func cpuNodeProcs(cpuEth string) (rpFilters []string, procs map[string]string) {
+	// Need to do some work in procfs
+	// @TODO: This likely needs to be cleaned up, there are a lot of martians in AWS
+	// that seem to necessitate this work.
+	rpFilters = []string{
+		filepath.Join(procConfDir, "default", "rp_filter"),
+		filepath.Join(procConfDir, "all", "rp_filter"),
+		filepath.Join(procConfDir, cpuEth, "rp_filter"),
+	}
+	procs = map[string]string{
+		filepath.Join(procConfDir, cpuEth, "accept_local"): "1",
+	}
+	return rpFilters, procs
+}
+
+// cpuNodeRoutes returns the ip route commands of CreateRulesOnCPUNode, in order. The ip rules
+// looking them up are added after them by addIPRules. With WireGuard, the captured traffic goes to
+// the DPU over the WireGuard link instead of cpuEth.
+func (s *Server) cpuNodeRoutes(cpuEth, dpuIP string) []*ExecList {
+	via, dev := dpuIP, cpuEth
+	if s.wireGuardEnabled() {
+		_, _, via = wireGuardLink(offmesh.CPUNode)
+		dev = constants.CPUTun
+	}
+	return []*ExecList{
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L166
+		newExec("ip",
+			[]string{
+				"route", "replace", "table", fmt.Sprint(s.routeTables.Outbound), "0.0.0.0/0",
+				"via", via, "dev", dev,
+			},
+		),
+	}
+}
+
+// validateCPUNodeArgs checks the arguments of CreateRulesOnCPUNode before anything is changed, as
+// they are used as is in the rules and ip commands, which fail cryptically on e.g. an empty IP.
+func (s *Server) validateCPUNodeArgs(cpuEth, ztunnelIP string) error {
+	if ip := net.ParseIP(ztunnelIP); ip == nil || ip.To4() == nil {
+		return fmt.Errorf("%w: %q", ErrInvalidZtunnelIP, ztunnelIP)
+	}
+	if cpuEth == "" {
+		return fmt.Errorf("%w: no CPU device given", ErrDeviceNotFound)
+	}
+	if _, err := s.netlink().LinkByName(cpuEth); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrDeviceNotFound, cpuEth, err)
+	}
+	return nil
+}
+
+// cpuNodeRules returns the iptables rules of CreateRulesOnCPUNode, in the two groups they are applied in.
+// ztunnel runs on the DPU, and the traffic it sends back to the pods comes in on cpuEth.
+func (s *Server) cpuNodeRules(cpuEth, ztunnelIP string, captureDNS bool) (appendRules, appendRules2 []*iptablesRule) {
+	marks := s.markArgs()
+	return s.nodeRules(nodeRuleSpec{
+		ztunnelIP:  ztunnelIP,
+		captureDNS: captureDNS,
 		// Make sure anything that leaves ztunnel is routed normally (xds, connections to other ztunnels,
 		// connections to upstream pods...)
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L143
-		newIptableRule(
+		fromZTunnel: newIptableRule(
 			constants.TableMangle,
 			constants.ChainZTunnelPrerouting,
 			"-i", cpuEth,
 			"-m", "set",
-			"--match-set", Ipset.Name, "dst",
+			"--match-set", ipsetName, "dst",
 			"-j", "MARK",
-			"--set-mark", constants.SkipMark,
+			"--set-mark", marks.SkipMark,
 		),
+	})
+}
 
-		// skip udp so DNS works. We can make this more granular.
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L146
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-p", "udp",
-			"-j", "MARK",
-			"--set-mark", constants.ConnSkipMark,
-		),
+// CreateRulesOnDPUNode initializes the routing, firewall and ipset rules on the node.
+// Setup stops between phases if ctx is cancelled.
+// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh
+func (s *Server) CreateRulesOnDPUNode(ctx context.Context, ztunnelVeth, ztunnelIP string, captureDNS bool) error {
+	s.setupMu.Lock()
+	defer s.setupMu.Unlock()
+	nlog := log.WithLabels("node", offmesh.DPUNode, "device", ztunnelVeth, "ip", ztunnelIP)
+	var err error
 
-		// Skip things from host ip - these are usually kubectl probes
-		// skip anything with skip mark. This can be used to add features like port exclusions
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L149
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-m", "mark",
-			"--mark", constants.SkipMark,
-			"-j", "RETURN",
-		),
+	nlog.Debugf("CreateRulesOnNode: ztunnelVeth=%s, ztunnelIP=%s", ztunnelVeth, ztunnelIP)
+	s.warnPreflight()
 
-		// Mark outbound connections to route them to the proxy using ip rules/route tables
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L151
-		// Per Yuval, interface_prefix can be left off this rule... but we should check this (hard to automate
-		// detection).
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-p", "tcp",
-			"-m", "set",
-			"--match-set", Ipset.Name, "src",
-			"-j", "MARK",
-			"--set-mark", constants.OutboundMark,
-		),
+	// The DPU serves the pods of its CPU, so there is nothing to do without one.
+	cpu, err := s.getOffmeshPair(offmesh.DPUNode)
+	if err != nil {
+		return err
 	}
 
-	err = iptablesAppend(appendRules)
-	if err != nil {
-		log.Errorf("failed to append iptables rule: %v", err)
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	err = iptablesAppend(appendRules2)
-	if err != nil {
-		log.Errorf("failed to append iptables rule: %v", err)
+	if err := s.firewall().initChains(ctx); err != nil {
+		return err
 	}
 
-	// Need to do some work in procfs
-	// @TODO: This likely needs to be cleaned up, there are a lot of martians in AWS
-	// that seem to necessitate this work.
-	procs := map[string]int{
-		"/proc/sys/net/ipv4/conf/default/rp_filter":           0,
-		"/proc/sys/net/ipv4/conf/all/rp_filter":               0,
-		"/proc/sys/net/ipv4/conf/" + cpuEth + "/rp_filter":    0,
-		"/proc/sys/net/ipv4/conf/" + cpuEth + "/accept_local": 1,
+	if err := ctx.Err(); err != nil {
+		return err
 	}
-	for proc, val := range procs {
-		err = SetProc(proc, fmt.Sprint(val))
-		if err != nil {
-			log.Errorf("failed to write to proc file %s: %v", proc, err)
+
+	// The phases of the setup are timed, to tell which is slow on a node.
+	timer := newPhaseTimer()
+
+	// Create ipset of pod members.
+	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L85
+	nlog.Debug("Creating ipset")
+	err = s.EnsureIpset(Ipset)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		recordDataplaneError(ipsetOperation)
+		return fmt.Errorf("error creating ipset: %v", err)
+	}
+	for _, name := range extraIpsetNames() {
+		if err := s.EnsureIpset(extraIpsets[name]); err != nil && !errors.Is(err, os.ErrExist) {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("error creating ipset %s: %v", name, err)
+		}
+	}
+	if s.enableIPv6 {
+		if err := Ipset6.CreateSet(); err != nil {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("error creating IPv6 ipset: %v", err)
 		}
 	}
+	if s.enablePortIpset {
+		if err := IpsetPort.CreateSet(); err != nil {
+			recordDataplaneError(ipsetOperation)
+			return fmt.Errorf("error creating port ipset: %v", err)
+		}
+	}
+	timer.done(ipsetOperation)
+
+	appendRules, appendRules2 := s.dpuNodeRules(ztunnelVeth, ztunnelIP, captureDNS)
 
-	dpuIP := offmesh.GetPair(NodeName, offmesh.CPUNode, s.offmeshCluster).IP
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	dirEntries, err := os.ReadDir("/proc/sys/net/ipv4/conf")
+	err = s.applyNodeRules(ctx, ztunnelIP, appendRules, appendRules2)
 	if err != nil {
-		log.Errorf("failed to read /proc/sys/net/ipv4/conf: %v", err)
-	}
-	for _, dirEntry := range dirEntries {
-		if dirEntry.IsDir() {
-			if _, err := os.Stat("/proc/sys/net/ipv4/conf/" + dirEntry.Name() + "/rp_filter"); err != nil {
-				err := SetProc("/proc/sys/net/ipv4/conf/"+dirEntry.Name()+"/rp_filter", "0")
-				if err != nil {
-					log.Errorf("failed to set /proc/sys/net/ipv4/conf/%s/rp_filter: %v", dirEntry.Name(), err)
-				}
+		recordDataplaneError(iptablesOperation)
+		return fmt.Errorf("failed to apply iptables rules: %v", err)
+	}
+	timer.done(iptablesOperation)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// The ztunnel pod creates its veth, possibly after node setup starts. Its proc files and routes
+	// fail without it, so wait for it first.
+	if _, err := s.linkByNameOrWait(ctx, ztunnelVeth); err != nil {
+		recordDataplaneError(linkOperation)
+		return fmt.Errorf("ztunnel veth: %w", err)
+	}
+
+	// The proc files of the tunnels and the veth are written along with the tunnels, so they are
+	// timed as the link phase.
+	if err := s.setUpDPUTunnels(ctx, ztunnelVeth, ztunnelIP); err != nil {
+		return err
+	}
+	if err := s.ensureWireGuard(ctx, offmesh.DPUNode, cpu.IP); err != nil {
+		recordDataplaneError(linkOperation)
+		return err
+	}
+	// The tunnel may have been recreated with a new index, so resolve it again for the pod routes.
+	s.resetInboundTunIndex()
+	s.inboundTunLinkIndex()
+	timer.done(linkOperation)
+
+	s.disableRPFilterInterfaces(s.rpFilterInterfaces(ztunnelVeth, constants.InboundTun, constants.OutboundTun))
+	timer.done(procOperation)
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	routes := s.dpuNodeRoutes(ztunnelVeth, ztunnelIP)
+
+	var errs error
+	for _, route := range routes {
+		err = s.executor().Run(ctx, route.Cmd, route.Args...)
+		if err != nil {
+			recordDataplaneError(routeOperation)
+			if deviceGone(err) {
+				// Without the ztunnel veth the table would be left partial, so fail for node setup
+				// to run again once ztunnel has its new veth.
+				return multierr.Append(errs, fmt.Errorf("%w: failed to add route (%+v): %v", ErrDeviceGone, route, err))
 			}
+			errs = multierr.Append(errs, fmt.Errorf("failed to add route (%+v): %v", route, err))
 		}
 	}
+	if err := s.addIPRules(offmesh.DPUNode); err != nil {
+		recordDataplaneError(routeOperation)
+		errs = multierr.Append(errs, fmt.Errorf("failed to add ip rules: %v", err))
+	}
+	timer.done(routeOperation)
+	if errs != nil {
+		return errs
+	}
+	nlog.Infof("Set up DPU node in %s", timer)
+
+	return nil
+}
 
-	routes := []*ExecList{
+// dpuNodeRoutes returns the ip route commands of CreateRulesOnDPUNode, in order. The ip rules
+// looking them up are added after them by addIPRules.
+func (s *Server) dpuNodeRoutes(ztunnelVeth, ztunnelIP string) []*ExecList {
+	return []*ExecList{
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L164
+		newExec("ip",
+			[]string{
+				"route", "replace", "table", fmt.Sprint(s.routeTables.Outbound), ztunnelIP,
+				"dev", ztunnelVeth, "scope", "link",
+			},
+		),
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L166
 		newExec("ip",
 			[]string{
-				"route", "add", "table", fmt.Sprint(constants.RouteTableOutbound), "0.0.0.0/0",
-				"via", dpuIP, "dev", cpuEth,
+				"route", "replace", "table", fmt.Sprint(s.routeTables.Outbound), "0.0.0.0/0",
+				"via", constants.ZTunnelOutboundTunIP, "dev", constants.OutboundTun,
+			},
+		),
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L168
+		newExec("ip",
+			[]string{
+				"route", "replace", "table", fmt.Sprint(s.routeTables.Proxy), ztunnelIP,
+				"dev", ztunnelVeth, "scope", "link",
 			},
 		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L62-L77
-		// Everything with the skip mark goes directly to the main table
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L169
 		newExec("ip",
 			[]string{
-				"rule", "add", "priority", "100",
-				"fwmark", fmt.Sprint(constants.SkipMark),
-				"goto", "32766",
+				"route", "replace", "table", fmt.Sprint(s.routeTables.Proxy), "0.0.0.0/0",
+				"via", ztunnelIP, "dev", ztunnelVeth, "onlink",
 			},
 		),
-		// Everything with the outbound mark goes to the tunnel out device
-		// using the outbound route table
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L171
 		newExec("ip",
 			[]string{
-				"rule", "add", "priority", "101",
-				"fwmark", fmt.Sprint(constants.OutboundMark),
-				"lookup", fmt.Sprint(constants.RouteTableOutbound),
+				"route", "replace", "table", fmt.Sprint(s.routeTables.Inbound), ztunnelIP,
+				"dev", ztunnelVeth, "scope", "link",
 			},
 		),
 	}
+}
 
-	for _, route := range routes {
-		err = execute(route.Cmd, route.Args...)
-		if err != nil {
-			log.Errorf(fmt.Errorf("failed to add route (%+v): %v", route, err))
-		}
-	}
-
-	return nil
+// dpuNodeRules returns the iptables rules of CreateRulesOnDPUNode, in the two groups they are applied in.
+func (s *Server) dpuNodeRules(ztunnelVeth, ztunnelIP string, captureDNS bool) (appendRules, appendRules2 []*iptablesRule) {
+	marks := s.markArgs()
+	return s.nodeRules(nodeRuleSpec{
+		tunnels:     []string{constants.InboundTun, constants.OutboundTun},
+		ztunnelVeth: ztunnelVeth,
+		ztunnelIP:   ztunnelIP,
+		captureDNS:  captureDNS,
+		// Make sure anything that leaves ztunnel is routed normally (xds, connections to other ztunnels,
+		// connections to upstream pods...)
+		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L143
+		fromZTunnel: newIptableRule(
+			constants.TableMangle,
+			constants.ChainZTunnelPrerouting,
+			"-i", ztunnelVeth,
+			"-j", "MARK",
+			"--set-mark", marks.ConnSkipMark,
+		),
+	})
 }
 
-// CreateRulesOnDPUNode initializes the routing, firewall and ipset rules on the node.
-// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh
-func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS bool) error {
-	var err error
+// nodeRuleSpec holds what the iptables rules of the CPU and DPU node setups differ in.
+type nodeRuleSpec struct {
+	// tunnels are the tunnels to ztunnel on the node, whose traffic isn't captured.
+	tunnels []string
+	// ztunnelVeth is the veth of the ztunnel pod if it runs on the node, which then proxies with
+	// original src.
+	ztunnelVeth string
+	ztunnelIP   string
+	captureDNS  bool
+	// fromZTunnel marks the traffic coming back from ztunnel, to route it normally.
+	fromZTunnel *iptablesRule
+}
 
-	log.Debugf("CreateRulesOnNode: ztunnelVeth=%s, ztunnelIP=%s", ztunnelVeth, ztunnelIP)
+// nodeRules returns the iptables rules of the node setup described by spec, in the two groups they
+// are applied in. The CPU and DPU node setups share it, so that the rules they have in common are
+// the same and in the same order.
+func (s *Server) nodeRules(spec nodeRuleSpec) (appendRules, appendRules2 []*iptablesRule) {
+	appendRules = append(appendRules, s.tunnelSkipRules(spec.tunnels)...)
+	appendRules = append(appendRules, s.connMarkSaveRules(spec.ztunnelVeth != "")...)
+	appendRules = append(appendRules, s.hostRules()...)
+	// Skip the traffic of the excluded host processes along with that of the host IP.
+	appendRules = append(appendRules, s.ownerExclusionRules()...)
 
-	// Check if chain exists, if it exists flush.. otherwise initialize
-	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L28
-	err = execute(IptablesCmd, "-t", "mangle", "-C", "output", "-j", constants.ChainZTunnelOutput)
-	if err == nil {
-		log.Debugf("Chain %s already exists, flushing", constants.ChainOutput)
-		s.flushLists()
-	} else {
-		log.Debugf("Initializing lists")
-		err = s.initializeLists()
-		if err != nil {
-			return err
-		}
+	if spec.captureDNS {
+		appendRules = append(appendRules, s.dnsCaptureRules(spec.ztunnelIP)...)
 	}
 
-	// Create ipset of pod members.
-	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L85
-	log.Debug("Creating ipset")
-	err = Ipset.CreateSet()
-	if err != nil && !errors.Is(err, os.ErrExist) {
-		return fmt.Errorf("error creating ipset: %v", err)
+	if len(spec.tunnels) > 0 {
+		appendRules2 = append(appendRules2, s.tunnelPortRule())
+	}
+	appendRules2 = append(appendRules2, s.connMarkRestoreRules()...)
+	if spec.ztunnelVeth != "" {
+		appendRules2 = append(appendRules2, s.proxyRules(spec.ztunnelVeth, spec.ztunnelIP)...)
 	}
 
-	appendRules := []*iptablesRule{
-		// Skip things that come from the tunnels, but don't apply the conn skip mark
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L88
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-i", constants.InboundTun,
-			"-j", "MARK",
-			"--set-mark", constants.SkipMark,
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L89
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-i", constants.InboundTun,
-			"-j", "RETURN",
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L90
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-i", constants.OutboundTun,
-			"-j", "MARK",
-			"--set-mark", constants.SkipMark,
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L91
-		newIptableRule(constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-i", constants.OutboundTun,
-			"-j", "RETURN",
-		),
+	// Traffic to the excluded CIDRs, and to link-local and multicast destinations, is marked ahead
+	// of the rules skipping ztunnel traffic.
+	appendRules2 = append(appendRules2, s.cidrExclusionRules()...)
+	appendRules2 = append(appendRules2, s.linkLocalMulticastRules()...)
+	appendRules2 = append(appendRules2, spec.fromZTunnel)
+	appendRules2 = append(appendRules2, s.captureRules()...)
+
+	return ipsetRules(appendRules), ipsetRules(appendRules2)
+}
+
+// tunnelSkipRules skips the traffic coming from the tunnels, without the conn skip mark.
+func (s *Server) tunnelSkipRules(tunnels []string) []*iptablesRule {
+	marks := s.markArgs()
+	var rules []*iptablesRule
+	for _, tun := range tunnels {
+		rules = append(rules,
+			// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L88-L91
+			newIptableRule(
+				constants.TableMangle,
+				constants.ChainZTunnelPrerouting,
+				"-i", tun,
+				"-j", "MARK",
+				"--set-mark", marks.SkipMark,
+			),
+			newIptableRule(
+				constants.TableMangle,
+				constants.ChainZTunnelPrerouting,
+				"-i", tun,
+				"-j", "RETURN",
+			),
+		)
+	}
+	return rules
+}
 
+// connMarkSaveRules saves the skip mark, and the proxy mark if ztunnel proxies on the node, to the
+// conn mark.
+func (s *Server) connMarkSaveRules(proxy bool) []*iptablesRule {
+	marks := s.markArgs()
+	rules := []*iptablesRule{
 		// Make sure that whatever is skipped is also skipped for returning packets.
 		// If we have a skip mark, save it to conn mark.
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L95
@@ -588,11 +1762,11 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableMangle,
 			constants.ChainZTunnelForward,
 			"-m", "mark",
-			"--mark", constants.ConnSkipMark,
+			"--mark", marks.ConnSkipMark,
 			"-j", "CONNMARK",
 			"--save-mark",
-			"--nfmask", constants.ConnSkipMask,
-			"--ctmask", constants.ConnSkipMask,
+			"--nfmask", marks.ConnSkipMask,
+			"--ctmask", marks.ConnSkipMask,
 		),
 		// Input chain might be needed for things in host namespace that are skipped.
 		// Place the mark here after routing was done, not sure if conn-tracking will figure
@@ -602,13 +1776,17 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableMangle,
 			constants.ChainZTunnelInput,
 			"-m", "mark",
-			"--mark", constants.ConnSkipMark,
+			"--mark", marks.ConnSkipMark,
 			"-j", "CONNMARK",
 			"--save-mark",
-			"--nfmask", constants.ConnSkipMask,
-			"--ctmask", constants.ConnSkipMask,
+			"--nfmask", marks.ConnSkipMask,
+			"--ctmask", marks.ConnSkipMask,
 		),
-
+	}
+	if !proxy {
+		return rules
+	}
+	return append(rules,
 		// For things with the proxy mark, we need different routing just on returning packets
 		// so we give a different mark to them.
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L103
@@ -616,30 +1794,39 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableMangle,
 			constants.ChainZTunnelForward,
 			"-m", "mark",
-			"--mark", constants.ProxyMark,
+			"--mark", marks.ProxyMark,
 			"-j", "CONNMARK",
 			"--save-mark",
-			"--nfmask", constants.ProxyMask,
-			"--ctmask", constants.ProxyMask,
+			"--nfmask", marks.ProxyMask,
+			"--ctmask", marks.ProxyMask,
 		),
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L104
 		newIptableRule(
 			constants.TableMangle,
 			constants.ChainZTunnelInput,
 			"-m", "mark",
-			"--mark", constants.ProxyMark,
+			"--mark", marks.ProxyMark,
 			"-j", "CONNMARK",
 			"--save-mark",
-			"--nfmask", constants.ProxyMask,
-			"--ctmask", constants.ProxyMask,
+			"--nfmask", marks.ProxyMask,
+			"--ctmask", marks.ProxyMask,
 		),
+	)
+}
+
+// hostRules skips the traffic of the host IP, and keeps kube-proxy away from outbound traffic.
+func (s *Server) hostRules() []*iptablesRule {
+	marks := s.markArgs()
+	return []*iptablesRule{
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L106
+		// Like the other skip marks, the mark is set under its mask, so that the other bits of the
+		// mark of host traffic, e.g. those of other dataplanes, are kept.
 		newIptableRule(
 			constants.TableMangle,
 			constants.ChainZTunnelOutput,
-			"--source", HostIP,
+			"--source", s.hostIP,
 			"-j", "MARK",
-			"--set-mark", constants.ConnSkipMask,
+			"--set-mark", marks.ConnSkipMark,
 		),
 
 		// If we have an outbound mark, we don't need kube-proxy to do anything,
@@ -649,7 +1836,7 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableNat,
 			constants.ChainZTunnelPrerouting,
 			"-m", "mark",
-			"--mark", constants.OutboundMark,
+			"--mark", marks.OutboundMark,
 			"-j", "ACCEPT",
 		),
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L123
@@ -657,39 +1844,31 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableNat,
 			constants.ChainZTunnelPostrouting,
 			"-m", "mark",
-			"--mark", constants.OutboundMark,
+			"--mark", marks.OutboundMark,
 			"-j", "ACCEPT",
 		),
 	}
+}
 
-	if captureDNS {
-		appendRules = append(appendRules,
-			newIptableRule(
-				constants.TableNat,
-				constants.ChainZTunnelPrerouting,
-				"-p", "udp",
-				"-m", "set",
-				"--match-set", Ipset.Name, "src",
-				"--dport", "53",
-				"-j", "DNAT",
-				"--to", fmt.Sprintf("%s:%d", ztunnelIP, constants.DNSCapturePort),
-			),
-		)
-	}
-
-	appendRules2 := []*iptablesRule{
-		// Don't set anything on the tunnel (geneve port is 6081), as the tunnel copies
-		// the mark to the un-tunneled packet.
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L126
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-p", "udp",
-			"-m", "udp",
-			"--dport", "6081",
-			"-j", "RETURN",
-		),
+// tunnelPortRule leaves the packets of the tunnels alone.
+func (s *Server) tunnelPortRule() *iptablesRule {
+	// Don't set anything on the tunnel (the geneve port of the tunnels), as the tunnel copies
+	// the mark to the un-tunneled packet.
+	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L126
+	return newIptableRule(
+		constants.TableMangle,
+		constants.ChainZTunnelPrerouting,
+		"-p", "udp",
+		"-m", "udp",
+		"--dport", strconv.Itoa(int(s.tunnelOptions.port())),
+		"-j", "RETURN",
+	)
+}
 
+// connMarkRestoreRules restores the skip mark from the conn mark, and skips what has it.
+func (s *Server) connMarkRestoreRules() []*iptablesRule {
+	marks := s.markArgs()
+	return []*iptablesRule{
 		// If we have the conn mark, restore it to mark, to make sure that the other side of the connection
 		// is skipped as well.
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L129-L130
@@ -697,18 +1876,24 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableMangle,
 			constants.ChainZTunnelPrerouting,
 			"-m", "connmark",
-			"--mark", constants.ConnSkipMark,
+			"--mark", marks.ConnSkipMark,
 			"-j", "MARK",
-			"--set-mark", constants.SkipMark,
+			"--set-mark", marks.SkipMark,
 		),
 		newIptableRule(
 			constants.TableMangle,
 			constants.ChainZTunnelPrerouting,
 			"-m", "mark",
-			"--mark", constants.SkipMark,
+			"--mark", marks.SkipMark,
 			"-j", "RETURN",
 		),
+	}
+}
 
+// proxyRules route the original src traffic of the ztunnel on ztunnelVeth.
+func (s *Server) proxyRules(ztunnelVeth, ztunnelIP string) []*iptablesRule {
+	marks := s.markArgs()
+	return []*iptablesRule{
 		// If we have the proxy mark in, set the return mark to make sure that original src packets go to ztunnel
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L133-L134
 		newIptableRule(
@@ -716,15 +1901,15 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.ChainZTunnelPrerouting,
 			"!", "-i", ztunnelVeth,
 			"-m", "connmark",
-			"--mark", constants.ProxyMark,
+			"--mark", marks.ProxyMark,
 			"-j", "MARK",
-			"--set-mark", constants.ProxyRetMark,
+			"--set-mark", marks.ProxyRetMark,
 		),
 		newIptableRule(
 			constants.TableMangle,
 			constants.ChainZTunnelPrerouting,
 			"-m", "mark",
-			"--mark", constants.ProxyRetMark,
+			"--mark", marks.ProxyRetMark,
 			"-j", "RETURN",
 		),
 
@@ -738,27 +1923,23 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			"-i", ztunnelVeth,
 			"!", "--source", ztunnelIP,
 			"-j", "MARK",
-			"--set-mark", constants.ProxyMark,
+			"--set-mark", marks.ProxyMark,
 		),
 		newIptableRule(
 			constants.TableMangle,
 			constants.ChainZTunnelPrerouting,
 			"-m", "mark",
-			"--mark", constants.SkipMark,
+			"--mark", marks.SkipMark,
 			"-j", "RETURN",
 		),
+	}
+}
 
-		// Make sure anything that leaves ztunnel is routed normally (xds, connections to other ztunnels,
-		// connections to upstream pods...)
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L143
-		newIptableRule(
-			constants.TableMangle,
-			constants.ChainZTunnelPrerouting,
-			"-i", ztunnelVeth,
-			"-j", "MARK",
-			"--set-mark", constants.ConnSkipMark,
-		),
-
+// captureRules skip UDP and the excluded ports, and mark the outbound TCP connections of the mesh
+// pods, which the ip rules then route to ztunnel.
+func (s *Server) captureRules() []*iptablesRule {
+	marks := s.markArgs()
+	rules := []*iptablesRule{
 		// skip udp so DNS works. We can make this more granular.
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L146
 		newIptableRule(
@@ -766,9 +1947,14 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.ChainZTunnelPrerouting,
 			"-p", "udp",
 			"-j", "MARK",
-			"--set-mark", constants.ConnSkipMark,
+			"--set-mark", marks.ConnSkipMark,
 		),
+	}
 
+	// Port exclusions must come before the skip mark is checked for the last time, so that they take
+	// precedence over the outbound mark.
+	rules = append(rules, s.portExclusionRules()...)
+	rules = append(rules,
 		// Skip things from host ip - these are usually kubectl probes
 		// skip anything with skip mark. This can be used to add features like port exclusions
 		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L149
@@ -776,7 +1962,7 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.TableMangle,
 			constants.ChainZTunnelPrerouting,
 			"-m", "mark",
-			"--mark", constants.SkipMark,
+			"--mark", marks.SkipMark,
 			"-j", "RETURN",
 		),
 
@@ -789,279 +1975,380 @@ func (s *Server) CreateRulesOnDPUNode(ztunnelVeth, ztunnelIP string, captureDNS
 			constants.ChainZTunnelPrerouting,
 			"-p", "tcp",
 			"-m", "set",
-			"--match-set", Ipset.Name, "src",
+			"--match-set", ipsetName, "src",
 			"-j", "MARK",
-			"--set-mark", constants.OutboundMark,
+			"--set-mark", marks.OutboundMark,
 		),
-	}
+	)
+	return append(rules, s.portCaptureRules()...)
+}
 
-	err = iptablesAppend(appendRules)
-	if err != nil {
-		log.Errorf("failed to append iptables rule: %v", err)
+func (s *Server) cleanup() {
+	log.Infof("server terminated, cleaning up")
+	if err := s.uninstall(offmesh.MyNodeType(s.nodeName, s.offmeshCluster)); err != nil {
+		log.Warnf("Cleanup finished with failed steps: %v", err)
+	} else {
+		log.Infof("Cleanup finished")
 	}
+}
 
-	err = iptablesAppend(appendRules2)
-	if err != nil {
-		log.Errorf("failed to append iptables rule: %v", err)
+// Uninstall undoes the node setup of CreateRulesOnCPUNode if cpu, or else of CreateRulesOnDPUNode.
+// It deletes exactly the chains, routes, ip rules and links the setup created, destroys the ipsets
+// and restores the proc files. Every step is attempted, so that one failure doesn't leave the rest
+// of the node set up, and the failures are returned together.
+func (s *Server) Uninstall(cpu bool) error {
+	if cpu {
+		return s.uninstall(offmesh.CPUNode)
 	}
+	return s.uninstall(offmesh.DPUNode)
+}
 
-	// Need to do some work in procfs
-	// @TODO: This likely needs to be cleaned up, there are a lot of martians in AWS
-	// that seem to necessitate this work.
-	procs := map[string]int{
-		"/proc/sys/net/ipv4/conf/default/rp_filter":                0,
-		"/proc/sys/net/ipv4/conf/all/rp_filter":                    0,
-		"/proc/sys/net/ipv4/conf/" + ztunnelVeth + "/rp_filter":    0,
-		"/proc/sys/net/ipv4/conf/" + ztunnelVeth + "/accept_local": 1,
-	}
-	for proc, val := range procs {
-		err = SetProc(proc, fmt.Sprint(val))
+// uninstall undoes the node setup for a node of nodeType. For other node types, which have no
+// routes, ip rules or links, only the chains, ipsets and proc files are cleaned up.
+func (s *Server) uninstall(nodeType string) error {
+	s.setupMu.Lock()
+	defer s.setupMu.Unlock()
+	// The server context is usually already done by now, so don't use it.
+	ctx := context.Background()
+	s.firewall().deleteChains(ctx)
+
+	var errs error
+	step := func(name string, err error) {
 		if err != nil {
-			log.Errorf("failed to write to proc file %s: %v", proc, err)
+			log.Warnf("Error cleaning up %s: %v", name, err)
+			errs = multierr.Append(errs, fmt.Errorf("%s: %v", name, err))
 		}
 	}
 
-	// Create tunnels
-	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L153-L161
-	inbnd := &netlink.Geneve{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: constants.InboundTun,
-		},
-		ID:     1000,
-		Remote: net.ParseIP(ztunnelIP),
+	var tables []int
+	var links []string
+	switch nodeType {
+	case offmesh.CPUNode:
+		tables = []int{s.routeTables.Outbound}
+	case offmesh.DPUNode:
+		tables = []int{s.routeTables.Inbound, s.routeTables.Outbound, s.routeTables.Proxy}
+		links = []string{constants.InboundTun, constants.OutboundTun}
 	}
-	log.Debugf("Building inbound tunnel: %+v", inbnd)
-	err = netlink.LinkAdd(inbnd)
-	if err != nil {
-		log.Errorf("failed to add inbound tunnel: %v", err)
+	for _, table := range tables {
+		n, err := s.routeFlushTable(table)
+		log.Infof("Flushed %d routes from route table %d", n, table)
+		step(fmt.Sprintf("route table %d", table), err)
 	}
-	err = netlink.AddrAdd(inbnd, &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   net.ParseIP(constants.InboundTunIP),
-			Mask: net.CIDRMask(constants.TunPrefix, 32),
-		},
-	})
-	if err != nil {
-		log.Errorf("failed to add inbound tunnel address: %v", err)
+	if rules := s.ipRules(nodeType); len(rules) > 0 {
+		n, err := s.deleteIPRules(rules)
+		log.Infof("Deleted %d ip rules", n)
+		step("ip rules", err)
 	}
 
-	outbnd := &netlink.Geneve{
-		LinkAttrs: netlink.LinkAttrs{
-			Name: constants.OutboundTun,
-		},
-		ID:     1001,
-		Remote: net.ParseIP(ztunnelIP),
+	// Delete tunnel links
+	for _, name := range links {
+		step("tunnel "+name, s.netlink().LinkDel(&netlink.Geneve{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: name,
+			},
+		}))
 	}
-	log.Debugf("Building outbound tunnel: %+v", outbnd)
-	err = netlink.LinkAdd(outbnd)
-	if err != nil {
-		log.Errorf("failed to add outbound tunnel: %v", err)
+	if len(links) > 0 {
+		s.resetInboundTunIndex()
 	}
-	err = netlink.AddrAdd(outbnd, &netlink.Addr{
-		IPNet: &net.IPNet{
-			IP:   net.ParseIP(constants.OutboundTunIP),
-			Mask: net.CIDRMask(constants.TunPrefix, 32),
-		},
-	})
-	if err != nil {
-		log.Errorf("failed to add outbound tunnel address: %v", err)
+	if s.wireGuardEnabled() && len(tables) > 0 {
+		name, _, _ := wireGuardLink(nodeType)
+		step("wireguard link "+name, s.netlink().LinkDel(&netlink.Wireguard{
+			LinkAttrs: netlink.LinkAttrs{
+				Name: name,
+			},
+		}))
 	}
 
-	err = netlink.LinkSetUp(inbnd)
-	if err != nil {
-		log.Errorf("failed to set inbound tunnel up: %v", err)
+	step("ipset", Ipset.DestroySet())
+	for _, name := range extraIpsetNames() {
+		step("ipset "+name, extraIpsets[name].DestroySet())
 	}
-	err = netlink.LinkSetUp(outbnd)
-	if err != nil {
-		log.Errorf("failed to set outbound tunnel up: %v", err)
+	if s.enableIPv6 {
+		step("IPv6 ipset", Ipset6.DestroySet())
+	}
+	if s.enablePortIpset {
+		step("port ipset", IpsetPort.DestroySet())
 	}
 
-	procs = map[string]int{
-		"/proc/sys/net/ipv4/conf/" + constants.InboundTun + "/rp_filter":     0,
-		"/proc/sys/net/ipv4/conf/" + constants.InboundTun + "/accept_local":  1,
-		"/proc/sys/net/ipv4/conf/" + constants.OutboundTun + "/rp_filter":    0,
-		"/proc/sys/net/ipv4/conf/" + constants.OutboundTun + "/accept_local": 1,
+	s.restoreProcs()
+	return errs
+}
+
+// ipRules returns the ip rules added by the node setup for a node of nodeType, as RuleList lists
+// them.
+func (s *Server) ipRules(nodeType string) []netlink.Rule {
+	marks := s.markArgs()
+	rule := func(priority int, mark string, table, gotoPriority int) netlink.Rule {
+		r := *netlink.NewRule()
+		r.Family = netlink.FAMILY_V4
+		r.Priority = priority
+		r.Table = table
+		r.Goto = gotoPriority
+		if mark != "" {
+			r.Mark, r.Mask = parseMark(mark)
+		}
+		return r
+	}
+	// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L62-L77
+	rules := []netlink.Rule{
+		// Everything with the skip mark goes directly to the main table. The goto rule has no table.
+		rule(100, marks.SkipMark, 0, 32766),
+		// Everything with the outbound mark goes to the tunnel out device using the outbound route
+		// table.
+		rule(101, marks.OutboundMark, s.routeTables.Outbound, -1),
+	}
+	switch nodeType {
+	case offmesh.CPUNode:
+		return rules
+	case offmesh.DPUNode:
+		return append(rules,
+			// Things with the proxy return mark go directly to the proxy veth using the proxy route
+			// table (useful for original src).
+			rule(102, marks.ProxyRetMark, s.routeTables.Proxy, -1),
+			// Send all traffic to the inbound table. This table has routes only to pods in the
+			// mesh. It does not have a catch-all route, so if a route is missing, the search will
+			// continue allowing us to override routing just for member pods.
+			rule(103, "", s.routeTables.Inbound, -1))
 	}
-	for proc, val := range procs {
-		err = SetProc(proc, fmt.Sprint(val))
-		if err != nil {
-			log.Errorf("failed to write to proc file %s: %v", proc, err)
+	return nil
+}
+
+// addIPRules adds the ip rules of nodeType, in order of priority, skipping those already in place.
+// A failed addition doesn't stop the rest from being added, the errors are returned together.
+func (s *Server) addIPRules(nodeType string) error {
+	existing := s.existingIPRules(nodeType)
+	var errs error
+	for _, rule := range s.ipRules(nodeType) {
+		if existing[rule.Priority] {
+			log.Debugf("ip rule %d already exists, not adding it again", rule.Priority)
+			continue
+		}
+		rule := rule
+		if err := s.netlink().RuleAdd(&rule); err != nil && !errors.Is(err, syscall.EEXIST) {
+			errs = multierr.Append(errs, &NetlinkError{Op: "RuleAdd", Err: err})
 		}
 	}
+	return errs
+}
 
-	dirEntries, err := os.ReadDir("/proc/sys/net/ipv4/conf")
+// existingIPRules returns the priorities of the ip rules of nodeType which are already in place,
+// e.g. from a previous setup. Adding a rule doesn't fail on every kernel when it exists but may add
+// a duplicate, so node setup skips these. If the rules can't be listed, none are skipped.
+func (s *Server) existingIPRules(nodeType string) map[int]bool {
+	rules, err := s.netlink().RuleList(netlink.FAMILY_V4)
 	if err != nil {
-		log.Errorf("failed to read /proc/sys/net/ipv4/conf: %v", err)
-	}
-	for _, dirEntry := range dirEntries {
-		if dirEntry.IsDir() {
-			if _, err := os.Stat("/proc/sys/net/ipv4/conf/" + dirEntry.Name() + "/rp_filter"); err != nil {
-				err := SetProc("/proc/sys/net/ipv4/conf/"+dirEntry.Name()+"/rp_filter", "0")
-				if err != nil {
-					log.Errorf("failed to set /proc/sys/net/ipv4/conf/%s/rp_filter: %v", dirEntry.Name(), err)
-				}
+		log.Warnf("Failed to list ip rules, adding them all: %v", &NetlinkError{Op: "RuleList", Err: err})
+		return nil
+	}
+	existing := map[int]bool{}
+	for _, want := range s.ipRules(nodeType) {
+		for _, rule := range rules {
+			if matchesIPRule(rule, []netlink.Rule{want}) {
+				existing[want.Priority] = true
+				break
 			}
 		}
 	}
+	return existing
+}
 
-	routes := []*ExecList{
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L164
-		newExec("ip",
-			[]string{
-				"route", "add", "table", fmt.Sprint(constants.RouteTableOutbound), ztunnelIP,
-				"dev", ztunnelVeth, "scope", "link",
-			},
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L166
-		newExec("ip",
-			[]string{
-				"route", "add", "table", fmt.Sprint(constants.RouteTableOutbound), "0.0.0.0/0",
-				"via", constants.ZTunnelOutboundTunIP, "dev", constants.OutboundTun,
-			},
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L168
-		newExec("ip",
-			[]string{
-				"route", "add", "table", fmt.Sprint(constants.RouteTableProxy), ztunnelIP,
-				"dev", ztunnelVeth, "scope", "link",
-			},
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L169
-		newExec("ip",
-			[]string{
-				"route", "add", "table", fmt.Sprint(constants.RouteTableProxy), "0.0.0.0/0",
-				"via", ztunnelIP, "dev", ztunnelVeth, "onlink",
-			},
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L171
-		newExec("ip",
-			[]string{
-				"route", "add", "table", fmt.Sprint(constants.RouteTableInbound), ztunnelIP,
-				"dev", ztunnelVeth, "scope", "link",
-			},
-		),
-		// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L62-L77
-		// Everything with the skip mark goes directly to the main table
-		newExec("ip",
-			[]string{
-				"rule", "add", "priority", "100",
-				"fwmark", fmt.Sprint(constants.SkipMark),
-				"goto", "32766",
-			},
-		),
-		// Everything with the outbound mark goes to the tunnel out device
-		// using the outbound route table
-		newExec("ip",
-			[]string{
-				"rule", "add", "priority", "101",
-				"fwmark", fmt.Sprint(constants.OutboundMark),
-				"lookup", fmt.Sprint(constants.RouteTableOutbound),
-			},
-		),
-		// Things with the proxy return mark go directly to the proxy veth using the proxy
-		// route table (useful for original src)
-		newExec("ip",
-			[]string{
-				"rule", "add", "priority", "102",
-				"fwmark", fmt.Sprint(constants.ProxyRetMark),
-				"lookup", fmt.Sprint(constants.RouteTableProxy),
-			},
-		),
-		// Send all traffic to the inbound table. This table has routes only to pods in the mesh.
-		// It does not have a catch-all route, so if a route is missing, the search will continue
-		// allowing us to override routing just for member pods.
-		newExec("ip",
-			[]string{
-				"rule", "add", "priority", "103",
-				"table", fmt.Sprint(constants.RouteTableInbound),
-			},
-		),
-	}
+// parseMark parses a value/mask mark, such as constants.SkipMark.
+func parseMark(mark string) (value, mask int) {
+	v, m, _ := strings.Cut(mark, "/")
+	parsedV, _ := strconv.ParseUint(v, 0, 32)
+	parsedM, _ := strconv.ParseUint(m, 0, 32)
+	return int(parsedV), int(parsedM)
+}
 
-	for _, route := range routes {
-		err = execute(route.Cmd, route.Args...)
-		if err != nil {
-			log.Errorf(fmt.Errorf("failed to add route (%+v): %v", route, err))
+// deleteIPRules deletes the ip rules matching any of want, and returns how many were deleted. The
+// rules are matched on their priority, fwmark, table and goto target rather than on the priority
+// alone, so that the rules other components added with the same priorities are left alone.
+func (s *Server) deleteIPRules(want []netlink.Rule) (int, error) {
+	rules, err := s.netlink().RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		return 0, &NetlinkError{Op: "RuleList", Err: err}
+	}
+	n := 0
+	var errs error
+	for _, rule := range rules {
+		if !matchesIPRule(rule, want) {
+			continue
+		}
+		rule := rule
+		if err := s.netlink().RuleDel(&rule); err != nil {
+			errs = multierr.Append(errs, &NetlinkError{Op: "RuleDel", Err: err})
+			continue
 		}
+		n++
 	}
-
-	return nil
+	return n, errs
 }
 
-func (s *Server) cleanup() {
-	log.Infof("server terminated, cleaning up")
-	s.cleanRules()
-
-	var exec []*ExecList
-	if offmesh.MyNodeType(NodeName, s.offmeshCluster) == offmesh.CPUNode {
-		_ = routeFlushTable(constants.RouteTableOutbound)
-		exec = []*ExecList{
-			newExec("ip", []string{"rule", "del", "priority", "100"}),
-			newExec("ip", []string{"rule", "del", "priority", "101"}),
-		}
-	} else if offmesh.MyNodeType(NodeName, s.offmeshCluster) == offmesh.DPUNode {
-		_ = routeFlushTable(constants.RouteTableInbound)
-		_ = routeFlushTable(constants.RouteTableOutbound)
-		_ = routeFlushTable(constants.RouteTableProxy)
-		exec = []*ExecList{
-			newExec("ip", []string{"rule", "del", "priority", "100"}),
-			newExec("ip", []string{"rule", "del", "priority", "101"}),
-			newExec("ip", []string{"rule", "del", "priority", "102"}),
-			newExec("ip", []string{"rule", "del", "priority", "103"}),
-		}
-	}
-	for _, e := range exec {
-		err := execute(e.Cmd, e.Args...)
-		if err != nil {
-			log.Warnf("Error running command %v %v: %v", e.Cmd, strings.Join(e.Args, " "), err)
+// matchesIPRule reports whether rule matches any of want.
+func matchesIPRule(rule netlink.Rule, want []netlink.Rule) bool {
+	for _, w := range want {
+		if rule.Priority == w.Priority && rule.Mark == w.Mark && rule.Mask == w.Mask &&
+			rule.Table == w.Table && rule.Goto == w.Goto {
+			return true
 		}
 	}
+	return false
+}
 
-	// Delete tunnel links
-	if offmesh.MyNodeType(NodeName, s.offmeshCluster) == offmesh.DPUNode {
-		err := netlink.LinkDel(&netlink.Geneve{
-			LinkAttrs: netlink.LinkAttrs{
-				Name: constants.InboundTun,
-			},
-		})
-		if err != nil {
-			log.Warnf("error deleting inbound tunnel: %v", err)
-		}
-		err = netlink.LinkDel(&netlink.Geneve{
-			LinkAttrs: netlink.LinkAttrs{
-				Name: constants.OutboundTun,
-			},
-		})
-		if err != nil {
-			log.Warnf("error deleting outbound tunnel: %v", err)
+// routeFlushTable deletes the routes of table, and returns how many were deleted. A large count
+// for a table that should be mostly empty, e.g. inbound after the pods left, points at a leak.
+func (s *Server) routeFlushTable(table int) (int, error) {
+	routes, err := s.netlink().RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, &NetlinkError{Op: "RouteList", Err: err}
+	}
+	return routesDelete(s.netlink(), routes)
+}
+
+// routesDelete deletes the routes, and returns how many were deleted. A failed deletion doesn't
+// stop the rest from being deleted, the errors are returned together.
+func routesDelete(nl NetlinkHandle, routes []netlink.Route) (int, error) {
+	var errs error
+	deleted := 0
+	for _, r := range routes {
+		r := r
+		if err := nl.RouteDel(&r); err != nil {
+			errs = multierr.Append(errs, &NetlinkError{Op: "RouteDel", Err: err})
+			continue
 		}
+		deleted++
 	}
+	return deleted, errs
+}
 
-	_ = Ipset.DestroySet()
+func SetProc(path string, value string) error {
+	if dryRun {
+		fmt.Fprintf(dryRunOut, "echo %s > %s\n", shellQuote(value), shellQuote(path))
+		return nil
+	}
+	err := os.WriteFile(path, []byte(value), 0o644)
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("%w: %v", ErrPermission, err)
+	}
+	return err
 }
 
-func routeFlushTable(table int) error {
-	routes, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+// GetProc returns the value of a proc file, without the trailing newline.
+func GetProc(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// SetProcChecked is like SetProc, but reads the value back and fails if it didn't stick, which
+// happens for some proc files on some kernels. The write is skipped if the file already has value.
+func SetProcChecked(path string, value string) error {
+	if dryRun {
+		return SetProc(path, value)
+	}
+	if cur, err := GetProc(path); err == nil && cur == value {
+		return nil
+	}
+	if err := SetProc(path, value); err != nil {
 		return err
 	}
-	err = routesDelete(routes)
+	got, err := GetProc(path)
 	if err != nil {
-		return err
+		return fmt.Errorf("failed to read back %s: %v", path, err)
+	}
+	if got != value {
+		return fmt.Errorf("wrote %q to %s but read back %q", value, path, got)
 	}
 	return nil
 }
 
-func routesDelete(routes []netlink.Route) error {
-	for _, r := range routes {
-		err := netlink.RouteDel(&r)
-		if err != nil {
-			return err
-		}
+// setProc writes a proc file, first saving its original value so that cleanup can restore it.
+func (s *Server) setProc(path string, value string) error {
+	s.saveProc(path)
+	err := SetProc(path, value)
+	if err != nil {
+		recordDataplaneError(procOperation)
 	}
-	return nil
+	return err
 }
 
-func SetProc(path string, value string) error {
-	return os.WriteFile(path, []byte(value), 0o644)
+// procWriteConcurrency is the number of proc files setProcs writes at once. It is a variable for
+// tests.
+var procWriteConcurrency = 16
+
+// setProcs writes the proc files, as setProc, concurrently. The writes are best effort: failures
+// are logged.
+func (s *Server) setProcs(procs map[string]string) {
+	var g errgroup.Group
+	g.SetLimit(procWriteConcurrency)
+	if dryRun {
+		// Keep the dry-run script in order.
+		g.SetLimit(1)
+	}
+	paths := make([]string, 0, len(procs))
+	for path := range procs {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		path, value := path, procs[path]
+		g.Go(func() error {
+			if err := s.setProc(path, value); err != nil {
+				log.Errorf("failed to write to proc file %s: %v", path, err)
+			}
+			return nil
+		})
+	}
+	_ = g.Wait()
+}
+
+// setProcChecked is the SetProcChecked equivalent of setProc.
+func (s *Server) setProcChecked(path string, value string) error {
+	s.saveProc(path)
+	err := SetProcChecked(path, value)
+	if err != nil {
+		recordDataplaneError(procOperation)
+	}
+	return err
+}
+
+// saveProc saves the value of a proc file for restoreProcs. Only the value from before the first
+// write by s is kept.
+func (s *Server) saveProc(path string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.origProcs[path]; ok {
+		return
+	}
+	orig, err := GetProc(path)
+	if err != nil {
+		log.Debugf("Unable to read original value of %s, it will not be restored: %v", path, err)
+		return
+	}
+	if s.origProcs == nil {
+		s.origProcs = map[string]string{}
+	}
+	s.origProcs[path] = orig
+}
+
+// restoreProcs writes back the original values of the proc files changed by s. Files that no longer
+// exist, because their interface was removed, are skipped.
+func (s *Server) restoreProcs() {
+	s.mu.Lock()
+	procs := s.origProcs
+	s.origProcs = nil
+	s.mu.Unlock()
+
+	for path, value := range procs {
+		if _, err := os.Stat(path); err != nil {
+			log.Warnf("Not restoring %s, the interface is gone: %v", path, err)
+			continue
+		}
+		if err := SetProc(path, value); err != nil {
+			log.Warnf("Failed to restore %s to %s: %v", path, value, err)
+		}
+	}
 }
@@ -0,0 +1,2079 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/containernetworking/plugins/pkg/ns"
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// fakeIpset is an in-memory IpsetHandle. If listErr or addErr is set, List or AddIP fails with it.
+type fakeIpset struct {
+	entries []netlink.IPSetEntry
+	listErr error
+	addErr  error
+
+	added   []net.IP
+	deleted []net.IP
+	// lists is the number of List calls.
+	lists int
+}
+
+func (f *fakeIpset) CreateSet() error {
+	return nil
+}
+
+func (f *fakeIpset) DestroySet() error {
+	return nil
+}
+
+func (f *fakeIpset) AddIP(ip net.IP, comment string) error {
+	if f.addErr != nil {
+		return f.addErr
+	}
+	f.added = append(f.added, ip)
+	f.entries = append(f.entries, netlink.IPSetEntry{IP: ip, Comment: comment})
+	return nil
+}
+
+func (f *fakeIpset) DeleteIP(ip net.IP) error {
+	f.deleted = append(f.deleted, ip)
+	for i, e := range f.entries {
+		if e.IP.Equal(ip) {
+			f.entries = append(f.entries[:i], f.entries[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeIpset) Flush() error {
+	f.entries = nil
+	return nil
+}
+
+func (f *fakeIpset) List() ([]netlink.IPSetEntry, error) {
+	f.lists++
+	if f.listErr != nil {
+		return nil, f.listErr
+	}
+	return f.entries, nil
+}
+
+func setFakeIpset(t *testing.T, f *fakeIpset) {
+	orig := Ipset
+	Ipset = f
+	t.Cleanup(func() {
+		Ipset = orig
+	})
+}
+
+// fakeExecutor is an Executor recording the commands instead of running them.
+type fakeExecutor struct {
+	commands []string
+	// runErr, if set, returns the error of a command.
+	runErr func(command string) error
+}
+
+func (f *fakeExecutor) Run(ctx context.Context, cmd string, args ...string) error {
+	command := strings.Join(append([]string{cmd}, args...), " ")
+	f.commands = append(f.commands, command)
+	if f.runErr != nil {
+		return f.runErr(command)
+	}
+	return nil
+}
+
+func (f *fakeExecutor) Output(ctx context.Context, cmd string, args ...string) (string, error) {
+	return "", f.Run(ctx, cmd, args...)
+}
+
+// testHostIP is the host IP the pods of the package-level mesh functions are routed from.
+const testHostIP = "10.0.0.100"
+
+func newTestPod(name, uid, ip string) *corev1.Pod {
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			UID:       types.UID("uid-" + uid),
+		},
+		Status: corev1.PodStatus{
+			PodIP: ip,
+		},
+	}
+}
+
+func TestIsPodInIpset(t *testing.T) {
+	cases := []struct {
+		name      string
+		ipset     *fakeIpset
+		expected  bool
+		expectErr bool
+	}{
+		{
+			name:     "empty ipset",
+			ipset:    &fakeIpset{},
+			expected: false,
+		},
+		{
+			name: "match by comment",
+			ipset: &fakeIpset{
+				entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.9").To4(), Comment: "uid-a"}},
+			},
+			expected: true,
+		},
+		{
+			name: "match by ip",
+			ipset: &fakeIpset{
+				entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4()}},
+			},
+			expected: true,
+		},
+		{
+			name:      "list failure",
+			ipset:     &fakeIpset{listErr: errors.New("netlink failure")},
+			expected:  false,
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setFakeIpset(t, tc.ipset)
+			got, err := IsPodInIpset(newTestPod("a", "a", "10.0.0.1"))
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+// commentIpset is a fakeIpset which tells whether it stores comments.
+type commentIpset struct {
+	*fakeIpset
+	comments bool
+}
+
+func (f commentIpset) CommentsSupported() (bool, error) {
+	return f.comments, nil
+}
+
+func TestServerIsPodInIpset(t *testing.T) {
+	// The pod was deleted, and its IP recycled for pod b.
+	recycled := netlink.IPSetEntry{IP: net.ParseIP("10.0.0.1").To4(), Comment: "default/b/uid-b"}
+	cases := []struct {
+		name     string
+		comments bool
+		entries  []netlink.IPSetEntry
+		expected bool
+	}{
+		{
+			name:     "comments supported, recycled IP",
+			comments: true,
+			entries:  []netlink.IPSetEntry{recycled},
+			expected: false,
+		},
+		{
+			name:     "comments supported, match by comment",
+			comments: true,
+			entries:  []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.9").To4(), Comment: "default/a/uid-a"}},
+			expected: true,
+		},
+		{
+			name:     "comments supported, entry without comment",
+			comments: true,
+			entries:  []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4()}},
+			expected: true,
+		},
+		{
+			name:     "comments unsupported, recycled IP",
+			entries:  []netlink.IPSetEntry{recycled},
+			expected: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{entries: tc.entries}
+			setFakeIpset(t, f)
+			s := &Server{}
+			if err := s.EnsureIpset(commentIpset{fakeIpset: f, comments: tc.comments}); err != nil {
+				t.Fatal(err)
+			}
+			got, err := s.isPodInIpset(newTestPod("a", "a", "10.0.0.1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDelPodFromMeshListFailure(t *testing.T) {
+	f := &fakeIpset{
+		entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4(), Comment: "uid-a"}},
+		listErr: errors.New("netlink failure"),
+	}
+	setFakeIpset(t, f)
+
+	DelPodFromMesh(newTestPod("a", "a", "10.0.0.1"), testHostIP)
+	if len(f.deleted) != 0 {
+		t.Errorf("expected no ipset deletes when listing fails, got %v", f.deleted)
+	}
+}
+
+func TestDelPodFromMeshMember(t *testing.T) {
+	f := &fakeIpset{
+		entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4(), Comment: "uid-a"}},
+	}
+	setFakeIpset(t, f)
+
+	DelPodFromMesh(newTestPod("a", "a", "10.0.0.1"), testHostIP)
+	if len(f.deleted) != 1 || !f.deleted[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected pod ip to be deleted from ipset, got %v", f.deleted)
+	}
+}
+
+func TestRemovePodDataplaneRecycledIP(t *testing.T) {
+	// The IP of pod a was recycled by pod b, whose entry is the only one.
+	f := &fakeIpset{
+		entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4(), Comment: "default/b/uid-b"}},
+	}
+	setFakeIpset(t, f)
+	setFakeNetlink(t)
+
+	s := &Server{routeTables: DefaultRouteTables(), ipsetComments: true}
+	s.removePodDataplane(newTestPod("a", "a", "10.0.0.1"), "10.0.0.1")
+	if len(f.deleted) != 0 {
+		t.Errorf("expected the entry of the other pod to be kept, got deletes %v", f.deleted)
+	}
+
+	// Without comments, the entries can only be matched by IP.
+	s.ipsetComments = false
+	f.entries = []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4()}}
+	s.removePodDataplane(newTestPod("a", "a", "10.0.0.1"), "10.0.0.1")
+	if len(f.deleted) != 1 {
+		t.Errorf("expected the entry to be deleted, got deletes %v", f.deleted)
+	}
+}
+
+func TestDelPodFromMeshClearedPodIP(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	s := &Server{routeTables: DefaultRouteTables()}
+
+	s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+	// The pod IP is usually gone from the status by the time the pod is deleted.
+	s.delPodFromMesh(newTestPod("a", "a", ""))
+	if len(f.deleted) != 1 || !f.deleted[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the last known pod ip to be deleted from ipset, got %v", f.deleted)
+	}
+	if len(s.podIPs) != 0 {
+		t.Errorf("expected the pod ip to be forgotten, got %v", s.podIPs)
+	}
+}
+
+func TestAddPodToMeshTwice(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	nl := setFakeNetlink(t)
+	s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables(), inboundTunIndex: 7}
+
+	s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+	if len(f.added) != 1 || len(nl.routes) != 1 {
+		t.Fatalf("expected the pod to be added, got ipset adds %v and routes %v", f.added, nl.routes)
+	}
+	lists := f.lists
+
+	// A resync redelivers the same pod.
+	s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+	if len(f.added) != 1 || len(f.deleted) != 0 || f.lists != lists {
+		t.Errorf("expected no ipset calls for an identical add, got adds %v, deletes %v, %d lists", f.added, f.deleted, f.lists-lists)
+	}
+
+	// Once deleted, the pod is added again.
+	s.delPodFromMesh(newTestPod("a", "a", "10.0.0.1"))
+	s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+	if len(f.added) != 2 {
+		t.Errorf("expected the pod to be added again after its deletion, got adds %v", f.added)
+	}
+}
+
+func TestDelPodFromMeshEmptyPodIP(t *testing.T) {
+	f := &fakeIpset{
+		entries: []netlink.IPSetEntry{
+			{IP: net.ParseIP("10.0.0.2").To4(), Comment: "default/b/uid-b"},
+			{IP: net.ParseIP("10.0.0.1").To4(), Comment: "default/a/uid-a"},
+		},
+	}
+	setFakeIpset(t, f)
+	setFakeNetlink(t)
+
+	// Without the server, the IP the pod was added with is only known from its ipset entry.
+	DelPodFromMesh(newTestPod("a", "a", ""), testHostIP)
+	if len(f.deleted) != 1 || !f.deleted[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the ip of the ipset entry of the pod to be deleted, got %v", f.deleted)
+	}
+
+	// The entry is gone, so there is nothing left to delete.
+	DelPodFromMesh(newTestPod("a", "a", ""), testHostIP)
+	for _, ip := range f.deleted {
+		if ip == nil {
+			t.Fatalf("expected no nil ip to be deleted, got %v", f.deleted)
+		}
+	}
+	if len(f.deleted) != 1 {
+		t.Errorf("expected no further deletes, got %v", f.deleted)
+	}
+}
+
+func TestAddPodToMeshHostNetwork(t *testing.T) {
+	// The host IP is in the ipset, e.g. added by an older version.
+	f := &fakeIpset{entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.100").To4()}}}
+	setFakeIpset(t, f)
+	nl := setFakeNetlink(t)
+	pod := newTestPod("a", "a", "10.0.0.100")
+	pod.Spec.HostNetwork = true
+
+	if err := AddPodToMesh(pod, "", testHostIP, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AddPodsToMesh([]*corev1.Pod{pod}, testHostIP); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables()}
+	s.addPodToMesh(pod)
+	if len(f.added) != 0 || len(nl.routes) != 0 {
+		t.Errorf("expected the host network pod not to be added, got ipset entries %v and routes %v", f.added, nl.routes)
+	}
+
+	inIpset, err := IsPodInIpset(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inIpset {
+		t.Errorf("expected the host IP not to be reported as a member")
+	}
+}
+
+func TestAddPodsToMeshResults(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	setFakeNetlink(t)
+
+	pods := []*corev1.Pod{
+		newTestPod("a", "a", "10.0.0.1"),
+		newTestPod("b", "b", "10.0.0"),
+		newTestPod("c", "c", "10.0.0.3"),
+		newTestPod("d", "d", ""),
+	}
+	results, err := addPodsToMeshInTable(pods, "10.0.0.100", constants.RouteTableInbound, 7)
+	if !errors.Is(err, ErrInvalidPodIP) {
+		t.Errorf("expected ErrInvalidPodIP, got %v", err)
+	}
+	if len(results) != len(pods) {
+		t.Fatalf("expected a result for each pod, got %+v", results)
+	}
+	for i, expected := range []bool{true, false, true, false} {
+		r := results[i]
+		if r.UID != pods[i].UID || r.Added != expected || (r.Err == nil) != expected {
+			t.Errorf("expected pod %s to be added: %v, got %+v", pods[i].Name, expected, r)
+		}
+	}
+	if failed := FailedPodAdds(results); !reflect.DeepEqual(failed, []types.UID{"uid-b", "uid-d"}) {
+		t.Errorf("expected pods b and d to have failed, got %v", failed)
+	}
+	if len(f.added) != 2 {
+		t.Errorf("expected pods a and c in the ipset, got %v", f.added)
+	}
+
+	// The ipset is full, so no further pod can be added.
+	f.addErr = errors.New("set is full")
+	results, _ = addPodsToMeshInTable([]*corev1.Pod{pods[0], newTestPod("e", "e", "10.0.0.5")}, "10.0.0.100",
+		constants.RouteTableInbound, 7)
+	if len(results) != 2 || !results[0].Added || results[1].Added || results[1].Err == nil {
+		t.Errorf("expected pod a to stay added and pod e to fail, got %+v", results)
+	}
+}
+
+func TestAddPodsToMesh(t *testing.T) {
+	hostNetwork := newTestPod("h", "h", "10.0.0.100")
+	hostNetwork.Spec.HostNetwork = true
+
+	cases := []struct {
+		name    string
+		pods    []*corev1.Pod
+		entries []netlink.IPSetEntry
+		// results are the expected outcomes of the pods with a result, by name, true if added.
+		results   map[string]bool
+		expectErr error
+		expectIPs []string
+	}{
+		{
+			name:      "valid",
+			pods:      []*corev1.Pod{newTestPod("a", "a", "10.0.0.1"), newTestPod("b", "b", "10.0.0.2")},
+			results:   map[string]bool{"a": true, "b": true},
+			expectIPs: []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name:      "malformed IP",
+			pods:      []*corev1.Pod{newTestPod("a", "a", "10.0.0.1"), newTestPod("b", "b", "10.0.0")},
+			results:   map[string]bool{"a": true, "b": false},
+			expectErr: ErrInvalidPodIP,
+			expectIPs: []string{"10.0.0.1"},
+		},
+		{
+			name:      "missing IP",
+			pods:      []*corev1.Pod{newTestPod("a", "a", ""), newTestPod("b", "b", "10.0.0.2")},
+			results:   map[string]bool{"a": false, "b": true},
+			expectErr: ErrInvalidPodIP,
+			expectIPs: []string{"10.0.0.2"},
+		},
+		{
+			name:      "all invalid",
+			pods:      []*corev1.Pod{newTestPod("a", "a", "not-an-ip"), newTestPod("b", "b", "fe80::1%eth0")},
+			results:   map[string]bool{"a": false, "b": false},
+			expectErr: ErrInvalidPodIP,
+		},
+		{
+			name:      "host network pod",
+			pods:      []*corev1.Pod{hostNetwork, newTestPod("a", "a", "10.0.0.1")},
+			results:   map[string]bool{"a": true},
+			expectIPs: []string{"10.0.0.1"},
+		},
+		{
+			name:      "already in ipset",
+			pods:      []*corev1.Pod{newTestPod("a", "a", "10.0.0.1"), newTestPod("b", "b", "10.0.0.2")},
+			entries:   []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1").To4(), Comment: "default/a/uid-a"}},
+			results:   map[string]bool{"a": true, "b": true},
+			expectIPs: []string{"10.0.0.2"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{entries: append([]netlink.IPSetEntry(nil), tc.entries...)}
+			setFakeIpset(t, f)
+			nl := setFakeNetlink(t)
+			nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9}}
+
+			results, err := AddPodsToMesh(tc.pods, testHostIP)
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Errorf("expected %v, got %v", tc.expectErr, err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[string]bool{}
+			for _, r := range results {
+				for _, pod := range tc.pods {
+					if pod.UID == r.UID {
+						got[pod.Name] = r.Added
+					}
+				}
+				if r.Added != (r.Err == nil) {
+					t.Errorf("expected a result with an error iff not added, got %+v", r)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.results) {
+				t.Errorf("expected the results %v, got %v", tc.results, got)
+			}
+
+			var added []string
+			for _, ip := range f.added {
+				added = append(added, ip.String())
+			}
+			if !reflect.DeepEqual(added, tc.expectIPs) {
+				t.Errorf("expected %v to be added to the ipset, got %v", tc.expectIPs, added)
+			}
+		})
+	}
+}
+
+func TestPodRoute(t *testing.T) {
+	rte, err := podRoute("10.0.0.1", "10.0.0.100", constants.RouteTableInbound, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rte.LinkIndex != 7 || rte.Table != constants.RouteTableInbound {
+		t.Errorf("expected route through link 7 in table %d, got %+v", constants.RouteTableInbound, rte)
+	}
+	if !rte.Src.Equal(net.ParseIP("10.0.0.100")) {
+		t.Errorf("expected route from 10.0.0.100, got %+v", rte)
+	}
+	if rte.Dst.String() != "10.0.0.1/32" || !rte.Gw.Equal(net.ParseIP(constants.ZTunnelInboundTunIP)) {
+		t.Errorf("expected route to 10.0.0.1/32 via %s, got %+v", constants.ZTunnelInboundTunIP, rte)
+	}
+
+	if _, err := podRoute("", "10.0.0.100", constants.RouteTableInbound, 7); !errors.Is(err, ErrInvalidPodIP) {
+		t.Errorf("expected ErrInvalidPodIP, got %v", err)
+	}
+}
+
+// TestConcurrentMeshMembership fires concurrent adds and deletes for the same pod. fakeIpset is not
+// safe for concurrent use, so running with -race verifies that membership changes are serialized.
+func TestConcurrentMeshMembership(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	s := &Server{routeTables: DefaultRouteTables()}
+	pod := newTestPod("a", "a", "10.0.0.1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			s.addPodToMesh(pod)
+		}()
+		go func() {
+			defer wg.Done()
+			s.delPodFromMesh(pod)
+		}()
+	}
+	wg.Wait()
+
+	// Every add is followed by at most one matching delete, so the pod can't be in the ipset twice.
+	if len(f.entries) > 1 {
+		t.Errorf("expected at most one ipset entry for the pod, got %v", f.entries)
+	}
+}
+
+func TestRestoreProcs(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "eth0_rp_filter")
+	gone := filepath.Join(dir, "eth1_rp_filter")
+	for _, p := range []string{kept, gone} {
+		if err := os.WriteFile(p, []byte("1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &Server{}
+	for _, p := range []string{kept, gone} {
+		if err := s.setProc(p, "0"); err != nil {
+			t.Fatal(err)
+		}
+		// A second write must not overwrite the saved original value.
+		if err := s.setProc(p, "2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+
+	s.restoreProcs()
+	got, err := GetProc(kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "1" {
+		t.Errorf("expected %s to be restored to 1, got %q", kept, got)
+	}
+	if _, err := os.Stat(gone); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be skipped, got %v", gone, err)
+	}
+}
+
+func TestSetProcChecked(t *testing.T) {
+	dir := t.TempDir()
+
+	path := filepath.Join(dir, "rp_filter")
+	if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetProcChecked(path, "0"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, _ := GetProc(path); got != "0" {
+		t.Errorf("expected 0, got %q", got)
+	}
+	// Setting the same value again is a no-op.
+	if err := SetProcChecked(path, "0"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Writes to /dev/null succeed but never stick, like some rp_filter files.
+	lost := filepath.Join(dir, "lost")
+	if err := os.Symlink(os.DevNull, lost); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetProcChecked(lost, "0"); err == nil {
+		t.Errorf("expected an error when the written value doesn't stick")
+	}
+
+	if err := SetProcChecked(filepath.Join(dir, "missing", "rp_filter"), "0"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestCreateRulesOnDPUNodeCancelled(t *testing.T) {
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	origCmd := IptablesCmd
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+	})
+
+	// The setup is cancelled once the first tunnel is added.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nl.linkAdded = func(link netlink.Link) {
+		if link.Attrs().Name == constants.InboundTun {
+			cancel()
+		}
+	}
+
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        &fakeExecutor{},
+	}
+	err := s.CreateRulesOnDPUNode(ctx, "veth0", "10.0.0.2", false)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected %v, got %v", context.Canceled, err)
+	}
+	if _, ok := nl.links[constants.InboundTun]; !ok {
+		t.Fatalf("expected %s to be added before the cancellation", constants.InboundTun)
+	}
+	if _, ok := nl.links[constants.OutboundTun]; ok {
+		t.Errorf("expected setup to stop before creating %s", constants.OutboundTun)
+	}
+	if len(nl.routes) != 0 {
+		t.Errorf("expected no routes to be added, got %v", nl.routes)
+	}
+}
+
+func TestPodNodeOwnership(t *testing.T) {
+	cluster := offmesh.ClusterConfig{Pairs: []offmesh.PUPair{
+		{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"},
+		{CPUName: "cpu2", CPUIp: "10.0.0.20", DPUName: "dpu2", DPUIp: "10.0.0.21"},
+	}}
+	dpu1 := &Server{nodeName: "dpu1", offmeshCluster: cluster}
+	dpu2 := &Server{nodeName: "dpu2", offmeshCluster: cluster}
+
+	pod := newTestPod("a", "a", "10.0.0.1")
+	pod.Spec.NodeName = "cpu1"
+	if !dpu1.isPodOnMyCPU(pod) {
+		t.Errorf("expected the pod to be on the CPU of dpu1")
+	}
+	if dpu2.isPodOnMyCPU(pod) {
+		t.Errorf("expected the pod not to be on the CPU of dpu2")
+	}
+	if dpu1.podOnMyNode(pod) || !(&Server{nodeName: "cpu1"}).podOnMyNode(pod) {
+		t.Errorf("expected the pod to be on cpu1 only")
+	}
+}
+
+func TestGetHostIP(t *testing.T) {
+	nl := setFakeNetlink(t)
+	addFakeLink(t, nl, &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "lo", Flags: net.FlagLoopback}}, "127.0.0.1/8")
+	addFakeLink(t, nl, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}}, "10.244.1.1/24")
+
+	internalIP := []corev1.NodeAddress{{Type: corev1.NodeInternalIP, Address: "172.18.0.2"}}
+	cases := []struct {
+		name      string
+		podCIDR   string
+		addresses []corev1.NodeAddress
+		expected  string
+		expectErr bool
+	}{
+		{
+			name:      "pod CIDR matches an interface",
+			podCIDR:   "10.244.1.0/24",
+			addresses: internalIP,
+			expected:  "10.244.1.1",
+		},
+		{
+			name:      "pod CIDR matches no interface",
+			podCIDR:   "10.244.2.0/24",
+			addresses: internalIP,
+			expected:  "172.18.0.2",
+		},
+		{
+			name:      "pod CIDR matches no interface without internal IP",
+			podCIDR:   "10.244.2.0/24",
+			expectErr: true,
+		},
+		{
+			name:      "no pod CIDR",
+			addresses: internalIP,
+			expected:  "172.18.0.2",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			resetHostIPCache(t)
+			client := fake.NewSimpleClientset(&corev1.Node{
+				ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+				Spec:       corev1.NodeSpec{PodCIDR: tc.podCIDR},
+				Status:     corev1.NodeStatus{Addresses: tc.addresses},
+			})
+			got, err := GetHostIP(context.Background(), client, "node1", HostIPPreference{})
+			if tc.expectErr {
+				if !errors.Is(err, ErrHostIPNotFound) {
+					t.Fatalf("expected ErrHostIPNotFound, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+// resetHostIPCache empties the host IP cache for the test.
+func resetHostIPCache(t *testing.T) {
+	reset := func() {
+		hostIPCache.Lock()
+		hostIPCache.ips = nil
+		hostIPCache.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// blockingNetlink is a fakeNetlink whose LinkList blocks until unblock is closed.
+type blockingNetlink struct {
+	*fakeNetlink
+	unblock chan struct{}
+}
+
+func (b blockingNetlink) LinkList() ([]netlink.Link, error) {
+	<-b.unblock
+	return b.fakeNetlink.LinkList()
+}
+
+func TestGetHostIPTimeout(t *testing.T) {
+	resetHostIPCache(t)
+	nl := setFakeNetlink(t)
+	addFakeLink(t, nl, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}}, "10.244.1.1/24")
+	blocking := blockingNetlink{fakeNetlink: nl, unblock: make(chan struct{})}
+	defaultNetlink = blocking
+	defer close(blocking.unblock)
+	orig := hostIPTimeout
+	hostIPTimeout = 50 * time.Millisecond
+	t.Cleanup(func() {
+		hostIPTimeout = orig
+	})
+
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+	})
+	if _, err := GetHostIP(context.Background(), client, "node1", HostIPPreference{}); !errors.Is(err, ErrHostIPTimeout) {
+		t.Fatalf("expected ErrHostIPTimeout, got %v", err)
+	}
+}
+
+func TestGetHostIPCached(t *testing.T) {
+	resetHostIPCache(t)
+	nl := setFakeNetlink(t)
+	addFakeLink(t, nl, &netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}}, "10.244.1.1/24")
+	client := fake.NewSimpleClientset(&corev1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node1"},
+		Spec:       corev1.NodeSpec{PodCIDR: "10.244.1.0/24"},
+	})
+	if ip, err := GetHostIP(context.Background(), client, "node1", HostIPPreference{}); err != nil || ip != "10.244.1.1" {
+		t.Fatalf("expected 10.244.1.1, got %s, %v", ip, err)
+	}
+
+	// Neither the node nor the interfaces are looked up again.
+	blocking := blockingNetlink{fakeNetlink: nl, unblock: make(chan struct{})}
+	defaultNetlink = blocking
+	defer close(blocking.unblock)
+	client = fake.NewSimpleClientset()
+	if ip, err := GetHostIP(context.Background(), client, "node1", HostIPPreference{}); err != nil || ip != "10.244.1.1" {
+		t.Errorf("expected the cached 10.244.1.1, got %s, %v", ip, err)
+	}
+}
+
+// addFakeLink adds link to the fake netlink with the addresses cidrs.
+func addFakeLink(t *testing.T, nl *fakeNetlink, link netlink.Link, cidrs ...string) {
+	t.Helper()
+	if err := nl.LinkAdd(link); err != nil {
+		t.Fatal(err)
+	}
+	for _, cidr := range cidrs {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := nl.AddrReplace(link, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHostIPInPodCIDRSkipsIpvs(t *testing.T) {
+	cases := []struct {
+		name     string
+		links    map[netlink.Link]string
+		expected string
+	}{
+		{
+			name: "kube-ipvs0 and a NIC",
+			links: map[netlink.Link]string{
+				&netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "kube-ipvs0"}}: "10.96.0.10/32",
+				&netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0"}}:      "10.96.0.2/16",
+			},
+			expected: "10.96.0.2",
+		},
+		{
+			name: "bridge and a veth",
+			links: map[netlink.Link]string{
+				&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}}: "10.96.0.1/24",
+				&netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1"}}:  "10.96.0.3/32",
+			},
+			expected: "10.96.0.3",
+		},
+		{
+			name: "bridge only",
+			links: map[netlink.Link]string{
+				&netlink.Bridge{LinkAttrs: netlink.LinkAttrs{Name: "cni0"}}: "10.96.0.1/24",
+			},
+			expected: "10.96.0.1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			for link, cidr := range tc.links {
+				addFakeLink(t, nl, link, cidr)
+			}
+
+			// The pod CIDR overlaps the service CIDR.
+			got, err := hostIPInPodCIDR("10.96.0.0/16")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+
+	t.Run("kube-ipvs0 only", func(t *testing.T) {
+		nl := setFakeNetlink(t)
+		addFakeLink(t, nl, &netlink.Dummy{LinkAttrs: netlink.LinkAttrs{Name: "kube-ipvs0"}}, "10.96.0.10/32")
+		if _, err := hostIPInPodCIDR("10.96.0.0/16"); !errors.Is(err, ErrHostIPNotFound) {
+			t.Errorf("expected ErrHostIPNotFound, got %v", err)
+		}
+	})
+}
+
+func TestSelectInternalIP(t *testing.T) {
+	addrs := func(ips ...string) []net.Addr {
+		var res []net.Addr
+		for _, ip := range ips {
+			res = append(res, &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(24, 32)})
+		}
+		return res
+	}
+	origByName, origDefault := interfaceAddrsByName, defaultRouteAddrs
+	interfaceAddrsByName = func(name string) ([]net.Addr, error) {
+		if name == "eth1" {
+			return addrs("192.168.1.10"), nil
+		}
+		return nil, errors.New("no such interface")
+	}
+	defaultRouteAddrs = func() ([]net.Addr, error) {
+		return addrs("172.18.0.2"), nil
+	}
+	t.Cleanup(func() {
+		interfaceAddrsByName, defaultRouteAddrs = origByName, origDefault
+	})
+
+	// The first internal IP is on an isolated management interface.
+	ips := []string{"10.0.0.5", "192.168.1.10", "172.18.0.2"}
+	cases := []struct {
+		name     string
+		ips      []string
+		pref     HostIPPreference
+		expected string
+	}{
+		{
+			name:     "single internal IP",
+			ips:      []string{"10.0.0.5"},
+			pref:     HostIPPreference{Subnet: "192.168.1.0/24"},
+			expected: "10.0.0.5",
+		},
+		{
+			name:     "preferred subnet",
+			ips:      ips,
+			pref:     HostIPPreference{Subnet: "192.168.1.0/24"},
+			expected: "192.168.1.10",
+		},
+		{
+			name:     "preferred interface",
+			ips:      ips,
+			pref:     HostIPPreference{Interface: "eth1"},
+			expected: "192.168.1.10",
+		},
+		{
+			name:     "default route",
+			ips:      ips,
+			expected: "172.18.0.2",
+		},
+		{
+			name:     "unmatched preference falls back to the default route",
+			ips:      ips,
+			pref:     HostIPPreference{Subnet: "192.168.2.0/24", Interface: "eth2"},
+			expected: "172.18.0.2",
+		},
+		{
+			name:     "no match",
+			ips:      []string{"10.0.0.5", "10.0.1.5"},
+			expected: "10.0.0.5",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := selectInternalIP(tc.ips, tc.pref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestDNSCaptureRules(t *testing.T) {
+	cases := []struct {
+		name     string
+		server   *Server
+		expected map[string]bool
+		to       string
+	}{
+		{
+			name:     "udp and tcp",
+			server:   &Server{},
+			expected: map[string]bool{"udp": true, "tcp": true},
+			to:       "10.0.0.2:15053",
+		},
+		{
+			name:     "udp only with custom port",
+			server:   &Server{dnsCapturePort: 5353, dnsCaptureUDPOnly: true},
+			expected: map[string]bool{"udp": true, "tcp": false},
+			to:       "10.0.0.2:5353",
+		},
+		{
+			name:     "custom address",
+			server:   &Server{dnsCaptureAddr: "10.0.0.100"},
+			expected: map[string]bool{"udp": true, "tcp": true},
+			to:       "10.0.0.100:15053",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			cpu, _ := tc.server.cpuNodeRules("eth0", "10.0.0.2", true)
+			dpu, _ := tc.server.dpuNodeRules("veth0", "10.0.0.2", true)
+			for node, rules := range map[string][]*iptablesRule{"cpu": cpu, "dpu": dpu} {
+				for proto, expected := range tc.expected {
+					found := ruleIndex(rules, "-p", proto, "--dport", "53", "DNAT", "--to", tc.to) != -1
+					if found != expected {
+						t.Errorf("%s: expected %s DNAT rule to %s %v, got %v", node, proto, tc.to, expected, found)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHostOutputConnSkipMark(t *testing.T) {
+	s := &Server{hostIP: "10.0.0.5"}
+	cpu1, cpu2 := s.cpuNodeRules("eth0", "10.0.0.2", false)
+	dpu1, dpu2 := s.dpuNodeRules("veth0", "10.0.0.2", false)
+
+	// argAfter returns the argument following flag in the first rule of chain containing args.
+	argAfter := func(rules []*iptablesRule, chain, flag string, args ...string) string {
+		for _, r := range rules {
+			if r.Chain != chain || ruleIndex([]*iptablesRule{r}, args...) == -1 {
+				continue
+			}
+			for i, arg := range r.RuleSpec {
+				if arg == flag && i+1 < len(r.RuleSpec) {
+					return r.RuleSpec[i+1]
+				}
+			}
+		}
+		return ""
+	}
+
+	for name, rules := range map[string][]*iptablesRule{
+		"cpu": append(cpu1, cpu2...),
+		"dpu": append(dpu1, dpu2...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			set := argAfter(rules, constants.ChainZTunnelOutput, "--set-mark", "--source", s.hostIP)
+			matched := argAfter(rules, constants.ChainZTunnelPrerouting, "--mark", "-m", "connmark")
+			if set == "" || matched == "" {
+				t.Fatalf("missing host output rule %q or prerouting conn skip rule %q", set, matched)
+			}
+			if set != matched {
+				t.Errorf("host output traffic is marked %s, but the prerouting skip rule matches %s", set, matched)
+			}
+		})
+	}
+}
+
+func TestRouteExists(t *testing.T) {
+	rte, err := podRoute("10.0.0.1", "10.0.0.100", constants.RouteTableInbound, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	match := *rte
+	otherGw := *rte
+	otherGw.Gw = net.ParseIP("192.168.126.9")
+	otherDev := *rte
+	otherDev.LinkIndex = 8
+
+	cases := []struct {
+		name     string
+		routes   []netlink.Route
+		rte      *netlink.Route
+		expected bool
+	}{
+		{
+			name: "no routes",
+			rte:  rte,
+		},
+		{
+			name:     "one route",
+			routes:   []netlink.Route{match},
+			rte:      rte,
+			expected: true,
+		},
+		{
+			name:     "two routes",
+			routes:   []netlink.Route{otherGw, match},
+			rte:      rte,
+			expected: true,
+		},
+		{
+			name:   "other gateway",
+			routes: []netlink.Route{otherGw},
+			rte:    rte,
+		},
+		{
+			name:   "other device",
+			routes: []netlink.Route{otherDev},
+			rte:    rte,
+		},
+		{
+			name:     "any device",
+			routes:   []netlink.Route{otherDev},
+			rte:      &netlink.Route{Table: rte.Table, Dst: rte.Dst, Gw: rte.Gw},
+			expected: true,
+		},
+		{
+			name:   "no route to check",
+			routes: []netlink.Route{match},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := setFakeNetlink(t)
+			f.routes = tc.routes
+
+			if got := RouteExists(tc.rte); got != tc.expected {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
+
+func TestRoutesDeleteContinuesPastFailures(t *testing.T) {
+	f := setFakeNetlink(t)
+	f.routeDelErr = func(route *netlink.Route) error {
+		if len(f.routeDels) == 2 {
+			return errors.New("device or resource busy")
+		}
+		return nil
+	}
+
+	var routes []netlink.Route
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		routes = append(routes, netlink.Route{Dst: &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(32, 32)}})
+	}
+	f.routes = append(f.routes, routes...)
+	n, err := routesDelete(f, routes)
+	if n != 2 {
+		t.Errorf("expected 2 routes to be deleted, got %d", n)
+	}
+	var nlErr *NetlinkError
+	if !errors.As(err, &nlErr) || nlErr.Op != "RouteDel" {
+		t.Errorf("expected a RouteDel error, got %v", err)
+	}
+	if len(f.routeDels) != 3 || f.routeDels[2].Dst.IP.String() != "10.0.0.3" {
+		t.Errorf("expected every route to be attempted, got %v", f.routeDels)
+	}
+}
+
+func TestRouteFlushTable(t *testing.T) {
+	f := setFakeNetlink(t)
+	for i, table := range []int{100, 100, 101} {
+		f.routes = append(f.routes, netlink.Route{
+			Table: table,
+			Dst:   &net.IPNet{IP: net.IPv4(10, 0, 0, byte(i+1)), Mask: net.CIDRMask(32, 32)},
+		})
+	}
+
+	s := &Server{}
+	n, err := s.routeFlushTable(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("expected 2 routes to be flushed, got %d", n)
+	}
+	if len(f.routes) != 1 || f.routes[0].Table != 101 {
+		t.Errorf("expected only the route of table 101 to be left, got %v", f.routes)
+	}
+}
+
+func TestRemovePod(t *testing.T) {
+	cases := []struct {
+		name     string
+		routes   []netlink.Route
+		expected error
+	}{
+		{
+			name: "removed",
+		},
+		{
+			name: "route still listed",
+			routes: []netlink.Route{{
+				Table: DefaultRouteTables().Inbound,
+				Dst:   &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)},
+				Gw:    net.ParseIP(constants.ZTunnelInboundTunIP),
+			}},
+			expected: ErrPodNotRemoved,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{}
+			setFakeIpset(t, f)
+			nl := setFakeNetlink(t)
+			nl.routes = tc.routes
+			// The delete "succeeds", but doesn't change what is listed.
+			nl.keepRoutes = true
+
+			pod := newTestPod("a", "a", "10.0.0.1")
+			_ = f.AddIP(net.ParseIP("10.0.0.1"), string(pod.UID))
+			s := &Server{routeTables: DefaultRouteTables(), hostIP: "10.0.0.100"}
+			err := s.RemovePod(pod)
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+			if len(f.entries) != 0 {
+				t.Errorf("expected the ipset entry to be removed, got %v", f.entries)
+			}
+		})
+	}
+}
+
+func TestDisablePodRPFilter(t *testing.T) {
+	setFakeRPFilters(t)
+	f := setFakeNetlink(t)
+	// The host device routing to the pod, and the pod device with its address.
+	f.links["veth1"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 7}}
+	f.routes = []netlink.Route{{Dst: &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(32, 32)}, LinkIndex: 7}}
+	f.links["eth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 3}}
+	f.linkAddrs = map[int][]netlink.Addr{3: {IPNet: &net.IPNet{IP: net.ParseIP("10.0.0.1"), Mask: net.CIDRMask(24, 32)}}}
+
+	var entered []string
+	orig := withNetNSPath
+	withNetNSPath = func(nspath string, toRun func(ns.NetNS) error) error {
+		entered = append(entered, nspath)
+		return toRun(nil)
+	}
+	t.Cleanup(func() {
+		withNetNSPath = orig
+	})
+
+	cases := []struct {
+		name     string
+		netns    string
+		expected string
+	}{
+		{
+			name:     "host",
+			expected: "/proc/sys/net/ipv4/conf/veth1/rp_filter",
+		},
+		{
+			name:     "pod netns",
+			netns:    "/var/run/netns/cni-1234",
+			expected: "/proc/sys/net/ipv4/conf/eth0/rp_filter",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			out := setDryRun(t)
+			entered = nil
+			if err := disablePodRPFilter(newTestPod("a", "a", "10.0.0.1"), "10.0.0.1", tc.netns); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), tc.expected) {
+				t.Errorf("expected %s to be set, got %q", tc.expected, out.String())
+			}
+			if tc.netns == "" && len(entered) != 0 {
+				t.Errorf("expected no netns to be entered, got %v", entered)
+			}
+			if tc.netns != "" && (len(entered) != 1 || entered[0] != tc.netns) {
+				t.Errorf("expected netns %s to be entered, got %v", tc.netns, entered)
+			}
+		})
+	}
+}
+
+func TestAddPodToMeshErrors(t *testing.T) {
+	cases := []struct {
+		name        string
+		addErr      error
+		routeAddErr error
+		expectErr   bool
+	}{
+		{
+			name: "added",
+		},
+		{
+			name:      "ipset add failure",
+			addErr:    errors.New("ipset is full"),
+			expectErr: true,
+		},
+		{
+			name:        "route add failure",
+			routeAddErr: syscall.ENETUNREACH,
+			expectErr:   true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setFakeIpset(t, &fakeIpset{addErr: tc.addErr})
+			nl := setFakeNetlink(t)
+			nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9}}
+			nl.routeAddErr = tc.routeAddErr
+			// Without a device routing to the pod, rp_filter can't be disabled, which is only a warning.
+			err := AddPodToMesh(newTestPod("a", "a", "10.0.0.1"), "", testHostIP, "")
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestAddPodToMeshInvalidIP(t *testing.T) {
+	cases := []struct {
+		name      string
+		podCIDRs  []string
+		ip        string
+		podIP     string
+		expectErr error
+		expectIP  string
+	}{
+		{
+			name:     "valid",
+			ip:       "10.0.0.1",
+			expectIP: "10.0.0.1",
+		},
+		{
+			name:     "IPv4-mapped",
+			ip:       "::ffff:10.0.0.1",
+			expectIP: "10.0.0.1",
+		},
+		{
+			name:      "malformed",
+			ip:        "10.0.0",
+			expectErr: ErrInvalidPodIP,
+		},
+		{
+			name:      "missing",
+			expectErr: ErrInvalidPodIP,
+		},
+		{
+			name:     "pod IP in the pod CIDR",
+			podCIDRs: []string{"10.0.0.0/24"},
+			podIP:    "10.0.0.1",
+			expectIP: "10.0.0.1",
+		},
+		{
+			name:      "out of the pod CIDR",
+			podCIDRs:  []string{"10.0.0.0/24", "fd00::/64"},
+			ip:        "10.0.1.1",
+			expectErr: ErrInvalidPodIP,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{}
+			setFakeIpset(t, f)
+			nl := setFakeNetlink(t)
+			nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9}}
+			orig := podCIDRs
+			t.Cleanup(func() {
+				podCIDRs = orig
+			})
+			if err := UsePodCIDRs(tc.podCIDRs); err != nil {
+				t.Fatal(err)
+			}
+
+			err := AddPodToMesh(newTestPod("a", "a", tc.podIP), tc.ip, testHostIP, "")
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Fatalf("expected %v, got %v", tc.expectErr, err)
+				}
+				if len(f.added) != 0 || len(nl.routes) != 0 {
+					t.Errorf("expected nothing to be added, got ipset adds %v and routes %v", f.added, nl.routes)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(f.added) != 1 || f.added[0].String() != tc.expectIP {
+				t.Errorf("expected %s to be added to the ipset, got %v", tc.expectIP, f.added)
+			}
+			if len(nl.routes) != 1 || nl.routes[0].Dst.IP.String() != tc.expectIP {
+				t.Errorf("expected a route to %s, got %v", tc.expectIP, nl.routes)
+			}
+		})
+	}
+}
+
+func TestAddPodsToMeshInvalidIP(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	nl := setFakeNetlink(t)
+	orig := podCIDRs
+	t.Cleanup(func() {
+		podCIDRs = orig
+	})
+	if err := UsePodCIDRs([]string{"10.0.0.0/24"}); err != nil {
+		t.Fatal(err)
+	}
+
+	pods := []*corev1.Pod{
+		newTestPod("a", "a", "10.0.0.1"),
+		newTestPod("b", "b", "::ffff:10.0.0.2"),
+		newTestPod("c", "c", "10.0.1.3"),
+		newTestPod("d", "d", "fe80::1%eth0"),
+	}
+	results, err := addPodsToMeshInTable(pods, testHostIP, constants.RouteTableInbound, 7)
+	if !errors.Is(err, ErrInvalidPodIP) {
+		t.Errorf("expected ErrInvalidPodIP, got %v", err)
+	}
+	if len(results) != len(pods) {
+		t.Fatalf("expected a result for each pod, got %+v", results)
+	}
+	for i, expected := range []bool{true, true, false, false} {
+		r := results[i]
+		if r.UID != pods[i].UID || r.Added != expected {
+			t.Errorf("expected pod %s to be added: %v, got %+v", pods[i].Name, expected, r)
+		}
+		if !expected && !errors.Is(r.Err, ErrInvalidPodIP) {
+			t.Errorf("expected pod %s to be rejected with ErrInvalidPodIP, got %v", pods[i].Name, r.Err)
+		}
+	}
+
+	// The IPv4-mapped IP is added unmapped.
+	var added, routed []string
+	for _, ip := range f.added {
+		added = append(added, ip.String())
+	}
+	for _, r := range nl.routes {
+		routed = append(routed, r.Dst.IP.String())
+	}
+	expected := []string{"10.0.0.1", "10.0.0.2"}
+	if !reflect.DeepEqual(added, expected) || !reflect.DeepEqual(routed, expected) {
+		t.Errorf("expected the ipset entries and routes of %v, got %v and %v", expected, added, routed)
+	}
+}
+
+func TestUsePodCIDRs(t *testing.T) {
+	orig := podCIDRs
+	t.Cleanup(func() {
+		podCIDRs = orig
+	})
+	if err := UsePodCIDRs([]string{"10.0.0.0/24", "10.0.0.1"}); err == nil {
+		t.Errorf("expected an IP without prefix length to be rejected")
+	}
+	if err := UsePodCIDRs([]string{" 10.0.0.1/24"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := normalizePodIP("10.0.0.255"); err != nil {
+		t.Errorf("expected an IP in the masked CIDR to be accepted, got %v", err)
+	}
+	// The IPs of a family without pod CIDRs are not checked.
+	if _, err := normalizePodIP("fd00::1"); err != nil {
+		t.Errorf("expected an IPv6 address to be accepted, got %v", err)
+	}
+	if _, err := normalizePodIP("fe80::1%eth0"); !errors.Is(err, ErrInvalidPodIP) {
+		t.Errorf("expected a zoned address to be rejected, got %v", err)
+	}
+}
+
+func TestIpsetComment(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+
+	pod := newTestPod("a", "a", "10.0.0.1")
+	_ = AddPodToMesh(pod, "", testHostIP, "")
+	if len(f.entries) != 1 || f.entries[0].Comment != "default/a/uid-a" {
+		t.Fatalf("expected an entry with comment default/a/uid-a, got %v", f.entries)
+	}
+	// The pod IP is cleared from the status, so the entry is matched by UID.
+	if in, err := IsPodInIpset(newTestPod("a", "a", "")); err != nil || !in {
+		t.Errorf("expected the pod to be matched by UID, got %v, %v", in, err)
+	}
+	if in, _ := IsPodInIpset(newTestPod("b", "b", "")); in {
+		t.Errorf("expected another pod not to match")
+	}
+
+	long := newTestPod(strings.Repeat("n", 253), "a", "10.0.0.1")
+	comment := ipsetComment(long)
+	if len(comment) != maxIpsetComment || commentUID(comment) != "uid-a" {
+		t.Errorf("expected a truncated comment ending with the UID, got %q", comment)
+	}
+	if got := commentUID("uid-a"); got != "uid-a" {
+		t.Errorf("expected a plain UID comment to be the UID, got %q", got)
+	}
+}
+
+func TestCreateRulesOnDPUNodeCommands(t *testing.T) {
+	// Dry-run mode keeps the proc files of the node untouched.
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	origCmd := IptablesCmd
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+	})
+
+	f := &fakeExecutor{}
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        f,
+	}
+	if err := s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false); err != nil {
+		t.Fatal(err)
+	}
+
+	// The order of redirect-worker.sh: the routes to ztunnel, then the rules looking them up.
+	expected := []string{
+		"ip route replace table 101 10.0.0.2 dev veth0 scope link",
+		"ip route replace table 101 0.0.0.0/0 via 192.168.127.2 dev istioout",
+		"ip route replace table 102 10.0.0.2 dev veth0 scope link",
+		"ip route replace table 102 0.0.0.0/0 via 10.0.0.2 dev veth0 onlink",
+		"ip route replace table 100 10.0.0.2 dev veth0 scope link",
+	}
+	var got []string
+	for _, c := range f.commands {
+		if strings.HasPrefix(c, "ip ") {
+			got = append(got, c)
+		}
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected commands:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(got, "\n"))
+	}
+	if !reflect.DeepEqual(nl.rules, s.ipRules(offmesh.DPUNode)) {
+		t.Errorf("expected the ip rules %v, got %v", s.ipRules(offmesh.DPUNode), nl.rules)
+	}
+}
+
+func TestCreateRulesOnDPUNodeRerun(t *testing.T) {
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	origCmd := IptablesCmd
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+	})
+
+	f := &fakeExecutor{}
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        f,
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The rules of the first run are kept, not added again.
+	if expected := s.ipRules(offmesh.DPUNode); !reflect.DeepEqual(nl.rules, expected) {
+		t.Errorf("expected the ip rules %v, got %v", expected, nl.rules)
+	}
+}
+
+func TestNodeRulesShared(t *testing.T) {
+	s := &Server{
+		hostIP:                    "10.0.0.100",
+		excludeOutboundPorts:      []uint16{3306},
+		excludeOutboundCIDRs:      []netip.Prefix{netip.MustParsePrefix("169.254.169.254/32")},
+		excludeLinkLocalMulticast: true,
+		excludeOwnerUIDs:          []uint32{1337},
+	}
+	cpu1, cpu2 := s.cpuNodeRules("eth0", "10.0.0.2", true)
+	dpu1, dpu2 := s.dpuNodeRules("veth0", "10.0.0.2", true)
+
+	// Apart from the rule of the traffic coming back from ztunnel, every rule of the CPU node is a
+	// rule of the DPU node, in the same order.
+	for name, groups := range map[string][2][]*iptablesRule{
+		"appendRules":  {cpu1, dpu1},
+		"appendRules2": {cpu2, dpu2},
+	} {
+		cpu, dpu := groups[0], groups[1]
+		i := 0
+		for _, rule := range cpu {
+			if ruleIndex([]*iptablesRule{rule}, "-i", "eth0") == 0 {
+				continue
+			}
+			for i < len(dpu) && !reflect.DeepEqual(dpu[i], rule) {
+				i++
+			}
+			if i == len(dpu) {
+				t.Errorf("%s: CPU node rule %v isn't a rule of the DPU node in the same order", name, rule.RuleSpec)
+				break
+			}
+			i++
+		}
+	}
+
+	// Only the DPU node has the tunnels to ztunnel and the ztunnel veth.
+	for _, tun := range []string{constants.InboundTun, constants.OutboundTun} {
+		if ruleIndex(dpu1, "-i", tun, "-j", "RETURN") == -1 {
+			t.Errorf("expected the DPU node to skip the traffic of tunnel %s", tun)
+		}
+		if ruleIndex(append(cpu1, cpu2...), tun) != -1 {
+			t.Errorf("expected the CPU node to have no rules of tunnel %s", tun)
+		}
+	}
+	if ruleIndex(dpu2, "-i", "veth0", "--set-mark", s.markArgs().ConnSkipMark) == -1 {
+		t.Error("expected the DPU node to route the traffic of ztunnel normally")
+	}
+	if ruleIndex(cpu2, "-i", "eth0", "--match-set", ipsetName, "dst") == -1 {
+		t.Error("expected the CPU node to route the traffic coming back from ztunnel normally")
+	}
+}
+
+func TestIPRules(t *testing.T) {
+	s := &Server{routeTables: DefaultRouteTables()}
+	type rule struct {
+		priority, mark, mask, table, gotoPriority int
+	}
+	expected := []rule{
+		{priority: 100, mark: 0x200, mask: 0x200, gotoPriority: 32766},
+		{priority: 101, mark: 0x100, mask: 0x100, table: 101, gotoPriority: -1},
+		{priority: 102, mark: 0x040, mask: 0x040, table: 102, gotoPriority: -1},
+		{priority: 103, mark: -1, mask: -1, table: 100, gotoPriority: -1},
+	}
+	var got []rule
+	for _, r := range s.ipRules(offmesh.DPUNode) {
+		if r.Family != netlink.FAMILY_V4 {
+			t.Errorf("expected ip rule %d to be IPv4, got family %d", r.Priority, r.Family)
+		}
+		got = append(got, rule{priority: r.Priority, mark: r.Mark, mask: r.Mask, table: r.Table, gotoPriority: r.Goto})
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected the ip rules %+v, got %+v", expected, got)
+	}
+	if cpu := s.ipRules(offmesh.CPUNode); !reflect.DeepEqual(cpu, s.ipRules(offmesh.DPUNode)[:2]) {
+		t.Errorf("expected the CPU node to have the skip and outbound rules, got %v", cpu)
+	}
+}
+
+func TestCreateRulesOnDPUNodeWaitsForVeth(t *testing.T) {
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	origCmd, origInterval := IptablesCmd, linkPollInterval
+	linkPollInterval = 10 * time.Millisecond
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+		linkPollInterval = origInterval
+	})
+
+	// ztunnel creates its veth only after node setup started.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		nl.mu.Lock()
+		defer nl.mu.Unlock()
+		nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	}()
+
+	f := &fakeExecutor{}
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        f,
+	}
+	if err := s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false); err != nil {
+		t.Fatal(err)
+	}
+	var routes int
+	for _, c := range f.commands {
+		if strings.HasPrefix(c, "ip route replace ") && strings.Contains(c, " dev veth0 ") {
+			routes++
+		}
+	}
+	if routes == 0 {
+		t.Errorf("expected routes through veth0, got %v", f.commands)
+	}
+}
+
+func TestLinkByNameOrWaitTimeout(t *testing.T) {
+	setFakeNetlink(t)
+	origTimeout, origInterval := linkWaitTimeout, linkPollInterval
+	linkWaitTimeout, linkPollInterval = 50*time.Millisecond, 10*time.Millisecond
+	t.Cleanup(func() {
+		linkWaitTimeout, linkPollInterval = origTimeout, origInterval
+	})
+
+	_, err := (&Server{}).linkByNameOrWait(context.Background(), "veth0")
+	if !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("expected ErrDeviceNotFound, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := (&Server{}).linkByNameOrWait(ctx, "veth0"); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCreateRulesOnDPUNodeDeviceGone(t *testing.T) {
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	origCmd := IptablesCmd
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+	})
+
+	// ztunnel restarted during node setup, deleting its veth.
+	f := &fakeExecutor{runErr: func(command string) error {
+		if strings.HasPrefix(command, "ip route replace ") && strings.Contains(command, " dev veth0 ") {
+			return errors.New("Cannot find device \"veth0\"\n")
+		}
+		return nil
+	}}
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        f,
+	}
+	err := s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false)
+	if !errors.Is(err, ErrDeviceGone) {
+		t.Fatalf("expected ErrDeviceGone, got %v", err)
+	}
+	last := f.commands[len(f.commands)-1]
+	if !strings.Contains(last, " dev veth0 ") {
+		t.Errorf("expected no commands after the failed route, got %q", last)
+	}
+}
+
+func TestCreateRulesOnDPUNodeRouteFailures(t *testing.T) {
+	setDryRun(t)
+	setFakeIpset(t, &fakeIpset{})
+	setFakeIptables(t, newFakeIptables())
+	nl := setFakeNetlink(t)
+	nl.links["veth0"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth0", Index: 9}}
+	origCmd := IptablesCmd
+	t.Cleanup(func() {
+		IptablesCmd = origCmd
+	})
+
+	// The default route of the proxy table is rejected.
+	f := &fakeExecutor{runErr: func(command string) error {
+		args := strings.Fields(command)
+		if command == "ip route replace table 102 0.0.0.0/0 via 10.0.0.2 dev veth0 onlink" {
+			return newCommandError(args[0], args[1:], "RTNETLINK answers: Invalid argument\n")
+		}
+		return nil
+	}}
+	s := &Server{
+		nodeName: "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		tunnelVNIs:  DefaultTunnelVNIs(),
+		routeTables: DefaultRouteTables(),
+		tunnelMTU:   1450,
+		exec:        f,
+	}
+	err := s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false)
+	if err == nil {
+		t.Fatal("expected the failed route to be returned")
+	}
+	if errs := multierr.Errors(err); len(errs) != 1 || !strings.Contains(errs[0].Error(), "Invalid argument") {
+		t.Errorf("expected only the rejected route to fail, got %v", err)
+	}
+	// The routes and rules after the failed route are still set up.
+	if last := f.commands[len(f.commands)-1]; last != "ip route replace table 100 10.0.0.2 dev veth0 scope link" {
+		t.Errorf("expected the remaining routes to be added, got %q last", last)
+	}
+	if expected := s.ipRules(offmesh.DPUNode); !reflect.DeepEqual(nl.rules, expected) {
+		t.Errorf("expected the ip rules %v, got %v", expected, nl.rules)
+	}
+}
+
+func TestCreateRulesOnCPUNodeValidation(t *testing.T) {
+	cases := []struct {
+		name      string
+		cpuEth    string
+		ztunnelIP string
+		expected  error
+	}{
+		{
+			name:     "empty ztunnel IP",
+			cpuEth:   "eth0",
+			expected: ErrInvalidZtunnelIP,
+		},
+		{
+			name:      "IPv6 ztunnel IP",
+			cpuEth:    "eth0",
+			ztunnelIP: "fd00::2",
+			expected:  ErrInvalidZtunnelIP,
+		},
+		{
+			name:      "nonexistent device",
+			cpuEth:    "eth9",
+			ztunnelIP: "10.0.0.2",
+			expected:  ErrDeviceNotFound,
+		},
+		{
+			name:      "empty device",
+			ztunnelIP: "10.0.0.2",
+			expected:  ErrDeviceNotFound,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipt := newFakeIptables()
+			setFakeIptables(t, ipt)
+			nl := setFakeNetlink(t)
+			nl.links["eth0"] = &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+
+			f := &fakeExecutor{}
+			s := &Server{
+				nodeName: "cpu1",
+				offmeshCluster: offmesh.ClusterConfig{
+					Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+				},
+				exec: f,
+			}
+			err := s.CreateRulesOnCPUNode(context.Background(), tc.cpuEth, tc.ztunnelIP, false)
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+			if len(f.commands) != 0 {
+				t.Errorf("expected no commands to be run, got %v", f.commands)
+			}
+			for key := range ipt.rules {
+				if strings.Contains(key, "ztunnel-") {
+					t.Errorf("expected no chains to be created, got %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	pairs := []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}}
+	cases := []struct {
+		name     string
+		nodeName string
+		cpu      bool
+	}{
+		{
+			name:     "cpu",
+			nodeName: "cpu1",
+			cpu:      true,
+		},
+		{
+			name:     "dpu",
+			nodeName: "dpu1",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setDryRun(t)
+			setFakeIpset(t, &fakeIpset{})
+			ipt := newFakeIptables()
+			setFakeIptables(t, ipt)
+			nl := setFakeNetlink(t)
+			// The device the setup routes through, which isn't ours to delete.
+			device := "veth0"
+			if tc.cpu {
+				device = "eth0"
+			}
+			nl.links[device] = &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: device, Index: 2}}
+			origCmd := IptablesCmd
+			t.Cleanup(func() {
+				IptablesCmd = origCmd
+			})
+
+			f := &fakeExecutor{}
+			s := &Server{
+				nodeName:       tc.nodeName,
+				offmeshCluster: offmesh.ClusterConfig{Pairs: pairs},
+				tunnelVNIs:     DefaultTunnelVNIs(),
+				routeTables:    DefaultRouteTables(),
+				tunnelMTU:      1450,
+				exec:           f,
+			}
+			var err error
+			if tc.cpu {
+				err = s.CreateRulesOnCPUNode(context.Background(), "eth0", "10.0.0.2", false)
+			} else {
+				err = s.CreateRulesOnDPUNode(context.Background(), "veth0", "10.0.0.2", false)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var links []string
+			for name := range nl.links {
+				if name != device {
+					links = append(links, name)
+				}
+			}
+			if !tc.cpu && len(links) == 0 {
+				t.Fatal("expected the setup to create links")
+			}
+			nodeType := offmesh.DPUNode
+			if tc.cpu {
+				nodeType = offmesh.CPUNode
+			}
+			ours := s.ipRules(nodeType)
+			if !reflect.DeepEqual(nl.rules, ours) {
+				t.Fatalf("expected the setup to add the ip rules %v, got %v", ours, nl.rules)
+			}
+			// A rule of another component with the priority of one of ours.
+			foreign := *netlink.NewRule()
+			foreign.Priority = 101
+			foreign.Mark, foreign.Mask = 0x4000, 0x4000
+			foreign.Table = 200
+			nl.rules = append([]netlink.Rule{foreign}, ours...)
+
+			if err := s.Uninstall(tc.cpu); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := nl.links[device]; !ok || len(nl.links) != 1 {
+				t.Errorf("expected the links %v to be deleted and %s kept, got %v left", links, device, nl.links)
+			}
+			if !reflect.DeepEqual(nl.rules, []netlink.Rule{foreign}) {
+				t.Errorf("expected only the foreign ip rule to be left, got %v", nl.rules)
+			}
+			for key := range ipt.rules {
+				if strings.Contains(key, "ztunnel-") {
+					t.Errorf("expected chain %s to be deleted", key)
+				}
+			}
+		})
+	}
+}
+
+func TestAddPodToMeshChangedIP(t *testing.T) {
+	f := &fakeIpset{}
+	setFakeIpset(t, f)
+	nl := setFakeNetlink(t)
+
+	if err := addPodToMeshInTable(newTestPod("a", "a", "10.0.0.1"), "", "10.0.0.100", "", constants.RouteTableInbound, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err := addPodToMeshInTable(newTestPod("a", "a", "10.0.0.2"), "", "10.0.0.100", "", constants.RouteTableInbound, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.deleted) != 1 || !f.deleted[0].Equal(net.ParseIP("10.0.0.1")) {
+		t.Errorf("expected the old pod ip to be deleted from ipset, got %v", f.deleted)
+	}
+	if len(f.entries) != 1 || !f.entries[0].IP.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("expected only an entry for the new pod ip, got %v", f.entries)
+	}
+	if len(nl.routes) != 1 || nl.routes[0].Dst.IP.String() != "10.0.0.2" {
+		t.Errorf("expected only a route to the new pod ip, got %v", nl.routes)
+	}
+}
+
+func TestInboundRouteSrc(t *testing.T) {
+	cases := []struct {
+		name     string
+		routeSrc string
+		expected string
+	}{
+		{
+			name:     "default",
+			expected: "10.0.0.100",
+		},
+		{
+			name:     "inbound tunnel ip",
+			routeSrc: constants.InboundTunIP,
+			expected: constants.InboundTunIP,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setFakeIpset(t, &fakeIpset{})
+			nl := setFakeNetlink(t)
+			s := &Server{hostIP: "10.0.0.100", inboundRouteSrc: tc.routeSrc, routeTables: DefaultRouteTables(), inboundTunIndex: 7}
+
+			s.addPodToMesh(newTestPod("a", "a", "10.0.0.1"))
+			if len(nl.routes) != 1 {
+				t.Fatalf("expected a route to the pod, got %v", nl.routes)
+			}
+			args := strings.Join(routeArgs(&nl.routes[0]), " ")
+			if !strings.Contains(args, "src "+tc.expected) {
+				t.Errorf("expected the route from %s, got %q", tc.expected, args)
+			}
+		})
+	}
+}
+
+func TestValidateInboundRouteSrc(t *testing.T) {
+	cases := []struct {
+		name      string
+		src       string
+		expectErr bool
+	}{
+		{
+			name: "local address",
+			src:  "10.0.0.100",
+		},
+		{
+			name: "inbound tunnel ip",
+			src:  constants.InboundTunIP,
+		},
+		{
+			name:      "not local",
+			src:       "10.0.0.200",
+			expectErr: true,
+		},
+		{
+			name:      "ipv6",
+			src:       "fd00::1",
+			expectErr: true,
+		},
+		{
+			name:      "invalid",
+			src:       "10.0.0",
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			link := &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 2}}
+			nl.links["eth0"] = link
+			addr, _ := netlink.ParseAddr("10.0.0.100/24")
+			if err := nl.AddrReplace(link, addr); err != nil {
+				t.Fatal(err)
+			}
+
+			err := validateInboundRouteSrc(tc.src)
+			if tc.expectErr != (err != nil) {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
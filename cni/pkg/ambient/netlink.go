@@ -0,0 +1,175 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NetlinkHandle is the subset of the netlink library used for the links, addresses and routes of
+// the node setup and mesh membership, so that tests can fake the kernel state.
+type NetlinkHandle interface {
+	LinkAdd(link netlink.Link) error
+	LinkDel(link netlink.Link) error
+	LinkByName(name string) (netlink.Link, error)
+	LinkByIndex(index int) (netlink.Link, error)
+	LinkList() ([]netlink.Link, error)
+	LinkSetUp(link netlink.Link) error
+	LinkSetMTU(link netlink.Link, mtu int) error
+	AddrReplace(link netlink.Link, addr *netlink.Addr) error
+	AddrDel(link netlink.Link, addr *netlink.Addr) error
+	AddrList(link netlink.Link, family int) ([]netlink.Addr, error)
+	RouteAdd(route *netlink.Route) error
+	RouteDel(route *netlink.Route) error
+	RouteGet(dst net.IP) ([]netlink.Route, error)
+	RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error)
+	RuleList(family int) ([]netlink.Rule, error)
+	RuleAdd(rule *netlink.Rule) error
+	RuleDel(rule *netlink.Rule) error
+	LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error
+	RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error
+}
+
+// defaultNetlink is the handle of the package-level functions, such as AddPodToMesh which the CNI
+// plugin uses without a Server, and of a Server without its own. It is a variable for tests.
+var defaultNetlink NetlinkHandle = netlinkLib{}
+
+// netlinkLib is the NetlinkHandle of the netlink library. The changes are printed instead of made
+// in dry-run mode.
+type netlinkLib struct{}
+
+func (netlinkLib) LinkAdd(link netlink.Link) error {
+	return linkAdd(link)
+}
+
+func (netlinkLib) LinkDel(link netlink.Link) error {
+	return linkDel(link)
+}
+
+func (netlinkLib) LinkByName(name string) (netlink.Link, error) {
+	return netlink.LinkByName(name)
+}
+
+func (netlinkLib) LinkByIndex(index int) (netlink.Link, error) {
+	return netlink.LinkByIndex(index)
+}
+
+func (netlinkLib) LinkList() ([]netlink.Link, error) {
+	return netlink.LinkList()
+}
+
+func (netlinkLib) LinkSetUp(link netlink.Link) error {
+	return linkSetUp(link)
+}
+
+func (netlinkLib) LinkSetMTU(link netlink.Link, mtu int) error {
+	return linkSetMTU(link, mtu)
+}
+
+func (netlinkLib) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	return addrReplace(link, addr)
+}
+
+func (netlinkLib) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	return addrDel(link, addr)
+}
+
+func (netlinkLib) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	return netlink.AddrList(link, family)
+}
+
+func (netlinkLib) RouteAdd(route *netlink.Route) error {
+	return routeAdd(route)
+}
+
+func (netlinkLib) RouteDel(route *netlink.Route) error {
+	return routeDel(route)
+}
+
+func (netlinkLib) RouteGet(dst net.IP) ([]netlink.Route, error) {
+	return netlink.RouteGet(dst)
+}
+
+func (netlinkLib) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	return netlink.RouteListFiltered(family, filter, filterMask)
+}
+
+func (netlinkLib) RuleList(family int) ([]netlink.Rule, error) {
+	return netlink.RuleList(family)
+}
+
+func (netlinkLib) RuleAdd(rule *netlink.Rule) error {
+	return ruleAdd(rule)
+}
+
+func (netlinkLib) RuleDel(rule *netlink.Rule) error {
+	return ruleDel(rule)
+}
+
+func (netlinkLib) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	return netlink.LinkSubscribe(ch, done)
+}
+
+func (netlinkLib) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	return netlink.RouteSubscribe(ch, done)
+}
+
+// netlink returns the NetlinkHandle of s, or defaultNetlink if it has none.
+func (s *Server) netlink() NetlinkHandle {
+	if s.nl == nil {
+		return defaultNetlink
+	}
+	return s.nl
+}
+
+// linkWaitTimeout bounds how long linkByNameOrWait waits for a link to appear, and linkPollInterval
+// is how often it looks for the link. They are variables for tests.
+var (
+	linkWaitTimeout  = 30 * time.Second
+	linkPollInterval = 200 * time.Millisecond
+)
+
+// linkByNameOrWait returns the link called name, waiting up to linkWaitTimeout for it to be
+// created if it doesn't exist yet. It is for links created by other components, such as the veth
+// of the ztunnel pod, which node setup may run before. Errors other than a missing link are
+// returned right away.
+func (s *Server) linkByNameOrWait(ctx context.Context, name string) (netlink.Link, error) {
+	wctx, cancel := context.WithTimeout(ctx, linkWaitTimeout)
+	defer cancel()
+	for {
+		link, err := s.netlink().LinkByName(name)
+		if err == nil {
+			return link, nil
+		}
+		err = &NetlinkError{Op: "LinkByName", Err: err}
+		if !errors.Is(err, ErrDeviceNotFound) {
+			return nil, err
+		}
+		select {
+		case <-wctx.Done():
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, fmt.Errorf("timed out waiting for link %s: %w", name, err)
+		case <-time.After(linkPollInterval):
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+// fakeNetlink is an in-memory NetlinkHandle. Links are kept by name, their addresses by index, and
+// routes and ip rules in lists, the routes filtered by table and destination. If routeAddErr is set,
+// route additions fail with it, and if routeDelErr is set, route deletions fail with what it
+// returns. If keepRoutes is set, deleted routes are still listed.
+type fakeNetlink struct {
+	// mu serializes the calls, as node setup makes some concurrently.
+	mu sync.Mutex
+
+	links map[string]netlink.Link
+	// nextIndex is the index of the next added link without one, counting from 100.
+	nextIndex int
+	linkAddrs map[int][]netlink.Addr
+	addrs     []string
+	routes    []netlink.Route
+	rules     []netlink.Rule
+	mtu       int
+	up        bool
+	// deleted is the number of deleted links, and routeDels the deleted routes.
+	deleted   int
+	routeDels []netlink.Route
+
+	routeAddErr error
+	routeDelErr func(route *netlink.Route) error
+	keepRoutes  bool
+	// linkAdded is called with each added link, e.g. for the tests to cancel the setup midway.
+	linkAdded func(link netlink.Link)
+
+	// linkUpdates and routeUpdates are the channels of the event subscriptions, for the tests to
+	// send events on.
+	linkUpdates  chan<- netlink.LinkUpdate
+	routeUpdates chan<- netlink.RouteUpdate
+}
+
+func setFakeNetlink(t *testing.T) *fakeNetlink {
+	orig := defaultNetlink
+	f := &fakeNetlink{links: map[string]netlink.Link{}}
+	defaultNetlink = f
+	t.Cleanup(func() {
+		defaultNetlink = orig
+	})
+	return f
+}
+
+func (f *fakeNetlink) LinkAdd(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.links[link.Attrs().Name]; ok {
+		return syscall.EEXIST
+	}
+	if link.Attrs().Index == 0 {
+		// Like the netlink library, set the index the kernel picked on the added link.
+		link.Attrs().Index = 100 + f.nextIndex
+		f.nextIndex++
+	}
+	f.links[link.Attrs().Name] = link
+	if f.linkAdded != nil {
+		f.linkAdded(link)
+	}
+	return nil
+}
+
+func (f *fakeNetlink) LinkDel(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted++
+	delete(f.links, link.Attrs().Name)
+	return nil
+}
+
+func (f *fakeNetlink) LinkByName(name string) (netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if link, ok := f.links[name]; ok {
+		return link, nil
+	}
+	return nil, syscall.ENODEV
+}
+
+func (f *fakeNetlink) LinkByIndex(index int) (netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, link := range f.links {
+		if link.Attrs().Index == index {
+			return link, nil
+		}
+	}
+	return nil, syscall.ENODEV
+}
+
+func (f *fakeNetlink) LinkList() ([]netlink.Link, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	links := make([]netlink.Link, 0, len(f.links))
+	for _, link := range f.links {
+		links = append(links, link)
+	}
+	return links, nil
+}
+
+func (f *fakeNetlink) LinkSetUp(link netlink.Link) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.up = true
+	return nil
+}
+
+func (f *fakeNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.mtu = mtu
+	return nil
+}
+
+func (f *fakeNetlink) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	found := false
+	for _, a := range f.addrs {
+		found = found || a == addr.IPNet.String()
+	}
+	if !found {
+		f.addrs = append(f.addrs, addr.IPNet.String())
+	}
+	if f.linkAddrs == nil {
+		f.linkAddrs = map[int][]netlink.Addr{}
+	}
+	index := link.Attrs().Index
+	for _, a := range f.linkAddrs[index] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			return nil
+		}
+	}
+	f.linkAddrs[index] = append(f.linkAddrs[index], *addr)
+	return nil
+}
+
+func (f *fakeNetlink) AddrDel(link netlink.Link, addr *netlink.Addr) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, a := range f.addrs {
+		if a == addr.IPNet.String() {
+			f.addrs = append(f.addrs[:i], f.addrs[i+1:]...)
+			break
+		}
+	}
+	index := link.Attrs().Index
+	for i, a := range f.linkAddrs[index] {
+		if a.IPNet.String() == addr.IPNet.String() {
+			f.linkAddrs[index] = append(f.linkAddrs[index][:i], f.linkAddrs[index][i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeNetlink) AddrList(link netlink.Link, family int) ([]netlink.Addr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.linkAddrs[link.Attrs().Index], nil
+}
+
+func (f *fakeNetlink) RouteAdd(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.routeAddErr != nil {
+		return f.routeAddErr
+	}
+	f.routes = append(f.routes, *route)
+	return nil
+}
+
+func (f *fakeNetlink) RouteDel(route *netlink.Route) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routeDels = append(f.routeDels, *route)
+	if f.routeDelErr != nil {
+		if err := f.routeDelErr(route); err != nil {
+			return err
+		}
+	}
+	if f.keepRoutes {
+		return nil
+	}
+	for i, r := range f.routes {
+		if r.Table == route.Table && r.Dst.String() == route.Dst.String() {
+			f.routes = append(f.routes[:i], f.routes[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ESRCH
+}
+
+func (f *fakeNetlink) RouteGet(dst net.IP) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.routes {
+		if r.Dst == nil || r.Dst.Contains(dst) {
+			return []netlink.Route{r}, nil
+		}
+	}
+	return nil, nil
+}
+
+func (f *fakeNetlink) RouteListFiltered(family int, filter *netlink.Route, filterMask uint64) ([]netlink.Route, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var routes []netlink.Route
+	for _, r := range f.routes {
+		if filterMask&netlink.RT_FILTER_TABLE != 0 && r.Table != filter.Table {
+			continue
+		}
+		if filterMask&netlink.RT_FILTER_DST != 0 && r.Dst.String() != filter.Dst.String() {
+			continue
+		}
+		routes = append(routes, r)
+	}
+	return routes, nil
+}
+
+func (f *fakeNetlink) RuleList(family int) ([]netlink.Rule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]netlink.Rule(nil), f.rules...), nil
+}
+
+// RuleAdd adds rule even if an identical one exists, like ip rule add.
+func (f *fakeNetlink) RuleAdd(rule *netlink.Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, *rule)
+	return nil
+}
+
+func (f *fakeNetlink) RuleDel(rule *netlink.Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, r := range f.rules {
+		if r.Priority == rule.Priority && r.Mark == rule.Mark && r.Mask == rule.Mask &&
+			r.Table == rule.Table && r.Goto == rule.Goto {
+			f.rules = append(f.rules[:i], f.rules[i+1:]...)
+			return nil
+		}
+	}
+	return syscall.ENOENT
+}
+
+func (f *fakeNetlink) LinkSubscribe(ch chan<- netlink.LinkUpdate, done <-chan struct{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.linkUpdates = ch
+	return nil
+}
+
+func (f *fakeNetlink) RouteSubscribe(ch chan<- netlink.RouteUpdate, done <-chan struct{}) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routeUpdates = ch
+	return nil
+}
+
+// subscribed returns the channel of the link event subscription, or nil if there is none yet.
+func (f *fakeNetlink) subscribed() chan<- netlink.LinkUpdate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.linkUpdates
+}
+
+func TestGetDeviceWithDestinationOf(t *testing.T) {
+	cases := []struct {
+		name      string
+		route     string
+		ip        string
+		expected  string
+		expectErr error
+	}{
+		{
+			name:     "ipv4",
+			route:    "10.0.0.1/32",
+			ip:       "10.0.0.1",
+			expected: "veth1",
+		},
+		{
+			name:     "ipv6",
+			route:    "fd00::1/128",
+			ip:       "fd00::1",
+			expected: "veth1",
+		},
+		{
+			name:      "no route",
+			route:     "10.0.0.1/32",
+			ip:        "10.0.0.2",
+			expectErr: ErrNoRouteToDest,
+		},
+		{
+			name:      "invalid",
+			route:     "10.0.0.1/32",
+			ip:        "10.0.0",
+			expectErr: ErrInvalidPodIP,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := setFakeNetlink(t)
+			f.links["veth1"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 7}}
+			_, dst, _ := net.ParseCIDR(tc.route)
+			f.routes = []netlink.Route{{Dst: dst, LinkIndex: 7}}
+
+			dev, err := getDeviceWithDestinationOf(tc.ip)
+			if tc.expectErr != nil {
+				if !errors.Is(err, tc.expectErr) {
+					t.Errorf("expected %v, got %v", tc.expectErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, dev)
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// nftTable is the nftables table holding all of the ztunnel chains and the pod set.
+const nftTable = "ztunnel"
+
+// nftChains are the base chains standing in for the iptables chains. The iptables chains are
+// jumped to from the built-in chains, whereas these hook into netfilter directly, at the same
+// priority as the iptables table they replace.
+var nftChains = []struct {
+	table    string
+	chain    string
+	chainTyp string
+	hook     string
+	priority int
+}{
+	{constants.TableNat, constants.ChainZTunnelPrerouting, "nat", "prerouting", -100},
+	{constants.TableNat, constants.ChainZTunnelPostrouting, "nat", "postrouting", 100},
+	{constants.TableMangle, constants.ChainZTunnelPrerouting, "filter", "prerouting", -150},
+	{constants.TableMangle, constants.ChainZTunnelPostrouting, "filter", "postrouting", -150},
+	// A route chain, so that changing the mark reroutes locally generated packets like iptables does.
+	{constants.TableMangle, constants.ChainZTunnelOutput, "route", "output", -150},
+	{constants.TableMangle, constants.ChainZTunnelInput, "filter", "input", -150},
+	{constants.TableMangle, constants.ChainZTunnelForward, "filter", "forward", -150},
+}
+
+// nftChainName returns the name of the nft chain standing in for an iptables table and chain.
+func nftChainName(table, chain string) string {
+	return table + "-" + chain
+}
+
+var nftHandleRegexp = regexp.MustCompile(`# handle (\d+)`)
+
+// nftFirewall applies the rules natively with nft. Rules are translated from iptables syntax by
+// nftRule.
+//
+// Unlike iptables, accepting a packet in the nat chain doesn't stop other nat chains, e.g. those
+// of kube-proxy, from also seeing it.
+type nftFirewall struct {
+	exec Executor
+	mu   sync.Mutex
+	// handles are the nft handles of the appended rules, which are needed to delete them.
+	handles map[*iptablesRule]string
+}
+
+func newNftFirewall(exec Executor) *nftFirewall {
+	return &nftFirewall{exec: exec, handles: map[*iptablesRule]string{}}
+}
+
+func (f *nftFirewall) initChains(ctx context.Context) error {
+	if err := f.exec.Run(ctx, "nft", "add", "table", "ip", nftTable); err != nil {
+		return fmt.Errorf("failed to add nft table %s: %v", nftTable, err)
+	}
+	for _, c := range nftChains {
+		name := nftChainName(c.table, c.chain)
+		// Adding a chain that already exists is a no-op, so flush it too.
+		err := f.exec.Run(ctx, "nft", "add", "chain", "ip", nftTable, name,
+			"{", "type", c.chainTyp, "hook", c.hook, "priority", strconv.Itoa(c.priority), ";", "}")
+		if err != nil {
+			return fmt.Errorf("failed to add nft chain %s: %v", name, err)
+		}
+		if err := f.exec.Run(ctx, "nft", "flush", "chain", "ip", nftTable, name); err != nil {
+			return fmt.Errorf("failed to flush nft chain %s: %v", name, err)
+		}
+	}
+
+	f.mu.Lock()
+	f.handles = map[*iptablesRule]string{}
+	f.mu.Unlock()
+	return nil
+}
+
+func (f *nftFirewall) deleteChains(ctx context.Context) {
+	if err := f.exec.Run(ctx, "nft", "delete", "table", "ip", nftTable); err != nil {
+		log.Errorf("Error deleting nft table %s: %v", nftTable, err)
+	}
+
+	f.mu.Lock()
+	f.handles = map[*iptablesRule]string{}
+	f.mu.Unlock()
+}
+
+func (f *nftFirewall) appendRules(ctx context.Context, rules []*iptablesRule) ([]*iptablesRule, error) {
+	added := make([]*iptablesRule, 0, len(rules))
+	for _, rule := range rules {
+		expr, err := nftRule(rule)
+		if err != nil {
+			return added, err
+		}
+		log.Debugf("Appending nft rule: %s", strings.Join(expr, " "))
+		args := append([]string{"--echo", "--handle", "add", "rule", "ip", nftTable, nftChainName(rule.Table, rule.Chain)}, expr...)
+		out, err := f.exec.Output(ctx, "nft", args...)
+		if err != nil {
+			return added, fmt.Errorf("failed to append rule %+v: %v: %s", rule, err, out)
+		}
+		m := nftHandleRegexp.FindStringSubmatch(out)
+		if m == nil {
+			return added, fmt.Errorf("failed to append rule %+v: no handle in output %q", rule, out)
+		}
+
+		f.mu.Lock()
+		f.handles[rule] = m[1]
+		f.mu.Unlock()
+		added = append(added, rule)
+	}
+	return added, nil
+}
+
+func (f *nftFirewall) deleteRules(ctx context.Context, rules []*iptablesRule) error {
+	var errs error
+	for i := len(rules) - 1; i >= 0; i-- {
+		rule := rules[i]
+		f.mu.Lock()
+		handle, ok := f.handles[rule]
+		delete(f.handles, rule)
+		f.mu.Unlock()
+		if !ok {
+			errs = multierr.Append(errs, fmt.Errorf("no nft handle for rule %+v", rule))
+			continue
+		}
+		err := f.exec.Run(ctx, "nft", "delete", "rule", "ip", nftTable, nftChainName(rule.Table, rule.Chain), "handle", handle)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("failed to delete rule %+v: %v", rule, err))
+		}
+	}
+	return errs
+}
+
+// nftRule translates the spec of an iptables rule to an equivalent nft rule expression. Only the
+// matches and targets used by the ztunnel rules are supported.
+func nftRule(rule *iptablesRule) ([]string, error) {
+	var expr []string
+	var module, proto, target, savedMark string
+	targetOpts := map[string]string{}
+	negate := false
+
+	spec := rule.RuleSpec
+	for i := 0; i < len(spec); i++ {
+		arg := spec[i]
+		if arg == "!" {
+			negate = true
+			continue
+		}
+		if arg == "--save-mark" {
+			targetOpts[arg] = ""
+			continue
+		}
+		if i+1 >= len(spec) {
+			return nil, fmt.Errorf("missing value for %s in rule %v", arg, spec)
+		}
+		i++
+		val := spec[i]
+		op := []string{}
+		if negate {
+			op = []string{"!="}
+		}
+		negate = false
+
+		switch arg {
+		case "-m":
+			module = val
+		case "-p":
+			proto = val
+			expr = append(expr, "meta", "l4proto")
+			expr = append(append(expr, op...), val)
+		case "-i":
+			expr = append(append(append(expr, "iifname"), op...), val)
+		case "-o":
+			expr = append(append(append(expr, "oifname"), op...), val)
+		case "-s", "--source":
+			expr = append(append(append(expr, "ip", "saddr"), op...), val)
+		case "-d", "--destination":
+			expr = append(append(append(expr, "ip", "daddr"), op...), val)
+		case "--uid-owner":
+			expr = append(append(append(expr, "meta", "skuid"), op...), val)
+		case "--gid-owner":
+			expr = append(append(append(expr, "meta", "skgid"), op...), val)
+		case "--dport":
+			if proto == "" {
+				return nil, fmt.Errorf("--dport without a protocol in rule %v", spec)
+			}
+			expr = append(append(append(expr, proto, "dport"), op...), val)
+		case "--mark":
+			key := []string{"meta", "mark"}
+			if module == "connmark" {
+				key = []string{"ct", "mark"}
+			}
+			value, mask := splitMark(val)
+			if mask != "" {
+				key = append(key, "and", mask)
+			}
+			if module == "mark" && len(op) == 0 {
+				savedMark = val
+			}
+			cmp := "=="
+			if len(op) > 0 {
+				cmp = "!="
+			}
+			expr = append(append(expr, key...), cmp, value)
+		case "--match-set":
+			if i+1 >= len(spec) {
+				return nil, fmt.Errorf("missing direction for --match-set in rule %v", spec)
+			}
+			i++
+			field := "saddr"
+			if spec[i] == "dst" {
+				field = "daddr"
+			}
+			expr = append(append(append(expr, "ip", field), op...), "@"+val)
+		case "-j":
+			target = val
+		case "--set-mark", "--nfmask", "--ctmask", "--to":
+			targetOpts[arg] = val
+		default:
+			return nil, fmt.Errorf("unsupported option %s in rule %v", arg, spec)
+		}
+	}
+
+	switch target {
+	case "ACCEPT":
+		expr = append(expr, "accept")
+	case "RETURN":
+		expr = append(expr, "return")
+	case "MARK":
+		value, mask := splitMark(targetOpts["--set-mark"])
+		if mask == "" {
+			expr = append(expr, "meta", "mark", "set", value)
+		} else {
+			inv, err := invertMask(mask)
+			if err != nil {
+				return nil, err
+			}
+			expr = append(expr, "meta", "mark", "set", "meta", "mark", "and", inv, "or", value)
+		}
+	case "CONNMARK":
+		if _, ok := targetOpts["--save-mark"]; !ok || savedMark == "" {
+			return nil, fmt.Errorf("only CONNMARK --save-mark after a mark match is supported in rule %v", spec)
+		}
+		// nft can't combine the packet and conn marks in one statement, but the packet mark was
+		// matched by the rule, so the bits being saved are known.
+		value, err := maskMark(savedMark, targetOpts["--nfmask"])
+		if err != nil {
+			return nil, err
+		}
+		inv, err := invertMask(targetOpts["--ctmask"])
+		if err != nil {
+			return nil, err
+		}
+		expr = append(expr, "ct", "mark", "set", "ct", "mark", "and", inv, "or", value)
+	case "DNAT":
+		expr = append(expr, "dnat", "to", targetOpts["--to"])
+	default:
+		return nil, fmt.Errorf("unsupported target %q in rule %v", target, spec)
+	}
+	return expr, nil
+}
+
+// splitMark splits an iptables mark of the form value[/mask].
+func splitMark(mark string) (value, mask string) {
+	value, mask, _ = strings.Cut(mark, "/")
+	return value, mask
+}
+
+// maskMark returns the value of an iptables mark of the form value[/mask], masked by mask.
+func maskMark(mark, mask string) (string, error) {
+	value, markMask := splitMark(mark)
+	v, err := strconv.ParseUint(value, 0, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid mark %q: %v", mark, err)
+	}
+	for _, m := range []string{markMask, mask} {
+		if m == "" {
+			continue
+		}
+		mv, err := strconv.ParseUint(m, 0, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid mark mask %q: %v", m, err)
+		}
+		v &= mv
+	}
+	return fmt.Sprintf("0x%08x", v), nil
+}
+
+func invertMask(mask string) (string, error) {
+	m, err := strconv.ParseUint(mask, 0, 32)
+	if err != nil {
+		return "", fmt.Errorf("invalid mark mask %q: %v", mask, err)
+	}
+	return fmt.Sprintf("0x%08x", ^uint32(m)), nil
+}
+
+// nftSet is an IpsetHandle for an nft set in the ztunnel table, used for mesh membership with
+// the nftables backend.
+type nftSet struct {
+	name string
+}
+
+func newNftSet(name string) *nftSet {
+	return &nftSet{name: name}
+}
+
+func (n *nftSet) CreateSet() error {
+	ctx := context.Background()
+	if err := execute(ctx, "nft", "add", "table", "ip", nftTable); err != nil {
+		return fmt.Errorf("failed to add nft table %s: %v", nftTable, err)
+	}
+	if err := execute(ctx, "nft", "add", "set", "ip", nftTable, n.name, "{", "type", "ipv4_addr", ";", "}"); err != nil {
+		return fmt.Errorf("failed to create nft set %s: %v", n.name, err)
+	}
+	return nil
+}
+
+// CommentsSupported reports true, as nft sets always store the comments of their elements.
+func (n *nftSet) CommentsSupported() (bool, error) {
+	return true, nil
+}
+
+func (n *nftSet) DestroySet() error {
+	if err := execute(context.Background(), "nft", "delete", "set", "ip", nftTable, n.name); err != nil {
+		return fmt.Errorf("failed to destroy nft set %s: %v", n.name, err)
+	}
+	return nil
+}
+
+func (n *nftSet) AddIP(ip net.IP, comment string) error {
+	elem := []string{"{", ip.String()}
+	if comment != "" {
+		elem = append(elem, "comment", strconv.Quote(comment))
+	}
+	elem = append(elem, "}")
+	if err := execute(context.Background(), "nft", append([]string{"add", "element", "ip", nftTable, n.name}, elem...)...); err != nil {
+		return fmt.Errorf("failed to add IP %s to nft set %s: %v", ip, n.name, err)
+	}
+	return nil
+}
+
+func (n *nftSet) DeleteIP(ip net.IP) error {
+	if err := execute(context.Background(), "nft", "delete", "element", "ip", nftTable, n.name, "{", ip.String(), "}"); err != nil {
+		return fmt.Errorf("failed to delete IP %s from nft set %s: %v", ip, n.name, err)
+	}
+	return nil
+}
+
+func (n *nftSet) Flush() error {
+	if err := execute(context.Background(), "nft", "flush", "set", "ip", nftTable, n.name); err != nil {
+		return fmt.Errorf("failed to flush nft set %s: %v", n.name, err)
+	}
+	return nil
+}
+
+func (n *nftSet) List() ([]netlink.IPSetEntry, error) {
+	out, err := executeOutput(context.Background(), "nft", "-j", "list", "set", "ip", nftTable, n.name)
+	if err != nil {
+		if strings.Contains(out, "No such file or directory") {
+			return nil, fmt.Errorf("failed to list nft set %s: %w", n.name, os.ErrNotExist)
+		}
+		return nil, fmt.Errorf("failed to list nft set %s: %v: %s", n.name, err, out)
+	}
+	return parseNftSetElements(out)
+}
+
+// parseNftSetElements parses the elements from the JSON output of nft list set. Elements without
+// a comment are plain strings, and elements with a comment are objects.
+func parseNftSetElements(out string) ([]netlink.IPSetEntry, error) {
+	var res struct {
+		Nftables []struct {
+			Set *struct {
+				Elem []json.RawMessage `json:"elem"`
+			} `json:"set"`
+		} `json:"nftables"`
+	}
+	if err := json.Unmarshal([]byte(out), &res); err != nil {
+		return nil, fmt.Errorf("failed to parse nft set: %v", err)
+	}
+
+	var entries []netlink.IPSetEntry
+	for _, obj := range res.Nftables {
+		if obj.Set == nil {
+			continue
+		}
+		for _, raw := range obj.Set.Elem {
+			var val, comment string
+			if err := json.Unmarshal(raw, &val); err != nil {
+				var elem struct {
+					Elem struct {
+						Val     string `json:"val"`
+						Comment string `json:"comment"`
+					} `json:"elem"`
+				}
+				if err := json.Unmarshal(raw, &elem); err != nil {
+					return nil, fmt.Errorf("failed to parse nft set element %s: %v", raw, err)
+				}
+				val, comment = elem.Elem.Val, elem.Elem.Comment
+			}
+			ip := net.ParseIP(val)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP %q in nft set", val)
+			}
+			entries = append(entries, netlink.IPSetEntry{IP: ip.To4(), Comment: comment})
+		}
+	}
+	return entries, nil
+}
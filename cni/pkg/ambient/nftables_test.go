@@ -0,0 +1,444 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"testing"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// TestNftRule checks that the ztunnel marking rules translate to nft rules with the same effect.
+func TestNftRule(t *testing.T) {
+	cases := []struct {
+		name      string
+		rule      *iptablesRule
+		expected  string
+		expectErr bool
+	}{
+		{
+			name: "skip mark from ipset",
+			rule: newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+				"-m", "set", "!", "--match-set", ipsetName, "src",
+				"-j", "MARK", "--set-mark", constants.SkipMark),
+			expected: "ip saddr != @ztunnel-pods-ips meta mark set meta mark and 0xfffffdff or 0x200",
+		},
+		{
+			name: "save conn mark",
+			rule: newIptableRule(constants.TableMangle, constants.ChainZTunnelPostrouting,
+				"-m", "mark", "--mark", constants.ConnSkipMark,
+				"-j", "CONNMARK", "--save-mark",
+				"--nfmask", constants.ConnSkipMask, "--ctmask", constants.ConnSkipMask),
+			expected: "meta mark and 0x220 == 0x220 ct mark set ct mark and 0xfffffddf or 0x00000220",
+		},
+		{
+			name: "restore from conn mark",
+			rule: newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+				"-m", "connmark", "--mark", constants.ConnSkipMark,
+				"-j", "MARK", "--set-mark", constants.SkipMark),
+			expected: "ct mark and 0x220 == 0x220 meta mark set meta mark and 0xfffffdff or 0x200",
+		},
+		{
+			name: "accept outbound",
+			rule: newIptableRule(constants.TableNat, constants.ChainZTunnelPrerouting,
+				"-m", "mark", "--mark", constants.OutboundMark, "-j", "ACCEPT"),
+			expected: "meta mark and 0x100 == 0x100 accept",
+		},
+		{
+			name: "return for other interfaces",
+			rule: newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+				"!", "-i", constants.InboundTun, "-p", "udp", "--dport", "53", "-j", "RETURN"),
+			expected: "iifname != istioin meta l4proto udp udp dport 53 return",
+		},
+		{
+			name: "dns capture",
+			rule: newIptableRule(constants.TableNat, constants.ChainZTunnelPrerouting,
+				"--source", "10.0.0.1", "-p", "udp", "-m", "udp", "--dport", "53",
+				"-j", "DNAT", "--to", "10.0.0.2:15053"),
+			expected: "ip saddr 10.0.0.1 meta l4proto udp udp dport 53 dnat to 10.0.0.2:15053",
+		},
+		{
+			name: "skip mark by owner",
+			rule: newIptableRule(constants.TableMangle, constants.ChainZTunnelOutput,
+				"-m", "owner", "--uid-owner", "1000",
+				"-j", "MARK", "--set-mark", constants.ConnSkipMark),
+			expected: "meta skuid 1000 meta mark set meta mark and 0xfffffddf or 0x220",
+		},
+		{
+			name:      "unsupported target",
+			rule:      newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting, "-j", "TPROXY"),
+			expectErr: true,
+		},
+		{
+			name: "conn mark without mark match",
+			rule: newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+				"-j", "CONNMARK", "--save-mark"),
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			expr, err := nftRule(tc.rule)
+			if (err != nil) != tc.expectErr {
+				t.Fatalf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if got := strings.Join(expr, " "); got != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, got)
+			}
+		})
+	}
+}
+
+// TestNftRuleConformance checks that every rule of the node setups of both node types translates to
+// an nft rule, and that both forms of each rule match the same packets and leave them with the same
+// marks and verdict.
+func TestNftRuleConformance(t *testing.T) {
+	s := &Server{
+		hostIP:                    "10.0.0.100",
+		excludeInboundPorts:       []uint16{9000},
+		excludeOutboundPorts:      []uint16{9001},
+		excludeOutboundCIDRs:      []netip.Prefix{netip.MustParsePrefix("10.96.0.0/12")},
+		excludeLinkLocalMulticast: true,
+		excludeOwnerUIDs:          []uint32{1337},
+		excludeOwnerGIDs:          []uint32{1338},
+	}
+	cpuRules, cpuRules2 := s.cpuNodeRules("eth0", "10.0.0.2", true)
+	dpuRules, dpuRules2 := s.dpuNodeRules("veth0", "10.0.0.2", true)
+	nodeRules := []struct {
+		nodeType string
+		rules    []*iptablesRule
+	}{
+		{offmesh.CPUNode, append(cpuRules, cpuRules2...)},
+		{offmesh.DPUNode, append(dpuRules, dpuRules2...)},
+	}
+
+	m := DefaultMarks()
+	var packets []testPacket
+	for _, mark := range []uint32{0, m.Outbound, m.Skip, m.ConnSkip, m.Proxy, m.ProxyRet, m.Skip | m.Outbound} {
+		for _, ctMark := range []uint32{0, m.Skip, m.ConnSkip, m.Proxy} {
+			for _, saddr := range []string{"10.0.0.100", "10.0.0.1", "10.0.0.2", "192.168.1.1"} {
+				for _, daddr := range []string{"10.0.0.1", "10.96.0.10", "224.0.0.251"} {
+					for _, proto := range []string{"tcp", "udp"} {
+						for _, dport := range []string{"53", "80", "9000", "9001"} {
+							for _, iif := range []string{constants.InboundTun, constants.OutboundTun, "eth0", "veth0"} {
+								for _, owner := range [][2]string{{"0", "0"}, {"1337", "0"}, {"0", "1338"}} {
+									packets = append(packets, testPacket{
+										mark: mark, ctMark: ctMark, saddr: saddr, daddr: daddr,
+										proto: proto, dport: dport, iif: iif, uid: owner[0], gid: owner[1],
+									})
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	for _, node := range nodeRules {
+		for _, rule := range node.rules {
+			spec := strings.Join(rule.RuleSpec, " ")
+			t.Run(node.nodeType+" "+rule.Chain+" "+spec, func(t *testing.T) {
+				expr, err := nftRule(rule)
+				if err != nil {
+					t.Fatalf("failed to translate the rule: %v", err)
+				}
+				for _, p := range packets {
+					want, got := evalIptablesRule(t, rule.RuleSpec, p), evalNftRule(t, expr, p)
+					if want != got {
+						t.Fatalf("nft rule %q evaluates packet %+v to %+v, expected %+v", strings.Join(expr, " "), p, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// testPacket is a packet TestNftRuleConformance evaluates the rules on. Only the source 10.0.0.1 is
+// in the ipset.
+type testPacket struct {
+	mark, ctMark uint32
+	saddr, daddr string
+	proto, dport string
+	iif          string
+	uid, gid     string
+}
+
+// packetResult is what a rule does to a packet.
+type packetResult struct {
+	matched      bool
+	verdict      string
+	mark, ctMark uint32
+}
+
+func inTestIpset(name, ip string) bool {
+	return name == ipsetName && ip == "10.0.0.1"
+}
+
+func inTestPrefix(ip, prefix string) bool {
+	if !strings.Contains(prefix, "/") {
+		return ip == prefix
+	}
+	return netip.MustParsePrefix(prefix).Contains(netip.MustParseAddr(ip))
+}
+
+func parseTestMark(t *testing.T, mark string) (value, mask uint32) {
+	v, m, ok := strings.Cut(mark, "/")
+	if !ok {
+		m = "0xffffffff"
+	}
+	value64, err := strconv.ParseUint(v, 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask64, err := strconv.ParseUint(m, 0, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uint32(value64), uint32(mask64)
+}
+
+// evalIptablesRule evaluates an iptables rule spec on p, as iptables does.
+func evalIptablesRule(t *testing.T, spec []string, p testPacket) packetResult {
+	unmatched := packetResult{mark: p.mark, ctMark: p.ctMark}
+	var module, target string
+	opts := map[string]string{}
+	negate := false
+	for i := 0; i < len(spec); i++ {
+		arg := spec[i]
+		var ok bool
+		switch arg {
+		case "!":
+			negate = true
+			continue
+		case "--save-mark":
+			opts[arg] = ""
+			continue
+		case "-m":
+			i++
+			module = spec[i]
+			continue
+		case "-j":
+			i++
+			target = spec[i]
+			continue
+		case "--set-mark", "--nfmask", "--ctmask", "--to":
+			i++
+			opts[arg] = spec[i]
+			continue
+		case "-p":
+			i++
+			ok = p.proto == spec[i]
+		case "-i":
+			i++
+			ok = p.iif == spec[i]
+		case "-s", "--source":
+			i++
+			ok = inTestPrefix(p.saddr, spec[i])
+		case "-d", "--destination":
+			i++
+			ok = inTestPrefix(p.daddr, spec[i])
+		case "--uid-owner":
+			i++
+			ok = p.uid == spec[i]
+		case "--gid-owner":
+			i++
+			ok = p.gid == spec[i]
+		case "--dport":
+			i++
+			ok = p.dport == spec[i]
+		case "--mark":
+			i++
+			value, mask := parseTestMark(t, spec[i])
+			got := p.mark
+			if module == "connmark" {
+				got = p.ctMark
+			}
+			ok = got&mask == value
+		case "--match-set":
+			name, dir := spec[i+1], spec[i+2]
+			i += 2
+			ip := p.saddr
+			if dir == "dst" {
+				ip = p.daddr
+			}
+			ok = inTestIpset(name, ip)
+		default:
+			t.Fatalf("unsupported option %s in rule %v", arg, spec)
+		}
+		if ok == negate {
+			return unmatched
+		}
+		negate = false
+	}
+
+	res := packetResult{matched: true, mark: p.mark, ctMark: p.ctMark}
+	switch target {
+	case "ACCEPT", "RETURN":
+		res.verdict = strings.ToLower(target)
+	case "MARK":
+		value, mask := parseTestMark(t, opts["--set-mark"])
+		res.mark = p.mark&^mask ^ value
+	case "CONNMARK":
+		_, nfmask := parseTestMark(t, "0/"+opts["--nfmask"])
+		_, ctmask := parseTestMark(t, "0/"+opts["--ctmask"])
+		res.ctMark = p.ctMark&^ctmask ^ p.mark&nfmask
+	case "DNAT":
+		res.verdict = "dnat to " + opts["--to"]
+	default:
+		t.Fatalf("unsupported target %s in rule %v", target, spec)
+	}
+	return res
+}
+
+// evalNftRule evaluates an nft rule expression, as translated by nftRule, on p, as nft does.
+func evalNftRule(t *testing.T, expr []string, p testPacket) packetResult {
+	unmatched := packetResult{mark: p.mark, ctMark: p.ctMark}
+	res := packetResult{matched: true, mark: p.mark, ctMark: p.ctMark}
+	i := 0
+	next := func() string {
+		if i >= len(expr) {
+			t.Fatalf("truncated nft rule %v", expr)
+		}
+		i++
+		return expr[i-1]
+	}
+	// cmp reads the optional operator and the value of a match, and reports whether it matches.
+	cmp := func(match func(value string) bool) bool {
+		value := next()
+		negate := value == "!="
+		if value == "!=" || value == "==" {
+			value = next()
+		}
+		return match(value) != negate
+	}
+	mark := func(value string) uint32 {
+		v, _ := parseTestMark(t, value)
+		return v
+	}
+	// markSet evaluates the value set to a mark, either a constant or the mark masked and or'ed.
+	markSet := func(cur uint32) uint32 {
+		value := next()
+		if value != "meta" && value != "ct" {
+			return mark(value)
+		}
+		if next() != "mark" || next() != "and" {
+			t.Fatalf("unexpected mark statement in nft rule %v", expr)
+		}
+		and := mark(next())
+		if next() != "or" {
+			t.Fatalf("unexpected mark statement in nft rule %v", expr)
+		}
+		return cur&and | mark(next())
+	}
+	// markMatch matches a mark, with an optional mask.
+	markMatch := func(got uint32) bool {
+		if expr[i] == "and" {
+			i++
+			got &= mark(next())
+		}
+		return cmp(func(value string) bool { return got == mark(value) })
+	}
+
+	for i < len(expr) {
+		ok := true
+		switch tok := next(); tok {
+		case "meta":
+			switch key := next(); key {
+			case "l4proto":
+				ok = cmp(func(v string) bool { return p.proto == v })
+			case "skuid":
+				ok = cmp(func(v string) bool { return p.uid == v })
+			case "skgid":
+				ok = cmp(func(v string) bool { return p.gid == v })
+			case "mark":
+				if expr[i] == "set" {
+					i++
+					res.mark = markSet(p.mark)
+				} else {
+					ok = markMatch(p.mark)
+				}
+			default:
+				t.Fatalf("unsupported meta key %s in nft rule %v", key, expr)
+			}
+		case "ct":
+			if next() != "mark" {
+				t.Fatalf("unsupported ct key in nft rule %v", expr)
+			}
+			if expr[i] == "set" {
+				i++
+				res.ctMark = markSet(p.ctMark)
+			} else {
+				ok = markMatch(p.ctMark)
+			}
+		case "iifname":
+			ok = cmp(func(v string) bool { return p.iif == v })
+		case "ip":
+			addr := p.saddr
+			if next() == "daddr" {
+				addr = p.daddr
+			}
+			ok = cmp(func(v string) bool {
+				if strings.HasPrefix(v, "@") {
+					return inTestIpset(v[1:], addr)
+				}
+				return inTestPrefix(addr, v)
+			})
+		case "tcp", "udp":
+			if next() != "dport" {
+				t.Fatalf("unsupported %s match in nft rule %v", tok, expr)
+			}
+			// The port match implies the protocol, even when negated.
+			ok = cmp(func(v string) bool { return p.dport == v }) && p.proto == tok
+		case "accept", "return":
+			res.verdict = tok
+		case "dnat":
+			if next() != "to" {
+				t.Fatalf("unsupported dnat in nft rule %v", expr)
+			}
+			res.verdict = "dnat to " + next()
+		default:
+			t.Fatalf("unsupported token %s in nft rule %v", tok, expr)
+		}
+		if !ok {
+			return unmatched
+		}
+	}
+	return res
+}
+
+func TestParseNftSetElements(t *testing.T) {
+	out := `{"nftables": [{"metainfo": {"version": "1.0.2"}}, {"set": {"family": "ip", "name": "ztunnel-pods-ips",
+"table": "ztunnel", "type": "ipv4_addr", "elem": ["10.0.0.1", {"elem": {"val": "10.0.0.2", "comment": "uid-2"}}]}}]}`
+	entries, err := parseNftSetElements(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 entries, got %v", entries)
+	}
+	if !entries[0].IP.Equal(net.ParseIP("10.0.0.1")) || entries[0].Comment != "" {
+		t.Errorf("unexpected first entry %+v", entries[0])
+	}
+	if !entries[1].IP.Equal(net.ParseIP("10.0.0.2")) || entries[1].Comment != "uid-2" {
+		t.Errorf("unexpected second entry %+v", entries[1])
+	}
+}
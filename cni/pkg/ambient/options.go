@@ -15,10 +15,16 @@
 package ambient
 
 import (
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"istio.io/api/label"
 	"istio.io/api/mesh/v1alpha1"
+	ambientconstants "istio.io/istio/cni/pkg/ambient/constants"
 	ipsetlib "istio.io/istio/cni/pkg/ipset"
 	"istio.io/istio/pkg/config/constants"
 	"istio.io/pkg/env"
@@ -29,7 +35,107 @@ var (
 	PodName      = env.RegisterStringVar("POD_NAME", "", "").Get()
 	NodeName     = env.RegisterStringVar("NODE_NAME", "", "").Get()
 	Revision     = env.RegisterStringVar("REVISION", "", "").Get()
-	HostIP       = env.RegisterStringVar("HOST_IP", "", "").Get()
+
+	InboundTunnelVNI = env.RegisterIntVar("AMBIENT_INBOUND_TUNNEL_VNI", ambientconstants.InboundTunVNI,
+		"Geneve VNI of the inbound tunnel to ztunnel").Get()
+	OutboundTunnelVNI = env.RegisterIntVar("AMBIENT_OUTBOUND_TUNNEL_VNI", ambientconstants.OutboundTunVNI,
+		"Geneve VNI of the outbound tunnel to ztunnel").Get()
+	TunnelMTU = env.RegisterIntVar("AMBIENT_TUNNEL_MTU", 0,
+		"MTU of the tunnels to ztunnel. If 0, the MTU of the underlay device minus the Geneve overhead").Get()
+	GenevePort = env.RegisterIntVar("AMBIENT_GENEVE_PORT", ambientconstants.GenevePort,
+		"UDP destination port of the tunnels to ztunnel").Get()
+	GeneveUDPCsum = env.RegisterBoolVar("AMBIENT_GENEVE_UDP_CSUM", false,
+		"Set UDP checksums on the tunnels to ztunnel over an IPv4 underlay").Get()
+	GeneveUDPZeroCsum6Tx = env.RegisterBoolVar("AMBIENT_GENEVE_UDP_ZERO_CSUM6_TX", false,
+		"Send zero UDP checksums on the tunnels to ztunnel over an IPv6 underlay").Get()
+	GeneveUDPZeroCsum6Rx = env.RegisterBoolVar("AMBIENT_GENEVE_UDP_ZERO_CSUM6_RX", false,
+		"Accept zero UDP checksums on the tunnels to ztunnel over an IPv6 underlay").Get()
+	TunnelUnderlay = env.RegisterStringVar("AMBIENT_TUNNEL_UNDERLAY", "",
+		"IP family of the network the tunnels to ztunnel run over: ipv4 or ipv6. If unset, the family of the offmesh pair IP").Get()
+	TunnelEncryptionType = env.RegisterStringVar("AMBIENT_TUNNEL_ENCRYPTION", string(TunnelEncryptionNone),
+		"Encryption of the traffic between a CPU node and its DPU node: none or wireguard").Get()
+	WireGuardPrivateKeyFile = env.RegisterStringVar("AMBIENT_WIREGUARD_PRIVATE_KEY_FILE", "",
+		"File holding the WireGuard private key of this node, with wireguard tunnel encryption").Get()
+	WireGuardPeerPublicKey = env.RegisterStringVar("AMBIENT_WIREGUARD_PEER_PUBLIC_KEY", "",
+		"WireGuard public key of the offmesh node paired with this one, with wireguard tunnel encryption").Get()
+	WireGuardPort = env.RegisterIntVar("AMBIENT_WIREGUARD_PORT", ambientconstants.WireGuardPort,
+		"UDP port of the WireGuard link between a CPU node and its DPU node").Get()
+
+	InboundRouteTable = env.RegisterIntVar("AMBIENT_INBOUND_ROUTE_TABLE", ambientconstants.RouteTableInbound,
+		"Route table with the routes to mesh pods").Get()
+	OutboundRouteTable = env.RegisterIntVar("AMBIENT_OUTBOUND_ROUTE_TABLE", ambientconstants.RouteTableOutbound,
+		"Route table for traffic captured to ztunnel").Get()
+	ProxyRouteTable = env.RegisterIntVar("AMBIENT_PROXY_ROUTE_TABLE", ambientconstants.RouteTableProxy,
+		"Route table for traffic returning to ztunnel").Get()
+
+	FirewallBackendType = env.RegisterStringVar("AMBIENT_FIREWALL_BACKEND", string(FirewallIptables),
+		"Backend applying the ztunnel rules, iptables or nftables").Get()
+
+	DryRunMode = env.RegisterBoolVar("AMBIENT_DRY_RUN", false,
+		"Print the node setup as shell commands instead of applying it").Get()
+
+	ExcludeInboundPorts = env.RegisterStringVar("AMBIENT_EXCLUDE_INBOUND_PORTS", "",
+		"Comma separated ports of mesh pods whose inbound traffic bypasses ztunnel").Get()
+	ExcludeOutboundPorts = env.RegisterStringVar("AMBIENT_EXCLUDE_OUTBOUND_PORTS", "",
+		"Comma separated destination ports of outbound traffic from mesh pods which bypasses ztunnel").Get()
+	ExcludeOutboundCIDRs = env.RegisterStringVar("AMBIENT_EXCLUDE_OUTBOUND_CIDRS", "",
+		"Comma separated destination CIDRs of traffic which bypasses ztunnel").Get()
+	ExcludeLinkLocalMulticast = env.RegisterBoolVar("AMBIENT_EXCLUDE_LINK_LOCAL_MULTICAST", true,
+		"Bypass ztunnel for traffic to link-local (169.254.0.0/16) and multicast (224.0.0.0/4) destinations").Get()
+	ExcludeOwnerUIDs = env.RegisterStringVar("AMBIENT_EXCLUDE_OWNER_UIDS", "",
+		"Comma separated UIDs of host processes whose traffic bypasses ztunnel").Get()
+	ExcludeOwnerGIDs = env.RegisterStringVar("AMBIENT_EXCLUDE_OWNER_GIDS", "",
+		"Comma separated GIDs of host processes whose traffic bypasses ztunnel").Get()
+	NamespaceIpsetMapping = env.RegisterStringVar("AMBIENT_NAMESPACE_IPSETS", "",
+		"Comma separated namespace=ipset pairs, adding the mesh pods of the namespaces to their own ipset").Get()
+	PodCIDRs = env.RegisterStringVar("AMBIENT_POD_CIDRS", "",
+		"Comma separated CIDRs the IPs of the pods added to the mesh must be in, or \"node\" for the pod CIDRs of the node. "+
+			"If unset, the IPs are not checked").Get()
+	IpsetHashSize = env.RegisterIntVar("AMBIENT_IPSET_HASH_SIZE", int(DefaultIpsetSize().HashSize),
+		"Initial hash size of the ipsets of the mesh pods, a power of 2. Existing sets keep their size").Get()
+	IpsetMaxElem = env.RegisterIntVar("AMBIENT_IPSET_MAX_ELEM", int(DefaultIpsetSize().MaxElem),
+		"Maximum number of members of each ipset of the mesh pods. Existing sets keep their size").Get()
+
+	HostIPSubnet = env.RegisterStringVar("AMBIENT_HOST_IP_SUBNET", "",
+		"CIDR of the preferred host IP, on nodes with several internal IPs").Get()
+	HostIPInterface = env.RegisterStringVar("AMBIENT_HOST_IP_INTERFACE", "",
+		"Interface with the preferred host IP, on nodes with several internal IPs").Get()
+	InboundRouteSrc = env.RegisterStringVar("AMBIENT_INBOUND_ROUTE_SRC", "",
+		"Local IPv4 address the inbound pod routes use as their source, e.g. the inbound tunnel IP. If unset, the host IP").Get()
+
+	DataplaneRetries = env.RegisterIntVar("AMBIENT_DATAPLANE_RETRIES", 5,
+		"Attempts at tunnel and rule operations failing with transient errors during node setup").Get()
+	IptablesWait = env.RegisterIntVar("AMBIENT_IPTABLES_WAIT", 5,
+		"Seconds the iptables commands wait for the xtables lock held by other iptables users").Get()
+	MarkBase = env.RegisterStringVar("AMBIENT_MARK_BASE", "0x10",
+		"Lowest bit of the packet marks, which use 6 bits from it. Change it when the marks collide with another dataplane").Get()
+
+	DNSCapturePort = env.RegisterIntVar("AMBIENT_DNS_CAPTURE_PORT", ambientconstants.DNSCapturePort,
+		"Port of ztunnel which captured DNS queries are redirected to").Get()
+	DNSCaptureUDPOnly = env.RegisterBoolVar("AMBIENT_DNS_CAPTURE_UDP_ONLY", false,
+		"Only capture DNS queries over UDP, not TCP").Get()
+	DNSCaptureAddr = env.RegisterStringVar("AMBIENT_DNS_CAPTURE_ADDR", "",
+		"IPv4 address which captured DNS queries are redirected to, e.g. a resolver on the CPU node. If unset, the ztunnel IP").Get()
+
+	ZTunnelHealthPort = env.RegisterIntVar("AMBIENT_ZTUNNEL_HEALTH_PORT", 0,
+		"TCP port of ztunnel which node setup waits to accept connections before capturing traffic. 0 doesn't wait").Get()
+	ZTunnelHealthTimeout = env.RegisterDurationVar("AMBIENT_ZTUNNEL_HEALTH_TIMEOUT", 30*time.Second,
+		"How long node setup waits for the ztunnel health port").Get()
+
+	RPFilterScopeType = env.RegisterStringVar("AMBIENT_RP_FILTER_SCOPE", string(RPFilterScopeAll),
+		"Interfaces rp_filter is disabled on besides the ztunnel ones: all, mesh-only, or a regexp of interface names").Get()
+
+	InboundTunnelProbe = env.RegisterBoolVar("AMBIENT_INBOUND_TUNNEL_PROBE", false,
+		"Serve the inbound tunnel probe, which checks that the tunnel of a DPU node carries traffic to ztunnel").Get()
+
+	EnableIPv6 = env.RegisterBoolVar("AMBIENT_ENABLE_IPV6", false,
+		"Capture the IPv6 traffic of mesh pods on dual-stack nodes, with an IPv6 ipset and ip6tables").Get()
+
+	EnablePortIpset = env.RegisterBoolVar("AMBIENT_ENABLE_PORT_IPSET", false,
+		"Set up a hash:ip,port ipset, whose members are only captured to the destination ports of their entries").Get()
+
+	CaptureSelector = env.RegisterStringVar("AMBIENT_CAPTURE_SELECTOR", "",
+		"Label selector of the pods added to the mesh, e.g. to roll ambient out to some workloads. If unset, every pod is").Get()
 )
 
 type ConfigSourceAddressScheme string
@@ -46,8 +152,21 @@ const (
 	AmbientMeshOn        = v1alpha1.MeshConfig_AmbientMeshConfig_ON
 )
 
-var Ipset = &ipsetlib.IPSet{
-	Name: "ztunnel-pods-ips",
+// IpsetHandle is the set of ipset operations used to track mesh membership. It is
+// implemented by *ipsetlib.IPSet, and exists so that tests can substitute a fake.
+type IpsetHandle interface {
+	CreateSet() error
+	DestroySet() error
+	AddIP(ip net.IP, comment string) error
+	DeleteIP(ip net.IP) error
+	Flush() error
+	List() ([]netlink.IPSetEntry, error)
+}
+
+const ipsetName = "ztunnel-pods-ips"
+
+var Ipset IpsetHandle = &ipsetlib.IPSet{
+	Name: ipsetName,
 }
 
 var ambientSelectors metav1.LabelSelector = metav1.LabelSelector{
@@ -60,4 +179,85 @@ type AmbientArgs struct {
 	SystemNamespace string
 	Revision        string
 	KubeConfig      string
+	// NodeName is the name of this node. If unset, the NODE_NAME environment variable is used.
+	NodeName string
+	// TunnelVNIs are the Geneve VNIs of the ztunnel tunnels. Unset VNIs use the defaults.
+	TunnelVNIs TunnelVNIs
+	// TunnelMTU is the MTU of the ztunnel tunnels. If unset, it is derived from the underlay.
+	TunnelMTU int
+	// TunnelOptions are the UDP port and checksum options of the ztunnel tunnels.
+	TunnelOptions TunnelOptions
+	// TunnelEncryption protects the traffic between a CPU node and its DPU node. If unset, it is
+	// sent in the clear.
+	TunnelEncryption TunnelEncryption
+	// WireGuard configures the link between the nodes with TunnelEncryptionWireGuard.
+	WireGuard WireGuardOptions
+	// RouteTables are the policy routing tables to use. If unset, the defaults are used.
+	RouteTables RouteTables
+	// MarkBase is the lowest bit of the packet and conn marks. If unset, the marks of the constants
+	// package are used.
+	MarkBase uint32
+	// FirewallBackend applies the ztunnel rules. If unset, iptables is used.
+	FirewallBackend FirewallBackend
+	// DryRun prints the node setup as shell commands instead of applying it.
+	DryRun bool
+	// ExcludeInboundPorts are the ports of mesh pods whose inbound traffic bypasses ztunnel.
+	ExcludeInboundPorts []uint16
+	// ExcludeOutboundPorts are the destination ports of outbound traffic from mesh pods which
+	// bypasses ztunnel.
+	ExcludeOutboundPorts []uint16
+	// ExcludeOutboundCIDRs are the destination CIDRs of traffic which bypasses ztunnel.
+	ExcludeOutboundCIDRs []string
+	// ExcludeLinkLocalMulticast makes traffic to link-local and multicast destinations, such as the
+	// cloud metadata server or VRRP, bypass ztunnel.
+	ExcludeLinkLocalMulticast bool
+	// ExcludeOwnerUIDs and ExcludeOwnerGIDs are the users and groups of host processes whose
+	// traffic bypasses ztunnel, e.g. the kubelet's.
+	ExcludeOwnerUIDs []uint32
+	ExcludeOwnerGIDs []uint32
+	// NamespaceIpsets maps namespaces to the ipsets their mesh pods are added to, instead of the
+	// default ipset. It requires IPv6 to be disabled.
+	NamespaceIpsets map[string]string
+	// PodCIDRs are the CIDRs the IPs of the pods added to the mesh must be in, or PodCIDRsNode for
+	// the pod CIDRs of the node. If unset, the IPs are not checked.
+	PodCIDRs []string
+	// IpsetSize is the size the ipsets of the mesh pods are created with. If unset,
+	// DefaultIpsetSize is used.
+	IpsetSize IpsetSize
+	// CaptureSelector restricts the pods added to the mesh to those whose labels match it. If unset
+	// or empty, every pod is added.
+	CaptureSelector labels.Selector
+	// HostIPPreference chooses the host IP on nodes with several internal IPs.
+	HostIPPreference HostIPPreference
+	// InboundRouteSrc is the local IPv4 address the inbound pod routes use as their source. If
+	// unset, the host IP is used.
+	InboundRouteSrc string
+	// EnableIPv6 captures the IPv6 traffic of mesh pods on dual-stack nodes. It requires the
+	// iptables firewall backend.
+	EnableIPv6 bool
+	// EnablePortIpset sets up IpsetPort, whose members are only captured to the destination ports
+	// of their entries. It requires the iptables firewall backend.
+	EnablePortIpset bool
+	// DataplaneRetries is the number of attempts at tunnel and rule operations failing with
+	// transient errors during node setup. Values below 1 mean a single attempt.
+	DataplaneRetries int
+	// IptablesWait is how long the iptables commands wait for the xtables lock, in seconds. Values
+	// below 1 mean the default.
+	IptablesWait int
+	// DNSCapturePort is the port of ztunnel which captured DNS queries are redirected to. If unset,
+	// the default is used.
+	DNSCapturePort uint16
+	// DNSCaptureUDPOnly only captures DNS queries over UDP, not TCP.
+	DNSCaptureUDPOnly bool
+	// DNSCaptureAddr is the IPv4 address which captured DNS queries are redirected to. If unset,
+	// they are redirected to ztunnel.
+	DNSCaptureAddr string
+	// RPFilterScope selects the interfaces rp_filter is disabled on in bulk. If unset, it is
+	// disabled on all of them.
+	RPFilterScope RPFilterScope
+	// ZTunnelHealthPort is the TCP port of ztunnel which node setup waits to accept connections
+	// before capturing traffic. If unset, traffic is captured right away.
+	ZTunnelHealthPort uint16
+	// ZTunnelHealthTimeout is how long node setup waits for ZTunnelHealthPort.
+	ZTunnelHealthTimeout time.Duration
 }
@@ -0,0 +1,117 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+// requiredKernelModules are the kernel modules of the node setup: the tunnels, the ipset of the
+// mesh pods and the iptables matches and targets of the ztunnel rules.
+var requiredKernelModules = []string{"geneve", "ip_set_hash_ip", "xt_mark", "xt_connmark", "xt_set"}
+
+// The files listing the kernel modules. They are variables for tests.
+var (
+	procModulesPath = "/proc/modules"
+	modulesDir      = "/lib/modules"
+)
+
+// listKernelModules returns the names of the kernel modules available on the node. It is a
+// variable for tests.
+var listKernelModules = availableKernelModules
+
+// availableKernelModules returns the kernel modules which are loaded, built in, or installed and so
+// loaded on first use. The module files of the kernel are usually not mounted in the container, in
+// which case only the loaded modules are known.
+func availableKernelModules() (sets.Set, error) {
+	modules := sets.New()
+	if err := readModuleNames(procModulesPath, modules); err != nil {
+		return nil, err
+	}
+	release, err := os.ReadFile("/proc/sys/kernel/osrelease")
+	if err != nil {
+		return modules, nil
+	}
+	dir := filepath.Join(modulesDir, strings.TrimSpace(string(release)))
+	for _, name := range []string{"modules.builtin", "modules.dep"} {
+		if err := readModuleNames(filepath.Join(dir, name), modules); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return modules, nil
+}
+
+// readModuleNames adds the modules of the first field of each line of path to modules. The field is
+// the name of the module in /proc/modules, and the path of its file in the files of /lib/modules,
+// like kernel/drivers/net/geneve.ko.xz: for modules.dep, followed by its dependencies.
+func readModuleNames(path string, modules sets.Set) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to read kernel modules: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		name := filepath.Base(strings.TrimSuffix(fields[0], ":"))
+		if i := strings.Index(name, ".ko"); i != -1 {
+			name = name[:i]
+		}
+		// Module names are listed with underscores but may be spelled with dashes in file names.
+		modules.Insert(strings.ReplaceAll(name, "-", "_"))
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read kernel modules from %s: %v", path, err)
+	}
+	return nil
+}
+
+// Preflight checks that the kernel modules of the node setup are available, returning an error
+// wrapping ErrKernelModulesMissing which lists the missing ones. Without them, the tunnel and ipset
+// calls of the node setup fail with errors which don't tell why.
+func (s *Server) Preflight() error {
+	modules, err := listKernelModules()
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, m := range requiredKernelModules {
+		if !modules.Contains(m) {
+			missing = append(missing, m)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%w: %s", ErrKernelModulesMissing, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// warnPreflight logs the failures of Preflight. The node setup goes on, as the modules may still be
+// loaded on first use when the module files aren't visible from the container.
+func (s *Server) warnPreflight() {
+	if err := s.Preflight(); err != nil {
+		log.Warnf("Node setup preflight failed, the setup may fail: %v", err)
+	}
+}
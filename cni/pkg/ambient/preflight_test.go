@@ -0,0 +1,107 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+func setFakeKernelModules(t *testing.T, modules ...string) {
+	orig := listKernelModules
+	listKernelModules = func() (sets.Set, error) {
+		return sets.New(modules...), nil
+	}
+	t.Cleanup(func() {
+		listKernelModules = orig
+	})
+}
+
+func TestPreflight(t *testing.T) {
+	cases := []struct {
+		name          string
+		modules       []string
+		expectMissing []string
+	}{
+		{
+			name:    "all available",
+			modules: requiredKernelModules,
+		},
+		{
+			name:          "geneve missing",
+			modules:       []string{"ip_set_hash_ip", "xt_mark", "xt_connmark", "xt_set"},
+			expectMissing: []string{"geneve"},
+		},
+		{
+			name:          "none",
+			expectMissing: requiredKernelModules,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setFakeKernelModules(t, tc.modules...)
+			s := &Server{}
+			err := s.Preflight()
+			if len(tc.expectMissing) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.Is(err, ErrKernelModulesMissing) {
+				t.Fatalf("expected ErrKernelModulesMissing, got %v", err)
+			}
+			if !strings.HasSuffix(err.Error(), ": "+strings.Join(tc.expectMissing, ", ")) {
+				t.Errorf("expected the missing modules %v, got %v", tc.expectMissing, err)
+			}
+		})
+	}
+}
+
+func TestReadModuleNames(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"modules": "xt_set 16384 2 - Live 0x0000000000000000\n" +
+			"ip_set 53248 2 xt_set,ip_set_hash_ip, Live 0x0000000000000000\n",
+		"modules.builtin": "kernel/net/netfilter/xt_mark.ko\n",
+		"modules.dep": "kernel/drivers/net/geneve.ko.xz: kernel/net/ipv6/ip6_udp_tunnel.ko.xz\n" +
+			"kernel/net/netfilter/xt_connmark.ko.xz:\n" +
+			"kernel/net/netfilter/ipset/ip_set_hash_ip.ko.xz: kernel/net/netfilter/ipset/ip_set.ko.xz\n",
+	}
+	modules := sets.New()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := readModuleNames(path, modules); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, m := range requiredKernelModules {
+		if !modules.Contains(m) {
+			t.Errorf("expected module %s, got %v", m, modules.SortedList())
+		}
+	}
+	if modules.Contains("ip6_udp_tunnel") {
+		t.Errorf("expected only the first field of modules.dep, got %v", modules.SortedList())
+	}
+}
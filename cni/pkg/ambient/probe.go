@@ -0,0 +1,121 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// tunnelProbePort is the UDP port of ztunnel the inbound tunnel probe is sent to. Nothing listens on
+// it, so the probe is dropped by ztunnel.
+const tunnelProbePort = 15099
+
+// tunnelProbeTimeout bounds sending the probe.
+const tunnelProbeTimeout = time.Second
+
+// sendTunnelProbe sends a small UDP packet to addr. It is a variable for tests.
+var sendTunnelProbe = func(addr string) error {
+	conn, err := net.DialTimeout("udp", addr, tunnelProbeTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(time.Now().Add(tunnelProbeTimeout)); err != nil {
+		return err
+	}
+	_, err = conn.Write([]byte("ztunnel-probe"))
+	return err
+}
+
+// ProbeInboundTunnel checks that the inbound tunnel of a DPU node carries traffic to ztunnel: the
+// tunnel is up, the route to ztunnel resolves to it, and a UDP probe sent to ztunnel through it
+// leaves the node. Nothing replies to the probe, so ztunnel receiving it isn't verified. An error is
+// returned until ztunnel is running and the node is set up, so that an init container can wait for
+// the dataplane on it. On other nodes there is no inbound tunnel, and nil is returned.
+func (s *Server) ProbeInboundTunnel() error {
+	if offmesh.MyNodeType(s.nodeName, s.offmeshCluster) != offmesh.DPUNode {
+		return nil
+	}
+	if !s.isZTunnelRunning() {
+		return errors.New("ztunnel is not running")
+	}
+
+	link, err := s.netlink().LinkByName(constants.InboundTun)
+	if err != nil {
+		return fmt.Errorf("tunnel %s: %v", constants.InboundTun, &NetlinkError{Op: "LinkByName", Err: err})
+	}
+	if link.Attrs().Flags&net.FlagUp == 0 {
+		return fmt.Errorf("tunnel %s is down", constants.InboundTun)
+	}
+
+	routes, err := s.netlink().RouteGet(net.ParseIP(constants.ZTunnelInboundTunIP))
+	if err != nil {
+		return &NetlinkError{Op: "RouteGet", Err: err}
+	}
+	if len(routes) == 0 {
+		return fmt.Errorf("%w: %s", ErrNoRouteToDest, constants.ZTunnelInboundTunIP)
+	}
+	if routes[0].LinkIndex != link.Attrs().Index {
+		return fmt.Errorf("route to %s goes through link %d, not tunnel %s",
+			constants.ZTunnelInboundTunIP, routes[0].LinkIndex, constants.InboundTun)
+	}
+
+	addr := net.JoinHostPort(constants.ZTunnelInboundTunIP, strconv.Itoa(tunnelProbePort))
+	if err := sendTunnelProbe(addr); err != nil {
+		return fmt.Errorf("failed to send probe to %s: %v", addr, err)
+	}
+	return nil
+}
+
+// zTunnelHealthPollInterval is how often WaitForZTunnel tries to connect to ztunnel.
+const zTunnelHealthPollInterval = 500 * time.Millisecond
+
+// dialZTunnel opens and closes a TCP connection to addr. It is a variable for tests.
+var dialZTunnel = func(ctx context.Context, addr string) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// WaitForZTunnel polls the TCP health port of ztunnel until it accepts a connection, or timeout
+// passes. Node setup waits for it before capturing traffic, which would be black-holed until
+// ztunnel listens.
+func (s *Server) WaitForZTunnel(ctx context.Context, ztunnelIP string, port uint16, timeout time.Duration) error {
+	addr := net.JoinHostPort(ztunnelIP, strconv.Itoa(int(port)))
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		err := dialZTunnel(ctx, addr)
+		if err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%w: %s: %v", ErrZTunnelNotReady, addr, err)
+		case <-time.After(zTunnelHealthPollInterval):
+		}
+	}
+}
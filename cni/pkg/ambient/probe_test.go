@@ -0,0 +1,137 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+func TestProbeInboundTunnel(t *testing.T) {
+	pairs := []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}}
+	cases := []struct {
+		name      string
+		nodeName  string
+		running   bool
+		down      bool
+		routeDev  int
+		sendErr   error
+		expectErr bool
+		expectTo  string
+	}{
+		{
+			name:     "probed",
+			nodeName: "dpu1",
+			running:  true,
+			routeDev: 9,
+			expectTo: "192.168.126.2:15099",
+		},
+		{
+			name:     "cpu node",
+			nodeName: "cpu1",
+		},
+		{
+			name:      "ztunnel not running",
+			nodeName:  "dpu1",
+			routeDev:  9,
+			expectErr: true,
+		},
+		{
+			name:      "tunnel down",
+			nodeName:  "dpu1",
+			running:   true,
+			down:      true,
+			routeDev:  9,
+			expectErr: true,
+		},
+		{
+			name:      "route through another device",
+			nodeName:  "dpu1",
+			running:   true,
+			routeDev:  2,
+			expectErr: true,
+		},
+		{
+			name:      "send failure",
+			nodeName:  "dpu1",
+			running:   true,
+			routeDev:  9,
+			sendErr:   errors.New("network is unreachable"),
+			expectErr: true,
+			expectTo:  "192.168.126.2:15099",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			flags := net.FlagUp
+			if tc.down {
+				flags = 0
+			}
+			nl.links[constants.InboundTun] = &netlink.Geneve{
+				LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9, Flags: flags},
+			}
+			_, dst, _ := net.ParseCIDR(constants.ZTunnelInboundTunIP + "/32")
+			nl.routes = []netlink.Route{{Dst: dst, LinkIndex: tc.routeDev}}
+
+			var sentTo string
+			orig := sendTunnelProbe
+			sendTunnelProbe = func(addr string) error {
+				sentTo = addr
+				return tc.sendErr
+			}
+			t.Cleanup(func() {
+				sendTunnelProbe = orig
+			})
+
+			s := &Server{
+				nodeName:       tc.nodeName,
+				offmeshCluster: offmesh.ClusterConfig{Pairs: pairs},
+				ztunnelRunning: tc.running,
+			}
+			err := s.ProbeInboundTunnel()
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+			if sentTo != tc.expectTo {
+				t.Errorf("expected the probe to be sent to %q, got %q", tc.expectTo, sentTo)
+			}
+		})
+	}
+}
+
+func TestWaitForZTunnelTimeout(t *testing.T) {
+	orig := dialZTunnel
+	dialZTunnel = func(ctx context.Context, addr string) error {
+		return errors.New("connection refused")
+	}
+	t.Cleanup(func() {
+		dialZTunnel = orig
+	})
+
+	err := (&Server{}).WaitForZTunnel(context.Background(), "10.0.0.2", 15021, 100*time.Millisecond)
+	if !errors.Is(err, ErrZTunnelNotReady) {
+		t.Errorf("expected %v, got %v", ErrZTunnelNotReady, err)
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	corev1 "k8s.io/api/core/v1"
+	klabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pilot/pkg/ambient/ambientpod"
+	"istio.io/istio/pkg/offmesh"
+	"istio.io/istio/pkg/util/sets"
+)
+
+// dataplaneReconcilePeriod is how often the ipset and inbound routes are reconciled against the mesh pods.
+const dataplaneReconcilePeriod = 5 * time.Minute
+
+// DataplaneReconcileResult summarizes a single ReconcileDataplane pass.
+type DataplaneReconcileResult struct {
+	// Added is the number of mesh pods that were missing from the ipset.
+	Added int
+	// Removed is the number of orphaned ipset entries and routes that were deleted.
+	Removed int
+	// Orphans is the number of ipset entries and routes found without a matching mesh pod.
+	Orphans int
+}
+
+// orphanGrace decides which of the orphans found by a ReconcileDataplane pass are deleted. The CNI
+// plugin adds a pod from its own process, before the pod IP is in the pod status, so an orphan may
+// be a pod just added. An orphan is only deleted if the UID of its ipset entry is unknown to the pod
+// lister, or if it was orphaned in the previous pass too.
+type orphanGrace struct {
+	liveUIDs sets.Set
+	// last are the orphans of the previous pass, and seen those of this one, by orphanKey.
+	last, seen sets.Set
+}
+
+// orphanKey is the key of the orphaned ipset entry or route with the IP.
+func orphanKey(kind, ip string) string {
+	return kind + "/" + ip
+}
+
+// expired records the orphan with key, whose ipset entry has the UID uid, or none if empty, and
+// reports whether it is to be deleted.
+func (g *orphanGrace) expired(key, uid string) bool {
+	g.seen.Insert(key)
+	return (uid != "" && !g.liveUIDs.Contains(uid)) || g.last.Contains(key)
+}
+
+// ReconcileDataplane compares the ipset members and the routes in the inbound route table against the
+// pods that should currently be in the mesh. Missing pods are added, and orphaned entries, e.g. left
+// behind by a DelPodFromMesh that was missed during a restart, are deleted as allowed by
+// orphanGrace, as are the duplicate entries of the pods removed by DedupeIpset. It is safe to call
+// repeatedly.
+func (s *Server) ReconcileDataplane() (DataplaneReconcileResult, error) {
+	var res DataplaneReconcileResult
+
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	// The missing pods would be added back, and the drained ones are all orphans.
+	if s.isDraining() {
+		log.Debugf("Draining, skipping dataplane reconcile")
+		return res, nil
+	}
+
+	pods, err := s.meshPods()
+	if err != nil {
+		return res, err
+	}
+	// The entries and routes of the bypassed pods, and of those not matching the capture selector,
+	// are orphans.
+	pods = s.capturedPods(s.withoutBypassedPods(pods))
+	liveUIDs, err := s.livePodUIDs()
+	if err != nil {
+		return res, err
+	}
+	grace := &orphanGrace{liveUIDs: liveUIDs, last: s.lastOrphans, seen: sets.New()}
+	wantIPs := sets.NewWithLength(len(pods))
+	// The pods are the desired members of the ipset of their namespace.
+	members := make(map[IpsetHandle][]*corev1.Pod)
+	for _, pod := range pods {
+		if pod.Status.PodIP != "" {
+			wantIPs.Insert(pod.Status.PodIP)
+		}
+		set := ipsetFor(pod.Namespace)
+		members[set] = append(members[set], pod)
+	}
+
+	removed, errs := dedupeIpsets(pods)
+	res.Removed += removed
+	for _, set := range allIpsets() {
+		entries, err := set.List()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return res, multierr.Append(errs, fmt.Errorf("%w: %v", ErrIpsetMissing, err))
+			}
+			return res, multierr.Append(errs, &NetlinkError{Op: "IpsetList", Err: err})
+		}
+		r, err := reconcileIpset(set, entries, wantIPs, members[set], grace)
+		res.Orphans += r.Orphans
+		res.Added += r.Added
+		res.Removed += r.Removed
+		errs = multierr.Append(errs, err)
+	}
+
+	routes, err := s.netlink().RouteListFiltered(
+		netlink.FAMILY_V4,
+		&netlink.Route{Table: s.routeTables.Inbound},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return res, multierr.Append(errs, &NetlinkError{Op: "RouteList", Err: err})
+	}
+	for _, r := range routes {
+		// Only pod routes go via the inbound tunnel, leave anything else in the table alone.
+		if r.Dst == nil || r.Gw == nil || r.Gw.String() != constants.ZTunnelInboundTunIP {
+			continue
+		}
+		if wantIPs.Contains(r.Dst.IP.String()) {
+			continue
+		}
+		res.Orphans++
+		if !grace.expired(orphanKey("route", r.Dst.IP.String()), "") {
+			log.Infof("Keeping orphaned route %s until the next reconcile", r.Dst)
+			continue
+		}
+		log.Infof("Removing orphaned route %s", r.Dst)
+		r := r
+		if err := s.netlink().RouteDel(&r); err != nil {
+			errs = multierr.Append(errs, &NetlinkError{Op: "RouteDel", Err: err})
+			continue
+		}
+		res.Removed++
+	}
+
+	s.lastOrphans = grace.seen
+
+	_, err = addPodsToMeshInTable(pods, s.routeSrc(), s.routeTables.Inbound, s.inboundTunLinkIndex())
+	errs = multierr.Append(errs, err)
+
+	s.mu.Lock()
+	s.dataplaneOrphans = res.Orphans
+	s.mu.Unlock()
+
+	log.Infof("Reconciled dataplane: %d mesh pods, added %d, removed %d, orphans %d",
+		len(pods), res.Added, res.Removed, res.Orphans)
+	return res, errs
+}
+
+// DedupeIpset removes the duplicate ipset entries of the pods. Where the UID of a pod is in the
+// comments of several entries, e.g. after crash and restart cycles, only the entry with the
+// current IP of the pod is kept. It returns the number of entries removed.
+func (s *Server) DedupeIpset(pods []*corev1.Pod) (int, error) {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+	return dedupeIpsets(pods)
+}
+
+// dedupeIpsets removes the entries of the pods with their UID but not their IP from the ipsets
+// holding several entries with the UID. The entries of other UIDs are left to reconcileIpset.
+func dedupeIpsets(pods []*corev1.Pod) (removed int, errs error) {
+	podIPs := make(map[string]string, len(pods))
+	for _, pod := range pods {
+		podIPs[string(pod.UID)] = pod.Status.PodIP
+	}
+
+	for _, set := range allIpsets() {
+		entries, err := set.List()
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return removed, multierr.Append(errs, fmt.Errorf("%w: %v", ErrIpsetMissing, err))
+			}
+			return removed, multierr.Append(errs, &NetlinkError{Op: "IpsetList", Err: err})
+		}
+		uidEntries := make(map[string][]netlink.IPSetEntry)
+		for _, entry := range entries {
+			if entry.Comment == "" {
+				continue
+			}
+			if uid := commentUID(entry.Comment); podIPs[uid] != "" {
+				uidEntries[uid] = append(uidEntries[uid], entry)
+			}
+		}
+		for uid, dups := range uidEntries {
+			if len(dups) < 2 {
+				continue
+			}
+			for _, entry := range dups {
+				if entry.IP.String() == podIPs[uid] {
+					continue
+				}
+				log.Infof("Removing duplicate ipset entry %s (%s)", entry.IP, entry.Comment)
+				if err := set.DeleteIP(entry.IP); err != nil {
+					errs = multierr.Append(errs, err)
+					continue
+				}
+				removed++
+			}
+		}
+	}
+	return removed, errs
+}
+
+// SyncInboundRoutes converges the pod routes in the inbound route table to pods, e.g. the mesh pods
+// known to the pod controller. The missing routes are added, and the routes to IPs of no pod in pods
+// are deleted. Routes which don't go via the inbound tunnel are left alone. It returns the number of
+// routes added and removed.
+func (s *Server) SyncInboundRoutes(pods []*corev1.Pod) (added, removed int, errs error) {
+	s.meshMu.Lock()
+	defer s.meshMu.Unlock()
+
+	pods = s.capturedPods(s.withoutBypassedPods(withoutHostNetworkPods(pods)))
+	wantIPs := sets.NewWithLength(len(pods))
+	for _, pod := range pods {
+		addr, err := normalizePodIP(pod.Status.PodIP)
+		if err != nil {
+			errs = multierr.Append(errs, fmt.Errorf("pod %s/%s: %w", pod.Namespace, pod.Name, err))
+			continue
+		}
+		// The routes of IPv6 pods go through the IPv4 inbound tunnel, there is none of their own.
+		if addr.Is4() {
+			wantIPs.Insert(addr.String())
+		}
+	}
+
+	routes, err := s.netlink().RouteListFiltered(
+		netlink.FAMILY_V4,
+		&netlink.Route{Table: s.routeTables.Inbound},
+		netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return 0, 0, multierr.Append(errs, &NetlinkError{Op: "RouteList", Err: err})
+	}
+	haveIPs := sets.NewWithLength(len(routes))
+	for _, r := range routes {
+		if r.Dst == nil || r.Gw == nil || r.Gw.String() != constants.ZTunnelInboundTunIP {
+			continue
+		}
+		ip := r.Dst.IP.String()
+		if wantIPs.Contains(ip) {
+			haveIPs.Insert(ip)
+			continue
+		}
+		log.Infof("Removing route %s of no mesh pod", r.Dst)
+		r := r
+		if err := s.netlink().RouteDel(&r); err != nil {
+			errs = multierr.Append(errs, &NetlinkError{Op: "RouteDel", Err: err})
+			continue
+		}
+		removed++
+	}
+
+	missing := wantIPs.Difference(haveIPs).SortedList()
+	if len(missing) == 0 {
+		return added, removed, errs
+	}
+	tunIndex := s.inboundTunLinkIndex()
+	if tunIndex == 0 {
+		if tunIndex, err = lookupInboundTunIndex(); err != nil {
+			return added, removed, multierr.Append(errs, err)
+		}
+	}
+	for _, ip := range missing {
+		rte, err := podRoute(ip, s.routeSrc(), s.routeTables.Inbound, tunIndex)
+		if err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		log.Infof("Adding missing route %s of a mesh pod", rte.Dst)
+		if err := s.netlink().RouteAdd(rte); err != nil {
+			errs = multierr.Append(errs, &NetlinkError{Op: "RouteAdd", Err: err})
+			continue
+		}
+		added++
+	}
+	return added, removed, errs
+}
+
+// DataplaneOrphans returns the number of orphaned ipset entries and routes found by the last
+// ReconcileDataplane. A non-zero value means mesh membership is leaking.
+func (s *Server) DataplaneOrphans() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dataplaneOrphans
+}
+
+// reconcileDataplaneLoop runs ReconcileDataplane immediately and then periodically, until stop is closed.
+func (s *Server) reconcileDataplaneLoop(stop <-chan struct{}) {
+	wait.Until(func() {
+		if !s.isZTunnelRunning() {
+			log.Debugf("Skipping dataplane reconcile as ztunnel is not running")
+			return
+		}
+		if _, err := s.ReconcileDataplane(); err != nil {
+			log.Errorf("Failed to reconcile dataplane: %v", err)
+		}
+	}, dataplaneReconcilePeriod, stop)
+}
+
+// livePodUIDs returns the UIDs of the pods known to the pod lister, of any node.
+func (s *Server) livePodUIDs() (sets.Set, error) {
+	pods, err := s.kubeClient.KubeInformer().Core().V1().Pods().Lister().List(klabels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+	uids := sets.NewWithLength(len(pods))
+	for _, pod := range pods {
+		uids.Insert(string(pod.UID))
+	}
+	return uids, nil
+}
+
+// meshPods returns the running pods handled by this node that should currently be in the mesh.
+func (s *Server) meshPods() ([]*corev1.Pod, error) {
+	namespaces, err := s.nsLister.List(klabels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list namespaces: %v", err)
+	}
+
+	nodeType := offmesh.MyNodeType(s.nodeName, s.offmeshCluster)
+	podLister := s.kubeClient.KubeInformer().Core().V1().Pods().Lister()
+	var pods []*corev1.Pod
+	for _, ns := range namespaces {
+		matchDisabled, err := s.matchesDisabledSelectors(ns.GetLabels())
+		if err != nil {
+			return nil, err
+		}
+		if matchDisabled {
+			continue
+		}
+		nsPods, err := podLister.Pods(ns.Name).List(klabels.Everything())
+		if err != nil {
+			return nil, fmt.Errorf("failed to list pods in namespace %s: %v", ns.Name, err)
+		}
+		for _, pod := range nsPods {
+			onNode := (nodeType == offmesh.CPUNode && s.podOnMyNode(pod)) ||
+				(nodeType == offmesh.DPUNode && s.isPodOnMyCPU(pod))
+			if onNode && !ztunnelPod(pod) && !hostNetworkPod(pod) && ambientpod.ShouldPodBeInIpset(ns, pod, s.meshMode.String(), false) {
+				pods = append(pods, pod)
+			}
+		}
+	}
+	return pods, nil
+}
+
+// ipsetReplaceThreshold is the number of orphaned entries of an ipset from which reconcileIpset
+// replaces its members at once. An entry added by the CNI plugin between the listing of the set and
+// the swap is lost, so the swap is only worth it for many orphans. It is a variable for tests.
+var ipsetReplaceThreshold = 100
+
+// reconcileIpset makes the pods the members of set, whose current entries are entries. Entries
+// with an IP not in wantIPs are orphans, deleted as allowed by grace. Where set supports it, its
+// members are replaced at once if there are at least ipsetReplaceThreshold orphans to delete, and
+// otherwise the orphans are deleted one at a time and the missing pods are left to
+// addPodsToMeshInTable.
+func reconcileIpset(set IpsetHandle, entries []netlink.IPSetEntry, wantIPs sets.Set, pods []*corev1.Pod, grace *orphanGrace) (DataplaneReconcileResult, error) {
+	var res DataplaneReconcileResult
+	haveUIDs := sets.New()
+	haveIPs := sets.New()
+	var orphans []netlink.IPSetEntry
+	for _, entry := range entries {
+		ip := entry.IP.String()
+		if wantIPs.Contains(ip) {
+			haveIPs.Insert(ip)
+			haveUIDs.Insert(commentUID(entry.Comment))
+			continue
+		}
+		res.Orphans++
+		if !grace.expired(orphanKey("ipset", ip), commentUID(entry.Comment)) {
+			log.Infof("Keeping orphaned ipset entry %s (%s) until the next reconcile", entry.IP, entry.Comment)
+			continue
+		}
+		orphans = append(orphans, entry)
+	}
+	for _, pod := range pods {
+		// A pod without an IP yet is added once it has one.
+		if pod.Status.PodIP == "" {
+			continue
+		}
+		if !haveUIDs.Contains(string(pod.UID)) && !haveIPs.Contains(pod.Status.PodIP) {
+			res.Added++
+		}
+	}
+	if len(orphans) == 0 && res.Added == 0 {
+		return res, nil
+	}
+
+	if r, ok := set.(ipsetReplacer); ok && len(orphans) >= ipsetReplaceThreshold {
+		log.Infof("Replacing ipset members: %d mesh pods, %d orphaned entries", len(pods), len(orphans))
+		if err := r.Replace(replacementEntries(entries, orphans, pods)); err != nil {
+			return res, &NetlinkError{Op: "IpsetSwap", Err: err}
+		}
+		res.Removed = len(orphans)
+		return res, nil
+	}
+	var errs error
+	for _, entry := range orphans {
+		log.Infof("Removing orphaned ipset entry %s (%s)", entry.IP, entry.Comment)
+		if err := set.DeleteIP(entry.IP); err != nil {
+			errs = multierr.Append(errs, err)
+			continue
+		}
+		res.Removed++
+	}
+	return res, errs
+}
+
+// replacementEntries returns the members replacing the entries of an ipset: the entries of the pods,
+// and the entries not in orphans with an IP of none of the pods, such as those of the pods added by
+// the CNI plugin before their IP is in the pod status.
+func replacementEntries(entries, orphans []netlink.IPSetEntry, pods []*corev1.Pod) []netlink.IPSetEntry {
+	res := ipsetEntries(pods)
+	skip := sets.NewWithLength(len(res) + len(orphans))
+	for _, entry := range res {
+		skip.Insert(entry.IP.String())
+	}
+	for _, entry := range orphans {
+		skip.Insert(entry.IP.String())
+	}
+	for _, entry := range entries {
+		if !skip.InsertContains(entry.IP.String()) {
+			res = append(res, entry)
+		}
+	}
+	return res
+}
+
+// ipsetEntries returns the ipset entries of the pods, skipping those without a valid IPv4 address.
+func ipsetEntries(pods []*corev1.Pod) []netlink.IPSetEntry {
+	entries := make([]netlink.IPSetEntry, 0, len(pods))
+	for _, pod := range pods {
+		addr, err := normalizePodIP(pod.Status.PodIP)
+		if err != nil || !addr.Is4() {
+			continue
+		}
+		entries = append(entries, netlink.IPSetEntry{IP: net.IP(addr.AsSlice()), Comment: ipsetComment(pod)})
+	}
+	return entries
+}
@@ -0,0 +1,404 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"istio.io/api/mesh/v1alpha1"
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/kube"
+	"istio.io/istio/pkg/offmesh"
+	"istio.io/istio/pkg/util/sets"
+)
+
+func TestSyncInboundRoutes(t *testing.T) {
+	cases := []struct {
+		name            string
+		routeIPs        []string
+		podIPs          []string
+		expectedAdded   int
+		expectedRemoved int
+	}{
+		{
+			name:          "add only",
+			routeIPs:      []string{"10.244.0.5"},
+			podIPs:        []string{"10.244.0.5", "10.244.0.6", "10.244.0.7"},
+			expectedAdded: 2,
+		},
+		{
+			name:            "remove only",
+			routeIPs:        []string{"10.244.0.5", "10.244.0.6", "10.244.0.7"},
+			podIPs:          []string{"10.244.0.6"},
+			expectedRemoved: 2,
+		},
+		{
+			name:            "mixed",
+			routeIPs:        []string{"10.244.0.5", "10.244.0.6"},
+			podIPs:          []string{"10.244.0.6", "10.244.0.7"},
+			expectedAdded:   1,
+			expectedRemoved: 1,
+		},
+		{
+			name:     "in sync",
+			routeIPs: []string{"10.244.0.5"},
+			podIPs:   []string{"10.244.0.5"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := setFakeNetlink(t)
+			f.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 7}}
+			s := &Server{hostIP: "10.0.0.100", routeTables: DefaultRouteTables()}
+			for _, ip := range tc.routeIPs {
+				rte, err := podRoute(ip, s.hostIP, s.routeTables.Inbound, 7)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.routes = append(f.routes, *rte)
+			}
+			// Routes which don't go via the inbound tunnel are not pod routes, and are kept.
+			other := netlink.Route{Table: s.routeTables.Inbound, Dst: &net.IPNet{IP: net.ParseIP("10.0.0.0"), Mask: net.CIDRMask(8, 32)}}
+			f.routes = append(f.routes, other)
+
+			var pods []*corev1.Pod
+			for _, ip := range tc.podIPs {
+				pods = append(pods, newTestPod("pod-"+ip, ip, ip))
+			}
+			added, removed, err := s.SyncInboundRoutes(pods)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != tc.expectedAdded || removed != tc.expectedRemoved {
+				t.Errorf("expected %d added and %d removed, got %d and %d",
+					tc.expectedAdded, tc.expectedRemoved, added, removed)
+			}
+
+			var got []string
+			for _, r := range f.routes {
+				if r.Gw == nil {
+					continue
+				}
+				if r.LinkIndex != 7 || r.Table != s.routeTables.Inbound {
+					t.Errorf("expected the route %s via the inbound tunnel in table %d, got %+v", r.Dst, s.routeTables.Inbound, r)
+				}
+				got = append(got, r.Dst.IP.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.podIPs) {
+				t.Errorf("expected the routes of %v, got %v", tc.podIPs, got)
+			}
+			if len(f.routes) != len(tc.podIPs)+1 {
+				t.Errorf("expected the route %s to be kept, got %v", other.Dst, f.routes)
+			}
+		})
+	}
+}
+
+func TestReconcileDataplane(t *testing.T) {
+	// Pod c was just added by the CNI plugin, before kubelet reported its IP.
+	f := &fakeIpset{entries: []netlink.IPSetEntry{
+		{IP: net.ParseIP("10.244.0.5").To4(), Comment: "default/a/uid-a"},
+		{IP: net.ParseIP("10.244.0.7").To4(), Comment: "default/c/uid-c"},
+		{IP: net.ParseIP("10.244.0.9").To4(), Comment: "default/gone/uid-gone"},
+	}}
+	setFakeIpset(t, f)
+	nl := setFakeNetlink(t)
+	nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 7}}
+
+	var pods []runtime.Object
+	for _, pod := range []*corev1.Pod{newTestPod("a", "a", "10.244.0.5"), newTestPod("b", "b", "10.244.0.6"), newTestPod("c", "c", "")} {
+		pod.Spec.NodeName = "cpu1"
+		pod.Status.Phase = corev1.PodRunning
+		pods = append(pods, pod)
+	}
+	client := kube.NewFakeClient(append(pods, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})...)
+	s := &Server{
+		kubeClient: client,
+		nsLister:   client.KubeInformer().Core().V1().Namespaces().Lister(),
+		nodeName:   "cpu1",
+		offmeshCluster: offmesh.ClusterConfig{
+			Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: "10.0.0.10", DPUName: "dpu1", DPUIp: "10.0.0.11"}},
+		},
+		meshMode:    v1alpha1.MeshConfig_AmbientMeshConfig_ON,
+		hostIP:      "10.0.0.100",
+		routeTables: DefaultRouteTables(),
+	}
+	client.KubeInformer().Core().V1().Pods().Informer()
+	stop := make(chan struct{})
+	t.Cleanup(func() {
+		close(stop)
+	})
+	client.RunAndWait(stop)
+
+	// The route of the deleted pod was left behind too.
+	for _, ip := range []string{"10.244.0.5", "10.244.0.7", "10.244.0.9"} {
+		rte, err := podRoute(ip, s.hostIP, s.routeTables.Inbound, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nl.routes = append(nl.routes, *rte)
+	}
+	dataplane := func() (members, routes []string) {
+		for _, entry := range f.entries {
+			members = append(members, entry.IP.String())
+		}
+		for _, r := range nl.routes {
+			routes = append(routes, r.Dst.IP.String())
+		}
+		sort.Strings(members)
+		sort.Strings(routes)
+		return members, routes
+	}
+
+	passes := []struct {
+		expected DataplaneReconcileResult
+		members  []string
+		routes   []string
+	}{
+		// Only the ipset entry of the deleted pod is removed at once, the orphaned routes and the
+		// entry of the live pod are kept for a pass.
+		{
+			expected: DataplaneReconcileResult{Added: 1, Removed: 1, Orphans: 4},
+			members:  []string{"10.244.0.5", "10.244.0.6", "10.244.0.7"},
+			routes:   []string{"10.244.0.5", "10.244.0.6", "10.244.0.7", "10.244.0.9"},
+		},
+		// Still orphaned, they are removed.
+		{
+			expected: DataplaneReconcileResult{Removed: 3, Orphans: 3},
+			members:  []string{"10.244.0.5", "10.244.0.6"},
+			routes:   []string{"10.244.0.5", "10.244.0.6"},
+		},
+		// The dataplane is now in sync, so nothing is found again.
+		{
+			members: []string{"10.244.0.5", "10.244.0.6"},
+			routes:  []string{"10.244.0.5", "10.244.0.6"},
+		},
+	}
+	for i, pass := range passes {
+		res, err := s.ReconcileDataplane()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != pass.expected {
+			t.Errorf("pass %d: expected %+v, got %+v", i, pass.expected, res)
+		}
+		if s.DataplaneOrphans() != pass.expected.Orphans {
+			t.Errorf("pass %d: expected %d orphans to be reported, got %d", i, pass.expected.Orphans, s.DataplaneOrphans())
+		}
+		members, routes := dataplane()
+		if !reflect.DeepEqual(members, pass.members) || !reflect.DeepEqual(routes, pass.routes) {
+			t.Errorf("pass %d: expected the ipset members %v and routes %v, got %v and %v", i, pass.members, pass.routes, members, routes)
+		}
+	}
+}
+
+// newOrphanGrace returns an orphanGrace of a first pass, with the pods known to the pod lister.
+func newOrphanGrace(pods ...*corev1.Pod) *orphanGrace {
+	g := &orphanGrace{liveUIDs: sets.New(), seen: sets.New()}
+	for _, pod := range pods {
+		g.liveUIDs.Insert(string(pod.UID))
+	}
+	return g
+}
+
+// replaceIpset is a fakeIpset which can replace its members at once, counting the replacements.
+type replaceIpset struct {
+	*fakeIpset
+	replaces int
+}
+
+func (f *replaceIpset) Replace(entries []netlink.IPSetEntry) error {
+	f.replaces++
+	f.entries = append([]netlink.IPSetEntry(nil), entries...)
+	return nil
+}
+
+func TestReconcileIpset(t *testing.T) {
+	entries := []netlink.IPSetEntry{
+		{IP: net.ParseIP("10.244.0.5").To4(), Comment: "default/a/uid-a"},
+		// Pod c was added by the CNI plugin, and has no IP in its status yet.
+		{IP: net.ParseIP("10.244.0.7").To4(), Comment: "default/c/uid-c"},
+		{IP: net.ParseIP("10.244.0.9").To4(), Comment: "default/gone/uid-gone"},
+	}
+	pods := []*corev1.Pod{newTestPod("a", "a", "10.244.0.5"), newTestPod("b", "b", "10.244.0.6")}
+	grace := func() *orphanGrace {
+		return newOrphanGrace(append(pods, newTestPod("c", "c", ""))...)
+	}
+	wantIPs := sets.New("10.244.0.5", "10.244.0.6")
+	expected := DataplaneReconcileResult{Added: 1, Removed: 1, Orphans: 2}
+
+	t.Run("replace", func(t *testing.T) {
+		orig := ipsetReplaceThreshold
+		ipsetReplaceThreshold = 1
+		t.Cleanup(func() {
+			ipsetReplaceThreshold = orig
+		})
+		f := &replaceIpset{fakeIpset: &fakeIpset{entries: append([]netlink.IPSetEntry(nil), entries...)}}
+
+		res, err := reconcileIpset(f, f.entries, wantIPs, pods, grace())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Errorf("expected %+v, got %+v", expected, res)
+		}
+		if f.replaces != 1 || len(f.added) != 0 || len(f.deleted) != 0 {
+			t.Errorf("expected a single replacement, got %d replacements, adds %v and deletes %v", f.replaces, f.added, f.deleted)
+		}
+		var got []string
+		for _, entry := range f.entries {
+			got = append(got, entry.IP.String()+" "+entry.Comment)
+		}
+		// The entry of the live pod is kept.
+		want := []string{"10.244.0.5 default/a/uid-a", "10.244.0.6 default/b/uid-b", "10.244.0.7 default/c/uid-c"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("expected members %v, got %v", want, got)
+		}
+
+		// The members are now the pods, so nothing is replaced again.
+		if _, err := reconcileIpset(f, f.entries, wantIPs, pods, grace()); err != nil {
+			t.Fatal(err)
+		}
+		if f.replaces != 1 {
+			t.Errorf("expected no replacement of an ipset in sync, got %d", f.replaces)
+		}
+	})
+
+	for _, tc := range []struct {
+		name     string
+		replacer bool
+	}{
+		{name: "delete"},
+		// Too few orphans to be worth a swap.
+		{name: "delete below replace threshold", replacer: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &replaceIpset{fakeIpset: &fakeIpset{entries: append([]netlink.IPSetEntry(nil), entries...)}}
+			var set IpsetHandle = f.fakeIpset
+			if tc.replacer {
+				set = f
+			}
+
+			res, err := reconcileIpset(set, f.entries, wantIPs, pods, grace())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res != expected {
+				t.Errorf("expected %+v, got %+v", expected, res)
+			}
+			// The missing pod is left to addPodsToMeshInTable.
+			if f.replaces != 0 || len(f.deleted) != 1 || !f.deleted[0].Equal(net.ParseIP("10.244.0.9")) || len(f.added) != 0 {
+				t.Errorf("expected the orphan to be deleted, got %d replacements, adds %v and deletes %v", f.replaces, f.added, f.deleted)
+			}
+		})
+	}
+}
+
+func TestIpsetEntries(t *testing.T) {
+	pods := []*corev1.Pod{
+		newTestPod("a", "a", "10.244.0.5"),
+		newTestPod("b", "b", "::ffff:10.244.0.6"),
+		newTestPod("c", "c", "10.244.0"),
+		newTestPod("d", "d", "fd00::7"),
+	}
+	// The IPv4-mapped IP is unmapped, and the malformed and IPv6 IPs have no entry.
+	var got []string
+	for _, entry := range ipsetEntries(pods) {
+		got = append(got, entry.IP.String()+" "+entry.Comment)
+	}
+	want := []string{"10.244.0.5 default/a/uid-a", "10.244.0.6 default/b/uid-b"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected entries %v, got %v", want, got)
+	}
+}
+
+func TestDedupeIpset(t *testing.T) {
+	entry := func(ip, comment string) netlink.IPSetEntry {
+		return netlink.IPSetEntry{IP: net.ParseIP(ip).To4(), Comment: comment}
+	}
+	cases := []struct {
+		name            string
+		entries         []netlink.IPSetEntry
+		expectedRemoved int
+		expected        []string
+	}{
+		{
+			name: "duplicate uid",
+			entries: []netlink.IPSetEntry{
+				entry("10.0.0.9", "default/a/uid-a"),
+				entry("10.0.0.1", "default/a/uid-a"),
+				entry("10.0.0.2", "default/b/uid-b"),
+			},
+			expectedRemoved: 1,
+			expected:        []string{"10.0.0.1", "10.0.0.2"},
+		},
+		{
+			name: "no entry with the pod ip",
+			entries: []netlink.IPSetEntry{
+				entry("10.0.0.8", "default/a/uid-a"),
+				entry("10.0.0.9", "default/a/uid-a"),
+			},
+			expectedRemoved: 2,
+		},
+		{
+			name: "unknown uid",
+			entries: []netlink.IPSetEntry{
+				entry("10.0.0.8", "default/c/uid-c"),
+				entry("10.0.0.9", "default/c/uid-c"),
+			},
+			expected: []string{"10.0.0.8", "10.0.0.9"},
+		},
+		{
+			// A single entry with another IP is left to reconcileIpset.
+			name:     "single entry",
+			entries:  []netlink.IPSetEntry{entry("10.0.0.9", "default/a/uid-a")},
+			expected: []string{"10.0.0.9"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := &fakeIpset{entries: tc.entries}
+			setFakeIpset(t, f)
+			s := &Server{}
+
+			removed, err := s.DedupeIpset([]*corev1.Pod{newTestPod("a", "a", "10.0.0.1"), newTestPod("b", "b", "10.0.0.2")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if removed != tc.expectedRemoved {
+				t.Errorf("expected %d removed, got %d", tc.expectedRemoved, removed)
+			}
+			var got []string
+			for _, e := range f.entries {
+				got = append(got, e.IP.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected entries %v, got %v", tc.expected, got)
+			}
+		})
+	}
+}
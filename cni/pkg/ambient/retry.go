@@ -0,0 +1,71 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// backoff retries operations failing with transient errors, which are common during node boot
+// while other components are setting up links and rules too.
+type backoff struct {
+	// attempts is the maximum number of attempts. Values below 1 mean a single attempt.
+	attempts int
+	// initial is the delay before the first retry. It is doubled after each retry, up to max.
+	initial time.Duration
+	max     time.Duration
+}
+
+func newBackoff(attempts int) backoff {
+	return backoff{attempts: attempts, initial: 100 * time.Millisecond, max: 2 * time.Second}
+}
+
+// retry calls op until it succeeds, fails with an error that isn't retryable, or the attempts
+// are used up, and returns the last error. If ctx is done while waiting, its error is returned.
+func (b backoff) retry(ctx context.Context, op func() error) error {
+	delay := b.initial
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt >= b.attempts || !isRetryable(err) {
+			return err
+		}
+		log.Debugf("Attempt %d/%d failed, retrying in %v: %v", attempt, b.attempts, delay, err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		delay *= 2
+		if delay > b.max {
+			delay = b.max
+		}
+	}
+}
+
+// isRetryable reports whether err is transient: the resource is busy, or another process holds
+// the xtables lock.
+func isRetryable(err error) bool {
+	if errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.EAGAIN) {
+		return true
+	}
+	return strings.Contains(err.Error(), "xtables lock")
+}
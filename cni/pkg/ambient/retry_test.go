@@ -0,0 +1,89 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBackoffRetry(t *testing.T) {
+	b := backoff{attempts: 3, initial: time.Millisecond, max: time.Millisecond}
+	cases := []struct {
+		name     string
+		errs     []error
+		expected error
+		calls    int
+	}{
+		{
+			name:  "success",
+			errs:  []error{nil},
+			calls: 1,
+		},
+		{
+			name:  "transient failure",
+			errs:  []error{syscall.EBUSY, errors.New("Another app is currently holding the xtables lock"), nil},
+			calls: 3,
+		},
+		{
+			name:     "attempts used up",
+			errs:     []error{syscall.EBUSY, syscall.EBUSY, syscall.EBUSY, nil},
+			expected: syscall.EBUSY,
+			calls:    3,
+		},
+		{
+			name:     "not retryable",
+			errs:     []error{fmt.Errorf("link add: %w", syscall.EEXIST), nil},
+			expected: syscall.EEXIST,
+			calls:    1,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			calls := 0
+			err := b.retry(context.Background(), func() error {
+				calls++
+				return tc.errs[calls-1]
+			})
+			if !errors.Is(err, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, err)
+			}
+			if calls != tc.calls {
+				t.Errorf("expected %d calls, got %d", tc.calls, calls)
+			}
+		})
+	}
+}
+
+func TestBackoffRetryCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := backoff{attempts: 5, initial: time.Hour, max: time.Hour}.retry(ctx, func() error {
+		calls++
+		cancel()
+		return syscall.EBUSY
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected %v, got %v", context.Canceled, err)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 call, got %d", calls)
+	}
+}
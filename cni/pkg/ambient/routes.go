@@ -0,0 +1,76 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// RouteTables are the policy routing tables used to steer traffic to and from ztunnel.
+type RouteTables struct {
+	// Inbound has a route for each mesh pod, via the inbound tunnel.
+	Inbound int `json:"inbound"`
+	// Outbound routes marked outbound traffic to ztunnel.
+	Outbound int `json:"outbound"`
+	// Proxy routes traffic returning to ztunnel, for original src.
+	Proxy int `json:"proxy"`
+}
+
+// DefaultRouteTables returns the route tables used when none are configured.
+func DefaultRouteTables() RouteTables {
+	return RouteTables{
+		Inbound:  constants.RouteTableInbound,
+		Outbound: constants.RouteTableOutbound,
+		Proxy:    constants.RouteTableProxy,
+	}
+}
+
+// Validate checks that the tables are distinct, and not reserved by the kernel.
+func (t RouteTables) Validate() error {
+	tables := map[string]int{"inbound": t.Inbound, "outbound": t.Outbound, "proxy": t.Proxy}
+	seen := map[int]string{}
+	for name, table := range tables {
+		// 0 is unspecified, and 253-255 are the default, main and local tables.
+		if table <= 0 || (table >= 253 && table <= 255) {
+			return fmt.Errorf("%s route table %d is reserved", name, table)
+		}
+		if other, ok := seen[table]; ok {
+			return fmt.Errorf("%s and %s route tables must be distinct, both are %d", name, other, table)
+		}
+		seen[table] = name
+	}
+	return nil
+}
+
+// logPopulatedTables warns about routes already present in the tables, which may have been added by
+// another component. Routes left behind by a previous run of ambient are reported too, as they
+// can't be told apart.
+func (t RouteTables) logPopulatedTables() {
+	for _, table := range []int{t.Inbound, t.Outbound, t.Proxy} {
+		routes, err := netlink.RouteListFiltered(netlink.FAMILY_ALL, &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			log.Warnf("Failed to list routes in table %d: %v", table, err)
+			continue
+		}
+		if len(routes) > 0 {
+			log.Warnf("Route table %d already has %d routes, which may conflict with another component: %v",
+				table, len(routes), routes)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"testing"
+)
+
+func TestRouteTablesValidate(t *testing.T) {
+	cases := []struct {
+		name      string
+		tables    RouteTables
+		expectErr bool
+	}{
+		{
+			name:   "defaults",
+			tables: DefaultRouteTables(),
+		},
+		{
+			name:   "custom",
+			tables: RouteTables{Inbound: 200, Outbound: 201, Proxy: 202},
+		},
+		{
+			name:      "duplicate",
+			tables:    RouteTables{Inbound: 200, Outbound: 200, Proxy: 202},
+			expectErr: true,
+		},
+		{
+			name:      "main table",
+			tables:    RouteTables{Inbound: 254, Outbound: 201, Proxy: 202},
+			expectErr: true,
+		},
+		{
+			name:      "unset",
+			tables:    RouteTables{Inbound: 200, Outbound: 201},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.tables.Validate()
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
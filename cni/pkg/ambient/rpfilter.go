@@ -0,0 +1,236 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"go.uber.org/multierr"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+
+	"istio.io/istio/pkg/util/sets"
+)
+
+// rpFilterReconcilePeriod is how often interfaces that appeared since node setup get rp_filter
+// disabled.
+const rpFilterReconcilePeriod = 10 * time.Second
+
+// procConfDir is the directory of the per-interface IPv4 settings. It is a variable for tests.
+var procConfDir = "/proc/sys/net/ipv4/conf"
+
+// RPFilterScope selects the interfaces rp_filter is disabled on in bulk, besides the ztunnel
+// interfaces node setup always disables it on: the tunnels, and the uplink or ztunnel veth. Scopes
+// other than RPFilterScopeAll and RPFilterScopeMeshOnly are regexps of interface names.
+type RPFilterScope string
+
+const (
+	// RPFilterScopeAll disables rp_filter on every interface, including the pod veths created after
+	// node setup. This is the default.
+	RPFilterScopeAll RPFilterScope = "all"
+	// RPFilterScopeMeshOnly only disables rp_filter on the ztunnel interfaces, skipping the walk of
+	// procConfDir. The pod veths get it disabled when their pod is added to the mesh.
+	RPFilterScopeMeshOnly RPFilterScope = "mesh-only"
+)
+
+// matcher returns whether an interface is in the scope, or nil for RPFilterScopeMeshOnly, in which
+// no interface is disabled in bulk.
+func (r RPFilterScope) matcher() (func(name string) bool, error) {
+	switch r {
+	case "", RPFilterScopeAll:
+		return func(string) bool { return true }, nil
+	case RPFilterScopeMeshOnly:
+		return nil, nil
+	}
+	re, err := regexp.Compile(string(r))
+	if err != nil {
+		return nil, fmt.Errorf("invalid rp_filter scope %q: %v", r, err)
+	}
+	return re.MatchString, nil
+}
+
+// rpFilterInterfaces returns the interfaces node setup disables rp_filter on: the mesh interfaces,
+// followed by the other interfaces in procConfDir within s.rpFilterScope.
+func (s *Server) rpFilterInterfaces(mesh ...string) []string {
+	res := append([]string(nil), mesh...)
+	match, _ := s.rpFilterScope.matcher()
+	if match == nil {
+		return res
+	}
+	entries, err := os.ReadDir(procConfDir)
+	if err != nil {
+		log.Warnf("failed to read %s: %v", procConfDir, err)
+		return res
+	}
+	for _, entry := range entries {
+		if entry.IsDir() && match(entry.Name()) && indexOf(mesh, entry.Name()) == -1 {
+			res = append(res, entry.Name())
+		}
+	}
+	return res
+}
+
+// disableRPFilterInterfaces sets rp_filter to 0 on the interfaces concurrently, saving the original
+// values for cleanup. Failures are only logged.
+func (s *Server) disableRPFilterInterfaces(ifaces []string) {
+	procs := make(map[string]string, len(ifaces))
+	for _, iface := range ifaces {
+		procs[filepath.Join(procConfDir, iface, "rp_filter")] = "0"
+	}
+	s.setProcs(procs)
+}
+
+// disableRPFilters sets rp_filter to 0 for every interface in procConfDir matching match on which it
+// is enabled.
+// Node setup disables it on the interfaces present at the time, but the pod veths created later
+// default to rp_filter=1 and drop the asymmetrically routed mesh traffic. Interfaces already at 0
+// are left alone, so it is safe to call repeatedly. It returns the interfaces that were changed.
+//
+// The original values are not saved for cleanup: the interfaces appearing after setup are pod
+// veths, which go away with their pods.
+func disableRPFilters(match func(name string) bool) ([]string, error) {
+	entries, err := os.ReadDir(procConfDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", procConfDir, err)
+	}
+	var changed []string
+	var errs error
+	for _, entry := range entries {
+		if !entry.IsDir() || !match(entry.Name()) {
+			continue
+		}
+		path := filepath.Join(procConfDir, entry.Name(), "rp_filter")
+		cur, err := GetProc(path)
+		if err != nil {
+			// The interface was removed since the directory was read.
+			if os.IsNotExist(err) {
+				continue
+			}
+			errs = multierr.Append(errs, fmt.Errorf("failed to read %s: %v", path, err))
+			continue
+		}
+		if cur == "0" {
+			continue
+		}
+		if err := SetProc(path, "0"); err != nil {
+			recordDataplaneError(procOperation)
+			errs = multierr.Append(errs, fmt.Errorf("failed to disable rp_filter for %s: %v", entry.Name(), err))
+			continue
+		}
+		changed = append(changed, entry.Name())
+	}
+	return changed, errs
+}
+
+// reconcileRPFilterLoop runs disableRPFilters immediately and then periodically, until stop is
+// closed. Like the node setup it follows up on, it only runs while ztunnel is running, and only on
+// the interfaces of s.rpFilterScope. It is the fallback of ReapplyOnLinkEvent.
+func (s *Server) reconcileRPFilterLoop(stop <-chan struct{}) {
+	match, _ := s.rpFilterScope.matcher()
+	if match == nil {
+		return
+	}
+	wait.Until(func() {
+		if !s.isZTunnelRunning() {
+			return
+		}
+		s.resetRPFilters(match)
+	}, rpFilterReconcilePeriod, stop)
+}
+
+// podRPFilters tracks the host devices rp_filter was disabled on for mesh pods, so that the original
+// value of a device is restored once the last of its pods leaves the mesh.
+var podRPFilters = &rpFilterTracker{}
+
+// rpFilterTracker maps host devices to the pods rp_filter was disabled for on them.
+type rpFilterTracker struct {
+	mu sync.Mutex
+	// pods are the UIDs of the pods of each device, and devices the device of each pod.
+	pods    map[string]sets.Set
+	devices map[types.UID]string
+	// orig holds the rp_filter of each device from before it was disabled for its first pod.
+	orig map[string]string
+}
+
+// disable sets rp_filter to 0 on dev for the pod with uid, first saving its value if no other pod
+// is tracked on dev. A pod moving to another device releases the previous one.
+func (t *rpFilterTracker) disable(uid types.UID, dev string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pods == nil {
+		t.pods = map[string]sets.Set{}
+		t.devices = map[types.UID]string{}
+		t.orig = map[string]string{}
+	}
+	if prev, ok := t.devices[uid]; ok && prev != dev {
+		t.releaseLocked(uid)
+	}
+
+	path := filepath.Join(procConfDir, dev, "rp_filter")
+	if len(t.pods[dev]) == 0 {
+		if orig, err := GetProc(path); err == nil {
+			t.orig[dev] = orig
+		} else {
+			log.Debugf("Unable to read original value of %s, it will not be restored: %v", path, err)
+		}
+	}
+	if t.pods[dev] == nil {
+		t.pods[dev] = sets.New()
+	}
+	t.pods[dev].Insert(string(uid))
+	t.devices[uid] = dev
+	return SetProc(path, "0")
+}
+
+// release stops tracking the pod with uid, restoring the rp_filter of its device if it was the last
+// pod there. An untracked pod is ignored.
+func (t *rpFilterTracker) release(uid types.UID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.releaseLocked(uid)
+}
+
+func (t *rpFilterTracker) releaseLocked(uid types.UID) {
+	dev, ok := t.devices[uid]
+	if !ok {
+		return
+	}
+	delete(t.devices, uid)
+	t.pods[dev].Delete(string(uid))
+	if len(t.pods[dev]) > 0 {
+		return
+	}
+	delete(t.pods, dev)
+	orig, ok := t.orig[dev]
+	delete(t.orig, dev)
+	if !ok || orig == "0" {
+		return
+	}
+	path := filepath.Join(procConfDir, dev, "rp_filter")
+	if _, err := os.Stat(path); err != nil {
+		log.Debugf("Not restoring %s, the interface is gone: %v", path, err)
+		return
+	}
+	log.Infof("Restoring rp_filter of %s to %s, its last mesh pod is gone", dev, orig)
+	if err := SetProc(path, orig); err != nil {
+		recordDataplaneError(procOperation)
+		log.Warnf("Failed to restore %s to %s: %v", path, orig, err)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+	corev1 "k8s.io/api/core/v1"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// setFakeRPFilters replaces podRPFilters with an empty tracker for the test.
+func setFakeRPFilters(t *testing.T) {
+	orig := podRPFilters
+	podRPFilters = &rpFilterTracker{}
+	t.Cleanup(func() {
+		podRPFilters = orig
+	})
+}
+
+func TestDisableRPFilters(t *testing.T) {
+	dir := t.TempDir()
+	orig := procConfDir
+	procConfDir = dir
+	t.Cleanup(func() {
+		procConfDir = orig
+	})
+
+	addInterface := func(name, rpFilter string) {
+		t.Helper()
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "rp_filter"), []byte(rpFilter+"\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	all, _ := RPFilterScopeAll.matcher()
+
+	// The state after node setup.
+	addInterface("all", "0")
+	addInterface("eth0", "0")
+	changed, err := disableRPFilters(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("expected no interfaces to be changed, got %v", changed)
+	}
+
+	// A pod veth is created afterwards.
+	addInterface("veth1234", "1")
+	changed, err = disableRPFilters(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(changed, []string{"veth1234"}) {
+		t.Errorf("expected veth1234 to be changed, got %v", changed)
+	}
+	if got, _ := GetProc(filepath.Join(dir, "veth1234", "rp_filter")); got != "0" {
+		t.Errorf("expected rp_filter of veth1234 to be 0, got %q", got)
+	}
+
+	// Nothing is left to change.
+	changed, err = disableRPFilters(all)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changed) != 0 {
+		t.Errorf("expected no interfaces to be changed, got %v", changed)
+	}
+}
+
+func TestRPFilterInterfaces(t *testing.T) {
+	dir := t.TempDir()
+	orig := procConfDir
+	procConfDir = dir
+	t.Cleanup(func() {
+		procConfDir = orig
+	})
+	for _, name := range []string{"all", "default", "eth0", "istioin", "istioout", "veth0", "veth1234", "docker0"} {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "rp_filter"), []byte("1\n"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cases := []struct {
+		name     string
+		scope    RPFilterScope
+		mesh     []string
+		expected []string
+	}{
+		{
+			name:     "default",
+			mesh:     []string{"eth0"},
+			expected: []string{"eth0", "all", "default", "docker0", "istioin", "istioout", "veth0", "veth1234"},
+		},
+		{
+			name:     "cpu mesh-only",
+			scope:    RPFilterScopeMeshOnly,
+			mesh:     []string{"eth0"},
+			expected: []string{"eth0"},
+		},
+		{
+			name:     "dpu mesh-only",
+			scope:    RPFilterScopeMeshOnly,
+			mesh:     []string{"veth0", "istioin", "istioout"},
+			expected: []string{"veth0", "istioin", "istioout"},
+		},
+		{
+			name:     "regexp",
+			scope:    "^veth",
+			mesh:     []string{"eth0"},
+			expected: []string{"eth0", "veth0", "veth1234"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{rpFilterScope: tc.scope}
+			got := s.rpFilterInterfaces(tc.mesh...)
+			if !reflect.DeepEqual(got, tc.expected) {
+				t.Errorf("expected %v, got %v", tc.expected, got)
+			}
+		})
+	}
+
+	// Only the interfaces of the mesh-only scope are written.
+	s := &Server{rpFilterScope: RPFilterScopeMeshOnly}
+	s.disableRPFilterInterfaces(s.rpFilterInterfaces("eth0"))
+	for _, name := range []string{"eth0", "veth1234", "docker0"} {
+		expected := "1"
+		if name == "eth0" {
+			expected = "0"
+		}
+		if got, _ := GetProc(filepath.Join(dir, name, "rp_filter")); got != expected {
+			t.Errorf("expected rp_filter of %s to be %s, got %q", name, expected, got)
+		}
+	}
+
+	if _, err := RPFilterScope("veth[").matcher(); err == nil {
+		t.Errorf("expected an invalid regexp scope to fail")
+	}
+}
+
+func TestDelPodFromMeshRestoresRPFilter(t *testing.T) {
+	dir := t.TempDir()
+	orig := procConfDir
+	procConfDir = dir
+	t.Cleanup(func() {
+		procConfDir = orig
+	})
+	path := filepath.Join(dir, "veth1", "rp_filter")
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte("1\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	rpFilter := func() string {
+		t.Helper()
+		v, err := GetProc(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return v
+	}
+
+	setFakeRPFilters(t)
+	setFakeIpset(t, &fakeIpset{})
+	nl := setFakeNetlink(t)
+	nl.links[constants.InboundTun] = &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Index: 9}}
+	// Both pods are routed through veth1.
+	nl.links["veth1"] = &netlink.Veth{LinkAttrs: netlink.LinkAttrs{Name: "veth1", Index: 7}}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		nl.routes = append(nl.routes, netlink.Route{Dst: &net.IPNet{IP: net.ParseIP(ip), Mask: net.CIDRMask(32, 32)}, LinkIndex: 7})
+	}
+
+	a, b := newTestPod("a", "a", "10.0.0.1"), newTestPod("b", "b", "10.0.0.2")
+	for _, pod := range []*corev1.Pod{a, b} {
+		if err := AddPodToMesh(pod, "", testHostIP, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := rpFilter(); got != "0" {
+		t.Fatalf("expected rp_filter to be disabled, got %s", got)
+	}
+
+	DelPodFromMesh(a, testHostIP)
+	if got := rpFilter(); got != "0" {
+		t.Errorf("expected rp_filter to stay disabled for pod b, got %s", got)
+	}
+	DelPodFromMesh(b, testHostIP)
+	if got := rpFilter(); got != "1" {
+		t.Errorf("expected rp_filter to be restored once the last pod is gone, got %s", got)
+	}
+}
@@ -19,10 +19,15 @@ import (
 	"encoding/json"
 	"fmt"
 	"istio.io/istio/pkg/offmesh"
+	"net/netip"
 	"os"
 	"sync"
+	"time"
 
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
 	listerv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 
@@ -32,6 +37,7 @@ import (
 	"istio.io/istio/pilot/pkg/model"
 	"istio.io/istio/pkg/kube"
 	"istio.io/istio/pkg/kube/controllers"
+	"istio.io/istio/pkg/util/sets"
 )
 
 type Server struct {
@@ -39,6 +45,10 @@ type Server struct {
 	environment *model.Environment
 	ctx         context.Context
 	queue       controllers.Queue
+	// nodeName is the name of this node, and hostIP the address pods are routed from. They are set
+	// by NewServer and not changed afterwards.
+	nodeName string
+	hostIP   string
 
 	nsLister listerv1.NamespaceLister
 
@@ -47,12 +57,161 @@ type Server struct {
 	mu                sync.Mutex
 	ztunnelRunning    bool
 	offmeshCluster    offmesh.ClusterConfig
+	tunnelVNIs        TunnelVNIs
+	routeTables       RouteTables
+	firewallBackend   FirewallBackend
+	// nft applies the rules when firewallBackend is FirewallNftables.
+	nft *nftFirewall
+	// marks are the packet and conn marks of the rules. The zero value means DefaultMarks.
+	marks Marks
+	// excludeInboundPorts and excludeOutboundPorts are the ports of traffic to and from mesh pods
+	// which bypasses ztunnel.
+	excludeInboundPorts  []uint16
+	excludeOutboundPorts []uint16
+	// excludeOutboundCIDRs are the destinations of traffic which bypasses ztunnel.
+	excludeOutboundCIDRs []netip.Prefix
+	// excludeLinkLocalMulticast makes traffic to linkLocalMulticastCIDRs bypass ztunnel.
+	excludeLinkLocalMulticast bool
+	// excludeOwnerUIDs and excludeOwnerGIDs are the owners of host traffic which bypasses ztunnel.
+	excludeOwnerUIDs []uint32
+	excludeOwnerGIDs []uint32
+	// namespaceIpsets maps namespaces to the ipsets their mesh pods are added to. It is passed on
+	// to the CNI plugin through the config file.
+	namespaceIpsets map[string]string
+	// podCIDRs are the CIDRs the IPs of the pods added to the mesh must be in. They are passed on to
+	// the CNI plugin through the config file.
+	podCIDRs []string
+	// hostIPPreference chooses the host IP on nodes with several internal IPs. It is passed on to
+	// the CNI plugin through the config file.
+	hostIPPreference HostIPPreference
+	// inboundRouteSrc is the source of the inbound pod routes. Empty means hostIP.
+	inboundRouteSrc string
+	// enableIPv6 adds the IPv6 addresses of mesh pods to Ipset6, and mirrors the rules with ip6tables.
+	enableIPv6 bool
+	// enablePortIpset sets up IpsetPort, whose members are only captured to the ports of their entries.
+	enablePortIpset bool
+	// iptablesWait is how long iptables waits for the xtables lock, in seconds. 0 means
+	// defaultIptablesWait.
+	iptablesWait int
+	// backoff retries the tunnel and rule operations of node setup on transient errors.
+	backoff backoff
+	// dnsCapturePort is the port of ztunnel which captured DNS queries are redirected to. 0 means
+	// constants.DNSCapturePort.
+	dnsCapturePort uint16
+	// dnsCaptureUDPOnly only captures DNS queries over UDP.
+	dnsCaptureUDPOnly bool
+	// dnsCaptureAddr is the address which captured DNS queries are redirected to. Empty means the
+	// ztunnel IP.
+	dnsCaptureAddr string
+	// tunnelMTU is the MTU of the tunnels. 0 means it is derived from the underlay.
+	tunnelMTU int
+	// tunnelOptions are the UDP port, checksum and underlay options of the tunnels.
+	tunnelOptions TunnelOptions
+	// tunnelEncryption protects the traffic to the offmesh pair, with the wireGuard options if it
+	// is TunnelEncryptionWireGuard.
+	tunnelEncryption TunnelEncryption
+	wireGuard        WireGuardOptions
+	// ztunnelIPs are the addresses of the ztunnel pod paired with this node, of either family. The
+	// tunnels go to the one in the underlay family.
+	ztunnelIPs []string
+	// ztunnelHealthPort is the TCP port of ztunnel which node setup waits for before capturing
+	// traffic, for up to ztunnelHealthTimeout. 0 means it doesn't wait.
+	ztunnelHealthPort    uint16
+	ztunnelHealthTimeout time.Duration
+	// rpFilterScope selects the interfaces rp_filter is disabled on in bulk. The zero value means
+	// RPFilterScopeAll.
+	rpFilterScope RPFilterScope
+	// exec runs the external commands of node setup and cleanup. If nil, they are run for real.
+	exec Executor
+	// nl makes the netlink changes of node setup and cleanup. If nil, defaultNetlink is used.
+	nl NetlinkHandle
+	// dataplaneOrphans is the number of orphans found by the last ReconcileDataplane.
+	dataplaneOrphans int
+	// lastOrphans are the ipset entries and routes found orphaned by the last ReconcileDataplane,
+	// by orphanKey. Guarded by meshMu.
+	lastOrphans sets.Set
+	// origProcs holds the values of the proc files changed during node setup from before they were
+	// changed, keyed by path, so they can be restored on cleanup.
+	origProcs map[string]string
+	// appliedRules are the rules applied by the last node setup, for HealthCheck.
+	appliedRules []*iptablesRule
+	// completeChains are the rules of the chains of appliedRules as iptables lists them, keyed by
+	// chain and family, recorded by EnsureRules once the chain was seen complete. Reset along with
+	// appliedRules.
+	completeChains map[string][]string
+	// inboundTunIndex is the link index of the inbound tunnel, which the inbound pod routes go
+	// through. It is resolved during node setup, and reset when the tunnel is recreated or deleted.
+	// 0 if unknown.
+	inboundTunIndex int
+	// ipsetComments is whether the ipsets store the comments of their entries, as detected by
+	// EnsureIpset. Pods are then matched by UID only in isPodInIpset.
+	ipsetComments bool
+	// draining is set by Drain, after which no pods are added to the mesh.
+	draining bool
+
+	// setupMu serializes the node setup, its cleanup and the repairs of ReapplyOnLinkEvent, so that a
+	// repair neither races a setup nor reinstalls what a cleanup is removing.
+	setupMu sync.Mutex
+
+	// meshMu serializes changes to mesh membership: ipset entries, inbound routes and the rp_filter
+	// settings for pod devices. These are global kernel state which the informer handlers and the
+	// dataplane reconciler would otherwise race on. Membership changes made by the server must go
+	// through the locked wrappers (addPodToMesh, delPodFromMesh, addPodsToMesh). meshMu may be held
+	// while acquiring mu, but never the other way around.
+	meshMu sync.Mutex
+	// podIPs are the IPs of the pods added to the mesh, keyed by UID, as the IP may be gone from the
+	// status by the time the pod is deleted. Guarded by meshMu.
+	podIPs map[types.UID]string
+	// addedPods are the IPs the pods were successfully added to the mesh with by addPodToMesh, keyed
+	// by UID, so that adding them again is a no-op. Guarded by meshMu.
+	addedPods map[types.UID]string
+	// bypassedPods are the UIDs of the pods taken out of traffic capture by SetPodBypass. Guarded by
+	// meshMu.
+	bypassedPods sets.Set
+	// captureSelector selects the pods added to the mesh, by their labels. If nil, every pod is.
+	captureSelector labels.Selector
 }
 
 type AmbientConfigFile struct {
 	Mode              string                  `json:"mode"`
 	DisabledSelectors []*metav1.LabelSelector `json:"disabledSelectors"`
 	ZTunnelReady      bool                    `json:"ztunnelReady"`
+	FirewallBackend   string                  `json:"firewallBackend,omitempty"`
+	HostIPPreference  HostIPPreference        `json:"hostIPPreference"`
+	EnableIPv6        bool                    `json:"enableIPv6,omitempty"`
+	NamespaceIpsets   map[string]string       `json:"namespaceIpsets,omitempty"`
+	PodCIDRs          []string                `json:"podCIDRs,omitempty"`
+	// RouteTables are the route tables of the controller, for the CNI plugin to add the pod routes
+	// to the same inbound table.
+	RouteTables RouteTables `json:"routeTables"`
+	// InboundRouteSrc is the source of the inbound pod routes, if not the host IP.
+	InboundRouteSrc string `json:"inboundRouteSrc,omitempty"`
+	// CaptureSelector selects the pods added to the mesh, by their labels. If empty, every pod is.
+	CaptureSelector string `json:"captureSelector,omitempty"`
+	// Draining is set once the controller is draining, so that the CNI plugin adds no pods either.
+	Draining bool `json:"draining,omitempty"`
+}
+
+// CapturesPod reports whether the pod matches the capture selector, as the controller checks
+// before adding a pod to the mesh.
+func (c *AmbientConfigFile) CapturesPod(pod *corev1.Pod) (bool, error) {
+	if c.CaptureSelector == "" {
+		return true, nil
+	}
+	selector, err := labels.Parse(c.CaptureSelector)
+	if err != nil {
+		return false, fmt.Errorf("invalid capture selector %q: %v", c.CaptureSelector, err)
+	}
+	return selector.Matches(labels.Set(pod.Labels)), nil
+}
+
+// InboundRouteTable returns the inbound route table the pods are routed through, the default if
+// the config was written by a controller which didn't record it.
+func (c *AmbientConfigFile) InboundRouteTable() int {
+	if c.RouteTables.Inbound == 0 {
+		return constants.RouteTableInbound
+	}
+	return c.RouteTables.Inbound
 }
 
 func NewServer(ctx context.Context, args AmbientArgs) (*Server, error) {
@@ -67,20 +226,162 @@ func NewServer(ctx context.Context, args AmbientArgs) (*Server, error) {
 	s := &Server{
 		environment:       e,
 		ctx:               ctx,
+		nodeName:          args.NodeName,
 		meshMode:          v1alpha1.MeshConfig_AmbientMeshConfig_DEFAULT,
 		disabledSelectors: ambientpod.LegacySelectors,
 		ztunnelRunning:    false,
 		kubeClient:        client,
 		offmeshCluster:    offmesh.ReadClusterConfigYaml(offmesh.ClusterConfigYamlPath),
+		tunnelVNIs:        DefaultTunnelVNIs(),
+		routeTables:       DefaultRouteTables(),
+		firewallBackend:   FirewallIptables,
+	}
+	if s.nodeName == "" {
+		s.nodeName = NodeName
+	}
+	if args.TunnelVNIs.Inbound != 0 {
+		s.tunnelVNIs.Inbound = args.TunnelVNIs.Inbound
+	}
+	if args.TunnelVNIs.Outbound != 0 {
+		s.tunnelVNIs.Outbound = args.TunnelVNIs.Outbound
+	}
+	if err := s.tunnelVNIs.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid tunnel VNIs: %v", err)
+	}
+	if err := validateTunnelMTU(args.TunnelMTU); err != nil {
+		return nil, err
+	}
+	s.tunnelMTU = args.TunnelMTU
+	if err := args.TunnelOptions.Underlay.Validate(); err != nil {
+		return nil, err
+	}
+	s.tunnelOptions = args.TunnelOptions
+	if err := args.TunnelEncryption.Validate(); err != nil {
+		return nil, err
+	}
+	if args.TunnelEncryption == TunnelEncryptionWireGuard {
+		if err := args.WireGuard.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	s.tunnelEncryption = args.TunnelEncryption
+	s.wireGuard = args.WireGuard
+	if args.RouteTables != (RouteTables{}) {
+		s.routeTables = args.RouteTables
+	}
+	if err := s.routeTables.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid route tables: %v", err)
+	}
+	s.routeTables.logPopulatedTables()
+	s.marks = DefaultMarks()
+	if args.MarkBase != 0 {
+		if s.marks, err = MarksFromBase(args.MarkBase); err != nil {
+			return nil, fmt.Errorf("invalid mark base: %v", err)
+		}
+	}
+	if err := s.validateMarks(); err != nil {
+		return nil, fmt.Errorf("invalid marks: %v", err)
+	}
+	if args.FirewallBackend != "" {
+		s.firewallBackend = args.FirewallBackend
+	}
+	if args.IpsetSize != (IpsetSize{}) {
+		if err := UseIpsetSize(args.IpsetSize); err != nil {
+			return nil, err
+		}
+	}
+	if err := UseFirewallBackend(s.firewallBackend); err != nil {
+		return nil, err
+	}
+	if s.firewallBackend == FirewallNftables {
+		s.nft = newNftFirewall(s.executor())
+	}
+	if args.EnableIPv6 && s.firewallBackend == FirewallNftables {
+		return nil, fmt.Errorf("IPv6 is not supported with the %s firewall backend", FirewallNftables)
+	}
+	s.enableIPv6 = args.EnableIPv6
+	if args.EnablePortIpset && s.firewallBackend == FirewallNftables {
+		return nil, fmt.Errorf("the port ipset is not supported with the %s firewall backend", FirewallNftables)
 	}
+	s.enablePortIpset = args.EnablePortIpset
+	s.backoff = newBackoff(args.DataplaneRetries)
+	s.iptablesWait = args.IptablesWait
+	s.dnsCapturePort = args.DNSCapturePort
+	s.dnsCaptureUDPOnly = args.DNSCaptureUDPOnly
+	if args.DNSCaptureAddr != "" {
+		if addr, err := netip.ParseAddr(args.DNSCaptureAddr); err != nil || !addr.Is4() {
+			return nil, fmt.Errorf("invalid DNS capture address %q", args.DNSCaptureAddr)
+		}
+	}
+	s.dnsCaptureAddr = args.DNSCaptureAddr
+	if _, err := args.RPFilterScope.matcher(); err != nil {
+		return nil, err
+	}
+	s.rpFilterScope = args.RPFilterScope
+	s.ztunnelHealthPort = args.ZTunnelHealthPort
+	s.ztunnelHealthTimeout = args.ZTunnelHealthTimeout
+	s.excludeInboundPorts = args.ExcludeInboundPorts
+	s.excludeOutboundPorts = args.ExcludeOutboundPorts
+	s.excludeOwnerUIDs = args.ExcludeOwnerUIDs
+	s.excludeOwnerGIDs = args.ExcludeOwnerGIDs
+	if args.DryRun {
+		log.Warnf("Dry-run mode, the node setup will be printed but not applied")
+		dryRun = true
+		Ipset = dryRunIpset{IpsetHandle: Ipset, name: ipsetName}
+	}
+	if len(args.NamespaceIpsets) > 0 && s.enableIPv6 {
+		return nil, fmt.Errorf("namespace ipsets are not supported with IPv6")
+	}
+	if err := UseNamespaceIpsets(args.NamespaceIpsets); err != nil {
+		return nil, err
+	}
+	s.namespaceIpsets = args.NamespaceIpsets
+	if args.CaptureSelector != nil && !args.CaptureSelector.Empty() {
+		log.Infof("Only capturing the pods matching %s", args.CaptureSelector)
+		s.captureSelector = args.CaptureSelector
+	}
+	log.Infof("Using the %s firewall backend", s.firewallBackend)
 
 	// We need to find our Host IP -- is there a better way to do this?
-	h, err := GetHostIP(s.kubeClient.Kube())
-	if err != nil || h == "" {
+	s.hostIPPreference = args.HostIPPreference
+	s.hostIP, err = GetHostIP(ctx, s.kubeClient.Kube(), s.nodeName, s.hostIPPreference)
+	if err != nil || s.hostIP == "" {
 		return nil, fmt.Errorf("error getting host IP: %v", err)
 	}
-	HostIP = h
-	log.Infof("HostIP=%v", HostIP)
+	log.Infof("HostIP=%v", s.hostIP)
+	if args.InboundRouteSrc != "" {
+		if err := validateInboundRouteSrc(args.InboundRouteSrc); err != nil {
+			return nil, err
+		}
+		log.Infof("Routing inbound pod traffic from %v", args.InboundRouteSrc)
+	}
+	s.inboundRouteSrc = args.InboundRouteSrc
+
+	if len(args.ExcludeOutboundCIDRs) > 0 {
+		podCIDRs, err := s.nodePodCIDRs(ctx)
+		if err != nil {
+			return nil, err
+		}
+		s.excludeOutboundCIDRs, err = parseExcludedCIDRs(args.ExcludeOutboundCIDRs, podCIDRs)
+		if err != nil {
+			return nil, fmt.Errorf("invalid outbound CIDR exclusions: %v", err)
+		}
+	}
+
+	s.podCIDRs = args.PodCIDRs
+	if len(s.podCIDRs) == 1 && s.podCIDRs[0] == PodCIDRsNode {
+		if s.podCIDRs, err = s.nodePodCIDRs(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := UsePodCIDRs(s.podCIDRs); err != nil {
+		return nil, err
+	}
+	if len(s.podCIDRs) > 0 {
+		log.Infof("Only adding pods with IPs in %v to the mesh", s.podCIDRs)
+	}
+
+	s.excludeLinkLocalMulticast = args.ExcludeLinkLocalMulticast
 
 	s.initMeshConfiguration(args)
 	s.environment.AddMeshHandler(s.newConfigMapWatcher)
@@ -98,6 +399,30 @@ func NewServer(ctx context.Context, args AmbientArgs) (*Server, error) {
 	return s, nil
 }
 
+// setZTunnelIPs records the addresses of the ztunnel pod, for tunnelRemote.
+func (s *Server) setZTunnelIPs(pod *corev1.Pod) {
+	s.mu.Lock()
+	s.ztunnelIPs = podAddrs(pod)
+	s.mu.Unlock()
+}
+
+// PodCIDRsNode is the value of AmbientArgs.PodCIDRs checking the IPs of the pods against the pod
+// CIDRs of the node.
+const PodCIDRsNode = "node"
+
+// nodePodCIDRs returns the pod CIDRs of the node of s.
+func (s *Server) nodePodCIDRs(ctx context.Context) ([]string, error) {
+	node, err := s.kubeClient.Kube().CoreV1().Nodes().Get(ctx, s.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("error getting node: %v", err)
+	}
+	podCIDRs := node.Spec.PodCIDRs
+	if len(podCIDRs) == 0 && node.Spec.PodCIDR != "" {
+		podCIDRs = []string{node.Spec.PodCIDR}
+	}
+	return podCIDRs, nil
+}
+
 func (s *Server) setZTunnelRunning(running bool) {
 	s.mu.Lock()
 	s.ztunnelRunning = running
@@ -136,6 +461,13 @@ func (s *Server) Start() {
 		s.queue.Run(s.ctx.Done())
 		s.cleanup()
 	}()
+	go s.reconcileDataplaneLoop(s.ctx.Done())
+	go func() {
+		if err := s.ReapplyOnLinkEvent(s.ctx); err != nil {
+			log.Warnf("Failed to watch link events, falling back to periodic rp_filter checks: %v", err)
+			s.reconcileRPFilterLoop(s.ctx.Done())
+		}
+	}()
 }
 
 func (s *Server) UpdateConfig() {
@@ -145,6 +477,17 @@ func (s *Server) UpdateConfig() {
 		Mode:              s.meshMode.String(),
 		DisabledSelectors: s.disabledSelectors,
 		ZTunnelReady:      s.isZTunnelRunning(),
+		FirewallBackend:   string(s.firewallBackend),
+		HostIPPreference:  s.hostIPPreference,
+		EnableIPv6:        s.enableIPv6,
+		NamespaceIpsets:   s.namespaceIpsets,
+		PodCIDRs:          s.podCIDRs,
+		RouteTables:       s.routeTables,
+		InboundRouteSrc:   s.inboundRouteSrc,
+		Draining:          s.isDraining(),
+	}
+	if s.captureSelector != nil {
+		cfg.CaptureSelector = s.captureSelector.String()
 	}
 
 	if err := cfg.write(); err != nil {
@@ -153,8 +496,12 @@ func (s *Server) UpdateConfig() {
 	log.Debug("Done")
 }
 
+// ambientConfigPath is the path of the config file shared with the CNI plugin. It is a variable
+// for tests.
+var ambientConfigPath = constants.AmbientConfigFilepath
+
 func (c *AmbientConfigFile) write() error {
-	configFile := constants.AmbientConfigFilepath
+	configFile := ambientConfigPath
 
 	data, err := json.Marshal(c)
 	if err != nil {
@@ -175,7 +522,7 @@ func atomicWrite(filename string, data []byte) error {
 }
 
 func ReadAmbientConfig() (*AmbientConfigFile, error) {
-	configFile := constants.AmbientConfigFilepath
+	configFile := ambientConfigPath
 
 	if _, err := os.Stat(configFile); os.IsNotExist(err) {
 		return &AmbientConfigFile{
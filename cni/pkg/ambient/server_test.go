@@ -0,0 +1,91 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+)
+
+// setAmbientConfigPath points the config file shared with the CNI plugin at a temporary file.
+func setAmbientConfigPath(t *testing.T) {
+	orig := ambientConfigPath
+	ambientConfigPath = filepath.Join(t.TempDir(), "config.json")
+	t.Cleanup(func() {
+		ambientConfigPath = orig
+	})
+}
+
+func TestAmbientConfigRoutes(t *testing.T) {
+	setAmbientConfigPath(t)
+	s := &Server{routeTables: RouteTables{Inbound: 200, Outbound: 201, Proxy: 202}, inboundRouteSrc: "10.0.0.200"}
+	s.UpdateConfig()
+
+	cfg, err := ReadAmbientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.RouteTables != s.routeTables || cfg.InboundRouteTable() != 200 {
+		t.Errorf("expected the route tables %+v, got %+v", s.routeTables, cfg.RouteTables)
+	}
+	if cfg.InboundRouteSrc != s.inboundRouteSrc {
+		t.Errorf("expected the inbound route source %s, got %q", s.inboundRouteSrc, cfg.InboundRouteSrc)
+	}
+
+	// A config written without the route tables uses the default inbound table.
+	if table := (&AmbientConfigFile{}).InboundRouteTable(); table != constants.RouteTableInbound {
+		t.Errorf("expected the default inbound route table %d, got %d", constants.RouteTableInbound, table)
+	}
+}
+
+func TestAmbientConfigCaptureSelector(t *testing.T) {
+	setAmbientConfigPath(t)
+	s := &Server{captureSelector: labels.SelectorFromSet(labels.Set{"mesh": "on"})}
+	s.UpdateConfig()
+
+	cfg, err := ReadAmbientConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	matching := newTestPod("a", "a", "10.0.0.1")
+	matching.Labels = map[string]string{"mesh": "on"}
+	for _, tc := range []struct {
+		cfg      *AmbientConfigFile
+		pod      *corev1.Pod
+		expected bool
+	}{
+		{cfg: cfg, pod: matching, expected: true},
+		{cfg: cfg, pod: newTestPod("b", "b", "10.0.0.2")},
+		// Without a selector, every pod is captured.
+		{cfg: &AmbientConfigFile{}, pod: newTestPod("b", "b", "10.0.0.2"), expected: true},
+	} {
+		captured, err := tc.cfg.CapturesPod(tc.pod)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if captured != tc.expected {
+			t.Errorf("expected pod %s to be captured by %q: %v, got %v", tc.pod.Name, tc.cfg.CaptureSelector, tc.expected, captured)
+		}
+	}
+
+	if _, err := (&AmbientConfigFile{CaptureSelector: "mesh in ("}).CapturesPod(matching); err == nil {
+		t.Errorf("expected an invalid selector to fail")
+	}
+}
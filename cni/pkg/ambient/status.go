@@ -0,0 +1,147 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// Status is a snapshot of the dataplane of the node. Parts which can't be gathered are left
+// empty, and the reasons listed in Errors.
+type Status struct {
+	NodeType        string             `json:"nodeType"`
+	ZTunnelRunning  bool               `json:"ztunnelRunning"`
+	FirewallBackend FirewallBackend    `json:"firewallBackend"`
+	IpsetMembers    int                `json:"ipsetMembers"`
+	Chains          []ChainStatus      `json:"chains"`
+	Tunnels         []TunnelStatus     `json:"tunnels"`
+	RouteTables     []RouteTableStatus `json:"routeTables"`
+	Errors          []string           `json:"errors,omitempty"`
+}
+
+// ChainStatus is the presence of a ztunnel chain.
+type ChainStatus struct {
+	Table  string `json:"table"`
+	Chain  string `json:"chain"`
+	Exists bool   `json:"exists"`
+}
+
+// TunnelStatus is the state of a ztunnel tunnel.
+type TunnelStatus struct {
+	Name   string `json:"name"`
+	Exists bool   `json:"exists"`
+	Up     bool   `json:"up"`
+	Remote string `json:"remote,omitempty"`
+}
+
+// RouteTableStatus is the number of routes in a route table.
+type RouteTableStatus struct {
+	Name   string `json:"name"`
+	Table  int    `json:"table"`
+	Routes int    `json:"routes"`
+}
+
+// Status returns a snapshot of the dataplane of the node: the number of ipset members, the ztunnel
+// chains, the tunnels and the route counts of the route tables.
+func (s *Server) Status() Status {
+	nodeType := offmesh.MyNodeType(s.nodeName, s.offmeshCluster)
+	st := Status{
+		NodeType:        nodeType,
+		ZTunnelRunning:  s.isZTunnelRunning(),
+		FirewallBackend: s.firewallBackend,
+		Chains:          []ChainStatus{},
+		Tunnels:         []TunnelStatus{},
+		RouteTables:     []RouteTableStatus{},
+	}
+	fail := func(format string, args ...any) {
+		st.Errors = append(st.Errors, fmt.Sprintf(format, args...))
+	}
+
+	sets := allIpsets()
+	if s.enableIPv6 {
+		sets = append(sets, Ipset6)
+	}
+	for _, set := range sets {
+		entries, err := set.List()
+		if err != nil {
+			fail("ipset: %v", &NetlinkError{Op: "IpsetList", Err: err})
+			continue
+		}
+		st.IpsetMembers += len(entries)
+	}
+
+	if s.firewallBackend == FirewallNftables {
+		for _, c := range nftChains {
+			err := s.executor().Run(context.Background(), "nft", "list", "chain", "ip", nftTable, nftChainName(c.table, c.chain))
+			st.Chains = append(st.Chains, ChainStatus{Table: c.table, Chain: c.chain, Exists: err == nil})
+		}
+	} else if ipt, err := newIptablesHandle(s.iptablesLockWait()); err != nil {
+		fail("iptables: %v", err)
+	} else {
+		for _, c := range ztunnelChains {
+			exists, err := ipt.ChainExists(c.table, c.chain)
+			if err != nil {
+				fail("chain %s/%s: %v", c.table, c.chain, err)
+				continue
+			}
+			st.Chains = append(st.Chains, ChainStatus{Table: c.table, Chain: c.chain, Exists: exists})
+		}
+	}
+
+	if nodeType == offmesh.DPUNode {
+		for _, name := range []string{constants.InboundTun, constants.OutboundTun} {
+			st.Tunnels = append(st.Tunnels, s.tunnelStatus(name))
+		}
+	}
+
+	for _, t := range []struct {
+		name  string
+		table int
+	}{
+		{"inbound", s.routeTables.Inbound},
+		{"outbound", s.routeTables.Outbound},
+		{"proxy", s.routeTables.Proxy},
+	} {
+		routes, err := s.netlink().RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Table: t.table}, netlink.RT_FILTER_TABLE)
+		if err != nil {
+			fail("route table %d: %v", t.table, &NetlinkError{Op: "RouteList", Err: err})
+			continue
+		}
+		st.RouteTables = append(st.RouteTables, RouteTableStatus{Name: t.name, Table: t.table, Routes: len(routes)})
+	}
+	return st
+}
+
+// tunnelStatus returns the state of the tunnel name. A missing tunnel isn't an error.
+func (s *Server) tunnelStatus(name string) TunnelStatus {
+	ts := TunnelStatus{Name: name}
+	link, err := s.netlink().LinkByName(name)
+	if err != nil {
+		return ts
+	}
+	ts.Exists = true
+	ts.Up = link.Attrs().Flags&net.FlagUp != 0
+	if geneve, ok := link.(*netlink.Geneve); ok && geneve.Remote != nil {
+		ts.Remote = geneve.Remote.String()
+	}
+	return ts
+}
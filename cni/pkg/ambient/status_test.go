@@ -0,0 +1,96 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+func TestStatus(t *testing.T) {
+	setFakeIpset(t, &fakeIpset{entries: []netlink.IPSetEntry{{IP: net.ParseIP("10.0.0.1")}, {IP: net.ParseIP("10.0.0.2")}}})
+	ipt := newFakeIptables()
+	ipt.rules[constants.TableMangle+"/"+constants.ChainZTunnelPrerouting] = nil
+	setFakeIptables(t, ipt)
+	nl := setFakeNetlink(t)
+	nl.links[constants.InboundTun] = &netlink.Geneve{
+		LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun, Flags: net.FlagUp},
+		Remote:    net.ParseIP("10.0.0.11"),
+	}
+	tables := DefaultRouteTables()
+	nl.routes = []netlink.Route{{Table: tables.Inbound}, {Table: tables.Inbound}, {Table: tables.Proxy}}
+
+	s := &Server{
+		nodeName:       "dpu1",
+		offmeshCluster: offmesh.ClusterConfig{Pairs: []offmesh.PUPair{{CPUName: "cpu1", DPUName: "dpu1"}}},
+		ztunnelRunning: true,
+		routeTables:    tables,
+	}
+	st := s.Status()
+
+	if st.NodeType != offmesh.DPUNode || !st.ZTunnelRunning || st.IpsetMembers != 2 || len(st.Errors) != 0 {
+		t.Errorf("unexpected status %+v", st)
+	}
+	for _, c := range st.Chains {
+		expected := c.Table == constants.TableMangle && c.Chain == constants.ChainZTunnelPrerouting
+		if c.Exists != expected {
+			t.Errorf("expected chain %s/%s to exist %v", c.Table, c.Chain, expected)
+		}
+	}
+	if len(st.Chains) != len(ztunnelChains) {
+		t.Errorf("expected %d chains, got %d", len(ztunnelChains), len(st.Chains))
+	}
+	expectedTunnels := []TunnelStatus{
+		{Name: constants.InboundTun, Exists: true, Up: true, Remote: "10.0.0.11"},
+		{Name: constants.OutboundTun},
+	}
+	if !reflect.DeepEqual(st.Tunnels, expectedTunnels) {
+		t.Errorf("expected tunnels %+v, got %+v", expectedTunnels, st.Tunnels)
+	}
+	expectedTables := []RouteTableStatus{
+		{Name: "inbound", Table: tables.Inbound, Routes: 2},
+		{Name: "outbound", Table: tables.Outbound, Routes: 0},
+		{Name: "proxy", Table: tables.Proxy, Routes: 1},
+	}
+	if !reflect.DeepEqual(st.RouteTables, expectedTables) {
+		t.Errorf("expected route tables %+v, got %+v", expectedTables, st.RouteTables)
+	}
+}
+
+func TestStatusPartial(t *testing.T) {
+	setFakeIpset(t, &fakeIpset{listErr: errors.New("no such set")})
+	setFakeIptables(t, newFakeIptables())
+	setFakeNetlink(t)
+
+	s := &Server{
+		nodeName:       "cpu1",
+		offmeshCluster: offmesh.ClusterConfig{Pairs: []offmesh.PUPair{{CPUName: "cpu1", DPUName: "dpu1"}}},
+		routeTables:    DefaultRouteTables(),
+	}
+	st := s.Status()
+	if len(st.Errors) != 1 {
+		t.Errorf("expected the ipset error only, got %v", st.Errors)
+	}
+	if len(st.Tunnels) != 0 || len(st.RouteTables) != 3 {
+		t.Errorf("expected no tunnels and all route tables on a CPU node, got %+v", st)
+	}
+}
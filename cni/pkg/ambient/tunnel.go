@@ -0,0 +1,476 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"go.uber.org/multierr"
+	"golang.org/x/sync/errgroup"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// TunnelVNIs are the Geneve VNIs of the tunnels between the node and ztunnel.
+type TunnelVNIs struct {
+	Inbound  uint32
+	Outbound uint32
+}
+
+// MaxTunnelVNI is the largest Geneve VNI, as VNIs are 24 bits.
+const MaxTunnelVNI = 1<<24 - 1
+
+// DefaultTunnelVNIs returns the VNIs used when none are configured.
+func DefaultTunnelVNIs() TunnelVNIs {
+	return TunnelVNIs{
+		Inbound:  constants.InboundTunVNI,
+		Outbound: constants.OutboundTunVNI,
+	}
+}
+
+// Validate checks that the VNIs are usable, and are not already used by a Geneve link that isn't
+// one of ours, e.g. from another overlay on the node.
+func (v TunnelVNIs) Validate() error {
+	if v.Inbound == 0 || v.Outbound == 0 {
+		return fmt.Errorf("tunnel VNIs must be non-zero: inbound=%d, outbound=%d", v.Inbound, v.Outbound)
+	}
+	if v.Inbound > MaxTunnelVNI || v.Outbound > MaxTunnelVNI {
+		return fmt.Errorf("tunnel VNIs must be at most %d: inbound=%d, outbound=%d", MaxTunnelVNI, v.Inbound, v.Outbound)
+	}
+	if v.Inbound == v.Outbound {
+		return fmt.Errorf("inbound and outbound tunnel VNIs must be distinct, both are %d", v.Inbound)
+	}
+
+	links, err := defaultNetlink.LinkList()
+	if err != nil {
+		return &NetlinkError{Op: "LinkList", Err: err}
+	}
+	for _, link := range links {
+		geneve, ok := link.(*netlink.Geneve)
+		if !ok {
+			continue
+		}
+		name := geneve.Attrs().Name
+		if name == constants.InboundTun || name == constants.OutboundTun {
+			continue
+		}
+		if geneve.ID == v.Inbound || geneve.ID == v.Outbound {
+			return fmt.Errorf("tunnel VNI %d is already used by geneve link %s", geneve.ID, name)
+		}
+	}
+	return nil
+}
+
+// UnderlayFamily is the IP family of the network the tunnels run over.
+type UnderlayFamily string
+
+const (
+	// UnderlayAuto takes the family of the IP of the offmesh node paired with this one.
+	UnderlayAuto UnderlayFamily = ""
+	UnderlayIPv4 UnderlayFamily = "ipv4"
+	UnderlayIPv6 UnderlayFamily = "ipv6"
+)
+
+// Validate checks that f is a known family.
+func (f UnderlayFamily) Validate() error {
+	switch f {
+	case UnderlayAuto, UnderlayIPv4, UnderlayIPv6:
+		return nil
+	}
+	return fmt.Errorf("unknown tunnel underlay family %q, expected %s or %s", f, UnderlayIPv4, UnderlayIPv6)
+}
+
+// underlayFamilyOf returns the family of ip.
+func underlayFamilyOf(ip net.IP) UnderlayFamily {
+	if ip.To4() != nil {
+		return UnderlayIPv4
+	}
+	return UnderlayIPv6
+}
+
+// TunnelOptions are the UDP options of the Geneve tunnels.
+type TunnelOptions struct {
+	// Dport is the UDP destination port of the tunnels. 0 means constants.GenevePort.
+	Dport uint16
+	// Underlay is the IP family of the tunnel remote. UnderlayAuto means the family of the IP of
+	// the offmesh pair.
+	Underlay UnderlayFamily
+	// UDPCsum sets UDP checksums over an IPv4 underlay. UDPZeroCsum6Tx and UDPZeroCsum6Rx send and
+	// accept zero UDP checksums over an IPv6 underlay. Some NICs only offload Geneve with these set.
+	UDPCsum        bool
+	UDPZeroCsum6Tx bool
+	UDPZeroCsum6Rx bool
+}
+
+// port returns the UDP destination port of the tunnels.
+func (o TunnelOptions) port() uint16 {
+	if o.Dport == 0 {
+		return constants.GenevePort
+	}
+	return o.Dport
+}
+
+// apply sets the options on tun.
+func (o TunnelOptions) apply(tun *netlink.Geneve) {
+	tun.Dport = o.port()
+	tun.UdpCsum = boolToUint8(o.UDPCsum)
+	tun.UdpZeroCsum6Tx = boolToUint8(o.UDPZeroCsum6Tx)
+	tun.UdpZeroCsum6Rx = boolToUint8(o.UDPZeroCsum6Rx)
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// geneveArgs returns the ip link add arguments describing tun after its name, with remote as the
+// remote.
+func geneveArgs(tun *netlink.Geneve, remote string) []string {
+	args := []string{"type", "geneve", "id", strconv.FormatUint(uint64(tun.ID), 10), "remote", remote}
+	if tun.Dport != 0 {
+		args = append(args, "dstport", strconv.Itoa(int(tun.Dport)))
+	}
+	if tun.UdpCsum != 0 {
+		args = append(args, "udpcsum")
+	}
+	if tun.UdpZeroCsum6Tx != 0 {
+		args = append(args, "udp6zerocsumtx")
+	}
+	if tun.UdpZeroCsum6Rx != 0 {
+		args = append(args, "udp6zerocsumrx")
+	}
+	return args
+}
+
+// addTunnel adds the tunnel link. The netlink library doesn't encode the UDP checksum options of
+// geneve links, so a tunnel with any of them is added with the ip command instead.
+func (s *Server) addTunnel(ctx context.Context, tun *netlink.Geneve) error {
+	if tun.UdpCsum == 0 && tun.UdpZeroCsum6Tx == 0 && tun.UdpZeroCsum6Rx == 0 {
+		return s.netlink().LinkAdd(tun)
+	}
+	args := append([]string{"link", "add", tun.Name}, geneveArgs(tun, tun.Remote.String())...)
+	// An existing link fails with an error wrapping os.ErrExist, as LinkAdd does.
+	return s.executor().Run(ctx, "ip", args...)
+}
+
+const (
+	// geneveOverhead is the encapsulation overhead of the tunnels: the outer IPv4, UDP and Geneve
+	// headers, and the inner Ethernet header. The outer IPv6 header of an IPv6 underlay is 20 bytes
+	// more.
+	geneveOverhead  = 20 + 8 + 8 + 14
+	geneveOverhead6 = geneveOverhead + 20
+	minTunnelMTU    = 576
+	maxTunnelMTU    = 9000
+)
+
+// validateTunnelMTU checks that a tunnel MTU is within a usable range. 0 means the MTU is derived
+// from the underlay, and is valid.
+func validateTunnelMTU(mtu int) error {
+	if mtu != 0 && (mtu < minTunnelMTU || mtu > maxTunnelMTU) {
+		return fmt.Errorf("tunnel MTU %d is outside of the range %d-%d", mtu, minTunnelMTU, maxTunnelMTU)
+	}
+	return nil
+}
+
+// tunnelMTUTo returns the MTU of a tunnel to remote. It is the configured MTU if any, or else the
+// MTU of the underlay device routing to remote minus the Geneve overhead, so that full-size
+// packets aren't fragmented or dropped once encapsulated.
+func (s *Server) tunnelMTUTo(remote net.IP) (int, error) {
+	if s.tunnelMTU != 0 {
+		return s.tunnelMTU, nil
+	}
+	underlay, err := s.underlayMTU(remote)
+	if err != nil {
+		return 0, err
+	}
+	mtu := underlay - geneveOverhead
+	if underlayFamilyOf(remote) == UnderlayIPv6 {
+		mtu = underlay - geneveOverhead6
+	}
+	if err := validateTunnelMTU(mtu); err != nil {
+		return 0, fmt.Errorf("underlay MTU %d to %s: %v", underlay, remote, err)
+	}
+	return mtu, nil
+}
+
+// underlayMTU returns the MTU of the device routing to remote.
+func (s *Server) underlayMTU(remote net.IP) (int, error) {
+	routes, err := s.netlink().RouteGet(remote)
+	if err != nil {
+		return 0, &NetlinkError{Op: "RouteGet", Err: err}
+	}
+	if len(routes) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNoRouteToDest, remote)
+	}
+	link, err := s.netlink().LinkByIndex(routes[0].LinkIndex)
+	if err != nil {
+		return 0, &NetlinkError{Op: "LinkByIndex", Err: err}
+	}
+	return link.Attrs().MTU, nil
+}
+
+// ensureTunnel creates the tunnel with the address ip, sets its MTU, and sets it up. A tunnel that
+// already exists, e.g. when node setup runs again after a restart, is kept, and its address, MTU
+// and state are brought to the desired values. If it has drifted from tun, e.g. its remote is a replaced DPU,
+// it is recreated. Nothing is done once ctx is done, so that a cancelled setup stops between tunnels.
+func (s *Server) ensureTunnel(ctx context.Context, tun *netlink.Geneve, ip string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	log.Debugf("Building tunnel: %+v", tun)
+	err := s.backoff.retry(ctx, func() error {
+		return s.addTunnel(ctx, tun)
+	})
+	if errors.Is(err, os.ErrExist) {
+		err = s.recreateDriftedTunnel(ctx, tun)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add tunnel %s: %v", tun.Name, err)
+	}
+
+	mtu, err := s.tunnelMTUTo(tun.Remote)
+	if err != nil {
+		log.Warnf("Not setting the MTU of tunnel %s: %v", tun.Name, err)
+	} else {
+		err = s.backoff.retry(ctx, func() error {
+			return s.netlink().LinkSetMTU(tun, mtu)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set tunnel %s MTU to %d: %v", tun.Name, mtu, err)
+		}
+	}
+
+	addr := tunnelAddr(ip)
+	if err := s.delStaleTunnelAddrs(tun, addr); err != nil {
+		return fmt.Errorf("failed to replace tunnel %s address: %v", tun.Name, err)
+	}
+	err = s.backoff.retry(ctx, func() error {
+		return s.netlink().AddrReplace(tun, addr)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add tunnel %s address: %v", tun.Name, err)
+	}
+
+	err = s.backoff.retry(ctx, func() error {
+		return s.netlink().LinkSetUp(tun)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set tunnel %s up: %v", tun.Name, err)
+	}
+	return nil
+}
+
+// tunnelAddr returns the address ip of a tunnel: an IPv4 one in a constants.TunPrefix subnet, or
+// an IPv6 one with a /128 mask.
+func tunnelAddr(ip string) *netlink.Addr {
+	parsed := net.ParseIP(ip)
+	mask := net.CIDRMask(constants.TunPrefix, 32)
+	if parsed != nil && parsed.To4() == nil {
+		mask = net.CIDRMask(128, 128)
+	}
+	return &netlink.Addr{IPNet: &net.IPNet{IP: parsed, Mask: mask}}
+}
+
+// delStaleTunnelAddrs deletes the addresses of an existing tunnel of the family of addr other than
+// addr, e.g. after the tunnel IPs were changed, so that the tunnel ends up with addr only.
+func (s *Server) delStaleTunnelAddrs(tun *netlink.Geneve, addr *netlink.Addr) error {
+	family := netlink.FAMILY_V4
+	if addr.IP.To4() == nil {
+		family = netlink.FAMILY_V6
+	}
+	addrs, err := s.netlink().AddrList(tun, family)
+	if err != nil {
+		return &NetlinkError{Op: "AddrList", Err: err}
+	}
+	for _, a := range addrs {
+		if a.IPNet.String() == addr.IPNet.String() {
+			continue
+		}
+		log.Infof("Replacing address %s of tunnel %s with %s", a.IPNet, tun.Name, addr.IPNet)
+		a := a
+		if err := s.netlink().AddrDel(tun, &a); err != nil {
+			return &NetlinkError{Op: "AddrDel", Err: err}
+		}
+	}
+	return nil
+}
+
+// dpuTunnel is a tunnel between a DPU node and ztunnel, and the address of the node end.
+type dpuTunnel struct {
+	link *netlink.Geneve
+	ip   string
+}
+
+// dpuTunnels returns the tunnels setUpDPUTunnels creates to ztunnel, whose IP is ztunnelIP.
+// https://github.com/solo-io/istio-sidecarless/blob/master/redirect-worker.sh#L153-L161
+func (s *Server) dpuTunnels(ztunnelIP string) []dpuTunnel {
+	remote := s.tunnelRemote(ztunnelIP)
+	tunnels := []dpuTunnel{
+		{
+			link: &netlink.Geneve{
+				LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun},
+				ID:        s.tunnelVNIs.Inbound,
+				Remote:    remote,
+			},
+			ip: constants.InboundTunIP,
+		},
+		{
+			link: &netlink.Geneve{
+				LinkAttrs: netlink.LinkAttrs{Name: constants.OutboundTun},
+				ID:        s.tunnelVNIs.Outbound,
+				Remote:    remote,
+			},
+			ip: constants.OutboundTunIP,
+		},
+	}
+	for _, t := range tunnels {
+		s.tunnelOptions.apply(t.link)
+	}
+	return tunnels
+}
+
+// underlayFamily returns the IP family of the tunnel remote: the configured one, or else the family
+// of the IP of the offmesh pair, or else "" if there is none.
+func (s *Server) underlayFamily() UnderlayFamily {
+	if s.tunnelOptions.Underlay != UnderlayAuto {
+		return s.tunnelOptions.Underlay
+	}
+	pu, err := s.getOffmeshPair(offmesh.DPUNode)
+	if err != nil {
+		return UnderlayAuto
+	}
+	return underlayFamilyOf(net.ParseIP(pu.IP))
+}
+
+// tunnelRemote returns the address of ztunnel the tunnels go to. It is ztunnelIP, unless the
+// underlay is of the other family, in which case it is the address of ztunnel in the underlay
+// family. The tunnel IPs stay IPv4 either way, as the pod routes and rules go through them.
+func (s *Server) tunnelRemote(ztunnelIP string) net.IP {
+	remote := net.ParseIP(ztunnelIP)
+	family := s.underlayFamily()
+	if remote == nil || family == UnderlayAuto || underlayFamilyOf(remote) == family {
+		return remote
+	}
+	s.mu.Lock()
+	ips := s.ztunnelIPs
+	s.mu.Unlock()
+	for _, ip := range ips {
+		if parsed := net.ParseIP(ip); parsed != nil && underlayFamilyOf(parsed) == family {
+			return parsed
+		}
+	}
+	log.Warnf("ztunnel has no %s address among %v, the tunnels go to %s", family, ips, ztunnelIP)
+	return remote
+}
+
+// dpuNodeProcs returns the proc files of the ztunnel veth setUpDPUTunnels writes, and their values.
+func dpuNodeProcs(ztunnelVeth string) map[string]string {
+	// Need to do some work in procfs
+	// @TODO: This likely needs to be cleaned up, there are a lot of martians in AWS
+	// that seem to necessitate this work.
+	return map[string]string{
+		filepath.Join(procConfDir, "default", "rp_filter"):      "0",
+		filepath.Join(procConfDir, "all", "rp_filter"):          "0",
+		filepath.Join(procConfDir, ztunnelVeth, "rp_filter"):    "0",
+		filepath.Join(procConfDir, ztunnelVeth, "accept_local"): "1",
+	}
+}
+
+// tunnelProcs returns the proc files of the tunnel name setUpDPUTunnels writes once it exists, and
+// their values.
+func tunnelProcs(name string) map[string]string {
+	return map[string]string{
+		filepath.Join(procConfDir, name, "rp_filter"):    "0",
+		filepath.Join(procConfDir, name, "accept_local"): "1",
+	}
+}
+
+// setUpDPUTunnels writes the proc files of the ztunnel veth, and creates the inbound and outbound
+// tunnels to ztunnelIP, concurrently. The proc files of a tunnel are written once it exists. The
+// proc writes are best effort, but a tunnel failure cancels the tunnels still being created, and
+// the failures are returned together.
+func (s *Server) setUpDPUTunnels(ctx context.Context, ztunnelVeth, ztunnelIP string) error {
+	g, gctx := errgroup.WithContext(ctx)
+	if dryRun {
+		// Keep the dry-run script in order.
+		g.SetLimit(1)
+	}
+	var (
+		mu   sync.Mutex
+		errs error
+	)
+
+	g.Go(func() error {
+		s.setProcs(dpuNodeProcs(ztunnelVeth))
+		return nil
+	})
+
+	for _, t := range s.dpuTunnels(ztunnelIP) {
+		t := t
+		g.Go(func() error {
+			if err := s.ensureTunnel(gctx, t.link, t.ip); err != nil {
+				recordDataplaneError(linkOperation)
+				err = fmt.Errorf("failed to set up tunnel %s: %w", t.link.Name, err)
+				mu.Lock()
+				errs = multierr.Append(errs, err)
+				mu.Unlock()
+				return err
+			}
+			s.setProcs(tunnelProcs(t.link.Name))
+			return nil
+		})
+	}
+
+	_ = g.Wait()
+	return errs
+}
+
+// recreateDriftedTunnel recreates the existing tunnel with the name of tun if its ID, remote or port
+// differ from tun, which would otherwise blackhole the traffic through it.
+func (s *Server) recreateDriftedTunnel(ctx context.Context, tun *netlink.Geneve) error {
+	link, err := s.netlink().LinkByName(tun.Name)
+	if err != nil {
+		return &NetlinkError{Op: "LinkByName", Err: err}
+	}
+	existing, ok := link.(*netlink.Geneve)
+	if ok && existing.ID == tun.ID && existing.Remote.Equal(tun.Remote) && existing.Dport == tun.Dport {
+		log.Debugf("Tunnel %s already exists", tun.Name)
+		return nil
+	}
+
+	if ok {
+		log.Infof("Tunnel %s has drifted (id %d, remote %s, port %d), recreating it with id %d, remote %s, port %d",
+			tun.Name, existing.ID, existing.Remote, existing.Dport, tun.ID, tun.Remote, tun.Dport)
+	} else {
+		log.Infof("Link %s is a %s, recreating it as a geneve tunnel", tun.Name, link.Type())
+	}
+	if err := s.netlink().LinkDel(link); err != nil {
+		return &NetlinkError{Op: "LinkDel", Err: err}
+	}
+	return s.backoff.retry(ctx, func() error {
+		return s.addTunnel(ctx, tun)
+	})
+}
@@ -0,0 +1,393 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+func TestTunnelVNIsValidate(t *testing.T) {
+	cases := []struct {
+		name      string
+		vnis      TunnelVNIs
+		expectErr bool
+	}{
+		{
+			name: "defaults",
+			vnis: DefaultTunnelVNIs(),
+		},
+		{
+			name: "custom",
+			vnis: TunnelVNIs{Inbound: 4000, Outbound: 4001},
+		},
+		{
+			name:      "unset",
+			vnis:      TunnelVNIs{Inbound: 4000},
+			expectErr: true,
+		},
+		{
+			name: "max",
+			vnis: TunnelVNIs{Inbound: MaxTunnelVNI - 1, Outbound: MaxTunnelVNI},
+		},
+		{
+			name:      "over 24 bits",
+			vnis:      TunnelVNIs{Inbound: 4000, Outbound: MaxTunnelVNI + 1},
+			expectErr: true,
+		},
+		{
+			name:      "collision",
+			vnis:      TunnelVNIs{Inbound: 4000, Outbound: 4000},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.vnis.Validate()
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
+
+func TestEnsureTunnelExisting(t *testing.T) {
+	f := setFakeNetlink(t)
+	s := &Server{}
+	tun := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun}, ID: constants.InboundTunVNI, Remote: net.ParseIP("10.0.0.2")}
+	if err := s.ensureTunnel(context.Background(), tun, constants.InboundTunIP); err != nil {
+		t.Fatal(err)
+	}
+
+	// The address was removed and the link set down, e.g. by another component, before setup runs again.
+	f.addrs, f.up = nil, false
+	if err := s.ensureTunnel(context.Background(), tun, constants.InboundTunIP); err != nil {
+		t.Fatalf("expected the existing tunnel to be kept, got %v", err)
+	}
+	if f.deleted != 0 {
+		t.Errorf("expected the existing tunnel to be kept, got %d deletes", f.deleted)
+	}
+	if len(f.addrs) != 1 || !f.up {
+		t.Errorf("expected the tunnel address to be configured and the link up, got %v, up %v", f.addrs, f.up)
+	}
+}
+
+func TestEnsureTunnelDrifted(t *testing.T) {
+	f := setFakeNetlink(t)
+	s := &Server{}
+	stale := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun}, ID: constants.InboundTunVNI, Remote: net.ParseIP("10.0.0.2")}
+	f.links[constants.InboundTun] = stale
+
+	// The DPU was replaced, so ztunnel is at another address.
+	tun := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun}, ID: constants.InboundTunVNI, Remote: net.ParseIP("10.0.0.3")}
+	if err := s.ensureTunnel(context.Background(), tun, constants.InboundTunIP); err != nil {
+		t.Fatal(err)
+	}
+	if f.deleted != 1 {
+		t.Errorf("expected the drifted tunnel to be deleted, got %d deletes", f.deleted)
+	}
+	if got := f.links[constants.InboundTun]; got != tun {
+		t.Errorf("expected the tunnel to be recreated with remote %s, got %+v", tun.Remote, got)
+	}
+}
+
+func TestEnsureTunnelAddrReplaced(t *testing.T) {
+	f := setFakeNetlink(t)
+	s := &Server{}
+	tun := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun}, ID: constants.InboundTunVNI, Remote: net.ParseIP("10.0.0.2")}
+	if err := s.ensureTunnel(context.Background(), tun, constants.InboundTunIP); err != nil {
+		t.Fatal(err)
+	}
+	// Node setup runs again with another tunnel IP.
+	if err := s.ensureTunnel(context.Background(), tun, "192.168.126.5"); err != nil {
+		t.Fatalf("expected the tunnel address to be replaced, got %v", err)
+	}
+	expected := []string{"192.168.126.5/30"}
+	if !reflect.DeepEqual(f.addrs, expected) {
+		t.Errorf("expected addresses %v, got %v", expected, f.addrs)
+	}
+	addrs, _ := f.AddrList(tun, netlink.FAMILY_V4)
+	if len(addrs) != 1 || addrs[0].IPNet.String() != expected[0] {
+		t.Errorf("expected tunnel %s addresses %v, got %v", tun.Name, expected, addrs)
+	}
+}
+
+func TestEnsureTunnelMTU(t *testing.T) {
+	cases := []struct {
+		name     string
+		mtu      int
+		remote   string
+		expected int
+	}{
+		{
+			name:     "configured",
+			mtu:      1400,
+			remote:   "10.0.0.2",
+			expected: 1400,
+		},
+		{
+			name:     "from underlay",
+			remote:   "10.0.0.2",
+			expected: 1500 - geneveOverhead,
+		},
+		{
+			name:     "from ipv6 underlay",
+			remote:   "fd00::2",
+			expected: 1500 - geneveOverhead6,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := setFakeNetlink(t)
+			f.links["eth0"] = &netlink.Device{LinkAttrs: netlink.LinkAttrs{Name: "eth0", Index: 5, MTU: 1500}}
+			f.routes = []netlink.Route{{LinkIndex: 5}}
+			s := &Server{tunnelMTU: tc.mtu}
+			tun := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: constants.InboundTun}, ID: constants.InboundTunVNI, Remote: net.ParseIP(tc.remote)}
+			if err := s.ensureTunnel(context.Background(), tun, constants.InboundTunIP); err != nil {
+				t.Fatal(err)
+			}
+			if f.mtu != tc.expected {
+				t.Errorf("expected MTU %d, got %d", tc.expected, f.mtu)
+			}
+		})
+	}
+}
+
+func TestTunnelOptionsDport(t *testing.T) {
+	cases := []struct {
+		name     string
+		dport    uint16
+		expected uint16
+	}{
+		{
+			name:     "default",
+			expected: constants.GenevePort,
+		},
+		{
+			name:     "configured",
+			dport:    6082,
+			expected: 6082,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := setFakeNetlink(t)
+			s := &Server{tunnelVNIs: DefaultTunnelVNIs(), tunnelMTU: 1400, tunnelOptions: TunnelOptions{Dport: tc.dport}}
+			for _, tun := range s.dpuTunnels("10.0.0.2") {
+				if err := s.ensureTunnel(context.Background(), tun.link, tun.ip); err != nil {
+					t.Fatal(err)
+				}
+				got, ok := f.links[tun.link.Name].(*netlink.Geneve)
+				if !ok || got.Dport != tc.expected {
+					t.Errorf("expected tunnel %s with port %d, got %+v", tun.link.Name, tc.expected, f.links[tun.link.Name])
+				}
+			}
+
+			_, appendRules2 := s.dpuNodeRules("veth0", "10.0.0.2", false)
+			if ruleIndex(appendRules2, "-p", "udp", "--dport", strconv.Itoa(int(tc.expected)), "-j", "RETURN") == -1 {
+				t.Errorf("expected the RETURN rule of the tunnel port %d, got %v", tc.expected, appendRules2)
+			}
+		})
+	}
+}
+
+func TestTunnelUnderlay(t *testing.T) {
+	pair := func(cpuIP, dpuIP string) offmesh.ClusterConfig {
+		return offmesh.ClusterConfig{Pairs: []offmesh.PUPair{{CPUName: "cpu1", CPUIp: cpuIP, DPUName: "dpu1", DPUIp: dpuIP}}}
+	}
+	cases := []struct {
+		name     string
+		cluster  offmesh.ClusterConfig
+		underlay UnderlayFamily
+		expected string
+	}{
+		{
+			name:     "ipv4 pair",
+			cluster:  pair("10.1.0.10", "10.1.0.11"),
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "ipv6 pair",
+			cluster:  pair("fd01::10", "fd01::11"),
+			expected: "fd00::2",
+		},
+		{
+			name:     "configured ipv6",
+			cluster:  pair("10.1.0.10", "10.1.0.11"),
+			underlay: UnderlayIPv6,
+			expected: "fd00::2",
+		},
+		{
+			name:     "configured ipv4",
+			cluster:  pair("fd01::10", "fd01::11"),
+			underlay: UnderlayIPv4,
+			expected: "10.0.0.2",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			f := setFakeNetlink(t)
+			s := &Server{
+				nodeName:       "dpu1",
+				offmeshCluster: tc.cluster,
+				tunnelVNIs:     DefaultTunnelVNIs(),
+				tunnelMTU:      1400,
+				tunnelOptions:  TunnelOptions{Underlay: tc.underlay},
+				ztunnelIPs:     []string{"10.0.0.2", "fd00::2"},
+			}
+			for _, tun := range s.dpuTunnels("10.0.0.2") {
+				if err := s.ensureTunnel(context.Background(), tun.link, tun.ip); err != nil {
+					t.Fatal(err)
+				}
+				got, ok := f.links[tun.link.Name].(*netlink.Geneve)
+				if !ok || got.Remote.String() != tc.expected {
+					t.Errorf("expected tunnel %s with remote %s, got %+v", tun.link.Name, tc.expected, f.links[tun.link.Name])
+				}
+			}
+			// The tunnel IPs are IPv4 over either underlay.
+			if !reflect.DeepEqual(f.addrs, []string{constants.InboundTunIP + "/30", constants.OutboundTunIP + "/30"}) {
+				t.Errorf("expected the IPv4 tunnel addresses, got %v", f.addrs)
+			}
+		})
+	}
+
+	t.Run("no ztunnel address in the underlay family", func(t *testing.T) {
+		s := &Server{tunnelOptions: TunnelOptions{Underlay: UnderlayIPv6}, ztunnelIPs: []string{"10.0.0.2"}}
+		if got := s.tunnelRemote("10.0.0.2"); got.String() != "10.0.0.2" {
+			t.Errorf("expected the ztunnel IP as remote, got %s", got)
+		}
+	})
+}
+
+func TestTunnelAddr(t *testing.T) {
+	if got := tunnelAddr(constants.InboundTunIP).IPNet.String(); got != constants.InboundTunIP+"/30" {
+		t.Errorf("expected an IPv4 tunnel address in a /30, got %s", got)
+	}
+	if got := tunnelAddr("fd00::1").IPNet.String(); got != "fd00::1/128" {
+		t.Errorf("expected an IPv6 tunnel address with a /128 mask, got %s", got)
+	}
+}
+
+func TestValidateTunnelMTU(t *testing.T) {
+	for _, mtu := range []int{0, minTunnelMTU, 1450, maxTunnelMTU} {
+		if err := validateTunnelMTU(mtu); err != nil {
+			t.Errorf("expected MTU %d to be valid, got %v", mtu, err)
+		}
+	}
+	for _, mtu := range []int{-1, minTunnelMTU - 1, maxTunnelMTU + 1} {
+		if err := validateTunnelMTU(mtu); err == nil {
+			t.Errorf("expected MTU %d to be invalid", mtu)
+		}
+	}
+}
+
+// slowNetlink is a fakeNetlink taking latency for each link change, as the kernel does on a busy
+// node.
+type slowNetlink struct {
+	*fakeNetlink
+	latency time.Duration
+}
+
+func (f *slowNetlink) LinkAdd(link netlink.Link) error {
+	time.Sleep(f.latency)
+	return f.fakeNetlink.LinkAdd(link)
+}
+
+func (f *slowNetlink) LinkSetMTU(link netlink.Link, mtu int) error {
+	time.Sleep(f.latency)
+	return f.fakeNetlink.LinkSetMTU(link, mtu)
+}
+
+func (f *slowNetlink) AddrReplace(link netlink.Link, addr *netlink.Addr) error {
+	time.Sleep(f.latency)
+	return f.fakeNetlink.AddrReplace(link, addr)
+}
+
+func (f *slowNetlink) LinkSetUp(link netlink.Link) error {
+	time.Sleep(f.latency)
+	return f.fakeNetlink.LinkSetUp(link)
+}
+
+// BenchmarkSetUpDPUTunnels compares setUpDPUTunnels with setting up the tunnels and writing the
+// proc files one after the other.
+func BenchmarkSetUpDPUTunnels(b *testing.B) {
+	dir := b.TempDir()
+	orig := procConfDir
+	procConfDir = dir
+	b.Cleanup(func() {
+		procConfDir = orig
+	})
+	ifaces := []string{"default", "all", "veth0", constants.InboundTun, constants.OutboundTun}
+	for _, name := range ifaces {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0o755); err != nil {
+			b.Fatal(err)
+		}
+	}
+	newServer := func() *Server {
+		return &Server{
+			nl:         &slowNetlink{fakeNetlink: &fakeNetlink{links: map[string]netlink.Link{}}, latency: time.Millisecond},
+			tunnelVNIs: DefaultTunnelVNIs(),
+			tunnelMTU:  1450,
+		}
+	}
+
+	b.Run("sequential", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			s := newServer()
+			for _, tun := range []struct{ name, ip string }{
+				{constants.InboundTun, constants.InboundTunIP},
+				{constants.OutboundTun, constants.OutboundTunIP},
+			} {
+				geneve := &netlink.Geneve{LinkAttrs: netlink.LinkAttrs{Name: tun.name}, Remote: net.ParseIP("10.0.0.2")}
+				if err := s.ensureTunnel(context.Background(), geneve, tun.ip); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for _, name := range ifaces {
+				procs := []string{"rp_filter", "accept_local"}
+				if name == "default" || name == "all" {
+					procs = procs[:1]
+				}
+				for _, proc := range procs {
+					if err := s.setProc(filepath.Join(dir, name, proc), "0"); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+	})
+	b.Run("concurrent", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := newServer().setUpDPUTunnels(context.Background(), "veth0", "10.0.0.2"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -16,10 +16,12 @@ package ambient
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
 	"istio.io/istio/pkg/offmesh"
+	"net"
 	"os/exec"
+	"strconv"
 	"strings"
 
 	corev1 "k8s.io/api/core/v1"
@@ -41,15 +43,53 @@ func newExec(cmd string, args []string) *ExecList {
 	}
 }
 
-func executeOutput(cmd string, args ...string) (string, error) {
-	externalCommand := exec.Command(cmd, args...)
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
+// logCommandf logs the commands run by execute and executeOutput. It is a variable for tests.
+var logCommandf = log.Debugf
+
+// commandLine returns the command with its arguments in full, quoting those which are empty or
+// contain spaces.
+func commandLine(cmd string, args []string) string {
+	parts := make([]string, 0, len(args)+1)
+	parts = append(parts, cmd)
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n") {
+			arg = strconv.Quote(arg)
+		}
+		parts = append(parts, arg)
+	}
+	return strings.Join(parts, " ")
+}
+
+// runCommand runs the command, and returns its stdout and stderr. The command is logged in full
+// before it runs, and its exit status after, at debug level.
+func runCommand(ctx context.Context, cmd string, args ...string) (stdout, stderr *bytes.Buffer, err error) {
+	line := commandLine(cmd, args)
+	logCommandf("Running command: %s", line)
+	externalCommand := exec.CommandContext(ctx, cmd, args...)
+	stdout = &bytes.Buffer{}
+	stderr = &bytes.Buffer{}
 	externalCommand.Stdout = stdout
 	externalCommand.Stderr = stderr
 
-	err := externalCommand.Run()
+	err = externalCommand.Run()
+	if externalCommand.ProcessState == nil {
+		logCommandf("Command %s failed to start: %v", line, err)
+	} else {
+		logCommandf("Command %s exited with status %d", line, externalCommand.ProcessState.ExitCode())
+	}
+	return stdout, stderr, err
+}
+
+func executeOutput(ctx context.Context, cmd string, args ...string) (string, error) {
+	if dryRun {
+		printDryRun(cmd, args...)
+		return "", nil
+	}
+	stdout, stderr, err := runCommand(ctx, cmd, args...)
 
+	if ctx.Err() != nil {
+		return "", ctx.Err()
+	}
 	if err != nil || len(stderr.Bytes()) != 0 {
 		return stderr.String(), err
 	}
@@ -57,28 +97,57 @@ func executeOutput(cmd string, args ...string) (string, error) {
 	return strings.TrimSuffix(stdout.String(), "\n"), err
 }
 
-func execute(cmd string, args ...string) error {
-	log.Debugf("Running command: %s %s", cmd, strings.Join(args, " "))
-	externalCommand := exec.Command(cmd, args...)
-	stdout := &bytes.Buffer{}
-	stderr := &bytes.Buffer{}
-	externalCommand.Stdout = stdout
-	externalCommand.Stderr = stderr
-
-	err := externalCommand.Run()
+func execute(ctx context.Context, cmd string, args ...string) error {
+	if dryRun {
+		printDryRun(cmd, args...)
+		return nil
+	}
+	stdout, stderr, err := runCommand(ctx, cmd, args...)
 
 	if len(stdout.String()) != 0 {
 		log.Debugf("Command output: \n%v", stdout.String())
 	}
 
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != nil || len(stderr.Bytes()) != 0 {
 		log.Debugf("Command error output: \n%v", stderr.String())
-		return errors.New(stderr.String())
+		return newCommandError(cmd, args, stderr.String())
 	}
 
 	return nil
 }
 
+// Executor runs external commands. The Server runs its commands through one, so that tests can
+// record them instead of changing the node.
+type Executor interface {
+	// Run runs the command. On failure, the error holds the stderr of the command.
+	Run(ctx context.Context, cmd string, args ...string) error
+	// Output runs the command and returns its stdout, or its stderr on failure.
+	Output(ctx context.Context, cmd string, args ...string) (string, error)
+}
+
+// commandExecutor runs the commands with os/exec, or prints them in dry-run mode. The package-level
+// ipset handles, which the CNI plugin uses without a Server, always run their commands this way.
+type commandExecutor struct{}
+
+func (commandExecutor) Run(ctx context.Context, cmd string, args ...string) error {
+	return execute(ctx, cmd, args...)
+}
+
+func (commandExecutor) Output(ctx context.Context, cmd string, args ...string) (string, error) {
+	return executeOutput(ctx, cmd, args...)
+}
+
+// executor returns the Executor of s, which runs the commands for real unless another is set.
+func (s *Server) executor() Executor {
+	if s.exec == nil {
+		return commandExecutor{}
+	}
+	return s.exec
+}
+
 func (s *Server) matchesAmbientSelectors(lbl map[string]string) (bool, error) {
 	sel, err := metav1.LabelSelectorAsSelector(&ambientSelectors)
 	if err != nil {
@@ -103,18 +172,41 @@ func (s *Server) matchesDisabledSelectors(lbl map[string]string) (bool, error) {
 
 	return false, nil
 }
-func IsZtunnelOnMyDPU(pod *corev1.Pod, offmeshCluster offmesh.ClusterConfig) bool {
-	pu := offmesh.GetPair(NodeName, offmesh.CPUNode, offmeshCluster)
+
+// getOffmeshPair returns the node paired with this node, which is of type nodeType.
+// ErrNoOffmeshPair is returned if the cluster config has no pair for this node, or the IP of the
+// pair is invalid.
+func (s *Server) getOffmeshPair(nodeType string) (offmesh.PU, error) {
+	pairType := "DPU"
+	if nodeType == offmesh.DPUNode {
+		pairType = "CPU"
+	}
+	pu := offmesh.GetPair(s.nodeName, nodeType, s.offmeshCluster)
+	if pu.Name == "" || pu.IP == "" {
+		return offmesh.PU{}, fmt.Errorf("%w: no offmesh %s node paired with %s", ErrNoOffmeshPair, pairType, s.nodeName)
+	}
+	if net.ParseIP(pu.IP) == nil {
+		return offmesh.PU{}, fmt.Errorf("%w: offmesh %s node %s paired with %s has invalid IP %q",
+			ErrNoOffmeshPair, pairType, pu.Name, s.nodeName, pu.IP)
+	}
+	return pu, nil
+}
+
+// isZtunnelOnMyDPU reports whether the pod, usually ztunnel, runs on the DPU node paired with this
+// CPU node.
+func (s *Server) isZtunnelOnMyDPU(pod *corev1.Pod) bool {
+	pu := offmesh.GetPair(s.nodeName, offmesh.CPUNode, s.offmeshCluster)
 	return pu.Name == pod.Spec.NodeName
 }
 
-func IsPodOnMyCPU(pod *corev1.Pod, offmeshCluster offmesh.ClusterConfig) bool {
-	pu := offmesh.GetPair(NodeName, offmesh.DPUNode, offmeshCluster)
+// isPodOnMyCPU reports whether the pod runs on the CPU node paired with this DPU node.
+func (s *Server) isPodOnMyCPU(pod *corev1.Pod) bool {
+	pu := offmesh.GetPair(s.nodeName, offmesh.DPUNode, s.offmeshCluster)
 	return pu.Name == pod.Spec.NodeName
 }
 
-func podOnMyNode(pod *corev1.Pod) bool {
-	return pod.Spec.NodeName == NodeName
+func (s *Server) podOnMyNode(pod *corev1.Pod) bool {
+	return pod.Spec.NodeName == s.nodeName
 }
 
 func (s *Server) isAmbientGlobal() bool {
@@ -0,0 +1,85 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// setFakeLogCommand records the command logs of execute and executeOutput.
+func setFakeLogCommand(t *testing.T) *[]string {
+	orig := logCommandf
+	var lines []string
+	logCommandf = func(format string, args ...any) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	}
+	t.Cleanup(func() {
+		logCommandf = orig
+	})
+	return &lines
+}
+
+func TestExecuteLogsCommand(t *testing.T) {
+	// The rules of a long pod list would be truncated by a capped log line.
+	args := []string{"-t", "mangle", "-A", "ztunnel-PREROUTING", "--source", "10.244.123.234", "-m", "comment", "--comment", "a b"}
+	line := `true -t mangle -A ztunnel-PREROUTING --source 10.244.123.234 -m comment --comment "a b"`
+	cases := []struct {
+		name     string
+		run      func() error
+		expected []string
+	}{
+		{
+			name: "execute",
+			run: func() error {
+				return execute(context.Background(), "true", args...)
+			},
+			expected: []string{"Running command: " + line, "Command " + line + " exited with status 0"},
+		},
+		{
+			name: "executeOutput",
+			run: func() error {
+				_, err := executeOutput(context.Background(), "true", args...)
+				return err
+			},
+			expected: []string{"Running command: " + line, "Command " + line + " exited with status 0"},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := setFakeLogCommand(t)
+			if err := tc.run(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*lines, tc.expected) {
+				t.Errorf("expected logs %q, got %q", tc.expected, *lines)
+			}
+		})
+	}
+
+	t.Run("exit status", func(t *testing.T) {
+		lines := setFakeLogCommand(t)
+		if err := execute(context.Background(), "false", "10.244.123.234"); err == nil {
+			t.Fatal("expected the command to fail")
+		}
+		expected := []string{"Running command: false 10.244.123.234", "Command false 10.244.123.234 exited with status 1"}
+		if !reflect.DeepEqual(*lines, expected) {
+			t.Errorf("expected logs %q, got %q", expected, *lines)
+		}
+	})
+}
@@ -0,0 +1,248 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/pkg/offmesh"
+)
+
+const (
+	diffPresent = "present"
+	diffMissing = "missing"
+)
+
+// NodeDiff is a difference between the intended node setup and the live state of the node.
+type NodeDiff struct {
+	Item     string `json:"item"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// NodeValidation is the result of ValidateNode.
+type NodeValidation struct {
+	Diffs []NodeDiff `json:"diffs"`
+}
+
+// Valid reports whether the live state matches the intended setup.
+func (v NodeValidation) Valid() bool {
+	return len(v.Diffs) == 0
+}
+
+// Err returns an error listing the differences, or nil if valid.
+func (v NodeValidation) Err() error {
+	if v.Valid() {
+		return nil
+	}
+	diffs := make([]string, 0, len(v.Diffs))
+	for _, d := range v.Diffs {
+		diffs = append(diffs, fmt.Sprintf("%s: expected %s, got %s", d.Item, d.Expected, d.Actual))
+	}
+	return fmt.Errorf("ambient node setup differs: %s", strings.Join(diffs, "; "))
+}
+
+func (v *NodeValidation) diff(item, expected, actual string) {
+	v.Diffs = append(v.Diffs, NodeDiff{Item: item, Expected: expected, Actual: actual})
+}
+
+// ValidateNode compares the live state of the node to the setup done by CreateRulesOn*Node: the
+// ztunnel chains and their rules, one by one and by count, the tunnels and their remote, the ip
+// rules and the ipsets. Unlike HealthCheck, which only checks the invariants traffic depends on,
+// every difference is reported. Nothing is checked until ztunnel is running, as the node is only
+// set up then.
+func (s *Server) ValidateNode() NodeValidation {
+	var res NodeValidation
+	if !s.isZTunnelRunning() {
+		return res
+	}
+
+	if s.firewallBackend != FirewallNftables {
+		s.validateIptables(&res)
+	}
+	s.validateIpsets(&res)
+
+	nodeType := offmesh.MyNodeType(s.nodeName, s.offmeshCluster)
+	s.validateIPRules(&res, nodeType)
+	if nodeType == offmesh.DPUNode {
+		s.validateTunnels(&res)
+	}
+	return res
+}
+
+// validateIptables checks that the ztunnel chains exist and are hooked up, that each applied rule
+// is present, and that the ztunnel chains hold as many rules as were applied to them. Rules are
+// checked with Exists rather than compared to the listing, as iptables rewrites the rule specs it
+// lists.
+func (s *Server) validateIptables(res *NodeValidation) {
+	ipt, err := newIptablesHandle(s.iptablesLockWait())
+	if err != nil {
+		res.diff("iptables", "available", err.Error())
+		return
+	}
+
+	s.mu.Lock()
+	rules := s.appliedRules
+	s.mu.Unlock()
+	expected := map[string]int{}
+	for _, rule := range rules {
+		if !rule.IPv6 {
+			expected[rule.Table+"/"+rule.Chain]++
+		}
+	}
+
+	for _, c := range ztunnelChains {
+		key := c.table + "/" + c.chain
+		exists, err := ipt.ChainExists(c.table, c.chain)
+		if err != nil {
+			res.diff("chain "+key, diffPresent, err.Error())
+			continue
+		}
+		if !exists {
+			res.diff("chain "+key, diffPresent, diffMissing)
+			continue
+		}
+		exists, err = ipt.Exists(c.table, c.parent, "-j", c.chain)
+		if err != nil {
+			res.diff(fmt.Sprintf("jump %s/%s to %s", c.table, c.parent, c.chain), diffPresent, err.Error())
+		} else if !exists {
+			res.diff(fmt.Sprintf("jump %s/%s to %s", c.table, c.parent, c.chain), diffPresent, diffMissing)
+		}
+
+		listed, err := ipt.List(c.table, c.chain)
+		if err != nil {
+			res.diff("rules of "+key, "listed", err.Error())
+			continue
+		}
+		if n := countRules(listed); n != expected[key] {
+			res.diff("rule count of "+key, strconv.Itoa(expected[key]), strconv.Itoa(n))
+		}
+	}
+
+	for _, rule := range rules {
+		if rule.IPv6 {
+			continue
+		}
+		item := fmt.Sprintf("rule %s/%s", rule.Table, rule.Chain)
+		spec := strings.Join(rule.RuleSpec, " ")
+		exists, err := ipt.Exists(rule.Table, rule.Chain, rule.RuleSpec...)
+		if err != nil {
+			res.diff(item, spec, err.Error())
+		} else if !exists {
+			res.diff(item, spec, diffMissing)
+		}
+	}
+}
+
+// countRules returns the number of rules in the output of iptables -S for a chain, which also
+// lists the chain itself.
+func countRules(listed []string) int {
+	n := 0
+	for _, line := range listed {
+		if strings.HasPrefix(line, "-A ") {
+			n++
+		}
+	}
+	return n
+}
+
+// validateIpsets checks that Ipset and the namespace ipsets exist.
+func (s *Server) validateIpsets(res *NodeValidation) {
+	names := append([]string{ipsetName}, extraIpsetNames()...)
+	for i, set := range allIpsets() {
+		item := "ipset " + names[i]
+		if _, err := set.List(); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				res.diff(item, diffPresent, diffMissing)
+			} else {
+				res.diff(item, diffPresent, (&NetlinkError{Op: "IpsetList", Err: err}).Error())
+			}
+		}
+	}
+}
+
+// validateIPRules checks that the ip rules of nodeType are in place.
+func (s *Server) validateIPRules(res *NodeValidation, nodeType string) {
+	want := s.ipRules(nodeType)
+	if len(want) == 0 {
+		return
+	}
+	rules, err := s.netlink().RuleList(netlink.FAMILY_V4)
+	if err != nil {
+		res.diff("ip rules", "listed", (&NetlinkError{Op: "RuleList", Err: err}).Error())
+		return
+	}
+	for _, w := range want {
+		found := false
+		for _, rule := range rules {
+			if matchesIPRule(rule, []netlink.Rule{w}) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res.diff(fmt.Sprintf("ip rule %d", w.Priority), describeIPRule(w), diffMissing)
+		}
+	}
+}
+
+// describeIPRule formats rule like ip rule list does.
+func describeIPRule(rule netlink.Rule) string {
+	parts := []string{fmt.Sprintf("%d:", rule.Priority)}
+	if rule.Mark != 0 {
+		parts = append(parts, fmt.Sprintf("fwmark %#x/%#x", rule.Mark, rule.Mask))
+	}
+	if rule.Goto > 0 {
+		parts = append(parts, fmt.Sprintf("goto %d", rule.Goto))
+	} else {
+		parts = append(parts, fmt.Sprintf("lookup %d", rule.Table))
+	}
+	return strings.Join(parts, " ")
+}
+
+// validateTunnels checks that the tunnels exist as geneve links going to the ztunnel paired with
+// this node. The remote isn't checked until the ztunnel pod is known.
+func (s *Server) validateTunnels(res *NodeValidation) {
+	s.mu.Lock()
+	var ztunnelIP string
+	if len(s.ztunnelIPs) > 0 {
+		ztunnelIP = s.ztunnelIPs[0]
+	}
+	s.mu.Unlock()
+
+	for _, t := range s.dpuTunnels(ztunnelIP) {
+		want := t.link
+		item := "tunnel " + want.Name
+		link, err := s.netlink().LinkByName(want.Name)
+		if err != nil {
+			res.diff(item, diffPresent, err.Error())
+			continue
+		}
+		geneve, ok := link.(*netlink.Geneve)
+		if !ok {
+			res.diff(item, "geneve", link.Type())
+			continue
+		}
+		if want.Remote != nil && !geneve.Remote.Equal(want.Remote) {
+			res.diff(item+" remote", want.Remote.String(), geneve.Remote.String())
+		}
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+func TestValidateNode(t *testing.T) {
+	markRule := newIptableRule(constants.TableMangle, constants.ChainZTunnelPrerouting,
+		"-i", constants.InboundTun, "-j", "MARK", "--set-mark", constants.SkipMark)
+	acceptRule := newIptableRule(constants.TableNat, constants.ChainZTunnelPrerouting,
+		"-m", "mark", "--mark", constants.OutboundMark, "-j", "ACCEPT")
+
+	cases := []struct {
+		name     string
+		tamper   func(s *Server, ipt *fakeIptables, nl *fakeNetlink, set *fakeIpset)
+		expected []NodeDiff
+	}{
+		{
+			name: "valid",
+		},
+		{
+			name: "rule mutated",
+			tamper: func(_ *Server, ipt *fakeIptables, _ *fakeNetlink, _ *fakeIpset) {
+				_ = ipt.Delete(constants.TableMangle, constants.ChainZTunnelPrerouting,
+					"-i", constants.InboundTun, "-j", "MARK", "--set-mark", constants.SkipMark)
+				_ = ipt.Append(constants.TableMangle, constants.ChainZTunnelPrerouting,
+					"-i", constants.OutboundTun, "-j", "MARK", "--set-mark", constants.SkipMark)
+			},
+			expected: []NodeDiff{{
+				Item:     "rule mangle/ztunnel-PREROUTING",
+				Expected: "-i istioin -j MARK --set-mark 0x200/0x200",
+				Actual:   "missing",
+			}},
+		},
+		{
+			name: "extra rule",
+			tamper: func(_ *Server, ipt *fakeIptables, _ *fakeNetlink, _ *fakeIpset) {
+				_ = ipt.Append(constants.TableNat, constants.ChainZTunnelPrerouting, "-j", "RETURN")
+			},
+			expected: []NodeDiff{{Item: "rule count of nat/ztunnel-PREROUTING", Expected: "1", Actual: "2"}},
+		},
+		{
+			name: "ip rule missing",
+			tamper: func(_ *Server, _ *fakeIptables, nl *fakeNetlink, _ *fakeIpset) {
+				nl.rules = nl.rules[:3]
+			},
+			expected: []NodeDiff{{Item: "ip rule 103", Expected: "103: lookup 100", Actual: "missing"}},
+		},
+		{
+			name: "tunnel remote changed",
+			tamper: func(_ *Server, _ *fakeIptables, nl *fakeNetlink, _ *fakeIpset) {
+				nl.links[constants.OutboundTun].(*netlink.Geneve).Remote = net.ParseIP("10.0.0.3")
+			},
+			expected: []NodeDiff{{Item: "tunnel istioout remote", Expected: "10.0.0.2", Actual: "10.0.0.3"}},
+		},
+		{
+			name: "ipset missing",
+			tamper: func(_ *Server, _ *fakeIptables, _ *fakeNetlink, set *fakeIpset) {
+				set.listErr = os.ErrNotExist
+			},
+			expected: []NodeDiff{{Item: "ipset ztunnel-pods-ips", Expected: "present", Actual: "missing"}},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			ipt := newFakeIptables()
+			setFakeIptables(t, ipt)
+			nl := setFakeNetlink(t)
+			set := &fakeIpset{}
+			setFakeIpset(t, set)
+			s := &Server{
+				ztunnelRunning: true,
+				nodeName:       "dpu1",
+				offmeshCluster: offmesh.ClusterConfig{Pairs: []offmesh.PUPair{
+					{CPUName: "cpu1", CPUIp: "10.1.0.10", DPUName: "dpu1", DPUIp: "10.1.0.11"},
+				}},
+				routeTables: DefaultRouteTables(),
+				tunnelVNIs:  DefaultTunnelVNIs(),
+				ztunnelIPs:  []string{"10.0.0.2"},
+			}
+			if err := s.initializeLists(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.applyRulesTransactional(context.Background(), []*iptablesRule{markRule, acceptRule}); err != nil {
+				t.Fatal(err)
+			}
+			nl.rules = s.ipRules(offmesh.DPUNode)
+			for _, tun := range s.dpuTunnels("10.0.0.2") {
+				addFakeLink(t, nl, tun.link)
+			}
+			if tc.tamper != nil {
+				tc.tamper(s, ipt, nl, set)
+			}
+
+			res := s.ValidateNode()
+			if !reflect.DeepEqual(res.Diffs, tc.expected) {
+				t.Errorf("expected diffs %+v, got %+v", tc.expected, res.Diffs)
+			}
+			if res.Valid() != (res.Err() == nil) {
+				t.Errorf("Valid and Err disagree: %v", res.Err())
+			}
+		})
+	}
+}
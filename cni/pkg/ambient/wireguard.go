@@ -0,0 +1,145 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+// TunnelEncryption is how the traffic between a CPU node and its DPU node is protected.
+type TunnelEncryption string
+
+const (
+	// TunnelEncryptionNone sends the traffic in the clear, the default.
+	TunnelEncryptionNone TunnelEncryption = "none"
+	// TunnelEncryptionWireGuard sends the traffic over a WireGuard link between the nodes.
+	TunnelEncryptionWireGuard TunnelEncryption = "wireguard"
+)
+
+// Validate checks that e is a known encryption. Empty means TunnelEncryptionNone.
+func (e TunnelEncryption) Validate() error {
+	switch e {
+	case "", TunnelEncryptionNone, TunnelEncryptionWireGuard:
+		return nil
+	}
+	return fmt.Errorf("unknown tunnel encryption %q, expected %s or %s", e, TunnelEncryptionNone, TunnelEncryptionWireGuard)
+}
+
+// WireGuardOptions configure the WireGuard link to the offmesh pair with TunnelEncryptionWireGuard.
+type WireGuardOptions struct {
+	// PrivateKeyFile is the file holding the base64 private key of this node.
+	PrivateKeyFile string
+	// PeerPublicKey is the base64 public key of the offmesh pair.
+	PeerPublicKey string
+	// ListenPort is the UDP port of the link on both nodes. 0 means constants.WireGuardPort.
+	ListenPort int
+}
+
+// Validate checks that the keys are set and the port is usable.
+func (o WireGuardOptions) Validate() error {
+	if o.PrivateKeyFile == "" {
+		return errors.New("wireguard tunnel encryption requires a private key file")
+	}
+	key, err := base64.StdEncoding.DecodeString(o.PeerPublicKey)
+	if err != nil || len(key) != 32 {
+		return fmt.Errorf("invalid wireguard peer public key %q, expected 32 base64 encoded bytes", o.PeerPublicKey)
+	}
+	if o.ListenPort < 0 || o.ListenPort > 65535 {
+		return fmt.Errorf("invalid wireguard port %d", o.ListenPort)
+	}
+	return nil
+}
+
+func (o WireGuardOptions) port() string {
+	if o.ListenPort == 0 {
+		return strconv.Itoa(constants.WireGuardPort)
+	}
+	return strconv.Itoa(o.ListenPort)
+}
+
+// wireGuardEnabled reports whether the traffic to the offmesh pair goes over WireGuard.
+func (s *Server) wireGuardEnabled() bool {
+	return s.tunnelEncryption == TunnelEncryptionWireGuard
+}
+
+// wireGuardLink returns the name and IP of the WireGuard link of a node of nodeType, and the IP of
+// the link of its offmesh pair.
+func wireGuardLink(nodeType string) (name, ip, peerIP string) {
+	if nodeType == offmesh.CPUNode {
+		return constants.CPUTun, constants.CPUDPUTunIP, constants.DPUCPUTunIP
+	}
+	return constants.DPUTun, constants.DPUCPUTunIP, constants.CPUDPUTunIP
+}
+
+// ensureWireGuard creates the WireGuard link of a node of nodeType, and configures it with the
+// offmesh pair at pairIP as its only peer. The peer may send from any address, as the traffic of
+// the pods is routed over the link. Nothing is done without TunnelEncryptionWireGuard.
+func (s *Server) ensureWireGuard(ctx context.Context, nodeType, pairIP string) error {
+	if !s.wireGuardEnabled() {
+		return nil
+	}
+	name, ip, _ := wireGuardLink(nodeType)
+	wg := &netlink.Wireguard{LinkAttrs: netlink.LinkAttrs{Name: name}}
+	link, err := s.netlink().LinkByName(name)
+	switch {
+	case err != nil:
+		log.Debugf("Building WireGuard link %s to %s", name, pairIP)
+		err = s.backoff.retry(ctx, func() error {
+			return s.netlink().LinkAdd(wg)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add wireguard link %s: %v", name, err)
+		}
+		link = wg
+	case link.Type() != wg.Type():
+		return fmt.Errorf("link %s is a %s, not wireguard", name, link.Type())
+	}
+
+	port := s.wireGuard.port()
+	err = s.executor().Run(ctx, "wg", "set", name,
+		"listen-port", port,
+		"private-key", s.wireGuard.PrivateKeyFile,
+		"peer", s.wireGuard.PeerPublicKey,
+		"endpoint", net.JoinHostPort(pairIP, port),
+		"allowed-ips", "0.0.0.0/0")
+	if err != nil {
+		return fmt.Errorf("failed to configure wireguard link %s: %v", name, err)
+	}
+
+	addr := tunnelAddr(ip)
+	err = s.backoff.retry(ctx, func() error {
+		return s.netlink().AddrReplace(link, addr)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add wireguard link %s address: %v", name, err)
+	}
+	err = s.backoff.retry(ctx, func() error {
+		return s.netlink().LinkSetUp(link)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set wireguard link %s up: %v", name, err)
+	}
+	return nil
+}
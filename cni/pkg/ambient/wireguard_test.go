@@ -0,0 +1,158 @@
+// Copyright Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package ambient
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/vishvananda/netlink"
+
+	"istio.io/istio/cni/pkg/ambient/constants"
+	"istio.io/istio/pkg/offmesh"
+)
+
+const testPeerKey = "hIgHUaDMWyxnAILm0iPqFVbbQUkLiRYnmoP0rI2CpmA="
+
+func TestEnsureWireGuard(t *testing.T) {
+	cases := []struct {
+		name        string
+		nodeType    string
+		pairIP      string
+		port        int
+		expectedDev string
+		expectedIP  string
+		expectedCmd string
+	}{
+		{
+			name:        "dpu",
+			nodeType:    offmesh.DPUNode,
+			pairIP:      "10.1.0.10",
+			expectedDev: constants.DPUTun,
+			expectedIP:  constants.DPUCPUTunIP,
+			expectedCmd: "wg set dputunnel listen-port 51820 private-key /etc/wireguard/key peer " + testPeerKey +
+				" endpoint 10.1.0.10:51820 allowed-ips 0.0.0.0/0",
+		},
+		{
+			name:        "cpu over ipv6",
+			nodeType:    offmesh.CPUNode,
+			pairIP:      "fd01::11",
+			port:        51000,
+			expectedDev: constants.CPUTun,
+			expectedIP:  constants.CPUDPUTunIP,
+			expectedCmd: "wg set cputunnel listen-port 51000 private-key /etc/wireguard/key peer " + testPeerKey +
+				" endpoint [fd01::11]:51000 allowed-ips 0.0.0.0/0",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			nl := setFakeNetlink(t)
+			exec := &fakeExecutor{}
+			s := &Server{
+				exec:             exec,
+				tunnelEncryption: TunnelEncryptionWireGuard,
+				wireGuard: WireGuardOptions{
+					PrivateKeyFile: "/etc/wireguard/key",
+					PeerPublicKey:  testPeerKey,
+					ListenPort:     tc.port,
+				},
+			}
+			if err := s.ensureWireGuard(context.Background(), tc.nodeType, tc.pairIP); err != nil {
+				t.Fatal(err)
+			}
+
+			link, ok := nl.links[tc.expectedDev].(*netlink.Wireguard)
+			if !ok {
+				t.Fatalf("expected wireguard link %s, got %v", tc.expectedDev, nl.links[tc.expectedDev])
+			}
+			addrs := nl.linkAddrs[link.Index]
+			if len(addrs) != 1 || !addrs[0].IP.Equal(net.ParseIP(tc.expectedIP)) {
+				t.Errorf("expected address %s on %s, got %v", tc.expectedIP, tc.expectedDev, addrs)
+			}
+			if strings.Join(exec.commands, "\n") != tc.expectedCmd {
+				t.Errorf("expected command %q, got %q", tc.expectedCmd, exec.commands)
+			}
+
+			// Setting up the node again reconfigures the existing link.
+			if err := s.ensureWireGuard(context.Background(), tc.nodeType, tc.pairIP); err != nil {
+				t.Fatal(err)
+			}
+			if len(exec.commands) != 2 {
+				t.Errorf("expected the link to be reconfigured, got %q", exec.commands)
+			}
+		})
+	}
+}
+
+func TestEnsureWireGuardDisabled(t *testing.T) {
+	nl := setFakeNetlink(t)
+	exec := &fakeExecutor{}
+	s := &Server{exec: exec, tunnelEncryption: TunnelEncryptionNone}
+	if err := s.ensureWireGuard(context.Background(), offmesh.DPUNode, "10.1.0.10"); err != nil {
+		t.Fatal(err)
+	}
+	if len(nl.links) != 0 || len(exec.commands) != 0 {
+		t.Errorf("expected no wireguard link, got links %v and commands %q", nl.links, exec.commands)
+	}
+}
+
+func TestCPUNodeRoutesWireGuard(t *testing.T) {
+	s := &Server{routeTables: DefaultRouteTables(), tunnelEncryption: TunnelEncryptionWireGuard}
+	route := s.cpuNodeRoutes("eth0", "10.1.0.11")[0]
+	expected := "route replace table 101 0.0.0.0/0 via 192.168.128.2 dev cputunnel"
+	if got := strings.Join(route.Args, " "); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestWireGuardOptionsValidate(t *testing.T) {
+	cases := []struct {
+		name      string
+		opts      WireGuardOptions
+		expectErr bool
+	}{
+		{
+			name: "valid",
+			opts: WireGuardOptions{PrivateKeyFile: "/etc/wireguard/key", PeerPublicKey: testPeerKey},
+		},
+		{
+			name:      "no private key",
+			opts:      WireGuardOptions{PeerPublicKey: testPeerKey},
+			expectErr: true,
+		},
+		{
+			name:      "short peer key",
+			opts:      WireGuardOptions{PrivateKeyFile: "/etc/wireguard/key", PeerPublicKey: "aGVsbG8="},
+			expectErr: true,
+		},
+		{
+			name:      "invalid port",
+			opts:      WireGuardOptions{PrivateKeyFile: "/etc/wireguard/key", PeerPublicKey: testPeerKey, ListenPort: 70000},
+			expectErr: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.opts.Validate()
+			if (err != nil) != tc.expectErr {
+				t.Errorf("expected error %v, got %v", tc.expectErr, err)
+			}
+		})
+	}
+}
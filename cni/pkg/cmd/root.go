@@ -19,11 +19,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/cobra/doc"
 	"github.com/spf13/viper"
+	"k8s.io/apimachinery/pkg/labels"
 
 	"istio.io/istio/cni/pkg/ambient"
 	"istio.io/istio/cni/pkg/config"
@@ -80,19 +82,142 @@ var rootCmd = &cobra.Command{
 			return
 		}
 
+		var ambientHandlers install.AmbientHandlers
 		if cfg.InstallConfig.AmbientEnabled {
+			excludeInboundPorts, err := ambient.ParsePortList(ambient.ExcludeInboundPorts)
+			if err != nil {
+				return fmt.Errorf("invalid ambient inbound port exclusions: %v", err)
+			}
+			excludeOutboundPorts, err := ambient.ParsePortList(ambient.ExcludeOutboundPorts)
+			if err != nil {
+				return fmt.Errorf("invalid ambient outbound port exclusions: %v", err)
+			}
+			excludeOwnerUIDs, err := ambient.ParseIDList(ambient.ExcludeOwnerUIDs)
+			if err != nil {
+				return fmt.Errorf("invalid ambient owner UID exclusions: %v", err)
+			}
+			excludeOwnerGIDs, err := ambient.ParseIDList(ambient.ExcludeOwnerGIDs)
+			if err != nil {
+				return fmt.Errorf("invalid ambient owner GID exclusions: %v", err)
+			}
+			namespaceIpsets, err := ambient.ParseNamespaceIpsets(ambient.NamespaceIpsetMapping)
+			if err != nil {
+				return fmt.Errorf("invalid ambient namespace ipsets: %v", err)
+			}
+			var excludeOutboundCIDRs []string
+			if ambient.ExcludeOutboundCIDRs != "" {
+				excludeOutboundCIDRs = strings.Split(ambient.ExcludeOutboundCIDRs, ",")
+			}
+			var podCIDRs []string
+			if ambient.PodCIDRs != "" {
+				podCIDRs = strings.Split(ambient.PodCIDRs, ",")
+			}
+			captureSelector, err := labels.Parse(ambient.CaptureSelector)
+			if err != nil {
+				return fmt.Errorf("invalid ambient capture selector: %v", err)
+			}
+			markBase, err := strconv.ParseUint(ambient.MarkBase, 0, 32)
+			if err != nil {
+				return fmt.Errorf("invalid ambient mark base: %v", err)
+			}
+			if ambient.DNSCapturePort <= 0 || ambient.DNSCapturePort > 65535 {
+				return fmt.Errorf("invalid ambient DNS capture port %d", ambient.DNSCapturePort)
+			}
+			if ambient.GenevePort <= 0 || ambient.GenevePort > 65535 {
+				return fmt.Errorf("invalid ambient geneve port %d", ambient.GenevePort)
+			}
+			if ambient.ZTunnelHealthPort < 0 || ambient.ZTunnelHealthPort > 65535 {
+				return fmt.Errorf("invalid ambient ztunnel health port %d", ambient.ZTunnelHealthPort)
+			}
+			if ambient.InboundTunnelVNI <= 0 || ambient.InboundTunnelVNI > ambient.MaxTunnelVNI {
+				return fmt.Errorf("invalid ambient inbound tunnel VNI %d", ambient.InboundTunnelVNI)
+			}
+			if ambient.OutboundTunnelVNI <= 0 || ambient.OutboundTunnelVNI > ambient.MaxTunnelVNI {
+				return fmt.Errorf("invalid ambient outbound tunnel VNI %d", ambient.OutboundTunnelVNI)
+			}
+			if ambient.IpsetHashSize <= 0 || ambient.IpsetMaxElem <= 0 {
+				return fmt.Errorf("invalid ambient ipset size %d/%d", ambient.IpsetHashSize, ambient.IpsetMaxElem)
+			}
+
 			// Start ambient controller
 			server, err := ambient.NewServer(ctx, ambient.AmbientArgs{
 				SystemNamespace: ambient.PodNamespace,
 				Revision:        ambient.Revision,
+				NodeName:        ambient.NodeName,
+				TunnelVNIs: ambient.TunnelVNIs{
+					Inbound:  uint32(ambient.InboundTunnelVNI),
+					Outbound: uint32(ambient.OutboundTunnelVNI),
+				},
+				TunnelMTU: ambient.TunnelMTU,
+				TunnelOptions: ambient.TunnelOptions{
+					Dport:          uint16(ambient.GenevePort),
+					UDPCsum:        ambient.GeneveUDPCsum,
+					UDPZeroCsum6Tx: ambient.GeneveUDPZeroCsum6Tx,
+					UDPZeroCsum6Rx: ambient.GeneveUDPZeroCsum6Rx,
+					Underlay:       ambient.UnderlayFamily(ambient.TunnelUnderlay),
+				},
+				TunnelEncryption: ambient.TunnelEncryption(ambient.TunnelEncryptionType),
+				WireGuard: ambient.WireGuardOptions{
+					PrivateKeyFile: ambient.WireGuardPrivateKeyFile,
+					PeerPublicKey:  ambient.WireGuardPeerPublicKey,
+					ListenPort:     ambient.WireGuardPort,
+				},
+				RouteTables: ambient.RouteTables{
+					Inbound:  ambient.InboundRouteTable,
+					Outbound: ambient.OutboundRouteTable,
+					Proxy:    ambient.ProxyRouteTable,
+				},
+				MarkBase:                  uint32(markBase),
+				FirewallBackend:           ambient.FirewallBackend(ambient.FirewallBackendType),
+				DryRun:                    ambient.DryRunMode,
+				ExcludeInboundPorts:       excludeInboundPorts,
+				ExcludeOutboundPorts:      excludeOutboundPorts,
+				ExcludeOutboundCIDRs:      excludeOutboundCIDRs,
+				ExcludeLinkLocalMulticast: ambient.ExcludeLinkLocalMulticast,
+				ExcludeOwnerUIDs:          excludeOwnerUIDs,
+				ExcludeOwnerGIDs:          excludeOwnerGIDs,
+				NamespaceIpsets:           namespaceIpsets,
+				PodCIDRs:                  podCIDRs,
+				CaptureSelector:           captureSelector,
+				IpsetSize: ambient.IpsetSize{
+					HashSize: uint32(ambient.IpsetHashSize),
+					MaxElem:  uint32(ambient.IpsetMaxElem),
+				},
+				HostIPPreference: ambient.HostIPPreference{
+					Subnet:    ambient.HostIPSubnet,
+					Interface: ambient.HostIPInterface,
+				},
+				InboundRouteSrc:      ambient.InboundRouteSrc,
+				EnableIPv6:           ambient.EnableIPv6,
+				EnablePortIpset:      ambient.EnablePortIpset,
+				DataplaneRetries:     ambient.DataplaneRetries,
+				IptablesWait:         ambient.IptablesWait,
+				DNSCapturePort:       uint16(ambient.DNSCapturePort),
+				DNSCaptureUDPOnly:    ambient.DNSCaptureUDPOnly,
+				DNSCaptureAddr:       ambient.DNSCaptureAddr,
+				RPFilterScope:        ambient.RPFilterScope(ambient.RPFilterScopeType),
+				ZTunnelHealthPort:    uint16(ambient.ZTunnelHealthPort),
+				ZTunnelHealthTimeout: ambient.ZTunnelHealthTimeout,
 			})
 			if err != nil {
 				return fmt.Errorf("failed to create ambient informer service: %v", err)
 			}
 			server.Start()
+			ambientHandlers.Health = func() error {
+				return server.HealthCheck().Err()
+			}
+			ambientHandlers.MeshMembers = func() (any, error) {
+				return server.ListMeshMembers()
+			}
+			ambientHandlers.Status = func() (any, error) {
+				return server.Status(), nil
+			}
+			if ambient.InboundTunnelProbe {
+				ambientHandlers.TunnelProbe = server.ProbeInboundTunnel
+			}
 		}
 
-		isReady := install.StartServer()
+		isReady := install.StartServer(ambientHandlers)
 
 		installer := install.NewInstaller(&cfg.InstallConfig, isReady)
 
@@ -65,4 +65,15 @@ var (
 	LivenessEndpoint  = "/healthz"
 	ReadinessEndpoint = "/readyz"
 	Port              = "8000"
+
+	// AmbientHealthEndpoint reports whether the ambient node setup is still in place.
+	AmbientHealthEndpoint = "/healthz/ambient"
+	// AmbientMeshMembersEndpoint lists the ambient mesh members, and whether their ipset entries and
+	// routes agree.
+	AmbientMeshMembersEndpoint = "/debug/ambient/members"
+	// AmbientStatusEndpoint reports a snapshot of the ambient dataplane of the node.
+	AmbientStatusEndpoint = "/debug/ambient/status"
+	// AmbientTunnelProbeEndpoint reports whether the inbound tunnel carries traffic to ztunnel, for
+	// init containers waiting for the dataplane.
+	AmbientTunnelProbeEndpoint = "/readyz/ambient/tunnel"
 )
@@ -15,16 +15,42 @@
 package install
 
 import (
+	"encoding/json"
 	"net/http"
 	"sync/atomic"
 
 	"istio.io/istio/cni/pkg/constants"
 )
 
-// StartServer initializes and starts a web server that exposes liveness and readiness endpoints at port 8000.
-func StartServer() *atomic.Value {
+// AmbientHandlers are served by StartServer for the ambient controller, when set.
+type AmbientHandlers struct {
+	// Health checks the ambient node setup, at the ambient health endpoint.
+	Health func() error
+	// MeshMembers returns the mesh members, served as JSON at the ambient mesh members endpoint.
+	MeshMembers func() (any, error)
+	// Status returns the dataplane status, served as JSON at the ambient status endpoint.
+	Status func() (any, error)
+	// TunnelProbe probes the inbound tunnel, at the ambient tunnel probe endpoint.
+	TunnelProbe func() error
+}
+
+// StartServer initializes and starts a web server that exposes liveness and readiness endpoints at port 8000,
+// and the ambient endpoints that are set.
+func StartServer(ambient AmbientHandlers) *atomic.Value {
 	router := http.NewServeMux()
 	isReady := initRouter(router)
+	if ambient.Health != nil {
+		router.HandleFunc(constants.AmbientHealthEndpoint, healthCheck(ambient.Health))
+	}
+	if ambient.MeshMembers != nil {
+		router.HandleFunc(constants.AmbientMeshMembersEndpoint, jsonDebug(ambient.MeshMembers))
+	}
+	if ambient.Status != nil {
+		router.HandleFunc(constants.AmbientStatusEndpoint, jsonDebug(ambient.Status))
+	}
+	if ambient.TunnelProbe != nil {
+		router.HandleFunc(constants.AmbientTunnelProbeEndpoint, healthCheck(ambient.TunnelProbe))
+	}
 
 	go func() {
 		_ = http.ListenAndServe(":"+constants.Port, router)
@@ -59,6 +85,30 @@ func healthz(w http.ResponseWriter, _ *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
 
+func healthCheck(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+func jsonDebug(get func() (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		res, err := get()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}
+}
+
 func readyz(isReady *atomic.Value) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
 		if isReady == nil || !isReady.Load().(bool) {
@@ -15,6 +15,7 @@
 package install
 
 import (
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -48,6 +49,21 @@ func TestServer(t *testing.T) {
 	makeReq(t, server.URL, constants.ReadinessEndpoint, http.StatusServiceUnavailable)
 }
 
+func TestJSONDebug(t *testing.T) {
+	router := http.NewServeMux()
+	router.HandleFunc("/ok", jsonDebug(func() (any, error) {
+		return []string{"a"}, nil
+	}))
+	router.HandleFunc("/fail", jsonDebug(func() (any, error) {
+		return nil, errors.New("failed")
+	}))
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	makeReq(t, server.URL, "/ok", http.StatusOK)
+	makeReq(t, server.URL, "/fail", http.StatusInternalServerError)
+}
+
 func makeReq(t *testing.T, url, endpoint string, expectedStatusCode int) {
 	t.Helper()
 	res, err := http.Get(url + endpoint)
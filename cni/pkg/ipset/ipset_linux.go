@@ -15,27 +15,113 @@ package ipset
 // limitations under the License.
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"strings"
 
 	"github.com/vishvananda/netlink"
 	"github.com/vishvananda/netlink/nl"
 	"go.uber.org/multierr"
+	"golang.org/x/sys/unix"
 )
 
+// setType is the type of the sets created by CreateSet.
+const setType = "hash:ip"
+
+// maxSetName is the longest name of a set the kernel accepts.
+const maxSetName = 31
+
+// ipsetErrHashFull is the error of the kernel when an element is added to a hash set holding
+// maxelem elements, IPSET_ERR_HASH_FULL, which the netlink library has no constant for.
+const ipsetErrHashFull nl.IPSetError = 4352
+
 type IPSet struct {
 	// the name of the ipset to use
 	Name string
+	// HashSize and MaxElem are the initial hash size and the maximum number of elements of the set.
+	// If 0, the kernel defaults are used, 1024 and 65536.
+	HashSize uint32
+	MaxElem  uint32
 }
 
 func (m *IPSet) CreateSet() error {
-	err := netlink.IpsetCreate(m.Name, "hash:ip", netlink.IpsetCreateOptions{Comments: true})
+	err := m.create(m.Name)
 	if ipsetErr, ok := err.(nl.IPSetError); ok && ipsetErr == nl.IPSET_ERR_EXIST {
 		return nil
 	}
 	return err
 }
 
+// create creates the set name with the type, options and size of m.
+func (m *IPSet) create(name string) error {
+	if m.HashSize == 0 && m.MaxElem == 0 {
+		return netlink.IpsetCreate(name, setType, netlink.IpsetCreateOptions{Comments: true})
+	}
+	// The netlink library can't set the size of a set, so the request is built here like it
+	// builds it.
+	req := nl.NewNetlinkRequest(nl.IPSET_CMD_CREATE|(unix.NFNL_SUBSYS_IPSET<<8), nl.GetIpsetFlags(nl.IPSET_CMD_CREATE))
+	req.Flags |= unix.NLM_F_EXCL
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: uint8(unix.AF_NETLINK),
+		Version:     nl.NFNETLINK_V0,
+	})
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_PROTOCOL, nl.Uint8Attr(nl.IPSET_PROTOCOL)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(name)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_TYPENAME, nl.ZeroTerminated(setType)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_REVISION, nl.Uint8Attr(0)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_FAMILY, nl.Uint8Attr(unix.AF_INET)))
+	data := nl.NewRtAttr(nl.IPSET_ATTR_DATA|int(nl.NLA_F_NESTED), nil)
+	data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_CADT_FLAGS | nl.NLA_F_NET_BYTEORDER, Value: nl.IPSET_FLAG_WITH_COMMENT})
+	if m.HashSize != 0 {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_HASHSIZE | nl.NLA_F_NET_BYTEORDER, Value: m.HashSize})
+	}
+	if m.MaxElem != 0 {
+		data.AddChild(&nl.Uint32Attribute{Type: nl.IPSET_ATTR_MAXELEM | nl.NLA_F_NET_BYTEORDER, Value: m.MaxElem})
+	}
+	req.AddData(data)
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	if errno, ok := err.(unix.Errno); ok && int(errno) >= int(nl.IPSET_ERR_PRIVATE) {
+		// Like the netlink library, return the ipset errors of the kernel as such.
+		return nl.IPSetError(uintptr(errno))
+	}
+	return err
+}
+
+// IsSetFull reports whether err, returned by AddIP, is due to the set holding its maximum number
+// of elements.
+func IsSetFull(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ipsetErr nl.IPSetError
+	if errors.As(err, &ipsetErr) && ipsetErr == ipsetErrHashFull {
+		return true
+	}
+	return strings.Contains(err.Error(), "is full")
+}
+
+// SchemaMatches reports whether the existing set has the type and options CreateSet creates it
+// with. CreateSet keeps an existing set as is, so a set created by an older version with another
+// schema is only detected by this.
+func (m *IPSet) SchemaMatches() (bool, error) {
+	res, err := netlink.IpsetList(m.Name)
+	if err != nil {
+		return false, fmt.Errorf("failed to list ipset %s: %w", m.Name, err)
+	}
+	return res.TypeName == setType && res.CadtFlags&nl.IPSET_FLAG_WITH_COMMENT != 0, nil
+}
+
+// CommentsSupported reports whether the existing set stores the comments of its entries, which
+// needs the comment extension of the kernel.
+func (m *IPSet) CommentsSupported() (bool, error) {
+	res, err := netlink.IpsetList(m.Name)
+	if err != nil {
+		return false, fmt.Errorf("failed to list ipset %s: %w", m.Name, err)
+	}
+	return res.CadtFlags&nl.IPSET_FLAG_WITH_COMMENT != 0, nil
+}
+
 func (m *IPSet) DestroySet() error {
 	err := netlink.IpsetDestroy(m.Name)
 	return err
@@ -78,6 +164,51 @@ func (m *IPSet) DeleteIP(ip net.IP) error {
 	return nil
 }
 
+// Replace atomically replaces the members of the set with entries. They are added to a temporary
+// set, which is then swapped with the set, so the set never lacks a member present in both.
+func (m *IPSet) Replace(entries []netlink.IPSetEntry) error {
+	tmp := tempSetName(m.Name)
+	// A temporary set may be left behind by a failed replacement.
+	_ = netlink.IpsetDestroy(tmp)
+	if err := m.create(tmp); err != nil {
+		return fmt.Errorf("failed to create ipset %s: %w", tmp, err)
+	}
+	defer netlink.IpsetDestroy(tmp) // nolint: errcheck
+
+	for i := range entries {
+		if err := netlink.IpsetAdd(tmp, &entries[i]); err != nil {
+			return fmt.Errorf("failed to add IP %s to ipset %s: %w", entries[i].IP, tmp, err)
+		}
+	}
+	if err := ipsetSwap(m.Name, tmp); err != nil {
+		return fmt.Errorf("failed to swap ipset %s with %s: %w", m.Name, tmp, err)
+	}
+	return nil
+}
+
+// tempSetName returns the name of the temporary set Replace uses for the set name.
+func tempSetName(name string) string {
+	const suffix = "-tmp"
+	if len(name)+len(suffix) > maxSetName {
+		name = name[:maxSetName-len(suffix)]
+	}
+	return name + suffix
+}
+
+// ipsetSwap swaps the contents of the sets from and to, which the netlink library has no call for.
+func ipsetSwap(from, to string) error {
+	req := nl.NewNetlinkRequest(nl.IPSET_CMD_SWAP|(unix.NFNL_SUBSYS_IPSET<<8), nl.GetIpsetFlags(nl.IPSET_CMD_SWAP))
+	req.AddData(&nl.Nfgenmsg{
+		NfgenFamily: uint8(unix.AF_NETLINK),
+		Version:     nl.NFNETLINK_V0,
+	})
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_PROTOCOL, nl.Uint8Attr(nl.IPSET_PROTOCOL)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME, nl.ZeroTerminated(from)))
+	req.AddData(nl.NewRtAttr(nl.IPSET_ATTR_SETNAME2, nl.ZeroTerminated(to)))
+	_, err := req.Execute(unix.NETLINK_NETFILTER, 0)
+	return err
+}
+
 // This is only supported in kernel module from revision 2 or 4, so may not be present
 func (m *IPSet) ClearEntriesWithComment(comment string) error {
 	res, err := netlink.IpsetList(m.Name)
@@ -5,6 +5,7 @@ import (
 	"runtime"
 	"testing"
 
+	"github.com/vishvananda/netlink"
 	"k8s.io/apimachinery/pkg/util/rand"
 )
 
@@ -86,3 +87,71 @@ func TestXxx(t *testing.T) {
 		}
 	}
 }
+
+func TestReplace(t *testing.T) {
+	// skip if not linux
+	if runtime.GOOS != "linux" {
+		t.Skipf("skipping test on %s. this test only works on linux", runtime.GOOS)
+	}
+
+	ipset := &IPSet{
+		Name: "test" + rand.String(5),
+	}
+	if err := ipset.CreateSet(); err != nil {
+		t.Skipf("failed to create ipset %s: %v", ipset.Name, err)
+	}
+	defer ipset.DestroySet()
+
+	for _, ip := range []string{"1.2.3.4", "1.2.3.5"} {
+		if err := ipset.AddIP(net.ParseIP(ip).To4(), "old"); err != nil {
+			t.Fatalf("failed to add ipset %s: %v", ipset.Name, err)
+		}
+	}
+
+	err := ipset.Replace([]netlink.IPSetEntry{
+		{IP: net.ParseIP("1.2.3.5").To4(), Comment: "new"},
+		{IP: net.ParseIP("1.2.3.6").To4(), Comment: "new"},
+	})
+	if err != nil {
+		t.Fatalf("failed to replace ipset %s: %v", ipset.Name, err)
+	}
+
+	res, err := ipset.List()
+	if err != nil {
+		t.Fatalf("failed to list ipset %s: %v", ipset.Name, err)
+	}
+	got := map[string]bool{}
+	for _, entry := range res {
+		got[entry.IP.String()] = true
+	}
+	if len(got) != 2 || !got["1.2.3.5"] || !got["1.2.3.6"] {
+		t.Fatalf("expected the replaced members 1.2.3.5 and 1.2.3.6, got %+v", res)
+	}
+	if _, err := netlink.IpsetList(tempSetName(ipset.Name)); err == nil {
+		t.Errorf("expected the temporary set to be destroyed")
+	}
+}
+
+func TestTempSetName(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{
+			name:     "ztunnel-pods-ips",
+			expected: "ztunnel-pods-ips-tmp",
+		},
+		{
+			name:     "a-namespace-ipset-with-a-long-name",
+			expected: "a-namespace-ipset-with-a-lo-tmp",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tempSetName(tc.name); got != tc.expected {
+				t.Errorf("expected %s, got %s", tc.expected, got)
+			}
+		})
+	}
+}
@@ -25,11 +25,16 @@ import (
 	"istio.io/istio/pilot/pkg/ambient/ambientpod"
 )
 
-func checkAmbient(conf Config, ambientConfig ambient.AmbientConfigFile, podName, podNamespace, podIfname string, podIPs []net.IPNet) (bool, error) {
+func checkAmbient(conf Config, ambientConfig ambient.AmbientConfigFile, podName, podNamespace, podIfname, podNetns string, podIPs []net.IPNet) (bool, error) {
 	if ambientConfig.Mode == ambient.AmbientMeshOff.String() {
 		return false, nil
 	}
 
+	// The node is drained, so the pod is left out of the mesh as the controller does.
+	if ambientConfig.Draining {
+		return false, nil
+	}
+
 	if !ambientConfig.ZTunnelReady {
 		return false, fmt.Errorf("ztunnel not ready")
 	}
@@ -60,19 +65,44 @@ func checkAmbient(conf Config, ambientConfig ambient.AmbientConfigFile, podName,
 		return false, fmt.Errorf("ambient: namespace %s/%s has disabled selectors", podNamespace, podName)
 	}
 
+	captured, err := ambientConfig.CapturesPod(pod)
+	if err != nil {
+		return false, err
+	}
+	if !captured {
+		return false, nil
+	}
+
 	if ambientpod.ShouldPodBeInIpset(ns, pod, ambientConfig.Mode, true) {
-		ambient.NodeName = pod.Spec.NodeName
+		// The pods are routed from the same source as those added by the controller.
+		routeSrc := ambientConfig.InboundRouteSrc
+		if routeSrc == "" {
+			routeSrc, err = ambient.GetHostIP(context.Background(), client, pod.Spec.NodeName, ambientConfig.HostIPPreference)
+			if err != nil || routeSrc == "" {
+				return false, fmt.Errorf("error getting host IP: %v", err)
+			}
+		}
 
-		ambient.HostIP, err = ambient.GetHostIP(client)
-		if err != nil || ambient.HostIP == "" {
-			return false, fmt.Errorf("error getting host IP: %v", err)
+		if err := ambient.UseFirewallBackend(ambient.FirewallBackend(ambientConfig.FirewallBackend)); err != nil {
+			return false, err
+		}
+		if err := ambient.UseNamespaceIpsets(ambientConfig.NamespaceIpsets); err != nil {
+			return false, err
+		}
+		if err := ambient.UsePodCIDRs(ambientConfig.PodCIDRs); err != nil {
+			return false, err
 		}
 
 		// Can't set this on GKE, but needed in AWS.. so silently ignore failures
 		_ = ambient.SetProc("/proc/sys/net/ipv4/conf/"+podIfname+"/rp_filter", "0")
 
 		for _, ip := range podIPs {
-			ambient.AddPodToMesh(pod, ip.IP.String())
+			if ip.IP.To4() == nil && !ambientConfig.EnableIPv6 {
+				continue
+			}
+			if err := ambient.AddPodToMeshInTable(pod, ip.IP.String(), routeSrc, podNetns, ambientConfig.InboundRouteTable()); err != nil {
+				return true, fmt.Errorf("ambient: failed to add pod %s/%s to mesh: %v", podNamespace, podName, err)
+			}
 		}
 		return true, nil
 	}
@@ -234,9 +234,14 @@ func CmdAdd(args *skel.CmdArgs) (err error) {
 				return err
 			}
 			log.Infof("istio-cni cmdAdd podName: %s podIPs: %+v", podName, podIPs)
-			added, err = checkAmbient(*conf, *ambientConf, podName, podNamespace, args.IfName, podIPs)
+			added, err = checkAmbient(*conf, *ambientConf, podName, podNamespace, args.IfName, args.Netns, podIPs)
 			if err != nil {
 				log.Errorf("istio-cni cmdAdd failed to check ambient: %s", err)
+				// The pod is in the mesh, but its traffic isn't redirected, so fail the ADD for the
+				// runtime to retry it.
+				if added {
+					return err
+				}
 			}
 		}
 		if !added && !excludePod {